@@ -0,0 +1,204 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RuleBuilder is a helper for constructing Rule objects out of common matches and
+// verdicts. It assembles the same sort of rule string that you would get from Concat,
+// but it catches some simple mistakes (such as adding matches after the verdict). It
+// only covers a small number of commonly-used matches; use Match to add anything else.
+//
+// Eg:
+//
+//	rule, err := knftables.NewRule().
+//		MatchIPDaddr(clusterIP).
+//		MatchTCPDport(80).
+//		Jump("service-ULMVA6XW-ns1/svc1/tcp/p80").
+//		Build()
+//	if err != nil {
+//		...
+//	}
+//	rule.Chain = "services"
+type RuleBuilder struct {
+	clauses    []string
+	comment    *string
+	hasVerdict bool
+	err        error
+}
+
+// NewRule returns a new RuleBuilder
+func NewRule() *RuleBuilder {
+	return &RuleBuilder{}
+}
+
+func (rb *RuleBuilder) add(args ...interface{}) *RuleBuilder {
+	if rb.err != nil {
+		return rb
+	}
+	clause := Concat(args...)
+	if rb.hasVerdict {
+		rb.err = fmt.Errorf("cannot add %q after verdict", clause)
+		return rb
+	}
+	rb.clauses = append(rb.clauses, clause)
+	return rb
+}
+
+func (rb *RuleBuilder) verdict(verdict string) *RuleBuilder {
+	rb.add(verdict)
+	rb.hasVerdict = true
+	return rb
+}
+
+// Match adds an arbitrary match (or statement), constructed from args as with Concat.
+func (rb *RuleBuilder) Match(args ...interface{}) *RuleBuilder {
+	return rb.add(args...)
+}
+
+// MatchIPSaddr adds an "ip saddr" match. addr can be a string, net.IP, or *net.IPNet.
+func (rb *RuleBuilder) MatchIPSaddr(addr interface{}) *RuleBuilder {
+	return rb.add("ip saddr", addr)
+}
+
+// MatchIPDaddr adds an "ip daddr" match. addr can be a string, net.IP, or *net.IPNet.
+func (rb *RuleBuilder) MatchIPDaddr(addr interface{}) *RuleBuilder {
+	return rb.add("ip daddr", addr)
+}
+
+// MatchIP6Saddr adds an "ip6 saddr" match. addr can be a string, net.IP, or *net.IPNet.
+func (rb *RuleBuilder) MatchIP6Saddr(addr interface{}) *RuleBuilder {
+	return rb.add("ip6 saddr", addr)
+}
+
+// MatchIP6Daddr adds an "ip6 daddr" match. addr can be a string, net.IP, or *net.IPNet.
+func (rb *RuleBuilder) MatchIP6Daddr(addr interface{}) *RuleBuilder {
+	return rb.add("ip6 daddr", addr)
+}
+
+// MatchTCPSport adds a "tcp sport" match
+func (rb *RuleBuilder) MatchTCPSport(port int) *RuleBuilder {
+	return rb.add("tcp sport", port)
+}
+
+// MatchTCPDport adds a "tcp dport" match
+func (rb *RuleBuilder) MatchTCPDport(port int) *RuleBuilder {
+	return rb.add("tcp dport", port)
+}
+
+// MatchUDPSport adds a "udp sport" match
+func (rb *RuleBuilder) MatchUDPSport(port int) *RuleBuilder {
+	return rb.add("udp sport", port)
+}
+
+// MatchUDPDport adds a "udp dport" match
+func (rb *RuleBuilder) MatchUDPDport(port int) *RuleBuilder {
+	return rb.add("udp dport", port)
+}
+
+// MatchCTState adds a "ct state" match for any of the given states (eg "established",
+// "related").
+func (rb *RuleBuilder) MatchCTState(states ...string) *RuleBuilder {
+	if len(states) == 0 {
+		if rb.err == nil {
+			rb.err = fmt.Errorf("no states specified for ct state match")
+		}
+		return rb
+	}
+	return rb.add("ct state", strings.Join(states, ","))
+}
+
+// MatchTCPFlags adds a "tcp flags" match (see TCPFlags)
+func (rb *RuleBuilder) MatchTCPFlags(set, mask []string) *RuleBuilder {
+	match, err := TCPFlags(set, mask)
+	if err != nil {
+		if rb.err == nil {
+			rb.err = err
+		}
+		return rb
+	}
+	return rb.add(match)
+}
+
+// MatchIifname adds a "meta iifname" match
+func (rb *RuleBuilder) MatchIifname(name string) *RuleBuilder {
+	return rb.add("meta iifname", fmt.Sprintf("%q", name))
+}
+
+// MatchOifname adds a "meta oifname" match
+func (rb *RuleBuilder) MatchOifname(name string) *RuleBuilder {
+	return rb.add("meta oifname", fmt.Sprintf("%q", name))
+}
+
+// MatchMark adds a "meta mark" match
+func (rb *RuleBuilder) MatchMark(mark uint32) *RuleBuilder {
+	return rb.add("meta mark", fmt.Sprintf("0x%x", mark))
+}
+
+// Counter adds a "counter" statement
+func (rb *RuleBuilder) Counter() *RuleBuilder {
+	return rb.add("counter")
+}
+
+// Comment sets the rule's comment
+func (rb *RuleBuilder) Comment(comment string) *RuleBuilder {
+	rb.comment = &comment
+	return rb
+}
+
+// Accept adds an "accept" verdict. No further matches can be added after a verdict.
+func (rb *RuleBuilder) Accept() *RuleBuilder {
+	return rb.verdict(Accept())
+}
+
+// Drop adds a "drop" verdict. No further matches can be added after a verdict.
+func (rb *RuleBuilder) Drop() *RuleBuilder {
+	return rb.verdict(Drop())
+}
+
+// Return adds a "return" verdict. No further matches can be added after a verdict.
+func (rb *RuleBuilder) Return() *RuleBuilder {
+	return rb.verdict(Return())
+}
+
+// Jump adds a "jump" verdict. No further matches can be added after a verdict.
+func (rb *RuleBuilder) Jump(chain string) *RuleBuilder {
+	return rb.verdict(Jump(chain))
+}
+
+// Goto adds a "goto" verdict. No further matches can be added after a verdict.
+func (rb *RuleBuilder) Goto(chain string) *RuleBuilder {
+	return rb.verdict(Goto(chain))
+}
+
+// Build returns the constructed Rule (with its Chain field unset), or an error if any of
+// the builder calls were invalid or the rule is empty.
+func (rb *RuleBuilder) Build() (*Rule, error) {
+	if rb.err != nil {
+		return nil, rb.err
+	}
+	if len(rb.clauses) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	return &Rule{
+		Rule:    strings.Join(rb.clauses, " "),
+		Comment: rb.comment,
+	}, nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRuleBuilder(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+
+	for _, tc := range []struct {
+		name    string
+		builder *RuleBuilder
+		out     *Rule
+		err     string
+	}{
+		{
+			name:    "simple",
+			builder: NewRule().MatchIPSaddr("10.0.0.1").Drop(),
+			out:     &Rule{Rule: "ip saddr 10.0.0.1 drop"},
+		},
+		{
+			name: "kube-proxy-like",
+			builder: NewRule().
+				MatchIPDaddr(net.ParseIP("172.30.0.41")).
+				MatchTCPDport(80).
+				Jump("service-ULMVA6XW-ns1/svc1/tcp/p80").
+				Comment("ns1/svc1:p80"),
+			out: &Rule{
+				Rule:    "ip daddr 172.30.0.41 tcp dport 80 jump service-ULMVA6XW-ns1/svc1/tcp/p80",
+				Comment: PtrTo("ns1/svc1:p80"),
+			},
+		},
+		{
+			name: "all the helpers",
+			builder: NewRule().
+				MatchIifname("eth0").
+				MatchOifname("eth1").
+				MatchIPSaddr(cidr).
+				MatchIP6Daddr("fd00::/64").
+				MatchIP6Saddr("fd00::1").
+				MatchUDPSport(53).
+				MatchUDPDport(5353).
+				MatchTCPSport(1234).
+				MatchCTState("established", "related").
+				MatchMark(0x4000).
+				Match("ip daddr", "@", "local-addrs").
+				Counter().
+				Goto("other"),
+			out: &Rule{Rule: `meta iifname "eth0" meta oifname "eth1" ip saddr 10.0.0.0/8 ip6 daddr fd00::/64 ip6 saddr fd00::1 udp sport 53 udp dport 5353 tcp sport 1234 ct state established,related meta mark 0x4000 ip daddr @local-addrs counter goto other`},
+		},
+		{
+			name:    "verdicts",
+			builder: NewRule().Accept(),
+			out:     &Rule{Rule: "accept"},
+		},
+		{
+			name:    "return",
+			builder: NewRule().MatchMark(1).Return(),
+			out:     &Rule{Rule: "meta mark 0x1 return"},
+		},
+		{
+			name:    "empty",
+			builder: NewRule(),
+			err:     "empty rule",
+		},
+		{
+			name:    "match after verdict",
+			builder: NewRule().Drop().MatchTCPDport(80),
+			err:     `cannot add "tcp dport 80" after verdict`,
+		},
+		{
+			name:    "two verdicts",
+			builder: NewRule().Jump("a").Goto("b"),
+			err:     `cannot add "goto b" after verdict`,
+		},
+		{
+			name:    "tcp flags",
+			builder: NewRule().MatchTCPFlags([]string{"syn"}, []string{"syn", "ack"}).Drop(),
+			out:     &Rule{Rule: "tcp flags syn / syn,ack drop"},
+		},
+		{
+			name:    "invalid tcp flags",
+			builder: NewRule().MatchTCPFlags([]string{"sin"}, nil).Drop(),
+			err:     `invalid tcp flag "sin"`,
+		},
+		{
+			name:    "empty ct state",
+			builder: NewRule().MatchCTState().Accept(),
+			err:     "no states specified",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := tc.builder.Build()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.out, rule); diff != "" {
+				t.Errorf("unexpected rule:\n%s", diff)
+			}
+		})
+	}
+}
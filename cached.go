@@ -0,0 +1,192 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cachedInterface is an Interface that caches the results of List, ListRules, and
+// ListElements from another Interface.
+type cachedInterface struct {
+	Interface
+
+	ttl time.Duration
+	// now is time.Now, but can be overridden by unit tests
+	now func() time.Time
+
+	mutex   sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	// generation is incremented by each invalidate, so that a result from a List
+	// call that overlapped with an invalidation isn't cached.
+	generation uint64
+}
+
+// cacheKey identifies a cached call
+type cacheKey struct {
+	method string
+	args   string
+}
+
+// cacheEntry is a cached result
+type cacheEntry struct {
+	expires time.Time
+	result  interface{}
+}
+
+var _ Interface = &cachedInterface{}
+
+// NewCached returns an Interface that wraps inner, caching the results of List,
+// ListRules, and ListElements for up to ttl. The entire cache is invalidated whenever
+// Run, FlushTable, SwapTable, or ReplaceTable is called on the returned Interface
+// (whether or not the call succeeds). Changes made by other means (eg, by another
+// Interface, or directly via nft) will not be noticed until the cached results expire.
+// All other methods are passed through to inner without caching. Errors are not cached.
+func NewCached(inner Interface, ttl time.Duration) Interface {
+	return &cachedInterface{
+		Interface: inner,
+		ttl:       ttl,
+		now:       time.Now,
+		entries:   make(map[cacheKey]*cacheEntry),
+	}
+}
+
+// get returns the cached result for key, if there is an unexpired one, along with the
+// current cache generation.
+func (c *cachedInterface) get(key cacheKey) (interface{}, bool, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.entries[key]
+	if entry == nil {
+		return nil, false, c.generation
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false, c.generation
+	}
+	return entry.result, true, c.generation
+}
+
+// put caches result for key, unless the cache has been invalidated since generation.
+func (c *cachedInterface) put(key cacheKey, result interface{}, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation == c.generation {
+		c.entries[key] = &cacheEntry{expires: c.now().Add(c.ttl), result: result}
+	}
+}
+
+// invalidate clears the cache.
+func (c *cachedInterface) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[cacheKey]*cacheEntry)
+	c.generation++
+}
+
+// cached returns the cached result for key if there is one, or else calls list and
+// caches its result. Either way, it returns a copy of the result, so that the caller
+// can't modify the cache.
+func cached[T any](c *cachedInterface, key cacheKey, list func() ([]T, error), copyItem func(T) T) ([]T, error) {
+	result, ok, generation := c.get(key)
+	if !ok {
+		items, err := list()
+		if err != nil {
+			return nil, err
+		}
+		c.put(key, items, generation)
+		result = items
+	}
+
+	items := result.([]T)
+	if items == nil {
+		return nil, nil
+	}
+	itemsCopy := make([]T, len(items))
+	for i := range items {
+		itemsCopy[i] = copyItem(items[i])
+	}
+	return itemsCopy, nil
+}
+
+// List is part of Interface
+func (c *cachedInterface) List(ctx context.Context, objectType string) ([]string, error) {
+	// Normalize the plural form so "chain" and "chains" share a cache entry.
+	if objectType != "" && objectType[len(objectType)-1] != 's' {
+		objectType += "s"
+	}
+	return cached(c, cacheKey{"List", objectType},
+		func() ([]string, error) { return c.Interface.List(ctx, objectType) },
+		func(name string) string { return name })
+}
+
+// ListRules is part of Interface
+func (c *cachedInterface) ListRules(ctx context.Context, chain string) ([]*Rule, error) {
+	return cached(c, cacheKey{"ListRules", chain},
+		func() ([]*Rule, error) { return c.Interface.ListRules(ctx, chain) },
+		func(rule *Rule) *Rule {
+			ruleCopy := *rule
+			ruleCopy.Comment = clonePtr(rule.Comment)
+			ruleCopy.Index = clonePtr(rule.Index)
+			ruleCopy.Handle = clonePtr(rule.Handle)
+			return &ruleCopy
+		})
+}
+
+// ListElements is part of Interface
+func (c *cachedInterface) ListElements(ctx context.Context, objectType, name string) ([]*Element, error) {
+	return cached(c, cacheKey{"ListElements", objectType + " " + name},
+		func() ([]*Element, error) { return c.Interface.ListElements(ctx, objectType, name) },
+		func(elem *Element) *Element {
+			elemCopy := *elem
+			elemCopy.Key = cloneSlice(elem.Key)
+			elemCopy.Value = cloneSlice(elem.Value)
+			elemCopy.Comment = clonePtr(elem.Comment)
+			elemCopy.Timeout = clonePtr(elem.Timeout)
+			elemCopy.Expires = clonePtr(elem.Expires)
+			elemCopy.Packets = clonePtr(elem.Packets)
+			elemCopy.Bytes = clonePtr(elem.Bytes)
+			return &elemCopy
+		})
+}
+
+// Run is part of Interface
+func (c *cachedInterface) Run(ctx context.Context, tx *Transaction) error {
+	defer c.invalidate()
+	return c.Interface.Run(ctx, tx)
+}
+
+// FlushTable is part of Interface
+func (c *cachedInterface) FlushTable(ctx context.Context) error {
+	defer c.invalidate()
+	return c.Interface.FlushTable(ctx)
+}
+
+// SwapTable is part of Interface
+func (c *cachedInterface) SwapTable(ctx context.Context, build func(tx *Transaction)) error {
+	defer c.invalidate()
+	return c.Interface.SwapTable(ctx, build)
+}
+
+// ReplaceTable is part of Interface
+func (c *cachedInterface) ReplaceTable(ctx context.Context, desired *Fake) error {
+	defer c.invalidate()
+	return c.Interface.ReplaceTable(ctx, desired)
+}
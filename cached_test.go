@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCached(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake(IPv4Family, "kube-proxy")
+	nft := NewCached(fake, time.Minute)
+	now := time.Now()
+	nft.(*cachedInterface).now = func() time.Time { return now }
+
+	tx := nft.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop", Comment: PtrTo("first")})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	if err := nft.Run(ctx, tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expectChains := func(expected ...string) {
+		t.Helper()
+		chains, err := nft.List(ctx, "chains")
+		if err != nil {
+			t.Fatalf("unexpected error from List: %v", err)
+		}
+		sort.Strings(chains)
+		if diff := cmp.Diff(expected, chains); diff != "" {
+			t.Errorf("unexpected chains:\n%s", diff)
+		}
+	}
+	expectElements := func(expected ...string) {
+		t.Helper()
+		elements, err := nft.ListElements(ctx, "set", "set")
+		if err != nil {
+			t.Fatalf("unexpected error from ListElements: %v", err)
+		}
+		var keys []string
+		for _, elem := range elements {
+			keys = append(keys, elem.Key[0])
+		}
+		if diff := cmp.Diff(expected, keys); diff != "" {
+			t.Errorf("unexpected elements:\n%s", diff)
+		}
+	}
+
+	expectChains("chain")
+	expectElements("10.0.0.1")
+	rules, err := nft.ListRules(ctx, "chain")
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("unexpected result from ListRules: %v, %v", rules, err)
+	}
+
+	// Modifying the returned objects doesn't modify the cache
+	*rules[0].Comment = "modified"
+	rules, _ = nft.ListRules(ctx, "chain")
+	if *rules[0].Comment != "first" {
+		t.Errorf("modifying ListRules result modified the cache")
+	}
+
+	// Changes made behind the cache's back are not seen until the cache expires
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{Name: "other"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.2"}})
+	if err := fake.Run(ctx, tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	expectChains("chain")
+	expectElements("10.0.0.1")
+	// ("chain" and "chains" share a cache entry)
+	if chains, _ := nft.List(ctx, "chain"); len(chains) != 1 {
+		t.Errorf("expected cached result for List(\"chain\"), got %v", chains)
+	}
+
+	now = now.Add(time.Minute)
+	expectChains("chain", "other")
+	expectElements("10.0.0.1", "10.0.0.2")
+
+	// Changes made via the cache invalidate it immediately
+	tx = nft.NewTransaction()
+	tx.Delete(&Chain{Name: "other"})
+	tx.Delete(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Add(&Rule{Chain: "chain", Rule: "accept"})
+	if err := nft.Run(ctx, tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	expectChains("chain")
+	expectElements("10.0.0.2")
+	if rules, _ := nft.ListRules(ctx, "chain"); len(rules) != 2 {
+		t.Errorf("expected 2 rules after Run, got %d", len(rules))
+	}
+
+	if err := nft.FlushTable(ctx); err != nil {
+		t.Fatalf("unexpected error from FlushTable: %v", err)
+	}
+	expectChains()
+
+	// Errors are not cached
+	if _, err := nft.ListElements(ctx, "set", "set"); !IsNotFound(err) {
+		t.Errorf("expected not found error after flush, got %v", err)
+	}
+	tx = nft.NewTransaction()
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	if err := fake.Run(ctx, tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	expectElements()
+}
@@ -0,0 +1,738 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Diff returns a Transaction that, when run against current, would change its state to
+// match desired. Objects are compared by name (and rules by their position in their
+// chain), and objects that exist in both current and desired with the same properties
+// are left alone. Objects whose properties differ (eg, a set whose type or comment has
+// changed) are deleted and recreated, along with any rules or elements that refer to
+// them. Within each chain, rules common to both current and desired are kept, and
+// missing rules are inserted around them in the correct order. If the table's own
+// properties differ, the whole table is deleted and recreated. Counter values in rules
+// and elements are ignored when comparing.
+//
+// current and desired must have the same family and table. The returned transaction
+// uses rule handles from current, so it must be run before current is modified further.
+func Diff(current, desired *Fake) (*Transaction, error) {
+	if current.family != desired.family || current.table != desired.table {
+		return nil, fmt.Errorf("cannot diff %s %s against %s %s", current.family, current.table, desired.family, desired.table)
+	}
+
+	current.RLock()
+	defer current.RUnlock()
+	if desired != current {
+		desired.RLock()
+		defer desired.RUnlock()
+	}
+	return diffTables(&current.nftContext, current.Table, desired.Table)
+}
+
+// diffTables returns a Transaction that would transform current into desired (either
+// of which may be nil, indicating that the table does not exist). Objects that exist in
+// both current and desired with the same properties are left alone; objects whose
+// properties differ are deleted and recreated (along with any rules or elements that
+// refer to them). Rules are compared in order, and rules that are common to both
+// current and desired are kept, with new rules inserted around them. If the table itself
+// differs, the whole table is deleted and recreated.
+//
+// The returned transaction is checked by running it against a copy of current, and an
+// error is returned if the result doesn't match desired.
+func diffTables(ctx *nftContext, current, desired *FakeTable) (*Transaction, error) {
+	tx := &Transaction{nftContext: ctx}
+	original := current
+
+	if current != nil && (desired == nil || objectString(ctx, &current.Table) != objectString(ctx, &desired.Table)) {
+		tx.Delete(&Table{})
+		current = nil
+	}
+	if desired == nil {
+		return tx, checkDiff(ctx, original, desired, tx)
+	}
+	if current == nil {
+		tx.Add(withoutHandle(&desired.Table))
+		current = &FakeTable{}
+	}
+
+	d := &differ{
+		ctx:            ctx,
+		current:        current,
+		desired:        desired,
+		removedChains:  make(map[string]bool),
+		removedObjects: make(map[string]bool),
+	}
+	d.findRemovedObjects()
+
+	var later []func()
+	later = append(later, d.diffRules(tx)...)
+	later = append(later, d.diffElements(tx)...)
+	d.deleteRemovedObjects(tx)
+	d.addNewObjects(tx)
+	for _, f := range later {
+		f()
+	}
+
+	if err := checkDiff(ctx, original, desired, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// differ holds the state of a diffTables call
+type differ struct {
+	ctx              *nftContext
+	current, desired *FakeTable
+
+	// removedChains is the set of chains that are being deleted (because they don't
+	// exist in desired, or because their properties have changed)
+	removedChains map[string]bool
+	// removedObjects is the set of non-chain objects (flowtables, sets, maps, etc)
+	// that are being deleted. (Since this is only used for detecting references, we
+	// don't bother distinguishing the different types.)
+	removedObjects map[string]bool
+}
+
+// objectString returns the "add" command for obj, ignoring its handle and index, for
+// comparison purposes.
+func objectString(ctx *nftContext, obj Object) string {
+	buf := &bytes.Buffer{}
+	withoutHandle(obj).writeOperation(addVerb, ctx, buf)
+	return buf.String()
+}
+
+// withoutHandle returns a copy of obj without its Handle (and Index, for rules) set, so
+// that it can be used in an "add" operation.
+func withoutHandle(obj Object) Object {
+	switch o := obj.(type) {
+	case *Table:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *Flowtable:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *CTHelper:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *CTTimeout:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *CTExpectation:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *Synproxy:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *Chain:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *Rule:
+		c := *o
+		c.Handle = nil
+		c.Index = nil
+		// As with elements, counter values change as traffic flows, so ignore
+		// them.
+		c.Rule = StripCounters(c.Rule)
+		return &c
+	case *Set:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *Map:
+		c := *o
+		c.Handle = nil
+		return &c
+	case *Element:
+		c := *o
+		c.Expires = nil
+		// Counter values change as traffic flows, so only compare whether
+		// the element has a counter at all.
+		if c.Packets != nil || c.Bytes != nil {
+			c.Packets = PtrTo(uint64(0))
+			c.Bytes = PtrTo(uint64(0))
+		}
+		return &c
+	default:
+		return obj
+	}
+}
+
+// findRemoved compares the objects of a single type in current and desired and
+// records the ones in current that need to be removed.
+func findRemoved[T any](d *differ, current, desired map[string]*T, getObj func(*T) Object, removed map[string]bool) {
+	for name, cur := range current {
+		des := desired[name]
+		if des == nil || objectString(d.ctx, getObj(cur)) != objectString(d.ctx, getObj(des)) {
+			removed[name] = true
+		}
+	}
+}
+
+func (d *differ) findRemovedObjects() {
+	findRemoved(d, d.current.Flowtables, d.desired.Flowtables, func(ft *FakeFlowtable) Object { return &ft.Flowtable }, d.removedObjects)
+	findRemoved(d, d.current.CTHelpers, d.desired.CTHelpers, func(h *FakeCTHelper) Object { return &h.CTHelper }, d.removedObjects)
+	findRemoved(d, d.current.CTTimeouts, d.desired.CTTimeouts, func(t *FakeCTTimeout) Object { return &t.CTTimeout }, d.removedObjects)
+	findRemoved(d, d.current.CTExpectations, d.desired.CTExpectations, func(e *FakeCTExpectation) Object { return &e.CTExpectation }, d.removedObjects)
+	findRemoved(d, d.current.Synproxies, d.desired.Synproxies, func(s *FakeSynproxy) Object { return &s.Synproxy }, d.removedObjects)
+	findRemoved(d, d.current.Sets, d.desired.Sets, func(s *FakeSet) Object { return &s.Set }, d.removedObjects)
+	findRemoved(d, d.current.Maps, d.desired.Maps, func(m *FakeMap) Object { return &m.Map }, d.removedObjects)
+	findRemoved(d, d.current.Chains, d.desired.Chains, func(c *FakeChain) Object { return &c.Chain }, d.removedChains)
+}
+
+// refersToRemoved returns true if the given rule or element value refers to an object
+// that is being removed.
+func (d *differ) refersToRemoved(text string) bool {
+	chains, objects := ruleReferences(text)
+	for _, chain := range chains {
+		if d.removedChains[chain] {
+			return true
+		}
+	}
+	for _, name := range objects {
+		if d.removedObjects[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// diffRules deletes rules from surviving chains that are not in desired, and returns
+// a list of functions to add the missing rules (after any new objects they refer to
+// have been added).
+func (d *differ) diffRules(tx *Transaction) []func() {
+	var adds []func()
+	for _, name := range sortKeys(d.desired.Chains) {
+		desiredRules := d.desired.Chains[name].Rules
+		if d.current.Chains[name] == nil || d.removedChains[name] {
+			for _, rule := range desiredRules {
+				rule := rule
+				adds = append(adds, func() { tx.Add(withoutHandle(rule)) })
+			}
+			continue
+		}
+
+		currentRules := d.current.Chains[name].Rules
+		matches := d.matchRules(currentRules, desiredRules)
+
+		matched := make(map[int]bool)
+		for _, ci := range matches {
+			if ci != -1 {
+				matched[ci] = true
+			}
+		}
+		for ci, rule := range currentRules {
+			if !matched[ci] {
+				tx.Delete(&Rule{Chain: name, Handle: rule.Handle})
+			}
+		}
+
+		for di, rule := range desiredRules {
+			if matches[di] != -1 {
+				continue
+			}
+			// Insert the rule before the next rule that we're keeping, or add it
+			// at the end if there isn't one.
+			var next *int
+			for dj := di + 1; dj < len(desiredRules); dj++ {
+				if matches[dj] != -1 {
+					next = currentRules[matches[dj]].Handle
+					break
+				}
+			}
+			newRule := withoutHandle(rule).(*Rule)
+			if next != nil {
+				newRule.Handle = next
+				adds = append(adds, func() { tx.Insert(newRule) })
+			} else {
+				adds = append(adds, func() { tx.Add(newRule) })
+			}
+		}
+	}
+	return adds
+}
+
+// matchRules finds the longest common subsequence of currentRules and desiredRules
+// (ignoring current rules that refer to removed objects), and returns an array
+// mapping each index in desiredRules to the matching index in currentRules, or -1.
+func (d *differ) matchRules(currentRules, desiredRules []*Rule) []int {
+	cur := make([]string, len(currentRules))
+	for i, rule := range currentRules {
+		if !d.refersToRemoved(rule.Rule) {
+			cur[i] = objectString(d.ctx, rule)
+		}
+	}
+	des := make([]string, len(desiredRules))
+	for i, rule := range desiredRules {
+		des[i] = objectString(d.ctx, rule)
+	}
+
+	// lcs[i][j] is the length of the LCS of cur[i:] and des[j:]
+	lcs := make([][]int, len(cur)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(des)+1)
+	}
+	for i := len(cur) - 1; i >= 0; i-- {
+		for j := len(des) - 1; j >= 0; j-- {
+			if cur[i] != "" && cur[i] == des[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	matches := make([]int, len(des))
+	for j := range matches {
+		matches[j] = -1
+	}
+	for i, j := 0, 0; i < len(cur) && j < len(des); {
+		if cur[i] != "" && cur[i] == des[j] {
+			matches[j] = i
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return matches
+}
+
+// diffElements deletes elements from surviving sets and maps that are not in desired,
+// and returns a list of functions to add the missing elements.
+func (d *differ) diffElements(tx *Transaction) []func() {
+	var adds []func()
+	diff := func(currentElements, desiredElements []*Element, isNew bool) {
+		if !isNew {
+			for _, elem := range currentElements {
+				i := findElement(desiredElements, elem.Key)
+				if i == -1 || objectString(d.ctx, elem) != objectString(d.ctx, desiredElements[i]) || d.refersToRemoved(strings.Join(elem.Value, " ")) {
+					tx.Delete(&Element{Set: elem.Set, Map: elem.Map, Key: elem.Key})
+				}
+			}
+		}
+		for _, elem := range desiredElements {
+			elem := elem
+			if !isNew {
+				i := findElement(currentElements, elem.Key)
+				if i != -1 && objectString(d.ctx, elem) == objectString(d.ctx, currentElements[i]) && !d.refersToRemoved(strings.Join(elem.Value, " ")) {
+					continue
+				}
+			}
+			adds = append(adds, func() { tx.Add(elem) })
+		}
+	}
+
+	for _, name := range sortKeys(d.desired.Sets) {
+		isNew := d.current.Sets[name] == nil || d.removedObjects[name]
+		var currentElements []*Element
+		if !isNew {
+			currentElements = d.current.Sets[name].Elements
+		}
+		diff(currentElements, d.desired.Sets[name].Elements, isNew)
+	}
+	for _, name := range sortKeys(d.desired.Maps) {
+		isNew := d.current.Maps[name] == nil || d.removedObjects[name]
+		var currentElements []*Element
+		if !isNew {
+			currentElements = d.current.Maps[name].Elements
+		}
+		diff(currentElements, d.desired.Maps[name].Elements, isNew)
+	}
+	return adds
+}
+
+// deleteRemovedObjects deletes the objects in d.removedChains and d.removedObjects.
+func (d *differ) deleteRemovedObjects(tx *Transaction) {
+	// Flush the chains first, so that any references from their rules to other
+	// objects being deleted are removed.
+	for _, name := range sortKeys(d.removedChains) {
+		tx.Flush(&Chain{Name: name})
+	}
+
+	for _, name := range sortKeys(d.current.Sets) {
+		if d.removedObjects[name] {
+			tx.Delete(&Set{Name: name})
+		}
+	}
+	for _, name := range sortKeys(d.current.Maps) {
+		if d.removedObjects[name] {
+			tx.Delete(&Map{Name: name})
+		}
+	}
+	for _, name := range sortKeys(d.current.Flowtables) {
+		if d.removedObjects[name] {
+			tx.Delete(&Flowtable{Name: name})
+		}
+	}
+	for _, name := range sortKeys(d.current.CTHelpers) {
+		if d.removedObjects[name] {
+			tx.Delete(&CTHelper{Name: name})
+		}
+	}
+	for _, name := range sortKeys(d.current.CTTimeouts) {
+		if d.removedObjects[name] {
+			tx.Delete(&CTTimeout{Name: name})
+		}
+	}
+	for _, name := range sortKeys(d.current.CTExpectations) {
+		if d.removedObjects[name] {
+			tx.Delete(&CTExpectation{Name: name})
+		}
+	}
+	for _, name := range sortKeys(d.current.Synproxies) {
+		if d.removedObjects[name] {
+			tx.Delete(&Synproxy{Name: name})
+		}
+	}
+
+	for _, name := range sortKeys(d.removedChains) {
+		tx.Delete(&Chain{Name: name})
+	}
+}
+
+// addNewObjects adds the objects in desired that don't exist in current (or that are
+// being recreated).
+func (d *differ) addNewObjects(tx *Transaction) {
+	for _, name := range sortKeys(d.desired.Flowtables) {
+		if d.current.Flowtables[name] == nil || d.removedObjects[name] {
+			tx.Add(withoutHandle(&d.desired.Flowtables[name].Flowtable))
+		}
+	}
+	for _, name := range sortKeys(d.desired.CTHelpers) {
+		if d.current.CTHelpers[name] == nil || d.removedObjects[name] {
+			tx.Add(withoutHandle(&d.desired.CTHelpers[name].CTHelper))
+		}
+	}
+	for _, name := range sortKeys(d.desired.CTTimeouts) {
+		if d.current.CTTimeouts[name] == nil || d.removedObjects[name] {
+			tx.Add(withoutHandle(&d.desired.CTTimeouts[name].CTTimeout))
+		}
+	}
+	for _, name := range sortKeys(d.desired.CTExpectations) {
+		if d.current.CTExpectations[name] == nil || d.removedObjects[name] {
+			tx.Add(withoutHandle(&d.desired.CTExpectations[name].CTExpectation))
+		}
+	}
+	for _, name := range sortKeys(d.desired.Synproxies) {
+		if d.current.Synproxies[name] == nil || d.removedObjects[name] {
+			tx.Add(withoutHandle(&d.desired.Synproxies[name].Synproxy))
+		}
+	}
+	for _, name := range sortKeys(d.desired.Chains) {
+		if d.current.Chains[name] == nil || d.removedChains[name] {
+			tx.Add(withoutHandle(&d.desired.Chains[name].Chain))
+		}
+	}
+	for _, name := range sortKeys(d.desired.Sets) {
+		if d.current.Sets[name] == nil || d.removedObjects[name] {
+			tx.Add(withoutHandle(&d.desired.Sets[name].Set))
+		}
+	}
+	for _, name := range sortKeys(d.desired.Maps) {
+		if d.current.Maps[name] == nil || d.removedObjects[name] {
+			tx.Add(withoutHandle(&d.desired.Maps[name].Map))
+		}
+	}
+}
+
+// checkDiff confirms that running tx against current results in desired.
+func checkDiff(ctx *nftContext, current, desired *FakeTable, tx *Transaction) error {
+	if tx.err != nil {
+		return tx.err
+	}
+
+	check := &Fake{nftContext: *ctx, Table: current}
+	result, _, err := check.run(tx)
+	if err != nil {
+		return fmt.Errorf("internal error: computed transaction failed: %w", err)
+	}
+	check.Table = result
+
+	expected := &Fake{nftContext: *ctx, Table: desired}
+	if normalizeDump(check.Dump()) != normalizeDump(expected.Dump()) {
+		return fmt.Errorf("internal error: computed transaction did not produce the desired state")
+	}
+	return nil
+}
+
+// normalizeDump sorts the "add element" lines of dump, since the Fake does not preserve
+// element ordering across a diff, and strips counter values from the "add rule" lines,
+// since Diff ignores them.
+func normalizeDump(dump string) string {
+	var lines, elements []string
+	for _, line := range strings.Split(dump, "\n") {
+		if strings.HasPrefix(line, "add element ") {
+			elements = append(elements, line)
+		} else if strings.HasPrefix(line, "add rule ") {
+			lines = append(lines, StripCounters(line))
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(elements)
+	return strings.Join(append(lines, elements...), "\n")
+}
+
+// verify implements Interface.Verify, by comparing expected against the current state of
+// the table, as returned by readActual (which returns nil if the table does not exist).
+func verify(ctx *nftContext, expected *Fake, readActual func() (*FakeTable, error)) ([]Difference, error) {
+	if expected.family != ctx.family || expected.table != ctx.table {
+		return nil, fmt.Errorf("cannot verify %s %s against %s %s", ctx.family, ctx.table, expected.family, expected.table)
+	}
+
+	expected.RLock()
+	desired := expected.Table.copy()
+	expected.RUnlock()
+
+	actual, err := readActual()
+	if err != nil {
+		return nil, err
+	}
+	return verifyTables(ctx, actual, desired), nil
+}
+
+// verifyTables compares actual against desired (either of which may be nil, indicating
+// that the table does not exist), returning a Difference for each object that does not
+// match. Objects are compared by name and elements by key, and the rules in each chain
+// are matched up in the same way as with Diff.
+func verifyTables(ctx *nftContext, actual, desired *FakeTable) []Difference {
+	v := &verifier{ctx: ctx}
+	if actual == nil || desired == nil {
+		if desired != nil {
+			v.compare(&desired.Table, nil)
+		} else if actual != nil {
+			v.compare(nil, &actual.Table)
+		}
+		return v.diffs
+	}
+	v.compare(&desired.Table, &actual.Table)
+
+	v.verifyFlowtables(desired, actual)
+	v.verifyChains(desired, actual)
+
+	compareByName(v, desired.Sets, actual.Sets,
+		func(s *FakeSet) Object { return &s.Set })
+	for _, name := range sortKeys(actual.Sets) {
+		if des := desired.Sets[name]; des != nil {
+			v.verifyElements(des.Elements, actual.Sets[name].Elements)
+		}
+	}
+
+	compareByName(v, desired.Maps, actual.Maps,
+		func(m *FakeMap) Object { return &m.Map })
+	for _, name := range sortKeys(actual.Maps) {
+		if des := desired.Maps[name]; des != nil {
+			v.verifyElements(des.Elements, actual.Maps[name].Elements)
+		}
+	}
+
+	compareByName(v, desired.CTHelpers, actual.CTHelpers,
+		func(h *FakeCTHelper) Object { return &h.CTHelper })
+	compareByName(v, desired.CTTimeouts, actual.CTTimeouts,
+		func(t *FakeCTTimeout) Object { return &t.CTTimeout })
+	compareByName(v, desired.CTExpectations, actual.CTExpectations,
+		func(e *FakeCTExpectation) Object { return &e.CTExpectation })
+	compareByName(v, desired.Synproxies, actual.Synproxies,
+		func(s *FakeSynproxy) Object { return &s.Synproxy })
+
+	return v.diffs
+}
+
+// verifier holds the state of a verify call
+type verifier struct {
+	ctx   *nftContext
+	diffs []Difference
+}
+
+// compare records a Difference if expected and actual (either of which may be nil)
+// are not equivalent.
+func (v *verifier) compare(expected, actual Object) {
+	if expected != nil && actual != nil && objectString(v.ctx, expected) == objectString(v.ctx, actual) {
+		return
+	}
+	v.diffs = append(v.diffs, Difference{Expected: expected, Actual: actual})
+}
+
+// compareByName compares the objects in desired against the objects in actual with the
+// same names, in order by name.
+func compareByName[T any](v *verifier, desired, actual map[string]*T, getObject func(*T) Object) {
+	names := sortKeys(actual)
+	for name := range desired {
+		if actual[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var expectedObj, actualObj Object
+		if desired[name] != nil {
+			expectedObj = getObject(desired[name])
+		}
+		if actual[name] != nil {
+			actualObj = getObject(actual[name])
+		}
+		v.compare(expectedObj, actualObj)
+	}
+}
+
+// samePriority returns true if the priorities desired and actual are numerically
+// equivalent. (nft always reports priorities numerically.)
+func (v *verifier) samePriority(desired, actual string) bool {
+	desPriority, desErr := ParsePriority(v.ctx.family, desired)
+	actualPriority, actualErr := ParsePriority(v.ctx.family, actual)
+	return desErr == nil && actualErr == nil && desPriority == actualPriority
+}
+
+// verifyFlowtables compares flowtables.
+func (v *verifier) verifyFlowtables(desired, actual *FakeTable) {
+	flowtables := make(map[string]*FakeFlowtable, len(actual.Flowtables))
+	for name, flowtable := range actual.Flowtables {
+		f := *flowtable
+		if des := desired.Flowtables[name]; des != nil && des.Priority != nil && f.Priority != nil {
+			if v.samePriority(string(*des.Priority), string(*f.Priority)) {
+				f.Priority = des.Priority
+			}
+		}
+		flowtables[name] = &f
+	}
+	compareByName(v, desired.Flowtables, flowtables,
+		func(f *FakeFlowtable) Object { return &f.Flowtable })
+}
+
+// verifyChains compares chains and their rules.
+func (v *verifier) verifyChains(desired, actual *FakeTable) {
+	chains := make(map[string]*FakeChain, len(actual.Chains))
+	for name, chain := range actual.Chains {
+		c := *chain
+		// Use the expected form of the priority if it is numerically equivalent.
+		// Likewise, nft reports the default policy even if none was specified.
+		if des := desired.Chains[name]; des != nil {
+			if des.Priority != nil && c.Priority != nil && v.samePriority(string(*des.Priority), string(*c.Priority)) {
+				c.Priority = des.Priority
+			}
+			if des.Policy == nil && c.Policy != nil && *c.Policy == AcceptPolicy {
+				c.Policy = nil
+			}
+		}
+		chains[name] = &c
+	}
+	compareByName(v, desired.Chains, chains,
+		func(c *FakeChain) Object { return &c.Chain })
+
+	for _, name := range sortKeys(chains) {
+		if des := desired.Chains[name]; des != nil {
+			v.verifyRules(des.Rules, chains[name].Rules)
+		}
+	}
+}
+
+// verifyRules matches up the rules of a chain in the same way as Diff, and compares the
+// rules that did not match. Unmatched rules that fall between the same pair of matched
+// rules are compared in order, so that a rule that nft has rewritten differently than
+// expected is reported as a single Difference.
+func (v *verifier) verifyRules(desired, actual []*Rule) {
+	rules := make([]*Rule, len(actual))
+	for i, rule := range actual {
+		r := *rule
+		r.Index = PtrTo(i)
+		rules[i] = &r
+	}
+	matches := (&differ{ctx: v.ctx}).matchRules(rules, desired)
+
+	i, j := 0, 0
+	for j <= len(desired) {
+		// Find the next matched pair (or the end of both lists).
+		nextDesired, nextActual := j, len(rules)
+		for nextDesired < len(desired) && matches[nextDesired] == -1 {
+			nextDesired++
+		}
+		if nextDesired < len(desired) {
+			nextActual = matches[nextDesired]
+		}
+
+		for i < nextActual || j < nextDesired {
+			var expectedObj, actualObj Object
+			if j < nextDesired {
+				expectedObj = desired[j]
+				j++
+			}
+			if i < nextActual {
+				actualObj = rules[i]
+				i++
+			}
+			v.compare(expectedObj, actualObj)
+		}
+		i, j = nextActual+1, nextDesired+1
+	}
+}
+
+// verifyElements compares the elements of a set or map by key, ignoring their counters
+// and expiration times (and their timeouts, if no timeout was expected).
+func (v *verifier) verifyElements(desired, actual []*Element) {
+	desiredByKey := make(map[string]*Element, len(desired))
+	for _, elem := range desired {
+		e := *elem
+		e.Expires, e.Packets, e.Bytes = nil, nil, nil
+		desiredByKey[strings.Join(elem.Key, " . ")] = &e
+	}
+	actualByKey := make(map[string]*Element, len(actual))
+	for _, elem := range actual {
+		key := strings.Join(elem.Key, " . ")
+		e := *elem
+		e.Expires, e.Packets, e.Bytes = nil, nil, nil
+		if des := desiredByKey[key]; des != nil && des.Timeout == nil {
+			e.Timeout = nil
+		}
+		actualByKey[key] = &e
+	}
+
+	keys := sortKeys(actualByKey)
+	for key := range desiredByKey {
+		if actualByKey[key] == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var expectedObj, actualObj Object
+		if desiredByKey[key] != nil {
+			expectedObj = desiredByKey[key]
+		}
+		if actualByKey[key] != nil {
+			actualObj = actualByKey[key]
+		}
+		v.compare(expectedObj, actualObj)
+	}
+}
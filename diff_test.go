@@ -0,0 +1,291 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		current  string
+		desired  string
+		expected string
+	}{
+		{
+			name: "reordered rules",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.2 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.3 drop
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain ip daddr 10.0.0.3 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.2 drop
+				`,
+			expected: `
+				delete rule ip kube-proxy chain handle 5
+				insert rule ip kube-proxy chain handle 3 ip daddr 10.0.0.3 drop
+				`,
+		},
+		{
+			name: "rules added at start, middle, and end",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain ip daddr 10.0.0.2 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.4 drop
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain ip daddr 10.0.0.0 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.2 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.3 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.4 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.5 drop
+				`,
+			expected: `
+				insert rule ip kube-proxy chain handle 3 ip daddr 10.0.0.0 drop
+				insert rule ip kube-proxy chain handle 3 ip daddr 10.0.0.1 drop
+				insert rule ip kube-proxy chain handle 4 ip daddr 10.0.0.3 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.5 drop
+				`,
+		},
+		{
+			name: "recreated base chain",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy input { type filter hook input priority 0 ; }
+				add chain ip kube-proxy services
+				add map ip kube-proxy vmap { type ipv4_addr : verdict ; }
+				add rule ip kube-proxy input jump services
+				add rule ip kube-proxy input ip daddr vmap @vmap
+				add rule ip kube-proxy services ip daddr 10.0.0.1 drop
+				add element ip kube-proxy vmap { 10.0.0.2 : goto services }
+				add element ip kube-proxy vmap { 10.0.0.3 : drop }
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy input { type filter hook input priority 0 ; }
+				add chain ip kube-proxy services { comment "services" ; }
+				add map ip kube-proxy vmap { type ipv4_addr : verdict ; }
+				add rule ip kube-proxy input jump services
+				add rule ip kube-proxy input ip daddr vmap @vmap
+				add rule ip kube-proxy services ip daddr 10.0.0.1 drop
+				add element ip kube-proxy vmap { 10.0.0.2 : goto services }
+				add element ip kube-proxy vmap { 10.0.0.3 : drop }
+				`,
+			expected: `
+				delete rule ip kube-proxy input handle 5
+				delete element ip kube-proxy vmap { 10.0.0.2 }
+				flush chain ip kube-proxy services
+				delete chain ip kube-proxy services
+				add chain ip kube-proxy services { comment "services" ; }
+				insert rule ip kube-proxy input handle 6 jump services
+				add rule ip kube-proxy services ip daddr 10.0.0.1 drop
+				add element ip kube-proxy vmap { 10.0.0.2 : goto services }
+				`,
+		},
+		{
+			name: "rules differing only in counter values",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 counter packets 10 bytes 800 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.2 counter packets 0 bytes 0 drop
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 counter drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.2 counter packets 3 bytes 180 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.3 counter packets 3 bytes 180 drop
+				`,
+			expected: `
+				add rule ip kube-proxy chain ip daddr 10.0.0.3 counter drop
+				`,
+		},
+		{
+			name: "other object types",
+			current: `
+				add table ip kube-proxy
+				add flowtable ip kube-proxy ft { hook ingress priority filter ; devices = { eth0 } ; }
+				add ct helper ip kube-proxy ftp { type "ftp" protocol tcp ; }
+				add synproxy ip kube-proxy syn { mss 1460 wscale 7 ; }
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain flow add @ft
+				add rule ip kube-proxy chain tcp dport 443 synproxy name @syn
+				`,
+			desired: `
+				add table ip kube-proxy
+				add flowtable ip kube-proxy ft { hook ingress priority filter ; devices = { eth0, eth1 } ; }
+				add ct timeout ip kube-proxy timeout { protocol tcp ; policy = { established : 120 } ; }
+				add synproxy ip kube-proxy syn { mss 1460 wscale 7 ; }
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain flow add @ft
+				add rule ip kube-proxy chain tcp dport 443 synproxy name @syn
+				`,
+			expected: `
+				delete rule ip kube-proxy chain handle 6
+				delete flowtable ip kube-proxy ft
+				delete ct helper ip kube-proxy ftp
+				add flowtable ip kube-proxy ft { hook ingress priority filter ; devices = { eth0, eth1 } ; }
+				add ct timeout ip kube-proxy timeout { protocol tcp ; policy = { established : 120 } ; }
+				insert rule ip kube-proxy chain handle 7 flow add @ft
+				`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			current := NewFake(IPv4Family, "kube-proxy")
+			if err := current.ParseDump(dedent.Dedent(tc.current)); err != nil {
+				t.Fatalf("unexpected error parsing current state: %v", err)
+			}
+			desired := NewFake(IPv4Family, "kube-proxy")
+			if err := desired.ParseDump(dedent.Dedent(tc.desired)); err != nil {
+				t.Fatalf("unexpected error parsing desired state: %v", err)
+			}
+
+			tx, err := Diff(current, desired)
+			if err != nil {
+				t.Fatalf("unexpected error from Diff: %v", err)
+			}
+			expected := strings.TrimPrefix(dedent.Dedent(tc.expected), "\n")
+			if diff := cmp.Diff(expected, tx.String()); diff != "" {
+				t.Errorf("unexpected transaction:\n%s", diff)
+			}
+
+			if err := current.Run(context.Background(), tx); err != nil {
+				t.Fatalf("unexpected error running transaction: %v", err)
+			}
+			if diff := cmp.Diff(normalizeDump(desired.Dump()), normalizeDump(current.Dump())); diff != "" {
+				t.Errorf("unexpected result after running transaction:\n%s", diff)
+			}
+
+			// Diffing again should result in an empty transaction
+			tx, err = Diff(current, desired)
+			if err != nil {
+				t.Fatalf("unexpected error from second Diff: %v", err)
+			}
+			if tx.NumOperations() != 0 {
+				t.Errorf("expected empty transaction on second Diff, got:\n%s", tx.String())
+			}
+		})
+	}
+}
+
+func TestDiffMismatch(t *testing.T) {
+	_, err := Diff(NewFake(IPv4Family, "kube-proxy"), NewFake(IPv6Family, "kube-proxy"))
+	if err == nil {
+		t.Errorf("expected error diffing different families")
+	}
+	_, err = Diff(NewFake(IPv4Family, "kube-proxy"), NewFake(IPv4Family, "other"))
+	if err == nil {
+		t.Errorf("expected error diffing different tables")
+	}
+}
+
+func TestFakeVerify(t *testing.T) {
+	expected := NewFake(IPv4Family, "kube-proxy")
+	if err := expected.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add chain ip kube-proxy removed
+		add set ip kube-proxy ips { type ipv4_addr ; }
+		add rule ip kube-proxy chain ip daddr @ips drop
+		add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+		add element ip kube-proxy ips { 10.0.0.2 }
+		add element ip kube-proxy ips { 10.0.0.3 comment "old" }
+		`)); err != nil {
+		t.Fatalf("unexpected error parsing expected state: %v", err)
+	}
+
+	fake := NewFake(IPv4Family, "kube-proxy")
+	diffs, err := fake.Verify(context.Background(), expected)
+	if err != nil {
+		t.Fatalf("unexpected error from Verify: %v", err)
+	}
+	if diff := cmp.Diff([]Difference{{Expected: &expected.Table.Table}}, diffs); diff != "" {
+		t.Errorf("unexpected result from Verify of missing table:\n%s", diff)
+	}
+
+	if err := fake.ParseDump(expected.Dump()); err != nil {
+		t.Fatalf("unexpected error parsing dump: %v", err)
+	}
+	diffs, err = fake.Verify(context.Background(), expected)
+	if err != nil {
+		t.Fatalf("unexpected error from Verify: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v", diffs)
+	}
+
+	// Counter values in rules are ignored
+	fake.Table.Chains["chain"].Rules[1].Rule = "ip daddr 10.0.0.1 counter packets 5 bytes 300 drop"
+	expected.Table.Chains["chain"].Rules[1].Rule = "ip daddr 10.0.0.1 counter drop"
+	diffs, err = fake.Verify(context.Background(), expected)
+	if err != nil {
+		t.Fatalf("unexpected error from Verify: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v", diffs)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Delete(&Chain{Name: "removed"})
+	tx.Add(&Chain{Name: "added"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.2 drop"})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.3"}, Comment: PtrTo("new")})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	diffs, err = fake.Verify(context.Background(), expected)
+	if err != nil {
+		t.Fatalf("unexpected error from Verify: %v", err)
+	}
+	addedRule := *fake.Table.Chains["chain"].Rules[2]
+	addedRule.Index = PtrTo(2)
+	expectedDiffs := []Difference{
+		{Actual: &Chain{Name: "added", Handle: fake.Table.Chains["added"].Handle}},
+		{Expected: &expected.Table.Chains["removed"].Chain},
+		{Actual: &addedRule},
+		{
+			Expected: expected.Table.Sets["ips"].Elements[1],
+			Actual:   fake.Table.Sets["ips"].Elements[1],
+		},
+	}
+	if diff := cmp.Diff(expectedDiffs, diffs); diff != "" {
+		t.Errorf("unexpected result from Verify:\n%s", diff)
+	}
+
+	_, err = fake.Verify(context.Background(), NewFake(IPv6Family, "kube-proxy"))
+	if err == nil {
+		t.Errorf("expected error verifying against a different family")
+	}
+}
@@ -20,7 +20,9 @@ import (
 	"errors"
 	"fmt"
 	"os/exec"
+	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 )
 
@@ -28,6 +30,73 @@ type nftablesError struct {
 	wrapped error
 	msg     string
 	errno   syscall.Errno
+
+	// overlap is set for errors about overlapping interval set/map elements
+	overlap bool
+
+	// generationMismatch is set for errors from Fake.RunAtGeneration
+	generationMismatch bool
+}
+
+// nftErrnoMessages maps the (English) strerror() messages that nft may output to the
+// corresponding errno values.
+var nftErrnoMessages = []struct {
+	msg   string
+	errno syscall.Errno
+}{
+	{"No such file or directory", syscall.ENOENT},
+	{"File exists", syscall.EEXIST},
+	{"Device or resource busy", syscall.EBUSY},
+	{"Operation not permitted", syscall.EPERM},
+	{"Permission denied", syscall.EACCES},
+}
+
+// extraErrnoPatterns holds the patterns registered with RegisterNotFoundPattern and
+// RegisterExistsPattern
+var extraErrnoPatterns struct {
+	sync.RWMutex
+	patterns []errnoPattern
+}
+
+type errnoPattern struct {
+	re    *regexp.Regexp
+	errno syscall.Errno
+}
+
+// RegisterNotFoundPattern registers an additional pattern which, if it matches the first
+// line of the error output of an nft command, will cause IsNotFound to return true for
+// the resulting error. (This can be used to handle nft builds that output errors
+// differently from upstream nft.) Patterns are only matched against the stderr output of
+// nft commands that fail (ie, not against errors generated by knftables itself, or by the
+// Fake), and are only consulted if none of the built-in patterns match.
+func RegisterNotFoundPattern(re *regexp.Regexp) {
+	registerErrnoPattern(re, syscall.ENOENT)
+}
+
+// RegisterExistsPattern registers an additional pattern which, if it matches the first
+// line of the error output of an nft command, will cause IsAlreadyExists to return true
+// for the resulting error. (See RegisterNotFoundPattern for more details.)
+func RegisterExistsPattern(re *regexp.Regexp) {
+	registerErrnoPattern(re, syscall.EEXIST)
+}
+
+func registerErrnoPattern(re *regexp.Regexp, errno syscall.Errno) {
+	extraErrnoPatterns.Lock()
+	defer extraErrnoPatterns.Unlock()
+	extraErrnoPatterns.patterns = append(extraErrnoPatterns.patterns, errnoPattern{re: re, errno: errno})
+}
+
+// matchExtraErrnoPatterns returns the errno of the first registered pattern that matches
+// line, or 0 if none match.
+func matchExtraErrnoPatterns(line string) syscall.Errno {
+	extraErrnoPatterns.RLock()
+	defer extraErrnoPatterns.RUnlock()
+	for _, p := range extraErrnoPatterns.patterns {
+		if p.re.MatchString(line) {
+			return p.errno
+		}
+	}
+	return 0
 }
 
 // wrapError wraps an error resulting from running nft
@@ -37,15 +106,22 @@ func wrapError(err error) error {
 	if errors.As(err, &ee) {
 		if len(ee.Stderr) > 0 {
 			nerr.msg = string(ee.Stderr)
-			eol := strings.Index(nerr.msg, "\n")
+			// Only look at the first line; later lines may contain (parts of) the
+			// input that caused the error.
+			firstLine, _, _ := strings.Cut(nerr.msg, "\n")
 			// The nft binary does not call setlocale() and so will return
 			// English error strings regardless of the locale.
-			enoent := strings.Index(nerr.msg, "No such file or directory")
-			eexist := strings.Index(nerr.msg, "File exists")
-			if enoent != -1 && (enoent < eol || eol == -1) {
-				nerr.errno = syscall.ENOENT
-			} else if eexist != -1 && (eexist < eol || eol == -1) {
-				nerr.errno = syscall.EEXIST
+			for _, m := range nftErrnoMessages {
+				if strings.Contains(firstLine, m.msg) {
+					nerr.errno = m.errno
+					break
+				}
+			}
+			if nerr.errno == 0 {
+				nerr.errno = matchExtraErrnoPatterns(firstLine)
+			}
+			if strings.Contains(firstLine, "interval overlaps") || strings.Contains(firstLine, "conflicting intervals") {
+				nerr.overlap = true
 			}
 		}
 	}
@@ -64,6 +140,24 @@ func existsError(format string, args ...interface{}) error {
 	return &nftablesError{msg: fmt.Sprintf(format, args...), errno: syscall.EEXIST}
 }
 
+// busyError returns an nftablesError with the given message for which IsBusy will
+// return true.
+func busyError(format string, args ...interface{}) error {
+	return &nftablesError{msg: fmt.Sprintf(format, args...), errno: syscall.EBUSY}
+}
+
+// generationMismatchError returns an nftablesError with the given message for which
+// IsGenerationMismatch will return true.
+func generationMismatchError(format string, args ...interface{}) error {
+	return &nftablesError{msg: fmt.Sprintf(format, args...), generationMismatch: true}
+}
+
+// timeoutError wraps an error resulting from running nft after the command's context
+// deadline passed, such that IsTimeout will return true.
+func timeoutError(err error) error {
+	return &nftablesError{wrapped: err, msg: fmt.Sprintf("nft command timed out: %v", err), errno: syscall.ETIMEDOUT}
+}
+
 func (nerr *nftablesError) Error() string {
 	return nerr.msg
 }
@@ -92,3 +186,57 @@ func IsAlreadyExists(err error) bool {
 	}
 	return false
 }
+
+// IsBusy tests if err corresponds to an nftables "resource busy" error (e.g. when trying
+// to delete a chain that is still referenced by a "jump" or "goto" from another chain, or
+// a set that is still referenced by a rule).
+func IsBusy(err error) bool {
+	var nerr *nftablesError
+	if errors.As(err, &nerr) {
+		return nerr.errno == syscall.EBUSY
+	}
+	return false
+}
+
+// IsPermissionDenied tests if err corresponds to an nftables "permission denied" or
+// "operation not permitted" error (e.g. because the caller does not have CAP_NET_ADMIN).
+func IsPermissionDenied(err error) bool {
+	var nerr *nftablesError
+	if errors.As(err, &nerr) {
+		return nerr.errno == syscall.EPERM || nerr.errno == syscall.EACCES
+	}
+	return false
+}
+
+// IsOverlap tests if err corresponds to an nftables error about an interval set or map
+// element that overlaps with another element. (Depending on the version of nft, this may
+// be reported as an "already exists" error as well, in which case IsAlreadyExists will
+// also return true.)
+func IsOverlap(err error) bool {
+	var nerr *nftablesError
+	if errors.As(err, &nerr) {
+		return nerr.overlap
+	}
+	return false
+}
+
+// IsGenerationMismatch tests if err indicates that a transaction was not run because the
+// ruleset generation did not match the one passed to Fake.RunAtGeneration.
+func IsGenerationMismatch(err error) bool {
+	var nerr *nftablesError
+	if errors.As(err, &nerr) {
+		return nerr.generationMismatch
+	}
+	return false
+}
+
+// IsTimeout tests if err indicates that an nft command failed because the deadline of the
+// context passed to the operation (or the timeout set with WithListTimeout or
+// WithRunTimeout) passed before it completed.
+func IsTimeout(err error) bool {
+	var nerr *nftablesError
+	if errors.As(err, &nerr) {
+		return nerr.errno == syscall.ETIMEDOUT
+	}
+	return false
+}
@@ -19,6 +19,7 @@ package knftables
 import (
 	"fmt"
 	"os/exec"
+	"regexp"
 	"testing"
 )
 
@@ -32,6 +33,12 @@ func TestError(t *testing.T) {
 		err        error
 		isNotFound bool
 		isExists   bool
+
+		isBusy               bool
+		isPermissionDenied   bool
+		isOverlap            bool
+		isGenerationMismatch bool
+		isTimeout            bool
 	}{
 		{
 			name:       "generic doesn't exist",
@@ -75,6 +82,54 @@ func TestError(t *testing.T) {
 			isNotFound: false,
 			isExists:   false,
 		},
+		{
+			name:       "busy",
+			err:        mkExecError("Error: Could not process rule: Device or resource busy\ndelete chain ip kube-proxy services\n^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^\n"),
+			isNotFound: false,
+			isExists:   false,
+			isBusy:     true,
+		},
+		{
+			name:               "operation not permitted",
+			err:                mkExecError("Error: Could not process rule: Operation not permitted\nadd table ip kube-proxy\n^^^^^^^^^^^^^^^^^^^^^^^\n"),
+			isNotFound:         false,
+			isExists:           false,
+			isPermissionDenied: true,
+		},
+		{
+			name:               "cache initialization not permitted",
+			err:                mkExecError("netlink: Error: cache initialization failed: Operation not permitted\n"),
+			isNotFound:         false,
+			isExists:           false,
+			isPermissionDenied: true,
+		},
+		{
+			name:               "permission denied",
+			err:                mkExecError("Error: Could not process rule: Permission denied\n"),
+			isNotFound:         false,
+			isExists:           false,
+			isPermissionDenied: true,
+		},
+		{
+			name:       "interval overlap",
+			err:        mkExecError("Error: interval overlaps with an existing one\nadd element ip kube-proxy cidrs { 10.0.0.0/8 }\n                                ^^^^^^^^^^^\n"),
+			isNotFound: false,
+			isExists:   false,
+			isOverlap:  true,
+		},
+		{
+			name:       "conflicting intervals",
+			err:        mkExecError("Error: conflicting intervals specified\nadd element ip kube-proxy cidrs { 10.0.0.0/8, 10.1.0.0/16 }\n"),
+			isNotFound: false,
+			isExists:   false,
+			isOverlap:  true,
+		},
+		{
+			name:       "misleading busy error",
+			err:        mkExecError("Error: syntax error, unexpected string\nadd rule ip kube-proxy chain comment \"Device or resource busy\" drop\n"),
+			isNotFound: false,
+			isExists:   false,
+		},
 		{
 			name:       "fake not found",
 			err:        notFoundError("not found"),
@@ -87,6 +142,24 @@ func TestError(t *testing.T) {
 			isNotFound: false,
 			isExists:   true,
 		},
+		{
+			name:                 "fake generation mismatch",
+			err:                  generationMismatchError("wrong generation"),
+			isNotFound:           false,
+			isExists:             false,
+			isGenerationMismatch: true,
+		},
+		{
+			name:      "timeout",
+			err:       timeoutError(mkExecError("")),
+			isTimeout: true,
+		},
+		{
+			name:       "timeout wrapping not found",
+			err:        timeoutError(mkExecError("Error: No such file or directory\n")),
+			isNotFound: false,
+			isTimeout:  true,
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			if IsNotFound(tc.err) != tc.isNotFound {
@@ -95,6 +168,55 @@ func TestError(t *testing.T) {
 			if IsAlreadyExists(tc.err) != tc.isExists {
 				t.Errorf("expected IsAlreadyExists %v, got %v", tc.isExists, IsAlreadyExists(tc.err))
 			}
+			if IsBusy(tc.err) != tc.isBusy {
+				t.Errorf("expected IsBusy %v, got %v", tc.isBusy, IsBusy(tc.err))
+			}
+			if IsPermissionDenied(tc.err) != tc.isPermissionDenied {
+				t.Errorf("expected IsPermissionDenied %v, got %v", tc.isPermissionDenied, IsPermissionDenied(tc.err))
+			}
+			if IsOverlap(tc.err) != tc.isOverlap {
+				t.Errorf("expected IsOverlap %v, got %v", tc.isOverlap, IsOverlap(tc.err))
+			}
+			if IsGenerationMismatch(tc.err) != tc.isGenerationMismatch {
+				t.Errorf("expected IsGenerationMismatch %v, got %v", tc.isGenerationMismatch, IsGenerationMismatch(tc.err))
+			}
+			if IsTimeout(tc.err) != tc.isTimeout {
+				t.Errorf("expected IsTimeout %v, got %v", tc.isTimeout, IsTimeout(tc.err))
+			}
 		})
 	}
 }
+
+func TestRegisterErrorPatterns(t *testing.T) {
+	saved := extraErrnoPatterns.patterns
+	defer func() {
+		extraErrnoPatterns.patterns = saved
+	}()
+
+	notFound := "Fehler: Datei oder Verzeichnis nicht gefunden\ndelete chain ip foo bar\n"
+	exists := "Fehler: Datei existiert bereits\ncreate table foo\n"
+	misleading := "Error: syntax error\nadd rule foo chain1 comment \"nicht gefunden\" drop\n"
+	if IsNotFound(mkExecError(notFound)) || IsAlreadyExists(mkExecError(exists)) {
+		t.Fatalf("unexpected match before registering patterns")
+	}
+
+	RegisterNotFoundPattern(regexp.MustCompile(`nicht gefunden`))
+	RegisterExistsPattern(regexp.MustCompile(`existiert bereits`))
+
+	if !IsNotFound(mkExecError(notFound)) {
+		t.Errorf("expected registered pattern to match not-found error")
+	}
+	if !IsAlreadyExists(mkExecError(exists)) {
+		t.Errorf("expected registered pattern to match already-exists error")
+	}
+	if IsNotFound(mkExecError(misleading)) {
+		t.Errorf("expected registered pattern to only match the first line of the error")
+	}
+	if IsNotFound(wrapError(fmt.Errorf("%s", notFound))) {
+		t.Errorf("expected registered pattern not to match a non-exec error")
+	}
+	// Built-in patterns take precedence
+	if err := mkExecError("Error: File exists; nicht gefunden\n"); !IsAlreadyExists(err) || IsNotFound(err) {
+		t.Errorf("expected built-in pattern to take precedence")
+	}
+}
@@ -17,6 +17,10 @@ limitations under the License.
 package knftables
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"os/exec"
 )
 
@@ -26,8 +30,22 @@ type execer interface {
 	LookPath(file string) (string, error)
 
 	// Run runs cmd as with cmd.Output(). If an error occurs, and the process outputs
-	// stderr, then that output will be returned in the error.
-	Run(cmd *exec.Cmd) (string, error)
+	// stderr, then that output will be returned in the error. cmd must have been
+	// created with ctx; it is passed separately so that fake implementations can
+	// examine it.
+	Run(ctx context.Context, cmd *exec.Cmd) (string, error)
+
+	// RunReader runs cmd, passing its stdout to read as it is produced, rather than
+	// collecting it all first. If cmd fails, the returned error is the same as Run
+	// would have returned (including any stderr output), regardless of what read
+	// did. As with Run, cmd must have been created with ctx.
+	RunReader(ctx context.Context, cmd *exec.Cmd, read func(io.Reader)) error
+
+	// Start starts cmd and returns a reader for its stdout, for long-running
+	// commands. Closing the reader waits for the command to exit (so the caller
+	// should ensure that it has exited, eg by cancelling its context, first). As
+	// with Run, cmd must have been created with ctx.
+	Start(ctx context.Context, cmd *exec.Cmd) (io.ReadCloser, error)
 }
 
 // realExec implements execer by actually using os/exec
@@ -39,10 +57,61 @@ func (realExec) LookPath(file string) (string, error) {
 }
 
 // Run is part of execer
-func (realExec) Run(cmd *exec.Cmd) (string, error) {
+func (realExec) Run(_ context.Context, cmd *exec.Cmd) (string, error) {
 	out, err := cmd.Output()
 	if err != nil {
 		err = wrapError(err)
 	}
 	return string(out), err
 }
+
+// RunReader is part of execer
+func (realExec) RunReader(_ context.Context, cmd *exec.Cmd, read func(io.Reader)) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return wrapError(err)
+	}
+
+	read(stdout)
+	// Drain anything read didn't consume, so that the command can exit.
+	_, _ = io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		// cmd.Output() would fill in Stderr; do the same so wrapError can use it.
+		ee := &exec.ExitError{}
+		if errors.As(err, &ee) {
+			ee.Stderr = stderr.Bytes()
+		}
+		return wrapError(err)
+	}
+	return nil
+}
+
+// Start is part of execer
+func (realExec) Start(_ context.Context, cmd *exec.Cmd) (io.ReadCloser, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, wrapError(err)
+	}
+	return &cmdReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// cmdReader wraps the stdout of a running command
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close closes the reader and waits for the command to exit
+func (cr *cmdReader) Close() error {
+	_ = cr.ReadCloser.Close()
+	return cr.cmd.Wait()
+}
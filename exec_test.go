@@ -18,12 +18,14 @@ package knftables
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os/exec"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // fakeExec is a mockable implementation of execer for unit tests
@@ -48,6 +50,9 @@ func (fe *fakeExec) LookPath(file string) (string, error) {
 	if fe.missingBinaries[file] {
 		return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
 	}
+	if strings.HasPrefix(file, "/") {
+		return file, nil
+	}
 	return "/" + file, nil
 }
 
@@ -57,9 +62,13 @@ type expectedCmd struct {
 	stdin  string
 	stdout string
 	err    error
+
+	// deadline, if set, is the expected (approximate) time remaining before the
+	// command's context's deadline. If unset, the context must not have a deadline.
+	deadline time.Duration
 }
 
-func (fe *fakeExec) Run(cmd *exec.Cmd) (string, error) {
+func (fe *fakeExec) Run(ctx context.Context, cmd *exec.Cmd) (string, error) {
 	if fe.t.Failed() {
 		return "", fmt.Errorf("unit test failed")
 	}
@@ -86,9 +95,38 @@ func (fe *fakeExec) Run(cmd *exec.Cmd) (string, error) {
 		return "", fmt.Errorf("unit test failed")
 	}
 
+	deadline, hasDeadline := ctx.Deadline()
+	if expected.deadline == 0 && hasDeadline {
+		fe.t.Errorf("unexpected context deadline for %v", cmd.Args)
+		return "", fmt.Errorf("unit test failed")
+	} else if expected.deadline != 0 {
+		remaining := time.Until(deadline)
+		if !hasDeadline || remaining > expected.deadline || remaining < expected.deadline-time.Minute {
+			fe.t.Errorf("incorrect context deadline for %v: expected %v, got %v (%v)", cmd.Args, expected.deadline, remaining, hasDeadline)
+			return "", fmt.Errorf("unit test failed")
+		}
+	}
+
 	return expected.stdout, expected.err
 }
 
+func (fe *fakeExec) RunReader(ctx context.Context, cmd *exec.Cmd, read func(io.Reader)) error {
+	out, err := fe.Run(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	read(strings.NewReader(out))
+	return nil
+}
+
+func (fe *fakeExec) Start(ctx context.Context, cmd *exec.Cmd) (io.ReadCloser, error) {
+	out, err := fe.Run(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(out)), nil
+}
+
 type execTestCase struct {
 	name        string
 	command     []string
@@ -142,7 +180,7 @@ func TestRealExec(t *testing.T) {
 			if tc.stdin != "" {
 				cmd.Stdin = bytes.NewBufferString(tc.stdin)
 			}
-			out, err := execer.Run(cmd)
+			out, err := execer.Run(context.Background(), cmd)
 			if out != tc.expectedOut {
 				t.Errorf("expected output %q, got %q", tc.expectedOut, out)
 			}
@@ -159,6 +197,67 @@ func TestRealExec(t *testing.T) {
 	}
 }
 
+func TestRealExecRunReader(t *testing.T) {
+	for _, tc := range execTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			execer := &realExec{}
+			cmd := exec.Command(tc.command[0], tc.command[1:]...)
+			if tc.stdin != "" {
+				cmd.Stdin = bytes.NewBufferString(tc.stdin)
+			}
+			var out []byte
+			var readErr error
+			err := execer.RunReader(context.Background(), cmd, func(r io.Reader) {
+				out, readErr = io.ReadAll(r)
+			})
+			if readErr != nil {
+				t.Errorf("unexpected error reading output: %v", readErr)
+			}
+			if string(out) != tc.expectedOut {
+				t.Errorf("expected output %q, got %q", tc.expectedOut, string(out))
+			}
+			if err != nil {
+				if tc.expectedErr == "" {
+					t.Errorf("expected no error, got %v", err)
+				} else if !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+				}
+			} else if tc.expectedErr != "" {
+				t.Errorf("expected error containing %q, got no error", tc.expectedErr)
+			}
+		})
+	}
+
+	// If read returns without consuming all of the output, the command should still
+	// be able to exit.
+	cmd := exec.Command("/bin/sh", "-c", "yes | head -c 1000000")
+	err := realExec{}.RunReader(context.Background(), cmd, func(r io.Reader) {
+		_, _ = r.Read(make([]byte, 10))
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRealExecKillProcessGroup(t *testing.T) {
+	// The shell's stdout is held open by a background child, so without killing the
+	// whole process group, Run would not return until the child exited.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", "sleep 30 & wait")
+	killProcessGroupOnCancel(cmd)
+	cmd.WaitDelay = 10 * time.Second
+
+	start := time.Now()
+	_, err := realExec{}.Run(ctx, cmd)
+	if err == nil {
+		t.Errorf("expected error from killed command")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command was not killed promptly (took %v)", elapsed)
+	}
+}
+
 func TestFakeExec(t *testing.T) {
 	for _, tc := range execTestCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -177,7 +276,7 @@ func TestFakeExec(t *testing.T) {
 			if tc.stdin != "" {
 				cmd.Stdin = bytes.NewBufferString(tc.stdin)
 			}
-			out, err := execer.Run(cmd)
+			out, err := execer.Run(context.Background(), cmd)
 			if out != tc.expectedOut {
 				t.Errorf("expected output %q, got %q", tc.expectedOut, out)
 			}
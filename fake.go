@@ -17,13 +17,18 @@ limitations under the License.
 package knftables
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Fake is a fake implementation of Interface
@@ -45,6 +50,38 @@ type Fake struct {
 	// next time Run() is called. (It is not affected by Check().)
 	// Make sure to acquire Fake.RLock before accessing LastTransaction in a concurrent environment.
 	LastTransaction *Transaction
+
+	// StrictRuleValidation, if set, causes the Fake to do some basic syntax checking
+	// of rules, and return an error (as the real nft would) for rules that are
+	// obviously malformed (eg, that have unbalanced braces, or extra statements after
+	// a verdict). This does not actually try to fully parse the rules.
+	StrictRuleValidation bool
+
+	// StrictTypeChecking, if set, causes the Fake to check that the Key (and, for
+	// maps, Value) of each element added to a set or map has the number of fields
+	// implied by the set or map's Type or TypeOf (eg, that an element of a set of type
+	// "ipv4_addr . inet_service" has a two-field Key). It does not check the values of
+	// the fields themselves, except that "ether_addr" fields must be MAC addresses.
+	StrictTypeChecking bool
+
+	// monitors are the active Monitor() calls
+	monitors []*fakeMonitor
+
+	// detectHookConflicts is set by SetDetectHookConflicts
+	detectHookConflicts bool
+
+	// checkIntervalFlag is set by SetCheckIntervalFlag
+	checkIntervalFlag bool
+
+	// strictParsing is set by SetStrictParsing
+	strictParsing bool
+
+	// generation is incremented on each successful Run
+	generation uint32
+
+	// version and unsupportedFeatures are set by SetVersion and SetFeature
+	version             [3]int
+	unsupportedFeatures map[Feature]bool
 }
 
 // FakeTable wraps Table for the Fake implementation
@@ -54,6 +91,18 @@ type FakeTable struct {
 	// Flowtables contains the table's flowtables, keyed by name
 	Flowtables map[string]*FakeFlowtable
 
+	// CTHelpers contains the table's ct helpers, keyed by name
+	CTHelpers map[string]*FakeCTHelper
+
+	// CTTimeouts contains the table's ct timeouts, keyed by name
+	CTTimeouts map[string]*FakeCTTimeout
+
+	// CTExpectations contains the table's ct expectations, keyed by name
+	CTExpectations map[string]*FakeCTExpectation
+
+	// Synproxies contains the table's synproxies, keyed by name
+	Synproxies map[string]*FakeSynproxy
+
 	// Chains contains the table's chains, keyed by name
 	Chains map[string]*FakeChain
 
@@ -69,6 +118,26 @@ type FakeFlowtable struct {
 	Flowtable
 }
 
+// FakeCTHelper wraps CTHelper for the Fake implementation
+type FakeCTHelper struct {
+	CTHelper
+}
+
+// FakeCTTimeout wraps CTTimeout for the Fake implementation
+type FakeCTTimeout struct {
+	CTTimeout
+}
+
+// FakeCTExpectation wraps CTExpectation for the Fake implementation
+type FakeCTExpectation struct {
+	CTExpectation
+}
+
+// FakeSynproxy wraps Synproxy for the Fake implementation
+type FakeSynproxy struct {
+	Synproxy
+}
+
 // FakeChain wraps Chain for the Fake implementation
 type FakeChain struct {
 	Chain
@@ -102,11 +171,77 @@ func NewFake(family Family, table string) *Fake {
 			family: family,
 			table:  table,
 		},
+		version: fakeVersion,
 	}
 }
 
 var _ Interface = &Fake{}
 
+// fakeVersion is the default nft version reported by the Fake
+var fakeVersion = [3]int{1, 0, 9}
+
+// SetVersion sets the nft version that the Fake will report from Version(). (By default
+// it reports 1.0.9.) This does not affect HasFeature.
+func (fake *Fake) SetVersion(major, minor, patch int) {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.version = [3]int{major, minor, patch}
+}
+
+// SetFeature sets whether the Fake will report that feature is supported. (By default,
+// all features are reported as supported.) This only affects HasFeature; the Fake does
+// not change its behavior based on it.
+func (fake *Fake) SetFeature(feature Feature, supported bool) {
+	fake.Lock()
+	defer fake.Unlock()
+	if fake.unsupportedFeatures == nil {
+		fake.unsupportedFeatures = make(map[Feature]bool)
+	}
+	fake.unsupportedFeatures[feature] = !supported
+}
+
+// Version is part of Interface.
+func (fake *Fake) Version() (major, minor, patch int) {
+	fake.RLock()
+	defer fake.RUnlock()
+	return fake.version[0], fake.version[1], fake.version[2]
+}
+
+// HasFeature is part of Interface.
+func (fake *Fake) HasFeature(feature Feature) bool {
+	fake.RLock()
+	defer fake.RUnlock()
+	return !fake.unsupportedFeatures[feature]
+}
+
+// SetDetectHookConflicts sets whether the Fake should return an error when adding a base
+// chain with the same hook and priority as an existing base chain (since the relative
+// ordering of two such chains is undefined, which is almost always a bug).
+func (fake *Fake) SetDetectHookConflicts(detect bool) {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.detectHookConflicts = detect
+}
+
+// SetCheckIntervalFlag sets whether the Fake should return an error when adding an
+// element with a CIDR or range key (see NeedsIntervalFlag) to a set or map that does not
+// have the "interval" flag. (The real nft would fail in this case, but the Fake does not
+// check by default.)
+func (fake *Fake) SetCheckIntervalFlag(check bool) {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.checkIntervalFlag = check
+}
+
+// SetStrictParsing sets whether ParseDump should return an error for a rule whose chain
+// was not added earlier in the same dump. (By default, a rule may be added to a chain
+// that already existed in the Fake before ParseDump was called.)
+func (fake *Fake) SetStrictParsing(strict bool) {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.strictParsing = strict
+}
+
 // List is part of Interface.
 func (fake *Fake) List(_ context.Context, objectType string) ([]string, error) {
 	fake.RLock()
@@ -142,6 +277,102 @@ func (fake *Fake) List(_ context.Context, objectType string) ([]string, error) {
 	return result, nil
 }
 
+// ListChains is part of Interface
+func (fake *Fake) ListChains(_ context.Context) ([]*Chain, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		// As with the real implementation, a missing table just means no chains
+		return []*Chain{}, nil
+	}
+
+	chains := make([]*Chain, 0, len(fake.Table.Chains))
+	for _, name := range sortKeys(fake.Table.Chains) {
+		chains = append(chains, copyChain(&fake.Table.Chains[name].Chain))
+	}
+	return chains, nil
+}
+
+// ListSets is part of Interface
+func (fake *Fake) ListSets(_ context.Context) ([]*Set, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		// As with the real implementation, a missing table just means no sets
+		return []*Set{}, nil
+	}
+
+	sets := make([]*Set, 0, len(fake.Table.Sets))
+	for _, name := range sortKeys(fake.Table.Sets) {
+		sets = append(sets, copySet(&fake.Table.Sets[name].Set))
+	}
+	return sets, nil
+}
+
+// ListMaps is part of Interface
+func (fake *Fake) ListMaps(_ context.Context) ([]*Map, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		return []*Map{}, nil
+	}
+
+	maps := make([]*Map, 0, len(fake.Table.Maps))
+	for _, name := range sortKeys(fake.Table.Maps) {
+		maps = append(maps, copyMap(&fake.Table.Maps[name].Map))
+	}
+	return maps, nil
+}
+
+// GetTable is part of Interface
+func (fake *Fake) GetTable(_ context.Context) (*Table, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
+	return copyTable(&fake.Table.Table), nil
+}
+
+// GetChain is part of Interface
+func (fake *Fake) GetChain(_ context.Context, name string) (*Chain, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil || fake.Table.Chains[name] == nil {
+		return nil, notFoundError("no such chain %q", name)
+	}
+	return copyChain(&fake.Table.Chains[name].Chain), nil
+}
+
+// GetSet is part of Interface
+func (fake *Fake) GetSet(_ context.Context, name string) (*Set, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil || fake.Table.Sets[name] == nil {
+		return nil, notFoundError("no such set %q", name)
+	}
+	return copySet(&fake.Table.Sets[name].Set), nil
+}
+
+// GetMap is part of Interface
+func (fake *Fake) GetMap(_ context.Context, name string) (*Map, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil || fake.Table.Maps[name] == nil {
+		return nil, notFoundError("no such map %q", name)
+	}
+	return copyMap(&fake.Table.Maps[name].Map), nil
+}
+
+// Verify is part of Interface.
+func (fake *Fake) Verify(_ context.Context, expected *Fake) ([]Difference, error) {
+	return verify(&fake.nftContext, expected, func() (*FakeTable, error) {
+		fake.RLock()
+		defer fake.RUnlock()
+		return fake.Table.copy(), nil
+	})
+}
+
 // ListRules is part of Interface
 func (fake *Fake) ListRules(_ context.Context, chain string) ([]*Rule, error) {
 	fake.RLock()
@@ -150,22 +381,112 @@ func (fake *Fake) ListRules(_ context.Context, chain string) ([]*Rule, error) {
 		return nil, notFoundError("no such table %q", fake.table)
 	}
 
-	rules := []*Rule{}
+	var chains []*FakeChain
 	if chain == "" {
 		// Include all rules across all chains.
 		for _, ch := range fake.Table.Chains {
-			rules = append(rules, ch.Rules...)
+			chains = append(chains, ch)
 		}
 	} else {
 		ch := fake.Table.Chains[chain]
 		if ch == nil {
 			return nil, notFoundError("no such chain %q", chain)
 		}
-		rules = append(rules, ch.Rules...)
+		chains = append(chains, ch)
+	}
+
+	rules := []*Rule{}
+	for _, ch := range chains {
+		for i, rule := range ch.Rules {
+			ruleCopy := *rule
+			ruleCopy.Index = PtrTo(i)
+			rules = append(rules, &ruleCopy)
+		}
 	}
 	return rules, nil
 }
 
+// HasRule is part of Interface
+func (fake *Fake) HasRule(_ context.Context, chain, ruleText string) (bool, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		return false, notFoundError("no such table %q", fake.table)
+	}
+	ch := fake.Table.Chains[chain]
+	if ch == nil {
+		return false, notFoundError("no such chain %q", chain)
+	}
+
+	ruleText = normalizeRuleText(StripCounters(ruleText))
+	for _, rule := range ch.Rules {
+		if normalizeRuleText(StripCounters(rule.Rule)) == ruleText {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListCTHelpers is part of Interface
+func (fake *Fake) ListCTHelpers(_ context.Context) ([]*CTHelper, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
+
+	helpers := make([]*CTHelper, 0, len(fake.Table.CTHelpers))
+	for _, name := range sortKeys(fake.Table.CTHelpers) {
+		helpers = append(helpers, copyCTHelper(&fake.Table.CTHelpers[name].CTHelper))
+	}
+	return helpers, nil
+}
+
+// ListCTTimeouts is part of Interface
+func (fake *Fake) ListCTTimeouts(_ context.Context) ([]*CTTimeout, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
+
+	timeouts := make([]*CTTimeout, 0, len(fake.Table.CTTimeouts))
+	for _, name := range sortKeys(fake.Table.CTTimeouts) {
+		timeouts = append(timeouts, copyCTTimeout(&fake.Table.CTTimeouts[name].CTTimeout))
+	}
+	return timeouts, nil
+}
+
+// ListCTExpectations is part of Interface
+func (fake *Fake) ListCTExpectations(_ context.Context) ([]*CTExpectation, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
+
+	expectations := make([]*CTExpectation, 0, len(fake.Table.CTExpectations))
+	for _, name := range sortKeys(fake.Table.CTExpectations) {
+		expectations = append(expectations, copyCTExpectation(&fake.Table.CTExpectations[name].CTExpectation))
+	}
+	return expectations, nil
+}
+
+// ListSynproxies is part of Interface
+func (fake *Fake) ListSynproxies(_ context.Context) ([]*Synproxy, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
+
+	synproxies := make([]*Synproxy, 0, len(fake.Table.Synproxies))
+	for _, name := range sortKeys(fake.Table.Synproxies) {
+		synproxies = append(synproxies, copySynproxy(&fake.Table.Synproxies[name].Synproxy))
+	}
+	return synproxies, nil
+}
+
 // ListElements is part of Interface
 func (fake *Fake) ListElements(_ context.Context, objectType, name string) ([]*Element, error) {
 	fake.RLock()
@@ -187,6 +508,97 @@ func (fake *Fake) ListElements(_ context.Context, objectType, name string) ([]*E
 	return nil, notFoundError("no such %s %q", objectType, name)
 }
 
+// SetStats is part of Interface
+func (fake *Fake) SetStats(_ context.Context, name string) (*SetStats, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil || fake.Table.Sets[name] == nil {
+		return nil, notFoundError("no such set %q", name)
+	}
+	set := fake.Table.Sets[name]
+	return &SetStats{
+		Elements: len(set.Elements),
+		Size:     clonePtr(set.Size),
+	}, nil
+}
+
+// Monitor is part of Interface. The Fake emits synthetic events for the changes made by
+// each successful call to Run(). Flushing a chain, set, or map is reported as deleting
+// each of its rules or elements, while flushing the table is reported as deleting and
+// re-adding it. Flowtable changes are not reported.
+func (fake *Fake) Monitor(ctx context.Context) (<-chan *Event, error) {
+	monitor := &fakeMonitor{
+		ctx:    ctx,
+		events: make(chan *Event),
+	}
+	monitor.cond = sync.NewCond(&monitor.lock)
+
+	fake.Lock()
+	fake.monitors = append(fake.monitors, monitor)
+	fake.Unlock()
+
+	go monitor.run()
+	go func() {
+		<-ctx.Done()
+
+		fake.Lock()
+		for i := range fake.monitors {
+			if fake.monitors[i] == monitor {
+				fake.monitors = append(fake.monitors[:i], fake.monitors[i+1:]...)
+				break
+			}
+		}
+		fake.Unlock()
+
+		monitor.lock.Lock()
+		monitor.cond.Broadcast()
+		monitor.lock.Unlock()
+	}()
+
+	return monitor.events, nil
+}
+
+// fakeMonitor queues up events for a single Fake.Monitor() call, so that Run() doesn't
+// need to block waiting for the caller to read them.
+type fakeMonitor struct {
+	ctx    context.Context
+	events chan *Event
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	pending []*Event
+}
+
+func (monitor *fakeMonitor) send(events []*Event) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+	monitor.pending = append(monitor.pending, events...)
+	monitor.cond.Broadcast()
+}
+
+func (monitor *fakeMonitor) run() {
+	defer close(monitor.events)
+	for {
+		monitor.lock.Lock()
+		for len(monitor.pending) == 0 && monitor.ctx.Err() == nil {
+			monitor.cond.Wait()
+		}
+		if monitor.ctx.Err() != nil {
+			monitor.lock.Unlock()
+			return
+		}
+		event := monitor.pending[0]
+		monitor.pending = monitor.pending[1:]
+		monitor.lock.Unlock()
+
+		select {
+		case monitor.events <- event:
+		case <-monitor.ctx.Done():
+			return
+		}
+	}
+}
+
 // NewTransaction is part of Interface
 func (fake *Fake) NewTransaction() *Transaction {
 	return &Transaction{nftContext: &fake.nftContext}
@@ -196,26 +608,158 @@ func (fake *Fake) NewTransaction() *Transaction {
 func (fake *Fake) Run(_ context.Context, tx *Transaction) error {
 	fake.Lock()
 	defer fake.Unlock()
+	return fake.runLocked(tx)
+}
+
+// RunAtGeneration runs tx as with Run, but only if the Fake's ruleset generation (see
+// RulesetGeneration) is still gen. Otherwise, it returns an error for which
+// IsGenerationMismatch will return true, without making any changes. This can be used to
+// test optimistic concurrency when multiple writers share a table: read the generation,
+// examine the current state, build a transaction based on it, and then retry if the
+// transaction fails.
+//
+// (There is no equivalent for the real Interface, since nft does not provide any way to
+// read the ruleset generation or make a transaction conditional on it.)
+func (fake *Fake) RunAtGeneration(_ context.Context, tx *Transaction, gen uint32) error {
+	fake.Lock()
+	defer fake.Unlock()
+	if fake.generation != gen {
+		return generationMismatchError("ruleset generation is %d, not %d", fake.generation, gen)
+	}
+	return fake.runLocked(tx)
+}
+
+// runLocked runs tx and applies its changes (if it succeeds). fake must be locked.
+func (fake *Fake) runLocked(tx *Transaction) error {
 	fake.LastTransaction = tx
-	updatedTable, err := fake.run(tx)
+	updatedTable, events, err := fake.run(tx)
 	if err == nil {
 		fake.Table = updatedTable
+		if len(tx.operations) > 0 {
+			fake.generation++
+		}
+		for _, monitor := range fake.monitors {
+			monitor.send(events)
+		}
 	}
 	return err
 }
 
+// RulesetGeneration returns the Fake's ruleset generation number, which is incremented
+// each time a non-empty transaction is successfully Run (including by ParseDump), and
+// can be used to detect whether anything else has modified the Fake since it was last
+// examined. (See also RunAtGeneration.)
+// (There is no equivalent for the real Interface, since nft does not expose the kernel's
+// ruleset generation number.)
+func (fake *Fake) RulesetGeneration(_ context.Context) (uint32, error) {
+	fake.RLock()
+	defer fake.RUnlock()
+	return fake.generation, nil
+}
+
 // Check is part of Interface
 func (fake *Fake) Check(_ context.Context, tx *Transaction) error {
 	fake.RLock()
 	defer fake.RUnlock()
-	_, err := fake.run(tx)
+	_, _, err := fake.run(tx)
 	return err
 }
 
+// FlushTable is part of Interface
+func (fake *Fake) FlushTable(ctx context.Context) error {
+	tx := fake.NewTransaction()
+	tx.Flush(&Table{})
+	return fake.Run(ctx, tx)
+}
+
+// SwapTable is part of Interface
+func (fake *Fake) SwapTable(ctx context.Context, build func(tx *Transaction)) error {
+	return swapTable(ctx, fake, build)
+}
+
+// ReplaceTable is part of Interface
+func (fake *Fake) ReplaceTable(ctx context.Context, desired *Fake) error {
+	return replaceTable(ctx, fake, &fake.nftContext, desired)
+}
+
+// SeedSet adds elements to the set named name, directly modifying the Fake's state
+// without running a transaction. (This is intended to make it easier to set up state in
+// unit tests when the exact contents of the set are not what is being tested.) Each
+// element is specified as its key (with one string per field of a concatenated key).
+// Existing elements with the same key are replaced. It returns an error if the set does
+// not exist.
+func (fake *Fake) SeedSet(name string, elements ...[]string) error {
+	fake.Lock()
+	defer fake.Unlock()
+
+	if fake.Table == nil {
+		return notFoundError("no such table %q", fake.table)
+	}
+	set := fake.Table.Sets[name]
+	if set == nil {
+		return notFoundError("no such set %q", name)
+	}
+	for _, key := range elements {
+		if len(key) == 0 {
+			return fmt.Errorf("empty key for element of set %q", name)
+		}
+		set.Elements = seedElement(set.Elements, &Element{Set: name, Key: key})
+	}
+	return nil
+}
+
+// SeedMap adds elements to the map named name, directly modifying the Fake's state
+// without running a transaction, as with SeedSet. pairs maps each element's key to its
+// value (with one string per field of a concatenated value); concatenated keys can be
+// specified using nft syntax (eg, "10.0.0.1 . tcp . 80"). Existing elements with the
+// same key are replaced. It returns an error if the map does not exist.
+func (fake *Fake) SeedMap(name string, pairs map[string][]string) error {
+	fake.Lock()
+	defer fake.Unlock()
+
+	if fake.Table == nil {
+		return notFoundError("no such table %q", fake.table)
+	}
+	m := fake.Table.Maps[name]
+	if m == nil {
+		return notFoundError("no such map %q", name)
+	}
+	for _, key := range sortKeys(pairs) {
+		if key == "" || len(pairs[key]) == 0 {
+			return fmt.Errorf("empty key or value for element of map %q", name)
+		}
+		element := &Element{
+			Map:   name,
+			Key:   strings.Split(key, " . "),
+			Value: pairs[key],
+		}
+		m.Elements = seedElement(m.Elements, element)
+	}
+	return nil
+}
+
+// seedElement adds element to elements, replacing any existing element with the same key
+func seedElement(elements []*Element, element *Element) []*Element {
+	if i := findElement(elements, element.Key); i != -1 {
+		elements[i] = element
+		return elements
+	}
+	return append(elements, element)
+}
+
 // must be called with fake.lock held
-func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
+func (fake *Fake) run(tx *Transaction) (*FakeTable, []*Event, error) {
 	if tx.err != nil {
-		return nil, tx.err
+		return nil, nil, tx.err
+	}
+
+	var events []*Event
+	emit := func(eventType EventType, obj Object) {
+		// As with the real Monitor, rule events don't include the rule text
+		if rule, ok := obj.(*Rule); ok {
+			rule.Rule = ""
+		}
+		events = append(events, &Event{Type: eventType, Object: obj})
 	}
 
 	updatedTable := fake.Table.copy()
@@ -223,7 +767,7 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 		// If the table hasn't been created, and this isn't a Table operation, then fail
 		if updatedTable == nil {
 			if _, ok := op.obj.(*Table); !ok {
-				return nil, notFoundError("no such table \"%s %s\"", fake.family, fake.table)
+				return nil, nil, notFoundError("no such table \"%s %s\"", fake.family, fake.table)
 			}
 		}
 
@@ -235,10 +779,11 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 		case *Table:
 			err := checkExists(op.verb, "table", fake.table, updatedTable != nil)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			switch op.verb {
 			case flushVerb:
+				emit(DeleteEvent, PtrTo(updatedTable.Table))
 				updatedTable = nil
 				fallthrough
 			case addVerb, createVerb:
@@ -248,23 +793,29 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 				table := *obj
 				table.Handle = PtrTo(fake.nextHandle)
 				updatedTable = &FakeTable{
-					Table:      table,
-					Flowtables: make(map[string]*FakeFlowtable),
-					Chains:     make(map[string]*FakeChain),
-					Sets:       make(map[string]*FakeSet),
-					Maps:       make(map[string]*FakeMap),
+					Table:          table,
+					Flowtables:     make(map[string]*FakeFlowtable),
+					CTHelpers:      make(map[string]*FakeCTHelper),
+					CTTimeouts:     make(map[string]*FakeCTTimeout),
+					CTExpectations: make(map[string]*FakeCTExpectation),
+					Synproxies:     make(map[string]*FakeSynproxy),
+					Chains:         make(map[string]*FakeChain),
+					Sets:           make(map[string]*FakeSet),
+					Maps:           make(map[string]*FakeMap),
 				}
+				emit(AddEvent, PtrTo(table))
 			case deleteVerb:
+				emit(DeleteEvent, PtrTo(updatedTable.Table))
 				updatedTable = nil
 			default:
-				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 
 		case *Flowtable:
 			existingFlowtable := updatedTable.Flowtables[obj.Name]
 			err := checkExists(op.verb, "flowtable", obj.Name, existingFlowtable != nil)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			switch op.verb {
 			case addVerb, createVerb:
@@ -280,64 +831,186 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 				// FIXME delete-by-handle
 				delete(updatedTable.Flowtables, obj.Name)
 			default:
-				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 
-		case *Chain:
-			existingChain := updatedTable.Chains[obj.Name]
-			err := checkExists(op.verb, "chain", obj.Name, existingChain != nil)
+		case *CTHelper:
+			existingHelper := updatedTable.CTHelpers[obj.Name]
+			err := checkExists(op.verb, "ct helper", obj.Name, existingHelper != nil)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			switch op.verb {
 			case addVerb, createVerb:
-				if existingChain != nil {
+				if existingHelper != nil {
 					continue
 				}
-				chain := *obj
-				chain.Handle = PtrTo(fake.nextHandle)
-				updatedTable.Chains[obj.Name] = &FakeChain{
-					Chain: chain,
+				helper := *obj
+				helper.Handle = PtrTo(fake.nextHandle)
+				updatedTable.CTHelpers[obj.Name] = &FakeCTHelper{
+					CTHelper: helper,
 				}
-			case flushVerb:
-				existingChain.Rules = nil
 			case deleteVerb:
 				// FIXME delete-by-handle
-				delete(updatedTable.Chains, obj.Name)
+				delete(updatedTable.CTHelpers, obj.Name)
 			default:
-				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 
-		case *Rule:
-			existingChain := updatedTable.Chains[obj.Chain]
-			if existingChain == nil {
-				return nil, notFoundError("no such chain %q", obj.Chain)
+		case *CTTimeout:
+			existingTimeout := updatedTable.CTTimeouts[obj.Name]
+			err := checkExists(op.verb, "ct timeout", obj.Name, existingTimeout != nil)
+			if err != nil {
+				return nil, nil, err
 			}
-			if op.verb == deleteVerb {
-				i := findRule(existingChain.Rules, *obj.Handle)
-				if i == -1 {
-					return nil, notFoundError("no rule with handle %d", *obj.Handle)
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingTimeout != nil {
+					continue
 				}
-				existingChain.Rules = append(existingChain.Rules[:i], existingChain.Rules[i+1:]...)
-				continue
+				timeout := copyCTTimeout(obj)
+				timeout.Handle = PtrTo(fake.nextHandle)
+				updatedTable.CTTimeouts[obj.Name] = &FakeCTTimeout{
+					CTTimeout: *timeout,
+				}
+			case deleteVerb:
+				// FIXME delete-by-handle
+				delete(updatedTable.CTTimeouts, obj.Name)
+			default:
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 
-			rule := *obj
-			refRule := -1
-			if rule.Handle != nil {
-				refRule = findRule(existingChain.Rules, *obj.Handle)
-				if refRule == -1 {
-					return nil, notFoundError("no rule with handle %d", *obj.Handle)
+		case *CTExpectation:
+			existingExpectation := updatedTable.CTExpectations[obj.Name]
+			err := checkExists(op.verb, "ct expectation", obj.Name, existingExpectation != nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingExpectation != nil {
+					continue
+				}
+				expectation := *obj
+				expectation.Handle = PtrTo(fake.nextHandle)
+				updatedTable.CTExpectations[obj.Name] = &FakeCTExpectation{
+					CTExpectation: expectation,
+				}
+			case deleteVerb:
+				// FIXME delete-by-handle
+				delete(updatedTable.CTExpectations, obj.Name)
+			default:
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
+			}
+
+		case *Synproxy:
+			existingSynproxy := updatedTable.Synproxies[obj.Name]
+			err := checkExists(op.verb, "synproxy", obj.Name, existingSynproxy != nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingSynproxy != nil {
+					continue
+				}
+				synproxy := *obj
+				synproxy.Handle = PtrTo(fake.nextHandle)
+				updatedTable.Synproxies[obj.Name] = &FakeSynproxy{
+					Synproxy: synproxy,
+				}
+			case deleteVerb:
+				// FIXME delete-by-handle
+				delete(updatedTable.Synproxies, obj.Name)
+			default:
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
+			}
+
+		case *Chain:
+			existingChain := updatedTable.Chains[obj.Name]
+			err := checkExists(op.verb, "chain", obj.Name, existingChain != nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingChain != nil {
+					continue
+				}
+				if fake.detectHookConflicts {
+					if err := checkHookConflicts(fake.family, obj, updatedTable); err != nil {
+						return nil, nil, err
+					}
+				}
+				chain := *obj
+				chain.Handle = PtrTo(fake.nextHandle)
+				updatedTable.Chains[obj.Name] = &FakeChain{
+					Chain: chain,
+				}
+				emit(AddEvent, PtrTo(chain))
+			case flushVerb:
+				for _, rule := range existingChain.Rules {
+					emit(DeleteEvent, PtrTo(*rule))
+				}
+				existingChain.Rules = nil
+			case deleteVerb:
+				if err := checkChainUnreferenced(obj.Name, updatedTable); err != nil {
+					return nil, nil, err
+				}
+				// FIXME delete-by-handle
+				delete(updatedTable.Chains, obj.Name)
+				emit(DeleteEvent, PtrTo(existingChain.Chain))
+			default:
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
+			}
+
+		case *chainPolicy:
+			existingChain := updatedTable.Chains[obj.chain]
+			if existingChain == nil {
+				return nil, nil, notFoundError("no such chain %q", obj.chain)
+			}
+			if existingChain.Hook == nil {
+				return nil, nil, fmt.Errorf("chain %q is not a base chain", obj.chain)
+			}
+			existingChain.Policy = PtrTo(obj.policy)
+			emit(AddEvent, PtrTo(existingChain.Chain))
+
+		case *Rule:
+			existingChain := updatedTable.Chains[obj.Chain]
+			if existingChain == nil {
+				return nil, nil, notFoundError("no such chain %q", obj.Chain)
+			}
+			if op.verb == deleteVerb {
+				i := findRule(existingChain.Rules, *obj.Handle)
+				if i == -1 {
+					return nil, nil, notFoundError("no rule with handle %d", *obj.Handle)
+				}
+				emit(DeleteEvent, PtrTo(*existingChain.Rules[i]))
+				existingChain.Rules = append(existingChain.Rules[:i], existingChain.Rules[i+1:]...)
+				continue
+			}
+
+			rule := *obj
+			refRule := -1
+			if rule.Handle != nil {
+				refRule = findRule(existingChain.Rules, *obj.Handle)
+				if refRule == -1 {
+					return nil, nil, notFoundError("no rule with handle %d", *obj.Handle)
 				}
 			} else if obj.Index != nil {
 				if *obj.Index >= len(existingChain.Rules) {
-					return nil, notFoundError("no rule with index %d", *obj.Index)
+					return nil, nil, notFoundError("no rule with index %d", *obj.Index)
 				}
 				refRule = *obj.Index
 			}
 
+			if fake.StrictRuleValidation {
+				if err := validateRuleSyntax(obj.Rule); err != nil {
+					return nil, nil, err
+				}
+			}
 			if err := checkRuleRefs(obj, updatedTable); err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 
 			switch op.verb {
@@ -358,14 +1031,15 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 			case replaceVerb:
 				existingChain.Rules[refRule] = &rule
 			default:
-				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
+			emit(AddEvent, PtrTo(rule))
 
 		case *Set:
 			existingSet := updatedTable.Sets[obj.Name]
 			err := checkExists(op.verb, "set", obj.Name, existingSet != nil)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			switch op.verb {
 			case addVerb, createVerb:
@@ -377,19 +1051,24 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 				updatedTable.Sets[obj.Name] = &FakeSet{
 					Set: set,
 				}
+				emit(AddEvent, PtrTo(set))
 			case flushVerb:
+				for _, element := range existingSet.Elements {
+					emit(DeleteEvent, PtrTo(*element))
+				}
 				existingSet.Elements = nil
 			case deleteVerb:
 				// FIXME delete-by-handle
 				delete(updatedTable.Sets, obj.Name)
+				emit(DeleteEvent, PtrTo(existingSet.Set))
 			default:
-				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 		case *Map:
 			existingMap := updatedTable.Maps[obj.Name]
 			err := checkExists(op.verb, "map", obj.Name, existingMap != nil)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			switch op.verb {
 			case addVerb:
@@ -401,77 +1080,188 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 				updatedTable.Maps[obj.Name] = &FakeMap{
 					Map: mapObj,
 				}
+				emit(AddEvent, PtrTo(mapObj))
 			case flushVerb:
+				for _, element := range existingMap.Elements {
+					emit(DeleteEvent, PtrTo(*element))
+				}
 				existingMap.Elements = nil
 			case deleteVerb:
 				// FIXME delete-by-handle
 				delete(updatedTable.Maps, obj.Name)
+				emit(DeleteEvent, PtrTo(existingMap.Map))
 			default:
-				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+				return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 		case *Element:
 			if obj.Set != "" {
 				existingSet := updatedTable.Sets[obj.Set]
 				if existingSet == nil {
-					return nil, notFoundError("no such set %q", obj.Set)
+					return nil, nil, notFoundError("no such set %q", obj.Set)
 				}
 				switch op.verb {
 				case addVerb, createVerb:
 					element := *obj
+					fillElementCounters(&element, existingSet.Counters)
+					if fake.StrictTypeChecking {
+						if err := checkElementType(&element, existingSet.Type, existingSet.TypeOf); err != nil {
+							return nil, nil, err
+						}
+					}
+					if fake.checkIntervalFlag && !hasFlag(existingSet.Flags, IntervalFlag) && NeedsIntervalFlag([][]string{element.Key}) {
+						return nil, nil, fmt.Errorf("set %q does not have the \"interval\" flag, needed for element %q", existingSet.Name, strings.Join(element.Key, " . "))
+					}
 					if i := findElement(existingSet.Elements, element.Key); i != -1 {
 						if op.verb == createVerb {
-							return nil, existsError("element %q already exists", strings.Join(element.Key, " . "))
+							return nil, nil, existsError("element %q already exists", strings.Join(element.Key, " . "))
 						}
 						existingSet.Elements[i] = &element
 					} else {
 						existingSet.Elements = append(existingSet.Elements, &element)
 					}
+					emit(AddEvent, PtrTo(element))
 				case deleteVerb:
 					element := *obj
 					if i := findElement(existingSet.Elements, element.Key); i != -1 {
+						emit(DeleteEvent, PtrTo(*existingSet.Elements[i]))
 						existingSet.Elements = append(existingSet.Elements[:i], existingSet.Elements[i+1:]...)
 					} else {
-						return nil, notFoundError("no such element %q", strings.Join(element.Key, " . "))
+						return nil, nil, notFoundError("no such element %q", strings.Join(element.Key, " . "))
 					}
 				default:
-					return nil, fmt.Errorf("unhandled operation %q", op.verb)
+					return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 				}
 			} else {
 				existingMap := updatedTable.Maps[obj.Map]
 				if existingMap == nil {
-					return nil, notFoundError("no such map %q", obj.Map)
+					return nil, nil, notFoundError("no such map %q", obj.Map)
 				}
 				if err := checkElementRefs(obj, updatedTable); err != nil {
-					return nil, err
+					return nil, nil, err
 				}
 				switch op.verb {
 				case addVerb, createVerb:
 					element := *obj
+					fillElementCounters(&element, existingMap.Counters)
+					if fake.StrictTypeChecking {
+						if err := checkElementType(&element, existingMap.Type, existingMap.TypeOf); err != nil {
+							return nil, nil, err
+						}
+					}
+					if fake.checkIntervalFlag && !hasFlag(existingMap.Flags, IntervalFlag) && NeedsIntervalFlag([][]string{element.Key}) {
+						return nil, nil, fmt.Errorf("map %q does not have the \"interval\" flag, needed for element %q", existingMap.Name, strings.Join(element.Key, " . "))
+					}
 					if i := findElement(existingMap.Elements, element.Key); i != -1 {
 						if op.verb == createVerb {
-							return nil, existsError("element %q already exists", strings.Join(element.Key, ". "))
+							return nil, nil, existsError("element %q already exists", strings.Join(element.Key, ". "))
 						}
 						existingMap.Elements[i] = &element
 					} else {
 						existingMap.Elements = append(existingMap.Elements, &element)
 					}
+					emit(AddEvent, PtrTo(element))
 				case deleteVerb:
 					element := *obj
 					if i := findElement(existingMap.Elements, element.Key); i != -1 {
+						emit(DeleteEvent, PtrTo(*existingMap.Elements[i]))
 						existingMap.Elements = append(existingMap.Elements[:i], existingMap.Elements[i+1:]...)
 					} else {
-						return nil, notFoundError("no such element %q", strings.Join(element.Key, " . "))
+						return nil, nil, notFoundError("no such element %q", strings.Join(element.Key, " . "))
 					}
 				default:
-					return nil, fmt.Errorf("unhandled operation %q", op.verb)
+					return nil, nil, fmt.Errorf("unhandled operation %q", op.verb)
 				}
 			}
 		default:
-			return nil, fmt.Errorf("unhandled object type %T", op.obj)
+			return nil, nil, fmt.Errorf("unhandled object type %T", op.obj)
+		}
+	}
+
+	return updatedTable, events, nil
+}
+
+// checkElementType checks that element has the right number of key and value fields for
+// a set or map with the given type/typeof.
+func checkElementType(element *Element, typeProp, typeOf string) error {
+	setType := typeProp
+	if setType == "" {
+		setType = typeOf
+	}
+	keyType, valueType, isMap := strings.Cut(setType, " : ")
+
+	keyFields := strings.Split(keyType, " . ")
+	if len(element.Key) != len(keyFields) {
+		return fmt.Errorf("element %q has %d key fields but type %q has %d", strings.Join(element.Key, " . "), len(element.Key), setType, len(keyFields))
+	}
+	var valueFields []string
+	if isMap {
+		valueFields = strings.Split(valueType, " . ")
+		if len(element.Value) != len(valueFields) {
+			return fmt.Errorf("element %q has %d value fields but type %q has %d", strings.Join(element.Key, " . "), len(element.Value), setType, len(valueFields))
+		}
+	} else if len(element.Value) != 0 {
+		return fmt.Errorf("element %q has a value but type %q is not a map type", strings.Join(element.Key, " . "), setType)
+	}
+
+	// With TypeOf, we don't know the types of the fields.
+	if typeProp == "" {
+		return nil
+	}
+	for i := range keyFields {
+		if !isValidField(keyFields[i], element.Key[i]) {
+			return fmt.Errorf("element %q has invalid %s key field %q", strings.Join(element.Key, " . "), keyFields[i], element.Key[i])
+		}
+	}
+	for i := range valueFields {
+		if !isValidField(valueFields[i], element.Value[i]) {
+			return fmt.Errorf("element %q has invalid %s value field %q", strings.Join(element.Key, " . "), valueFields[i], element.Value[i])
 		}
 	}
+	return nil
+}
 
-	return updatedTable, nil
+// isValidField checks whether value is a valid value for a field of type fieldType. Only
+// "ether_addr" fields (which must be MAC addresses, or ranges of MAC addresses) are
+// currently checked.
+func isValidField(fieldType, value string) bool {
+	if fieldType != "ether_addr" {
+		return true
+	}
+	start, end, isRange := strings.Cut(value, "-")
+	if !isMACAddress(start) {
+		return false
+	}
+	return !isRange || isMACAddress(end)
+}
+
+// isMACAddress checks whether value is an Ethernet MAC address (eg "00:11:22:33:44:55").
+func isMACAddress(value string) bool {
+	mac, err := net.ParseMAC(value)
+	return err == nil && len(mac) == 6
+}
+
+// hasFlag returns whether flags contains flag
+func hasFlag(flags []SetFlag, flag SetFlag) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// fillElementCounters fills in element's Packets and Bytes, as nft would, if either
+// the element or its set/map has a counter.
+func fillElementCounters(element *Element, counters *bool) {
+	if element.Packets == nil && element.Bytes == nil && (counters == nil || !*counters) {
+		return
+	}
+	if element.Packets == nil {
+		element.Packets = PtrTo(uint64(0))
+	}
+	if element.Bytes == nil {
+		element.Bytes = PtrTo(uint64(0))
+	}
 }
 
 func checkExists(verb verb, objectType, name string, exists bool) error {
@@ -491,17 +1281,150 @@ func checkExists(verb verb, objectType, name string, exists bool) error {
 	return nil
 }
 
+// validateRuleSyntax does some basic sanity-checking of the syntax of rule
+func validateRuleSyntax(rule string) error {
+	words, err := tokenizeRule(rule)
+	if err != nil {
+		return fmt.Errorf("%w in rule %q", err, rule)
+	}
+	if len(words) == 0 {
+		return fmt.Errorf("syntax error: empty rule")
+	}
+
+	depth := 0
+	terminal := ""
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if depth == 0 && terminal != "" {
+			return fmt.Errorf("syntax error: statement after terminal statement %q in rule %q", terminal, rule)
+		}
+
+		switch word {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("syntax error: unbalanced braces in rule %q", rule)
+			}
+		case "map", "vmap":
+			if i == len(words)-1 || (words[i+1] != "{" && !strings.HasPrefix(words[i+1], "@")) {
+				return fmt.Errorf("syntax error: %s must be followed by @name or an anonymous map in rule %q", word, rule)
+			}
+		case "jump", "goto":
+			if i == len(words)-1 || words[i+1] == "{" || words[i+1] == "}" {
+				return fmt.Errorf("syntax error: %s with no chain name in rule %q", word, rule)
+			}
+			i++
+			if depth == 0 {
+				terminal = word
+			}
+		case "accept", "drop", "return", "continue":
+			if depth == 0 {
+				terminal = word
+			}
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("syntax error: unbalanced braces in rule %q", rule)
+	}
+	return nil
+}
+
+// checkHookConflicts checks if chain is a base chain with the same hook and priority as
+// an existing base chain in table.
+func checkHookConflicts(family Family, chain *Chain, table *FakeTable) error {
+	if chain.Hook == nil || chain.Priority == nil {
+		return nil
+	}
+	priority, err := ParsePriority(family, string(*chain.Priority))
+	if err != nil {
+		// Can't tell; let the real nft complain about it if it's invalid.
+		return nil
+	}
+
+	for _, name := range sortKeys(table.Chains) {
+		existing := table.Chains[name]
+		if existing.Hook == nil || existing.Priority == nil || *existing.Hook != *chain.Hook {
+			continue
+		}
+		if !devicesOverlap(chainDevices(&existing.Chain), chainDevices(chain)) {
+			continue
+		}
+		existingPriority, err := ParsePriority(family, string(*existing.Priority))
+		if err != nil {
+			continue
+		}
+		if existingPriority == priority {
+			return fmt.Errorf("chain %q has the same hook (%s) and priority (%d) as chain %q", chain.Name, *chain.Hook, priority, name)
+		}
+	}
+	return nil
+}
+
+// chainDevices returns the devices that chain is attached to
+func chainDevices(chain *Chain) []string {
+	if chain.Device != nil {
+		return []string{*chain.Device}
+	}
+	return chain.Devices
+}
+
+// devicesOverlap returns whether two chains with the given devices could conflict: either
+// one of them is not attached to specific devices, or they have a device in common.
+func devicesOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, devA := range a {
+		for _, devB := range b {
+			if devA == devB {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // checkRuleRefs checks for chains, sets, and maps referenced by rule in table
 func checkRuleRefs(rule *Rule, table *FakeTable) error {
-	words := strings.Split(rule.Rule, " ")
-	for i, word := range words {
-		if strings.HasPrefix(word, "@") {
+	words, err := tokenizeRule(rule.Rule)
+	if err != nil {
+		words = strings.Fields(rule.Rule)
+	}
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if word == "meter" {
+			// `meter NAME [size N] { ... }` declares an anonymous dynamic set
+			// whose contents are expressions, not references, so skip over it.
+			i = skipMeter(words, i)
+			continue
+		}
+		if i >= 3 && words[i-3] == "ct" && words[i-1] == "set" && isCTObjectType(words[i-2]) {
+			// `ct helper set "name"`, `ct timeout set @name`, etc. (The name can
+			// also be computed from a map, in which case it won't be quoted.)
+			if strings.HasPrefix(word, `"`) || strings.HasPrefix(word, "@") || i == len(words)-1 {
+				if err := checkCTObjectRef(words[i-2], word, table); err != nil {
+					return err
+				}
+			}
+		} else if i >= 2 && words[i-2] == "synproxy" && words[i-1] == "name" {
+			// `synproxy name "name"` or `synproxy name @name`. (As above, the
+			// name can also be computed from a map.)
+			if strings.HasPrefix(word, `"`) || strings.HasPrefix(word, "@") || i == len(words)-1 {
+				name := strings.TrimPrefix(strings.Trim(word, `"`), "@")
+				if table.Synproxies[name] == nil {
+					return notFoundError("no such synproxy %q", name)
+				}
+			}
+		} else if strings.HasPrefix(word, "@") {
 			name := word[1:]
 			if i > 0 && (words[i-1] == "map" || words[i-1] == "vmap") {
 				if table.Maps[name] == nil {
 					return notFoundError("no such map %q", name)
 				}
-			} else if i > 0 && words[i-1] == "offload" {
+			} else if (i > 0 && words[i-1] == "offload") || (i > 1 && words[i-2] == "flow" && words[i-1] == "add") {
+				// `flow offload @name` or `flow add @name`
 				if table.Flowtables[name] == nil {
 					return notFoundError("no such flowtable %q", name)
 				}
@@ -512,7 +1435,8 @@ func checkRuleRefs(rule *Rule, table *FakeTable) error {
 				}
 			}
 		} else if (word == "goto" || word == "jump") && i < len(words)-1 {
-			name := words[i+1]
+			// (Inside an anonymous vmap, the chain name may be followed by a comma.)
+			name := strings.TrimSuffix(words[i+1], ",")
 			if table.Chains[name] == nil {
 				return notFoundError("no such chain %q", name)
 			}
@@ -521,16 +1445,125 @@ func checkRuleRefs(rule *Rule, table *FakeTable) error {
 	return nil
 }
 
-// checkElementRefs checks for chains referenced by an element
-func checkElementRefs(element *Element, table *FakeTable) error {
-	if len(element.Value) != 1 {
+// skipMeter returns the index of the closing brace of the meter statement starting at
+// words[start] (or the index of the last word, if the meter is not properly terminated).
+func skipMeter(words []string, start int) int {
+	depth := 0
+	for i := start + 1; i < len(words); i++ {
+		switch words[i] {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(words) - 1
+}
+
+func isCTObjectType(word string) bool {
+	return word == "helper" || word == "timeout" || word == "expectation"
+}
+
+// checkCTObjectRef checks that a reference to a ct helper/timeout/expectation exists
+func checkCTObjectRef(objectType, ref string, table *FakeTable) error {
+	name := strings.TrimPrefix(strings.Trim(ref, `"`), "@")
+	var exists bool
+	switch objectType {
+	case "helper":
+		exists = table.CTHelpers[name] != nil
+	case "timeout":
+		exists = table.CTTimeouts[name] != nil
+	case "expectation":
+		exists = table.CTExpectations[name] != nil
+	}
+	if !exists {
+		return notFoundError("no such ct %s %q", objectType, name)
+	}
+	return nil
+}
+
+// ValidateElement checks that element refers to an existing set or map, and that if it
+// is a verdict map element whose verdict is a "goto" or "jump", the target chain exists.
+// (This checks the same things that Run would, without running a transaction.)
+func (fake *Fake) ValidateElement(element *Element) error {
+	fake.RLock()
+	defer fake.RUnlock()
+
+	if err := element.validate(addVerb); err != nil {
+		return err
+	}
+	if fake.Table == nil {
+		return notFoundError("no such table %q", fake.table)
+	}
+	if element.Set != "" {
+		if fake.Table.Sets[element.Set] == nil {
+			return notFoundError("no such set %q", element.Set)
+		}
 		return nil
 	}
-	words := strings.Split(element.Value[0], " ")
-	if len(words) == 2 && (words[0] == "goto" || words[0] == "jump") {
-		name := words[1]
-		if table.Chains[name] == nil {
-			return notFoundError("no such chain %q", name)
+	if fake.Table.Maps[element.Map] == nil {
+		return notFoundError("no such map %q", element.Map)
+	}
+	return checkElementRefs(element, fake.Table)
+}
+
+// checkElementRefs checks for chains referenced by an element. Each "goto" or "jump" in
+// the element's value must be followed by the name of an existing chain; other verdicts
+// ("drop", "accept", "return", etc) and other words (eg, in a quoted comment) are
+// ignored.
+func checkElementRefs(element *Element, table *FakeTable) error {
+	for _, value := range element.Value {
+		words, err := tokenizeRule(value)
+		if err != nil {
+			return fmt.Errorf("invalid element value %q: %w", value, err)
+		}
+		for i, word := range words {
+			if word != "goto" && word != "jump" {
+				continue
+			}
+			if i == len(words)-1 {
+				return fmt.Errorf("no chain name after %q in element value %q", word, value)
+			}
+			name := words[i+1]
+			if table.Chains[name] == nil {
+				return notFoundError("no such chain %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkChainUnreferenced returns an error for which IsBusy will return true if any rule
+// or verdict map element in table jumps to or gotos the chain named name.
+func checkChainUnreferenced(name string, table *FakeTable) error {
+	refersToChain := func(text string) bool {
+		words, err := tokenizeRule(text)
+		if err != nil {
+			words = strings.Fields(text)
+		}
+		for i := 1; i < len(words); i++ {
+			if (words[i-1] == "goto" || words[i-1] == "jump") && strings.TrimSuffix(words[i], ",") == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, chainName := range sortKeys(table.Chains) {
+		for _, rule := range table.Chains[chainName].Rules {
+			if refersToChain(rule.Rule) {
+				return busyError("chain %q is still referenced by a rule in chain %q", name, chainName)
+			}
+		}
+	}
+	for _, mapName := range sortKeys(table.Maps) {
+		for _, elem := range table.Maps[mapName].Elements {
+			if refersToChain(strings.Join(elem.Value, " ")) {
+				return busyError("chain %q is still referenced by an element of map %q", name, mapName)
+			}
 		}
 	}
 	return nil
@@ -548,6 +1581,10 @@ func (fake *Fake) Dump() string {
 
 	table := fake.Table
 	flowtables := sortKeys(table.Flowtables)
+	ctHelpers := sortKeys(table.CTHelpers)
+	ctTimeouts := sortKeys(table.CTTimeouts)
+	ctExpectations := sortKeys(table.CTExpectations)
+	synproxies := sortKeys(table.Synproxies)
 	chains := sortKeys(table.Chains)
 	sets := sortKeys(table.Sets)
 	maps := sortKeys(table.Maps)
@@ -559,6 +1596,22 @@ func (fake *Fake) Dump() string {
 		ft := table.Flowtables[fname]
 		ft.writeOperation(addVerb, &fake.nftContext, buf)
 	}
+	for _, hname := range ctHelpers {
+		helper := table.CTHelpers[hname]
+		helper.writeOperation(addVerb, &fake.nftContext, buf)
+	}
+	for _, tname := range ctTimeouts {
+		timeout := table.CTTimeouts[tname]
+		timeout.writeOperation(addVerb, &fake.nftContext, buf)
+	}
+	for _, ename := range ctExpectations {
+		expectation := table.CTExpectations[ename]
+		expectation.writeOperation(addVerb, &fake.nftContext, buf)
+	}
+	for _, sname := range synproxies {
+		synproxy := table.Synproxies[sname]
+		synproxy.writeOperation(addVerb, &fake.nftContext, buf)
+	}
 	for _, cname := range chains {
 		ch := table.Chains[cname]
 		ch.writeOperation(addVerb, &fake.nftContext, buf)
@@ -600,28 +1653,402 @@ func (fake *Fake) Dump() string {
 	return buf.String()
 }
 
+// Snapshot is a deep copy of the contents of a Fake's table, in a form that is easy to
+// compare (eg, with cmp.Diff) in golden-file tests. All objects are sorted by name
+// (rules are kept in chain order, and elements are sorted by key), and Handles are not
+// included, so two Fakes with the same contents will have identical Snapshots.
+type Snapshot struct {
+	Table          Table
+	Flowtables     []Flowtable
+	CTHelpers      []CTHelper
+	CTTimeouts     []CTTimeout
+	CTExpectations []CTExpectation
+	Synproxies     []Synproxy
+	Chains         []SnapshotChain
+	Sets           []SnapshotSet
+	Maps           []SnapshotMap
+}
+
+// SnapshotChain is a chain and its rules, as part of a Snapshot
+type SnapshotChain struct {
+	Chain Chain
+	Rules []Rule
+}
+
+// SnapshotSet is a set and its elements, as part of a Snapshot
+type SnapshotSet struct {
+	Set      Set
+	Elements []Element
+}
+
+// SnapshotMap is a map and its elements, as part of a Snapshot
+type SnapshotMap struct {
+	Map      Map
+	Elements []Element
+}
+
+// Snapshot returns a Snapshot of the current contents of fake's table, or nil if the
+// table does not exist. The Snapshot does not share any state with fake, so it can be
+// retained or modified freely.
+func (fake *Fake) Snapshot() *Snapshot {
+	fake.RLock()
+	defer fake.RUnlock()
+	if fake.Table == nil {
+		return nil
+	}
+
+	table := fake.Table
+	snapshot := &Snapshot{
+		Table: Table{
+			Comment: clonePtr(table.Comment),
+			Flags:   cloneSlice(table.Flags),
+		},
+	}
+	for _, name := range sortKeys(table.Flowtables) {
+		ft := table.Flowtables[name].Flowtable
+		snapshot.Flowtables = append(snapshot.Flowtables, Flowtable{
+			Name:     ft.Name,
+			Priority: clonePtr(ft.Priority),
+			Devices:  cloneSlice(ft.Devices),
+		})
+	}
+	for _, name := range sortKeys(table.CTHelpers) {
+		helper := table.CTHelpers[name].CTHelper
+		helper.L3Proto = clonePtr(helper.L3Proto)
+		helper.Handle = nil
+		snapshot.CTHelpers = append(snapshot.CTHelpers, helper)
+	}
+	for _, name := range sortKeys(table.CTTimeouts) {
+		timeout := copyCTTimeout(&table.CTTimeouts[name].CTTimeout)
+		timeout.Handle = nil
+		snapshot.CTTimeouts = append(snapshot.CTTimeouts, *timeout)
+	}
+	for _, name := range sortKeys(table.CTExpectations) {
+		expectation := table.CTExpectations[name].CTExpectation
+		expectation.L3Proto = clonePtr(expectation.L3Proto)
+		expectation.Handle = nil
+		snapshot.CTExpectations = append(snapshot.CTExpectations, expectation)
+	}
+	for _, name := range sortKeys(table.Synproxies) {
+		synproxy := table.Synproxies[name].Synproxy
+		synproxy.Timestamp = clonePtr(synproxy.Timestamp)
+		synproxy.SACKPerm = clonePtr(synproxy.SACKPerm)
+		synproxy.Handle = nil
+		snapshot.Synproxies = append(snapshot.Synproxies, synproxy)
+	}
+	for _, name := range sortKeys(table.Chains) {
+		ch := table.Chains[name]
+		sc := SnapshotChain{
+			Chain: Chain{
+				Name:     ch.Name,
+				Type:     clonePtr(ch.Type),
+				Hook:     clonePtr(ch.Hook),
+				Priority: clonePtr(ch.Priority),
+				Policy:   clonePtr(ch.Policy),
+				Device:   clonePtr(ch.Device),
+				Devices:  cloneSlice(ch.Devices),
+				Comment:  clonePtr(ch.Comment),
+			},
+		}
+		for _, rule := range ch.Rules {
+			sc.Rules = append(sc.Rules, Rule{
+				Chain:   rule.Chain,
+				Rule:    rule.Rule,
+				Comment: clonePtr(rule.Comment),
+			})
+		}
+		snapshot.Chains = append(snapshot.Chains, sc)
+	}
+	for _, name := range sortKeys(table.Sets) {
+		set := table.Sets[name]
+		snapshot.Sets = append(snapshot.Sets, SnapshotSet{
+			Set: Set{
+				Name:       set.Name,
+				Type:       set.Type,
+				TypeOf:     set.TypeOf,
+				Flags:      cloneSlice(set.Flags),
+				Timeout:    clonePtr(set.Timeout),
+				GCInterval: clonePtr(set.GCInterval),
+				Size:       clonePtr(set.Size),
+				Policy:     clonePtr(set.Policy),
+				AutoMerge:  clonePtr(set.AutoMerge),
+				Counters:   clonePtr(set.Counters),
+				Comment:    clonePtr(set.Comment),
+			},
+			Elements: snapshotElements(set.Elements),
+		})
+	}
+	for _, name := range sortKeys(table.Maps) {
+		mapObj := table.Maps[name]
+		snapshot.Maps = append(snapshot.Maps, SnapshotMap{
+			Map: Map{
+				Name:       mapObj.Name,
+				Type:       mapObj.Type,
+				TypeOf:     mapObj.TypeOf,
+				Flags:      cloneSlice(mapObj.Flags),
+				Timeout:    clonePtr(mapObj.Timeout),
+				GCInterval: clonePtr(mapObj.GCInterval),
+				Size:       clonePtr(mapObj.Size),
+				Policy:     clonePtr(mapObj.Policy),
+				Counters:   clonePtr(mapObj.Counters),
+				Comment:    clonePtr(mapObj.Comment),
+			},
+			Elements: snapshotElements(mapObj.Elements),
+		})
+	}
+
+	return snapshot
+}
+
+// snapshotElements returns a sorted deep copy of elements
+func snapshotElements(elements []*Element) []Element {
+	var result []Element
+	for _, elem := range elements {
+		result = append(result, Element{
+			Set:     elem.Set,
+			Map:     elem.Map,
+			Key:     cloneSlice(elem.Key),
+			Value:   cloneSlice(elem.Value),
+			Comment: clonePtr(elem.Comment),
+			Timeout: clonePtr(elem.Timeout),
+			Expires: clonePtr(elem.Expires),
+			Packets: clonePtr(elem.Packets),
+			Bytes:   clonePtr(elem.Bytes),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Join(result[i].Key, " . ") < strings.Join(result[j].Key, " . ")
+	})
+	return result
+}
+
+// DumpJSON returns the Snapshot of fake's table, encoded as (indented) JSON, for use in
+// golden-file tests. As with Snapshot, all objects are sorted, so two Fakes with the
+// same contents will produce identical JSON. The output can be loaded back into a Fake
+// with LoadJSON.
+func (fake *Fake) DumpJSON() ([]byte, error) {
+	return json.MarshalIndent(fake.Snapshot(), "", "  ")
+}
+
+// LoadJSON is the inverse of DumpJSON; it adds the objects in a JSON-encoded Snapshot to
+// fake (as with ParseDump).
+func (fake *Fake) LoadJSON(data []byte) error {
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("could not parse JSON: %w", err)
+	}
+	if snapshot == nil {
+		return nil
+	}
+
+	tx := fake.NewTransaction()
+	snapshot.addToTransaction(tx)
+	return fake.Run(context.Background(), tx)
+}
+
+// addToTransaction adds operations to tx to create all of the objects in snapshot
+func (snapshot *Snapshot) addToTransaction(tx *Transaction) {
+	tx.Add(&snapshot.Table)
+	for i := range snapshot.Flowtables {
+		tx.Add(&snapshot.Flowtables[i])
+	}
+	for i := range snapshot.CTHelpers {
+		tx.Add(&snapshot.CTHelpers[i])
+	}
+	for i := range snapshot.CTTimeouts {
+		tx.Add(&snapshot.CTTimeouts[i])
+	}
+	for i := range snapshot.CTExpectations {
+		tx.Add(&snapshot.CTExpectations[i])
+	}
+	for i := range snapshot.Synproxies {
+		tx.Add(&snapshot.Synproxies[i])
+	}
+	for i := range snapshot.Chains {
+		tx.Add(&snapshot.Chains[i].Chain)
+	}
+	for i := range snapshot.Sets {
+		tx.Add(&snapshot.Sets[i].Set)
+	}
+	for i := range snapshot.Maps {
+		tx.Add(&snapshot.Maps[i].Map)
+	}
+	for i := range snapshot.Chains {
+		for j := range snapshot.Chains[i].Rules {
+			tx.Add(&snapshot.Chains[i].Rules[j])
+		}
+	}
+	for i := range snapshot.Sets {
+		for j := range snapshot.Sets[i].Elements {
+			tx.Add(&snapshot.Sets[i].Elements[j])
+		}
+	}
+	for i := range snapshot.Maps {
+		for j := range snapshot.Maps[i].Elements {
+			tx.Add(&snapshot.Maps[i].Elements[j])
+		}
+	}
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	return PtrTo(*p)
+}
+
+func cloneSlice[T any](s []T) []T {
+	if s == nil {
+		return nil
+	}
+	return append([]T{}, s...)
+}
+
+// copyCTHelper returns a deep copy of helper
+func copyCTHelper(helper *CTHelper) *CTHelper {
+	return &CTHelper{
+		Name:     helper.Name,
+		Type:     helper.Type,
+		Protocol: helper.Protocol,
+		L3Proto:  clonePtr(helper.L3Proto),
+		Handle:   clonePtr(helper.Handle),
+	}
+}
+
+// copyCTTimeout returns a deep copy of timeout
+func copyCTTimeout(timeout *CTTimeout) *CTTimeout {
+	tcopy := &CTTimeout{
+		Name:     timeout.Name,
+		Protocol: timeout.Protocol,
+		L3Proto:  clonePtr(timeout.L3Proto),
+		Handle:   clonePtr(timeout.Handle),
+	}
+	if timeout.Policy != nil {
+		tcopy.Policy = make(map[string]time.Duration, len(timeout.Policy))
+		for state, t := range timeout.Policy {
+			tcopy.Policy[state] = t
+		}
+	}
+	return tcopy
+}
+
+// copyCTExpectation returns a deep copy of expectation
+func copyCTExpectation(expectation *CTExpectation) *CTExpectation {
+	return &CTExpectation{
+		Name:     expectation.Name,
+		Protocol: expectation.Protocol,
+		DPort:    expectation.DPort,
+		Timeout:  expectation.Timeout,
+		Size:     expectation.Size,
+		L3Proto:  clonePtr(expectation.L3Proto),
+		Handle:   clonePtr(expectation.Handle),
+	}
+}
+
+// copySynproxy returns a deep copy of synproxy
+func copySynproxy(synproxy *Synproxy) *Synproxy {
+	return &Synproxy{
+		Name:      synproxy.Name,
+		MSS:       synproxy.MSS,
+		WScale:    synproxy.WScale,
+		Timestamp: clonePtr(synproxy.Timestamp),
+		SACKPerm:  clonePtr(synproxy.SACKPerm),
+		Handle:    clonePtr(synproxy.Handle),
+	}
+}
+
+// copyTable returns a deep copy of table
+func copyTable(table *Table) *Table {
+	return &Table{
+		Comment: clonePtr(table.Comment),
+		Flags:   cloneSlice(table.Flags),
+		Handle:  clonePtr(table.Handle),
+	}
+}
+
+// copyChain returns a deep copy of chain
+func copyChain(chain *Chain) *Chain {
+	return &Chain{
+		Name:     chain.Name,
+		Type:     clonePtr(chain.Type),
+		Hook:     clonePtr(chain.Hook),
+		Priority: clonePtr(chain.Priority),
+		Policy:   clonePtr(chain.Policy),
+		Device:   clonePtr(chain.Device),
+		Devices:  cloneSlice(chain.Devices),
+		Comment:  clonePtr(chain.Comment),
+		Handle:   clonePtr(chain.Handle),
+	}
+}
+
+// copySet returns a deep copy of set
+func copySet(set *Set) *Set {
+	return &Set{
+		Name:       set.Name,
+		Type:       set.Type,
+		TypeOf:     set.TypeOf,
+		Flags:      cloneSlice(set.Flags),
+		Timeout:    clonePtr(set.Timeout),
+		GCInterval: clonePtr(set.GCInterval),
+		Size:       clonePtr(set.Size),
+		Policy:     clonePtr(set.Policy),
+		AutoMerge:  clonePtr(set.AutoMerge),
+		Counters:   clonePtr(set.Counters),
+		Comment:    clonePtr(set.Comment),
+		Handle:     clonePtr(set.Handle),
+	}
+}
+
+// copyMap returns a deep copy of mapObj
+func copyMap(mapObj *Map) *Map {
+	return &Map{
+		Name:       mapObj.Name,
+		Type:       mapObj.Type,
+		TypeOf:     mapObj.TypeOf,
+		Flags:      cloneSlice(mapObj.Flags),
+		Timeout:    clonePtr(mapObj.Timeout),
+		GCInterval: clonePtr(mapObj.GCInterval),
+		Size:       clonePtr(mapObj.Size),
+		Policy:     clonePtr(mapObj.Policy),
+		Counters:   clonePtr(mapObj.Counters),
+		Comment:    clonePtr(mapObj.Comment),
+		Handle:     clonePtr(mapObj.Handle),
+	}
+}
+
 // ParseDump can parse a dump for a given nft instance.
 // It expects fake's table name and family in all rules.
 // The best way to verify that everything important was properly parsed is to
 // compare given data with nft.Dump() output.
 func (fake *Fake) ParseDump(data string) (err error) {
 	lines := strings.Split(data, "\n")
-	var i int
+	var lineNum int
 	var line string
 	parsingDone := false
 	defer func() {
 		if err != nil && !parsingDone {
-			err = fmt.Errorf("%w (at line %v: %s", err, i+1, line)
+			err = fmt.Errorf("%w (at line %v: %s", err, lineNum, line)
 		}
 	}()
 	tx := fake.NewTransaction()
-	commonRegexp := regexp.MustCompile(fmt.Sprintf(`add ([^ ]*) %s %s( (.*))?`, fake.family, fake.table))
+	commonRegexp := regexp.MustCompile(fmt.Sprintf(`add ((?:ct )?[^ ]*) %s %s( (.*))?`, fake.family, fake.table))
+	fake.RLock()
+	strict := fake.strictParsing
+	fake.RUnlock()
+	declaredChains := make(map[string]bool)
 
-	for i, line = range lines {
-		line = strings.TrimSpace(line)
+	for i := 0; i < len(lines); i++ {
+		lineNum = i + 1
+		line = strings.TrimSpace(lines[i])
 		if line == "" || line[0] == '#' {
 			continue
 		}
+		// A command with unbalanced braces (eg, a long element list) continues on
+		// the following line(s).
+		for unclosedBraces(line) > 0 && i+1 < len(lines) {
+			i++
+			line += " " + strings.TrimSpace(lines[i])
+		}
 		match := commonRegexp.FindStringSubmatch(line)
 		if match == nil {
 			return fmt.Errorf("could not parse, or wrong table/family")
@@ -632,6 +2059,14 @@ func (fake *Fake) ParseDump(data string) (err error) {
 			obj = &Table{}
 		case "flowtable":
 			obj = &Flowtable{}
+		case "ct helper":
+			obj = &CTHelper{}
+		case "ct timeout":
+			obj = &CTTimeout{}
+		case "ct expectation":
+			obj = &CTExpectation{}
+		case "synproxy":
+			obj = &Synproxy{}
 		case "chain":
 			obj = &Chain{}
 		case "rule":
@@ -645,16 +2080,172 @@ func (fake *Fake) ParseDump(data string) (err error) {
 		default:
 			return fmt.Errorf("unknown object %s", match[1])
 		}
-		err = obj.parse(match[3])
+		body, inlineElements := extractInlineElements(match[3])
+		if _, ok := obj.(*Element); ok {
+			// An "add element" command may add multiple elements
+			if name, elements := splitElementCommand(body); len(elements) > 1 {
+				for _, elemStr := range elements {
+					elem := &Element{}
+					err = elem.parse(fmt.Sprintf("%s { %s }", name, elemStr))
+					if err != nil {
+						return err
+					}
+					tx.Add(elem)
+				}
+				continue
+			}
+		}
+		err = obj.parse(body)
 		if err != nil {
 			return err
 		}
+		if chain, ok := obj.(*Chain); ok {
+			declaredChains[chain.Name] = true
+		}
+		if rule, ok := obj.(*Rule); ok {
+			if strict && !declaredChains[rule.Chain] {
+				return fmt.Errorf("rule refers to chain %q, which was not declared earlier in the dump", rule.Chain)
+			}
+			// If the rule had a "# handle N" comment, then Rule.parse will
+			// have stored that in rule.Handle, but we don't want to treat it as
+			// the handle of a rule to add this one after. (The Fake will assign
+			// a new handle.)
+			if _, handle := stripHandleComment(body); handle != nil && rule.Handle != nil && *rule.Handle == *handle {
+				rule.Handle = nil
+			}
+		}
 		tx.Add(obj)
+
+		if inlineElements != nil {
+			var name string
+			switch o := obj.(type) {
+			case *Set:
+				name = o.Name
+			case *Map:
+				name = o.Name
+			default:
+				return fmt.Errorf("unexpected elements in %s", match[1])
+			}
+			for _, elemStr := range inlineElements {
+				elem := &Element{}
+				err = elem.parse(fmt.Sprintf("%s { %s }", name, elemStr))
+				if err != nil {
+					return err
+				}
+				tx.Add(elem)
+			}
+		}
 	}
 	parsingDone = true
 	return fake.Run(context.Background(), tx)
 }
 
+// ParseDumpDiff parses data (as with ParseDump) and returns a Transaction that would
+// transform fake's current state into the parsed state, without modifying fake. (If data
+// does not contain any objects then the returned transaction will delete fake's table.)
+func (fake *Fake) ParseDumpDiff(data string) (*Transaction, error) {
+	desired := NewFake(fake.family, fake.table)
+	if err := desired.ParseDump(data); err != nil {
+		return nil, err
+	}
+
+	fake.RLock()
+	defer fake.RUnlock()
+	return diffTables(&fake.nftContext, fake.Table, desired.Table)
+}
+
+// extractInlineElements looks for an "elements = { ... } ;" clause in the body of a set
+// or map, and if it finds one, returns the body with that clause removed, plus the
+// individual elements. (If there is no such clause, it returns body unchanged and nil.)
+func extractInlineElements(body string) (string, []string) {
+	start := strings.Index(body, " elements = {")
+	if start == -1 {
+		return body, nil
+	}
+
+	listStart := start + len(" elements = {")
+	elements, end := splitElementList(body[listStart:])
+	if end == -1 {
+		// Unterminated; let the regular parser fail on it.
+		return body, nil
+	}
+	rest := strings.TrimPrefix(body[listStart+end+1:], " ;")
+	return body[:start] + rest, elements
+}
+
+// splitElementCommand splits the body of an "add element" command ("NAME { ELEM, ...
+// }") into the set/map name and the individual elements. If body is not in that form, it
+// returns "" and nil.
+func splitElementCommand(body string) (string, []string) {
+	name, list, found := strings.Cut(body, " {")
+	if !found {
+		return "", nil
+	}
+	elements, end := splitElementList(list)
+	if end == -1 || strings.TrimSpace(list[end+1:]) != "" {
+		return "", nil
+	}
+	return name, elements
+}
+
+// splitElementList splits list (the part of an element list following the opening "{")
+// at top-level commas, returning the (whitespace-trimmed) elements and the index in list
+// of the closing "}", or -1 if the list is unterminated.
+func splitElementList(list string) ([]string, int) {
+	var elements []string
+	inQuotes := false
+	depth := 0
+	elemStart := 0
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case '{':
+			if !inQuotes {
+				depth++
+			}
+		case ',', '}':
+			if inQuotes {
+				continue
+			}
+			if list[i] == '}' && depth > 0 {
+				depth--
+				continue
+			}
+			if depth > 0 {
+				continue
+			}
+			if elem := strings.TrimSpace(list[elemStart:i]); elem != "" {
+				elements = append(elements, elem)
+			}
+			elemStart = i + 1
+			if list[i] == '}' {
+				return elements, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// unclosedBraces returns the number of "{"s in line (outside of quoted strings) that
+// are not matched by a following "}".
+func unclosedBraces(line string) int {
+	inQuotes := false
+	depth := 0
+	for _, c := range line {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		}
+	}
+	return depth
+}
+
 func sortKeys[K ~string, V any](m map[K]V) []K {
 	keys := make([]K, 0, len(m))
 	for key := range m {
@@ -690,17 +2281,41 @@ func (table *FakeTable) copy() *FakeTable {
 	}
 
 	tcopy := &FakeTable{
-		Table:      table.Table,
-		Flowtables: make(map[string]*FakeFlowtable),
-		Chains:     make(map[string]*FakeChain),
-		Sets:       make(map[string]*FakeSet),
-		Maps:       make(map[string]*FakeMap),
+		Table:          table.Table,
+		Flowtables:     make(map[string]*FakeFlowtable),
+		CTHelpers:      make(map[string]*FakeCTHelper),
+		CTTimeouts:     make(map[string]*FakeCTTimeout),
+		CTExpectations: make(map[string]*FakeCTExpectation),
+		Synproxies:     make(map[string]*FakeSynproxy),
+		Chains:         make(map[string]*FakeChain),
+		Sets:           make(map[string]*FakeSet),
+		Maps:           make(map[string]*FakeMap),
 	}
 	for name, flowtable := range table.Flowtables {
 		tcopy.Flowtables[name] = &FakeFlowtable{
 			Flowtable: flowtable.Flowtable,
 		}
 	}
+	for name, helper := range table.CTHelpers {
+		tcopy.CTHelpers[name] = &FakeCTHelper{
+			CTHelper: helper.CTHelper,
+		}
+	}
+	for name, timeout := range table.CTTimeouts {
+		tcopy.CTTimeouts[name] = &FakeCTTimeout{
+			CTTimeout: *copyCTTimeout(&timeout.CTTimeout),
+		}
+	}
+	for name, expectation := range table.CTExpectations {
+		tcopy.CTExpectations[name] = &FakeCTExpectation{
+			CTExpectation: expectation.CTExpectation,
+		}
+	}
+	for name, synproxy := range table.Synproxies {
+		tcopy.Synproxies[name] = &FakeSynproxy{
+			Synproxy: synproxy.Synproxy,
+		}
+	}
 	for name, chain := range table.Chains {
 		tcopy.Chains[name] = &FakeChain{
 			Chain: chain.Chain,
@@ -723,10 +2338,68 @@ func (table *FakeTable) copy() *FakeTable {
 	return tcopy
 }
 
+// findIntervalElement returns the index of the first element of elements whose key
+// contains key, where each field of an element's key may be a CIDR prefix or a range
+// (as with NeedsIntervalFlag), or -1 if there is none.
+func findIntervalElement(elements []*Element, key []string) int {
+	for i := range elements {
+		if len(elements[i].Key) != len(key) {
+			continue
+		}
+		matched := true
+		for j := range key {
+			if !intervalFieldContains(elements[i].Key[j], key[j]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return i
+		}
+	}
+	return -1
+}
+
+// intervalFieldContains returns true if value is equal to field, or if field is a CIDR
+// prefix or range that contains value.
+func intervalFieldContains(field, value string) bool {
+	if field == value {
+		return true
+	}
+	if _, cidr, err := net.ParseCIDR(field); err == nil {
+		ip := net.ParseIP(value)
+		return ip != nil && cidr.Contains(ip)
+	}
+	start, end, found := strings.Cut(field, "-")
+	if !found {
+		return false
+	}
+	if startIP, endIP := net.ParseIP(start), net.ParseIP(end); startIP != nil && endIP != nil {
+		ip := net.ParseIP(value)
+		if ip == nil || (ip.To4() == nil) != (startIP.To4() == nil) {
+			return false
+		}
+		return bytes.Compare(ip.To16(), startIP.To16()) >= 0 && bytes.Compare(ip.To16(), endIP.To16()) <= 0
+	}
+	startNum, startErr := strconv.ParseUint(start, 10, 64)
+	endNum, endErr := strconv.ParseUint(end, 10, 64)
+	num, err := strconv.ParseUint(value, 10, 64)
+	if startErr != nil || endErr != nil || err != nil {
+		return false
+	}
+	return num >= startNum && num <= endNum
+}
+
 // FindElement finds an element of the set with the given key. If there is no matching
-// element, it returns nil.
+// element, it returns nil. If the set has the "interval" flag, and there is no element
+// with exactly the given key, then FindElement will return an element whose key is a
+// CIDR prefix or range that contains key (eg, an element "10.0.0.0-10.0.0.255" for the
+// key "10.0.0.5").
 func (s *FakeSet) FindElement(key ...string) *Element {
 	index := findElement(s.Elements, key)
+	if index == -1 && hasFlag(s.Flags, IntervalFlag) {
+		index = findIntervalElement(s.Elements, key)
+	}
 	if index == -1 {
 		return nil
 	}
@@ -734,9 +2407,13 @@ func (s *FakeSet) FindElement(key ...string) *Element {
 }
 
 // FindElement finds an element of the map with the given key. If there is no matching
-// element, it returns nil.
+// element, it returns nil. As with FakeSet.FindElement, if the map has the "interval"
+// flag, this will also find an element whose key contains key.
 func (m *FakeMap) FindElement(key ...string) *Element {
 	index := findElement(m.Elements, key)
+	if index == -1 && hasFlag(m.Flags, IntervalFlag) {
+		index = findIntervalElement(m.Elements, key)
+	}
 	if index == -1 {
 		return nil
 	}
@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/lithammer/dedent"
@@ -399,360 +400,1997 @@ func TestFakeCheck(t *testing.T) {
 	}
 }
 
-func assertRules(t *testing.T, fake *Fake, expected ...string) {
-	t.Helper()
+func TestFakeStrictRuleValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rule string
+		err  string
+	}{
+		{
+			name: "simple rule",
+			rule: "ip daddr 10.0.0.1 tcp dport 80 drop",
+		},
+		{
+			name: "jump",
+			rule: "ip saddr != 10.0.0.0/8 jump chain",
+		},
+		{
+			name: "vmap lookup",
+			rule: "ip daddr . meta l4proto . th dport vmap @map",
+		},
+		{
+			name: "anonymous vmap",
+			rule: "numgen random mod 2 vmap { 0 : goto chain , 1 : drop }",
+		},
+		{
+			name: "quoted verdict and braces",
+			rule: `log prefix "drop { accept" accept`,
+		},
+		{
+			name: "empty",
+			rule: " ",
+			err:  "empty rule",
+		},
+		{
+			name: "unbalanced braces",
+			rule: "ip daddr { 10.0.0.1, 10.0.0.2 drop",
+			err:  "unbalanced braces",
+		},
+		{
+			name: "extra close brace",
+			rule: "ip daddr 10.0.0.1 } drop",
+			err:  "unbalanced braces",
+		},
+		{
+			name: "unterminated string",
+			rule: `log prefix "foo drop`,
+			err:  "unterminated string",
+		},
+		{
+			name: "vmap without @",
+			rule: "ip daddr vmap map",
+			err:  "vmap must be followed by @name",
+		},
+		{
+			name: "map at end",
+			rule: "ip daddr map",
+			err:  "map must be followed by @name",
+		},
+		{
+			name: "jump with no chain",
+			rule: "ip daddr 10.0.0.1 jump",
+			err:  "jump with no chain name",
+		},
+		{
+			name: "statement after verdict",
+			rule: "drop counter",
+			err:  `statement after terminal statement "drop"`,
+		},
+		{
+			name: "statement after goto",
+			rule: "goto chain accept",
+			err:  `statement after terminal statement "goto"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake(IPv4Family, "kube-proxy")
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(&Chain{Name: "chain"})
+			tx.Add(&Map{Name: "map", Type: "ipv4_addr . inet_proto . inet_service : verdict"})
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Fatalf("unexpected error from Run: %v", err)
+			}
 
-	actual, err := fake.ListRules(context.Background(), "test")
-	if err != nil {
-		t.Fatalf("could not ListRules: %v", err)
-	}
+			// Without StrictRuleValidation, the rule is accepted unless it
+			// references objects that don't exist.
+			tx = fake.NewTransaction()
+			tx.Add(&Rule{Chain: "chain", Rule: tc.rule})
+			if err := fake.Check(context.Background(), tx); err != nil && !IsNotFound(err) {
+				t.Errorf("unexpected error without StrictRuleValidation: %v", err)
+			}
 
-	if len(actual) != len(expected) {
-		t.Errorf("expected %d rules, got %d", len(expected), len(actual))
+			fake.StrictRuleValidation = true
+			err := fake.Check(context.Background(), tx)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
 	}
+}
 
-	for i := range expected {
-		if i == len(actual) {
-			break
-		}
-		if actual[i].Rule != expected[i] {
-			t.Errorf("expected rule %d to be %q but got %q", i+1, expected[i], actual[i].Rule)
-		}
-	}
+func TestFakeStrictTypeChecking(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		strict  bool
+		element *Element
+		err     string
+	}{
+		{
+			name:    "wrong key length ignored by default",
+			strict:  false,
+			element: &Element{Set: "concat", Key: []string{"10.0.0.1", "tcp", "80"}},
+		},
+		{
+			name:    "concatenated set key",
+			strict:  true,
+			element: &Element{Set: "concat", Key: []string{"10.0.0.1", "80"}},
+		},
+		{
+			name:    "too many key fields",
+			strict:  true,
+			element: &Element{Set: "concat", Key: []string{"10.0.0.1", "tcp", "80"}},
+			err:     `element "10.0.0.1 . tcp . 80" has 3 key fields but type "ipv4_addr . inet_service" has 2`,
+		},
+		{
+			name:    "too few key fields with typeof",
+			strict:  true,
+			element: &Element{Set: "typeof", Key: []string{"10.0.0.1"}},
+			err:     `element "10.0.0.1" has 1 key fields but type "ip daddr . tcp dport" has 2`,
+		},
+		{
+			name:    "map element",
+			strict:  true,
+			element: &Element{Map: "vmap", Key: []string{"10.0.0.1", "tcp"}, Value: []string{"goto chain"}},
+		},
+		{
+			name:    "map element with wrong key length",
+			strict:  true,
+			element: &Element{Map: "vmap", Key: []string{"10.0.0.1"}, Value: []string{"goto chain"}},
+			err:     `element "10.0.0.1" has 1 key fields but type "ipv4_addr . inet_proto : verdict" has 2`,
+		},
+		{
+			name:    "map element with concatenated value",
+			strict:  true,
+			element: &Element{Map: "dnat", Key: []string{"10.0.0.1"}, Value: []string{"10.1.0.1", "8080"}},
+		},
+		{
+			name:    "map element with wrong value length",
+			strict:  true,
+			element: &Element{Map: "dnat", Key: []string{"10.0.0.1"}, Value: []string{"10.1.0.1"}},
+			err:     `element "10.0.0.1" has 1 value fields but type "ipv4_addr : ipv4_addr . inet_service" has 2`,
+		},
+		{
+			name:    "MAC address",
+			strict:  true,
+			element: &Element{Set: "macs", Key: []string{"00:11:22:33:44:55"}},
+		},
+		{
+			name:    "MAC address range",
+			strict:  true,
+			element: &Element{Set: "macs", Key: []string{"00:11:22:33:44:00-00:11:22:33:44:ff"}},
+		},
+		{
+			name:    "invalid MAC address",
+			strict:  true,
+			element: &Element{Set: "macs", Key: []string{"00:11:22:33:44"}},
+			err:     `element "00:11:22:33:44" has invalid ether_addr key field "00:11:22:33:44"`,
+		},
+		{
+			name:    "invalid MAC address ignored by default",
+			strict:  false,
+			element: &Element{Set: "macs", Key: []string{"10.0.0.1"}},
+		},
+		{
+			name:    "invalid MAC address map value",
+			strict:  true,
+			element: &Element{Map: "arp", Key: []string{"10.0.0.1"}, Value: []string{"10.0.0.1"}},
+			err:     `element "10.0.0.1" has invalid ether_addr value field "10.0.0.1"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake(IPv4Family, "kube-proxy")
+			fake.StrictTypeChecking = tc.strict
+
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(&Chain{Name: "chain"})
+			tx.Add(&Set{Name: "concat", Type: "ipv4_addr . inet_service"})
+			tx.Add(&Set{Name: "typeof", TypeOf: "ip daddr . tcp dport"})
+			tx.Add(&Map{Name: "vmap", Type: "ipv4_addr . inet_proto : verdict"})
+			tx.Add(&Map{Name: "dnat", Type: "ipv4_addr : ipv4_addr . inet_service"})
+			tx.Add(&Set{Name: "macs", Type: "ether_addr", Flags: []SetFlag{IntervalFlag}})
+			tx.Add(&Map{Name: "arp", Type: "ipv4_addr : ether_addr"})
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Fatalf("unexpected error from Run: %v", err)
+			}
 
-	rulesByHandle := make(map[int][]string)
-	for _, r := range actual {
-		rulesByHandle[*r.Handle] = append(rulesByHandle[*r.Handle], r.Rule)
-	}
-	for handle, rules := range rulesByHandle {
-		if len(rules) > 1 {
-			t.Errorf("multiple rules for handle %d: %v", handle, rules)
-		}
+			tx = fake.NewTransaction()
+			tx.Add(tc.element)
+			err := fake.Run(context.Background(), tx)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("expected error %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
 	}
 }
 
-func TestFakeAddInsertReplace(t *testing.T) {
-	fake := NewFake(IPv4Family, "kube-proxy")
-
+func TestFakeBridgeMACSets(t *testing.T) {
+	fake := NewFake(BridgeFamily, "filter")
+	fake.StrictTypeChecking = true
 	tx := fake.NewTransaction()
 	tx.Add(&Table{})
-	err := fake.Run(context.Background(), tx)
-	if err != nil {
+	tx.Add(&Chain{Name: "forward", Type: PtrTo(FilterType), Hook: PtrTo(ForwardHook), Priority: PtrTo(FilterPriority)})
+	tx.Add(&Set{Name: "blocked-macs", Type: "ether_addr"})
+	tx.Add(&Map{Name: "mac-verdicts", Type: "ether_addr : verdict"})
+	tx.Add(&Element{Set: "blocked-macs", Key: []string{"00:11:22:33:44:55"}})
+	tx.Add(&Element{Set: "blocked-macs", Key: []string{"aa:bb:cc:dd:ee:ff"}, Comment: PtrTo("laptop")})
+	tx.Add(&Element{Map: "mac-verdicts", Key: []string{"00:11:22:33:44:66"}, Value: []string{"drop"}})
+	tx.Add(&Rule{Chain: "forward", Rule: "ether saddr @blocked-macs drop"})
+	tx.Add(&Rule{Chain: "forward", Rule: "ether daddr vmap @mac-verdicts"})
+	if err := fake.Run(context.Background(), tx); err != nil {
 		t.Fatalf("unexpected error from Run: %v", err)
 	}
 
-	_, err = fake.ListRules(context.Background(), "test")
-	if err == nil || !IsNotFound(err) {
-		t.Errorf("expected chain not found but got: %v", err)
+	// References to nonexistent MAC sets are caught
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "forward", Rule: "ether daddr @no-such-set drop"})
+	if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+		t.Errorf("expected not found error for missing set, got %v", err)
 	}
 
-	tx = fake.NewTransaction()
-	tx.Add(&Chain{
-		Name: "test",
-	})
-	err = fake.Run(context.Background(), tx)
-	if err != nil {
-		t.Fatalf("unexpected error from Run: %v", err)
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table bridge filter
+		add chain bridge filter forward { type filter hook forward priority -200 ; }
+		add set bridge filter blocked-macs { type ether_addr ; }
+		add map bridge filter mac-verdicts { type ether_addr : verdict ; }
+		add rule bridge filter forward ether saddr @blocked-macs drop
+		add rule bridge filter forward ether daddr vmap @mac-verdicts
+		add element bridge filter blocked-macs { 00:11:22:33:44:55 }
+		add element bridge filter blocked-macs { aa:bb:cc:dd:ee:ff comment "laptop" }
+		add element bridge filter mac-verdicts { 00:11:22:33:44:66 : drop }
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected dump:\n%s", diff)
 	}
 
-	assertRules(t, fake /* no rules */)
+	// The dump round-trips through ParseDump
+	parsed := NewFake(BridgeFamily, "filter")
+	if err := parsed.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	if diff := cmp.Diff(dump, parsed.Dump()); diff != "" {
+		t.Errorf("unexpected dump after ParseDump:\n%s", diff)
+	}
+	elem := parsed.Table.Maps["mac-verdicts"].FindElement("00:11:22:33:44:66")
+	if elem == nil || !reflect.DeepEqual(elem.Value, []string{"drop"}) {
+		t.Errorf("expected to find MAC map element after ParseDump, got %+v", elem)
+	}
+}
 
-	// Test basic Add
-	tx = fake.NewTransaction()
-	tx.Add(&Rule{
-		Chain: "test",
-		Rule:  "first",
-	})
-	tx.Add(&Rule{
-		Chain: "test",
-		Rule:  "second",
-	})
-	tx.Add(&Rule{
-		Chain: "test",
-		Rule:  "third",
-	})
-	err = fake.Run(context.Background(), tx)
-	if err != nil {
-		t.Fatalf("unexpected error from Run: %v", err)
+func TestFakeDetectHookConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		detect bool
+		chain  *Chain
+		err    string
+	}{
+		{
+			name:   "conflict ignored by default",
+			detect: false,
+			chain:  &Chain{Name: "input2", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(BaseChainPriority("0"))},
+		},
+		{
+			name:   "same hook and priority",
+			detect: true,
+			chain:  &Chain{Name: "input2", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(BaseChainPriority("0"))},
+			err:    `chain "input2" has the same hook (input) and priority (0) as chain "input1"`,
+		},
+		{
+			name:   "same hook and equivalent priority",
+			detect: true,
+			chain:  &Chain{Name: "input2", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(FilterPriority)},
+			err:    `chain "input2" has the same hook (input) and priority (0) as chain "input1"`,
+		},
+		{
+			name:   "same hook, different priority",
+			detect: true,
+			chain:  &Chain{Name: "input2", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(BaseChainPriority("filter+10"))},
+		},
+		{
+			name:   "same priority, different hook",
+			detect: true,
+			chain:  &Chain{Name: "output", Type: PtrTo(FilterType), Hook: PtrTo(OutputHook), Priority: PtrTo(BaseChainPriority("0"))},
+		},
+		{
+			name:   "re-adding existing chain",
+			detect: true,
+			chain:  &Chain{Name: "input1", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(BaseChainPriority("0"))},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake(IPv4Family, "kube-proxy")
+			fake.SetDetectHookConflicts(tc.detect)
+
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(&Chain{Name: "input1", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(BaseChainPriority("0"))})
+			tx.Add(&Chain{Name: "regular"})
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Fatalf("unexpected error from Run: %v", err)
+			}
+
+			tx = fake.NewTransaction()
+			tx.Add(tc.chain)
+			err := fake.Run(context.Background(), tx)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("expected error %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
 	}
+}
 
-	assertRules(t, fake, "first", "second", "third")
+func TestFakeCheckIntervalFlag(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		check   bool
+		element *Element
+		err     string
+	}{
+		{
+			name:    "missing flag ignored by default",
+			check:   false,
+			element: &Element{Set: "plain", Key: []string{"10.0.0.0/8"}},
+		},
+		{
+			name:    "CIDR in set without interval flag",
+			check:   true,
+			element: &Element{Set: "plain", Key: []string{"10.0.0.0/8"}},
+			err:     `set "plain" does not have the "interval" flag, needed for element "10.0.0.0/8"`,
+		},
+		{
+			name:    "range in map without interval flag",
+			check:   true,
+			element: &Element{Map: "plainmap", Key: []string{"10.0.0.1-10.0.0.5"}, Value: []string{"drop"}},
+			err:     `map "plainmap" does not have the "interval" flag, needed for element "10.0.0.1-10.0.0.5"`,
+		},
+		{
+			name:    "CIDR in set with interval flag",
+			check:   true,
+			element: &Element{Set: "interval", Key: []string{"10.0.0.0/8"}},
+		},
+		{
+			name:    "plain address in set without interval flag",
+			check:   true,
+			element: &Element{Set: "plain", Key: []string{"10.0.0.1"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake(IPv4Family, "kube-proxy")
+			fake.SetCheckIntervalFlag(tc.check)
+
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(&Set{Name: "plain", Type: "ipv4_addr"})
+			tx.Add(&Set{Name: "interval", Type: "ipv4_addr", Flags: []SetFlag{IntervalFlag}})
+			tx.Add(&Map{Name: "plainmap", Type: "ipv4_addr : verdict"})
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Fatalf("unexpected error from Run: %v", err)
+			}
 
-	// (can't fail: we just did this in assertRules)
-	rules, _ := fake.ListRules(context.Background(), "test")
-	firstHandle := *rules[0].Handle
-	secondHandle := *rules[1].Handle
-	thirdHandle := *rules[2].Handle
+			tx = fake.NewTransaction()
+			tx.Add(tc.element)
+			err := fake.Run(context.Background(), tx)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("expected error %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
 
-	// Test Add with Handle or Index
-	tx = fake.NewTransaction()
-	// Should go after "second"
-	tx.Add(&Rule{
-		Chain: "test",
-		Rule:  "fourth",
-		Index: PtrTo(1),
-	})
-	// Should go after "first"
-	tx.Add(&Rule{
-		Chain:  "test",
-		Rule:   "fifth",
-		Handle: PtrTo(firstHandle),
-	})
-	err = fake.Run(context.Background(), tx)
-	if err != nil {
+func TestFakeCTHelpers(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "prerouting"})
+	tx.Add(&CTHelper{Name: "ftp-helper", Type: "ftp", Protocol: "tcp", L3Proto: PtrTo(IPv4Family)})
+	tx.Add(&Rule{Chain: "prerouting", Rule: `tcp dport 21 ct helper set "ftp-helper"`})
+	if err := fake.Run(context.Background(), tx); err != nil {
 		t.Fatalf("unexpected error from Run: %v", err)
 	}
 
-	assertRules(t, fake, "first", "fifth", "second", "fourth", "third")
+	helpers, err := fake.ListCTHelpers(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListCTHelpers: %v", err)
+	}
+	handle := *fake.Table.CTHelpers["ftp-helper"].Handle
+	expected := []*CTHelper{
+		{Name: "ftp-helper", Type: "ftp", Protocol: "tcp", L3Proto: PtrTo(IPv4Family), Handle: PtrTo(handle)},
+	}
+	if diff := cmp.Diff(expected, helpers); diff != "" {
+		t.Errorf("unexpected result from ListCTHelpers:\n%s", diff)
+	}
+
+	// Modifying the results of ListCTHelpers should not modify the fake
+	*helpers[0].L3Proto = IPv6Family
+	*helpers[0].Handle = handle + 100
+	if diff := cmp.Diff(expected[0], &fake.Table.CTHelpers["ftp-helper"].CTHelper); diff != "" {
+		t.Errorf("modifying ListCTHelpers result modified the fake:\n%s", diff)
+	}
 
-	// Test Insert
 	tx = fake.NewTransaction()
-	// Should go first
-	tx.Insert(&Rule{
-		Chain: "test",
-		Rule:  "sixth",
-	})
-	// Should go before "second"
-	tx.Insert(&Rule{
-		Chain:  "test",
-		Rule:   "seventh",
-		Handle: PtrTo(secondHandle),
-	})
-	// Should go before "fourth". ("fourth" was rule[3] before this
-	// transaction and the previous two operations added two more rules
-	// before it, so it should now have index 5.)
-	tx.Insert(&Rule{
-		Chain: "test",
-		Rule:  "eighth",
-		Index: PtrTo(5),
-	})
+	tx.Add(&Rule{Chain: "prerouting", Rule: `udp dport 5060 ct helper set "sip-helper"`})
 	err = fake.Run(context.Background(), tx)
-	if err != nil {
-		t.Fatalf("unexpected error from Run: %v", err)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error for missing ct helper, got %v", err)
 	}
 
-	assertRules(t, fake, "sixth", "first", "fifth", "seventh", "second", "eighth", "fourth", "third")
+	tx = fake.NewTransaction()
+	tx.Create(&CTHelper{Name: "ftp-helper", Type: "ftp", Protocol: "tcp"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsAlreadyExists(err) {
+		t.Errorf("expected already-exists error, got %v", err)
+	}
 
-	// Test Replace. And Delete while we're here... the chain is getting kind of long
 	tx = fake.NewTransaction()
+	tx.Delete(&CTHelper{Name: "ftp-helper"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if len(fake.Table.CTHelpers) != 0 {
+		t.Errorf("expected ct helper to be deleted")
+	}
+}
 
-	tx.Replace(&Rule{
-		Chain:  "test",
-		Rule:   "ninth",
-		Handle: PtrTo(secondHandle),
-	})
-	tx.Delete(&Rule{
-		Chain:  "test",
-		Handle: PtrTo(firstHandle),
-	})
-	err = fake.Run(context.Background(), tx)
-	if err != nil {
+func TestFakeCTTimeouts(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "prerouting"})
+	policy := map[string]time.Duration{"established": 2 * time.Minute}
+	tx.Add(&CTTimeout{Name: "ct-time", Protocol: "tcp", Policy: policy})
+	tx.Add(&Rule{Chain: "prerouting", Rule: "tcp dport 8080 ct timeout set @ct-time"})
+	if err := fake.Run(context.Background(), tx); err != nil {
 		t.Fatalf("unexpected error from Run: %v", err)
 	}
 
-	assertRules(t, fake, "sixth", "fifth", "seventh", "ninth", "eighth", "fourth", "third")
+	// The fake should not share the policy map with the caller
+	policy["established"] = time.Hour
 
-	// Re-fetch handles; Replace should not have changed the handle for its rule.
-	// (can't fail: we just did this in assertRules)
-	rules, _ = fake.ListRules(context.Background(), "test")
-	if *rules[3].Handle != secondHandle {
-		t.Errorf("Replace changed the rule handle: expected %d got %d", secondHandle, *rules[3].Handle)
+	timeouts, err := fake.ListCTTimeouts(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListCTTimeouts: %v", err)
 	}
-	if *rules[6].Handle != thirdHandle {
-		t.Errorf("Handle for original third rule changed? expected %d got %d", thirdHandle, *rules[6].Handle)
+	expected := []*CTTimeout{
+		{
+			Name:     "ct-time",
+			Protocol: "tcp",
+			Policy:   map[string]time.Duration{"established": 2 * time.Minute},
+			Handle:   fake.Table.CTTimeouts["ct-time"].Handle,
+		},
+	}
+	if diff := cmp.Diff(expected, timeouts); diff != "" {
+		t.Errorf("unexpected result from ListCTTimeouts:\n%s", diff)
+	}
+
+	// ...or with the results of ListCTTimeouts
+	timeouts[0].Policy["established"] = time.Hour
+	if fake.Table.CTTimeouts["ct-time"].Policy["established"] != 2*time.Minute {
+		t.Errorf("modifying ListCTTimeouts result modified the fake")
+	}
+
+	for _, rule := range []string{
+		"tcp dport 8080 ct timeout set @other",
+		`tcp dport 8080 ct timeout set "other"`,
+	} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "prerouting", Rule: rule})
+		err = fake.Run(context.Background(), tx)
+		if err == nil || !IsNotFound(err) {
+			t.Errorf("expected not-found error for %q, got %v", rule, err)
+		}
+	}
+}
+
+func TestFakeFlushSet(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "myset", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.2"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
 	}
 
-	// Test edge cases
 	tx = fake.NewTransaction()
-	tx.Add(&Rule{
-		Chain: "test",
-		Rule:  "tenth",
-		Index: PtrTo(len(rules) - 1),
-	})
-	tx.Insert(&Rule{
-		Chain: "test",
-		Rule:  "eleventh",
-		Index: PtrTo(len(rules)),
-	})
-	tx.Add(&Rule{
-		Chain: "test",
-		Rule:  "twelfth",
-		Index: PtrTo(0),
-	})
-	tx.Insert(&Rule{
-		Chain: "test",
-		Rule:  "thirteenth",
-		Index: PtrTo(0),
-	})
-	err = fake.Run(context.Background(), tx)
-	if err != nil {
+	tx.Flush(&Set{Name: "myset"})
+	if err := fake.Run(context.Background(), tx); err != nil {
 		t.Fatalf("unexpected error from Run: %v", err)
 	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy myset { type ipv4_addr ; }
+		`), "\n")
+	if dump := fake.Dump(); dump != expected {
+		t.Errorf("expected empty set after flush, got:\n%s", dump)
+	}
 
-	assertRules(t, fake, "thirteenth", "sixth", "twelfth", "fifth", "seventh", "ninth", "eighth", "fourth", "third", "eleventh", "tenth")
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.3"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	expected += "add element ip kube-proxy myset { 10.0.0.3 }\n"
+	if dump := fake.Dump(); dump != expected {
+		t.Errorf("unexpected dump after re-adding element:\n%s", dump)
+	}
 }
 
-func TestFakeParseDump(t *testing.T) {
+func TestFakeDeleteReferencedChain(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "services"})
+	tx.Add(&Chain{Name: "service-a"})
+	tx.Add(&Chain{Name: "service-b"})
+	tx.Add(&Chain{Name: "endpoint"})
+	tx.Add(&Chain{Name: "unused"})
+	tx.Add(&Map{Name: "service-ips", Type: "ipv4_addr : verdict"})
+	tx.Add(&Rule{Chain: "services", Rule: "tcp dport vmap { 80 : goto service-a, 443 : drop }"})
+	tx.Add(&Rule{Chain: "service-a", Rule: "jump endpoint"})
+	tx.Add(&Element{Map: "service-ips", Key: []string{"10.0.0.1"}, Value: []string{Goto("service-b")}})
+	tx.Add(&Rule{Chain: "service-b", Rule: "drop comment \"goto unused\""})
+	if err := fake.Run(ctx, tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
 	for _, tc := range []struct {
-		ipFamily Family
-		dump     string
+		chain string
+		err   string
 	}{
-		{
-			ipFamily: IPv4Family,
-			dump: `
-			add table ip kube-proxy
-			add flowtable ip kube-proxy myflowtable { hook ingress priority filter ; devices = { eth0, eth1 } ; }
-			add chain ip kube-proxy anotherchain
-			add chain ip kube-proxy chain { comment "foo" ; }
-			add map ip kube-proxy map1 { type ipv4_addr . inet_proto . inet_service ; }
-			add set ip kube-proxy set1 { type ipv4_addr . inet_proto . inet_service ; flags dynamic ; gc-interval 15s ; policy memory ; auto-merge ; }
-			add rule ip kube-proxy anotherchain ip saddr 1.2.3.4 drop comment "drop rule"
-			add rule ip kube-proxy anotherchain ip daddr 5.6.7.8 reject comment "reject rule"
-			add rule ip kube-proxy chain ip daddr 10.0.0.0/8 drop
-			add rule ip kube-proxy chain masquerade comment "comment"
-			add element ip kube-proxy map1 { 192.168.0.1 . tcp . 80 : drop }
-			add element ip kube-proxy map1 { 192.168.0.2 . tcp . 443 comment "with a comment" : goto anotherchain }
-			`,
-		},
-		{
-			ipFamily: IPv4Family,
-			dump: `
-			add table ip kube-proxy { flags dormant ; }
-			add chain ip kube-proxy filter-prerouting { type filter hook prerouting priority -100 ; policy drop ; }
-			`,
-		},
-		{
-			ipFamily: IPv4Family,
-			dump: `
-			add table ip kube-proxy { comment "rules for kube-proxy" ; }
-			add chain ip kube-proxy mark-for-masquerade
-			add chain ip kube-proxy masquerading
-			add chain ip kube-proxy services
-			add chain ip kube-proxy firewall-check
-			add chain ip kube-proxy endpoints-check
-			add chain ip kube-proxy filter-prerouting { type filter hook prerouting priority -110 ; }
-			add chain ip kube-proxy filter-forward { type filter hook forward priority -110 ; }
-			add chain ip kube-proxy filter-input { type filter hook input priority -110 ; }
-			add chain ip kube-proxy filter-output { type filter hook output priority -110 ; }
-			add chain ip kube-proxy nat-output { type nat hook output priority -100 ; }
-			add chain ip kube-proxy nat-postrouting { type nat hook postrouting priority 100 ; }
-			add chain ip kube-proxy nat-prerouting { type nat hook prerouting priority -100 ; }
-			add chain ip kube-proxy reject-chain { comment "helper for @no-endpoint-services / @no-endpoint-nodeports" ; }
-			add chain ip kube-proxy service-ULMVA6XW-ns1/svc1/tcp/p80
-			add chain ip kube-proxy endpoint-5OJB2KTY-ns1/svc1/tcp/p80__10.180.0.1/80
-			add chain ip kube-proxy service-42NFTM6N-ns2/svc2/tcp/p80
-			add chain ip kube-proxy endpoint-SGOXE6O3-ns2/svc2/tcp/p80__10.180.0.2/80
-			add chain ip kube-proxy external-42NFTM6N-ns2/svc2/tcp/p80
-			add chain ip kube-proxy service-4AT6LBPK-ns3/svc3/tcp/p80
-			add chain ip kube-proxy endpoint-UEIP74TE-ns3/svc3/tcp/p80__10.180.0.3/80
-			add chain ip kube-proxy external-4AT6LBPK-ns3/svc3/tcp/p80
-			add chain ip kube-proxy service-LAUZTJTB-ns4/svc4/tcp/p80
-			add chain ip kube-proxy endpoint-UNZV3OEC-ns4/svc4/tcp/p80__10.180.0.4/80
-			add chain ip kube-proxy endpoint-5RFCDDV7-ns4/svc4/tcp/p80__10.180.0.5/80
-			add chain ip kube-proxy external-LAUZTJTB-ns4/svc4/tcp/p80
-			add chain ip kube-proxy service-HVFWP5L3-ns5/svc5/tcp/p80
-			add chain ip kube-proxy external-HVFWP5L3-ns5/svc5/tcp/p80
-			add chain ip kube-proxy endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80
-			add chain ip kube-proxy firewall-HVFWP5L3-ns5/svc5/tcp/p80
-
-			add rule ip kube-proxy mark-for-masquerade mark set mark or 0x4000
-			add rule ip kube-proxy masquerading mark and 0x4000 == 0 return
-			add rule ip kube-proxy masquerading mark set mark xor 0x4000
-			add rule ip kube-proxy masquerading masquerade fully-random
-			add rule ip kube-proxy filter-prerouting ct state new jump firewall-check
-			add rule ip kube-proxy filter-forward ct state new jump endpoints-check
-			add rule ip kube-proxy filter-input ct state new jump endpoints-check
-			add rule ip kube-proxy filter-output ct state new jump endpoints-check
-			add rule ip kube-proxy filter-output ct state new jump firewall-check
-			add rule ip kube-proxy nat-output jump services
-			add rule ip kube-proxy nat-postrouting jump masquerading
-			add rule ip kube-proxy nat-prerouting jump services
+		{"service-a", `chain "service-a" is still referenced by a rule in chain "services"`},
+		{"service-b", `chain "service-b" is still referenced by an element of map "service-ips"`},
+		{"endpoint", `chain "endpoint" is still referenced by a rule in chain "service-a"`},
+	} {
+		tx = fake.NewTransaction()
+		tx.Delete(&Chain{Name: tc.chain})
+		err := fake.Run(ctx, tx)
+		if !IsBusy(err) || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected busy error %q deleting %q, got %v", tc.err, tc.chain, err)
+		}
+	}
 
-			add map ip kube-proxy firewall-ips { type ipv4_addr . inet_proto . inet_service : verdict ; comment "destinations that are subject to LoadBalancerSourceRanges" ; }
-			add rule ip kube-proxy firewall-check ip daddr . meta l4proto . th dport vmap @firewall-ips
+	// A chain that is only mentioned in a comment can be deleted
+	tx = fake.NewTransaction()
+	tx.Delete(&Chain{Name: "unused"})
+	if err := fake.Run(ctx, tx); err != nil {
+		t.Errorf("unexpected error deleting unreferenced chain: %v", err)
+	}
 
-			add rule ip kube-proxy reject-chain reject
+	// Removing the references first in the same transaction allows the deletion
+	tx = fake.NewTransaction()
+	tx.Flush(&Chain{Name: "service-a"})
+	tx.Delete(&Chain{Name: "endpoint"})
+	tx.Delete(&Element{Map: "service-ips", Key: []string{"10.0.0.1"}})
+	tx.Delete(&Chain{Name: "service-b"})
+	if err := fake.Run(ctx, tx); err != nil {
+		t.Errorf("unexpected error deleting chains after removing references: %v", err)
+	}
+	if fake.Table.Chains["endpoint"] != nil || fake.Table.Chains["service-b"] != nil {
+		t.Errorf("expected chains to be deleted")
+	}
+}
 
-			add map ip kube-proxy no-endpoint-services { type ipv4_addr . inet_proto . inet_service : verdict ; comment "vmap to drop or reject packets to services with no endpoints" ; }
-			add map ip kube-proxy no-endpoint-nodeports { type inet_proto . inet_service : verdict ; comment "vmap to drop or reject packets to service nodeports with no endpoints" ; }
+func TestFakeFlushTable(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if err := fake.FlushTable(context.Background()); !IsNotFound(err) {
+		t.Errorf("expected NotFound error flushing nonexistent table, got %v", err)
+	}
 
-			add rule ip kube-proxy endpoints-check ip daddr . meta l4proto . th dport vmap @no-endpoint-services
-			add rule ip kube-proxy endpoints-check fib daddr type local ip daddr != 127.0.0.0/8 meta l4proto . th dport vmap @no-endpoint-nodeports
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.1 drop"})
+	tx.Add(&Set{Name: "myset", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
 
-			add map ip kube-proxy service-ips { type ipv4_addr . inet_proto . inet_service : verdict ; comment "ClusterIP, ExternalIP and LoadBalancer IP traffic" ; }
-			add map ip kube-proxy service-nodeports { type inet_proto . inet_service : verdict ; comment "NodePort traffic" ; }
-			add rule ip kube-proxy services ip daddr . meta l4proto . th dport vmap @service-ips
-			add rule ip kube-proxy services fib daddr type local ip daddr != 127.0.0.0/8 meta l4proto . th dport vmap @service-nodeports
+	if err := fake.FlushTable(context.Background()); err != nil {
+		t.Fatalf("unexpected error from FlushTable: %v", err)
+	}
+	dump := fake.Dump()
+	if !strings.HasPrefix(dump, "add table ip kube-proxy\n") {
+		t.Errorf("expected table to still exist after FlushTable, got:\n%s", dump)
+	}
+	if strings.Contains(dump, "add rule") || strings.Contains(dump, "add element") {
+		t.Errorf("expected no rules or elements after FlushTable, got:\n%s", dump)
+	}
+}
 
-			# svc1
-			add rule ip kube-proxy service-ULMVA6XW-ns1/svc1/tcp/p80 ip daddr 172.30.0.41 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
-			add rule ip kube-proxy service-ULMVA6XW-ns1/svc1/tcp/p80 numgen random mod 1 vmap { 0 : goto endpoint-5OJB2KTY-ns1/svc1/tcp/p80__10.180.0.1/80 }
+func TestFakeSwapTable(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake(IPv4Family, "kube-proxy")
 
-			add rule ip kube-proxy endpoint-5OJB2KTY-ns1/svc1/tcp/p80__10.180.0.1/80 ip saddr 10.180.0.1 jump mark-for-masquerade
-			add rule ip kube-proxy endpoint-5OJB2KTY-ns1/svc1/tcp/p80__10.180.0.1/80 meta l4proto tcp dnat to 10.180.0.1:80
+	// SwapTable works when the table doesn't exist yet
+	err := fake.SwapTable(ctx, func(tx *Transaction) {
+		tx.Add(&Chain{Name: "old"})
+		tx.Add(&Rule{Chain: "old", Rule: "ip daddr 10.0.0.1 drop"})
+		tx.Add(&Set{Name: "oldset", Type: "ipv4_addr"})
+		tx.Add(&Element{Set: "oldset", Key: []string{"10.0.0.1"}})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from SwapTable: %v", err)
+	}
+	oldDump := fake.Dump()
+
+	// While the new contents are being built, the Fake still has the old contents
+	err = fake.SwapTable(ctx, func(tx *Transaction) {
+		tx.Add(&Table{Comment: PtrTo("new")})
+		tx.Add(&Chain{Name: "new"})
+		if dump := fake.Dump(); dump != oldDump {
+			t.Errorf("table modified before transaction was run:\n%s", dump)
+		}
+		tx.Add(&Rule{Chain: "new", Rule: "ip daddr 10.0.0.2 drop"})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from SwapTable: %v", err)
+	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy { comment "new" ; }
+		add chain ip kube-proxy new
+		add rule ip kube-proxy new ip daddr 10.0.0.2 drop
+		`), "\n")
+	if dump := fake.Dump(); dump != expected {
+		t.Errorf("unexpected dump after SwapTable:\n%s", dump)
+	}
 
-			add element ip kube-proxy service-ips { 172.30.0.41 . tcp . 80 : goto service-ULMVA6XW-ns1/svc1/tcp/p80 }
+	// If the new contents are invalid, the old contents are left in place
+	err = fake.SwapTable(ctx, func(tx *Transaction) {
+		tx.Add(&Chain{Name: "broken"})
+		tx.Add(&Rule{Chain: "broken", Rule: "jump nosuchchain"})
+	})
+	if err == nil {
+		t.Fatalf("expected error from SwapTable with invalid contents")
+	}
+	if dump := fake.Dump(); dump != expected {
+		t.Errorf("failed SwapTable modified the table:\n%s", dump)
+	}
+}
 
-			# svc2
-			add rule ip kube-proxy service-42NFTM6N-ns2/svc2/tcp/p80 ip daddr 172.30.0.42 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
-			add rule ip kube-proxy service-42NFTM6N-ns2/svc2/tcp/p80 numgen random mod 1 vmap { 0 : goto endpoint-SGOXE6O3-ns2/svc2/tcp/p80__10.180.0.2/80 }
-			add rule ip kube-proxy external-42NFTM6N-ns2/svc2/tcp/p80 ip saddr 10.0.0.0/8 goto service-42NFTM6N-ns2/svc2/tcp/p80 comment "short-circuit pod traffic"
-			add rule ip kube-proxy external-42NFTM6N-ns2/svc2/tcp/p80 fib saddr type local jump mark-for-masquerade comment "masquerade local traffic"
-			add rule ip kube-proxy external-42NFTM6N-ns2/svc2/tcp/p80 fib saddr type local goto service-42NFTM6N-ns2/svc2/tcp/p80 comment "short-circuit local traffic"
-			add rule ip kube-proxy endpoint-SGOXE6O3-ns2/svc2/tcp/p80__10.180.0.2/80 ip saddr 10.180.0.2 jump mark-for-masquerade
-			add rule ip kube-proxy endpoint-SGOXE6O3-ns2/svc2/tcp/p80__10.180.0.2/80 meta l4proto tcp dnat to 10.180.0.2:80
+func TestFakeReplaceTable(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake(IPv4Family, "kube-proxy")
+	err := fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy old
+		add rule ip kube-proxy old drop
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
 
-			add element ip kube-proxy service-ips { 172.30.0.42 . tcp . 80 : goto service-42NFTM6N-ns2/svc2/tcp/p80 }
-			add element ip kube-proxy service-ips { 192.168.99.22 . tcp . 80 : goto external-42NFTM6N-ns2/svc2/tcp/p80 }
-			add element ip kube-proxy service-ips { 1.2.3.4 . tcp . 80 : goto external-42NFTM6N-ns2/svc2/tcp/p80 }
-			add element ip kube-proxy service-nodeports { tcp . 3001 : goto external-42NFTM6N-ns2/svc2/tcp/p80 }
+	desiredDump := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy { comment "new" ; }
+		add chain ip kube-proxy new
+		add map ip kube-proxy map { type ipv4_addr : verdict ; }
+		add rule ip kube-proxy new ip daddr vmap @map
+		add element ip kube-proxy map { 10.0.0.1 : goto new }
+		`), "\n")
+	desired := NewFake(IPv4Family, "kube-proxy")
+	if err := desired.ParseDump(desiredDump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
 
-			add element ip kube-proxy no-endpoint-nodeports { tcp . 3001 comment "ns2/svc2:p80" : drop }
-			add element ip kube-proxy no-endpoint-services { 1.2.3.4 . tcp . 80 comment "ns2/svc2:p80" : drop }
-			add element ip kube-proxy no-endpoint-services { 192.168.99.22 . tcp . 80 comment "ns2/svc2:p80" : drop }
+	if err := fake.ReplaceTable(ctx, desired); err != nil {
+		t.Fatalf("unexpected error from ReplaceTable: %v", err)
+	}
+	if diff := cmp.Diff(desiredDump, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump after ReplaceTable:\n%s", diff)
+	}
 
-			# svc3
-			add rule ip kube-proxy service-4AT6LBPK-ns3/svc3/tcp/p80 ip daddr 172.30.0.43 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
-			add rule ip kube-proxy service-4AT6LBPK-ns3/svc3/tcp/p80 numgen random mod 1 vmap { 0 : goto endpoint-UEIP74TE-ns3/svc3/tcp/p80__10.180.0.3/80 }
-			add rule ip kube-proxy external-4AT6LBPK-ns3/svc3/tcp/p80 jump mark-for-masquerade
-			add rule ip kube-proxy external-4AT6LBPK-ns3/svc3/tcp/p80 goto service-4AT6LBPK-ns3/svc3/tcp/p80
-			add rule ip kube-proxy endpoint-UEIP74TE-ns3/svc3/tcp/p80__10.180.0.3/80 ip saddr 10.180.0.3 jump mark-for-masquerade
-			add rule ip kube-proxy endpoint-UEIP74TE-ns3/svc3/tcp/p80__10.180.0.3/80 meta l4proto tcp dnat to 10.180.0.3:80
+	if err := fake.ReplaceTable(ctx, NewFake(IPv4Family, "other")); err == nil {
+		t.Errorf("expected error from ReplaceTable with wrong table")
+	}
 
-			add element ip kube-proxy service-ips { 172.30.0.43 . tcp . 80 : goto service-4AT6LBPK-ns3/svc3/tcp/p80 }
-			add element ip kube-proxy service-nodeports { tcp . 3003 : goto external-4AT6LBPK-ns3/svc3/tcp/p80 }
+	if err := fake.ReplaceTable(ctx, NewFake(IPv4Family, "kube-proxy")); err != nil {
+		t.Fatalf("unexpected error from ReplaceTable: %v", err)
+	}
+	if fake.Table != nil {
+		t.Errorf("expected table to be deleted, got:\n%s", fake.Dump())
+	}
+}
 
-			# svc4
-			add rule ip kube-proxy service-LAUZTJTB-ns4/svc4/tcp/p80 ip daddr 172.30.0.44 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
-			add rule ip kube-proxy service-LAUZTJTB-ns4/svc4/tcp/p80 numgen random mod 2 vmap { 0 : goto endpoint-UNZV3OEC-ns4/svc4/tcp/p80__10.180.0.4/80 , 1 : goto endpoint-5RFCDDV7-ns4/svc4/tcp/p80__10.180.0.5/80 }
-			add rule ip kube-proxy external-LAUZTJTB-ns4/svc4/tcp/p80 jump mark-for-masquerade
-			add rule ip kube-proxy external-LAUZTJTB-ns4/svc4/tcp/p80 goto service-LAUZTJTB-ns4/svc4/tcp/p80
-			add rule ip kube-proxy endpoint-5RFCDDV7-ns4/svc4/tcp/p80__10.180.0.5/80 ip saddr 10.180.0.5 jump mark-for-masquerade
-			add rule ip kube-proxy endpoint-5RFCDDV7-ns4/svc4/tcp/p80__10.180.0.5/80 meta l4proto tcp dnat to 10.180.0.5:80
-			add rule ip kube-proxy endpoint-UNZV3OEC-ns4/svc4/tcp/p80__10.180.0.4/80 ip saddr 10.180.0.4 jump mark-for-masquerade
-			add rule ip kube-proxy endpoint-UNZV3OEC-ns4/svc4/tcp/p80__10.180.0.4/80 meta l4proto tcp dnat to 10.180.0.4:80
+func TestFakeSetStats(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if _, err := fake.SetStats(context.Background(), "myset"); !IsNotFound(err) {
+		t.Errorf("expected NotFound error with no table, got %v", err)
+	}
 
-			add element ip kube-proxy service-ips { 172.30.0.44 . tcp . 80 : goto service-LAUZTJTB-ns4/svc4/tcp/p80 }
-			add element ip kube-proxy service-ips { 192.168.99.33 . tcp . 80 : goto external-LAUZTJTB-ns4/svc4/tcp/p80 }
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "myset", Type: "ipv4_addr", Size: PtrTo[uint64](100)})
+	tx.Add(&Set{Name: "unbounded", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.2"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
 
-			# svc5
-			add set ip kube-proxy affinity-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 { type ipv4_addr ; flags dynamic,timeout ; timeout 10800s ; }
-			add rule ip kube-proxy service-HVFWP5L3-ns5/svc5/tcp/p80 ip daddr 172.30.0.45 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
-			add rule ip kube-proxy service-HVFWP5L3-ns5/svc5/tcp/p80 ip saddr @affinity-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 goto endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80
-			add rule ip kube-proxy service-HVFWP5L3-ns5/svc5/tcp/p80 numgen random mod 1 vmap { 0 : goto endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 }
-			add rule ip kube-proxy external-HVFWP5L3-ns5/svc5/tcp/p80 jump mark-for-masquerade
-			add rule ip kube-proxy external-HVFWP5L3-ns5/svc5/tcp/p80 goto service-HVFWP5L3-ns5/svc5/tcp/p80
+	stats, err := fake.SetStats(context.Background(), "myset")
+	if err != nil {
+		t.Fatalf("unexpected error from SetStats: %v", err)
+	}
+	if diff := cmp.Diff(&SetStats{Elements: 2, Size: PtrTo[uint64](100)}, stats); diff != "" {
+		t.Errorf("unexpected stats:\n%s", diff)
+	}
 
-			add rule ip kube-proxy endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 ip saddr 10.180.0.3 jump mark-for-masquerade
-			add rule ip kube-proxy endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 update @affinity-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 { ip saddr }
-			add rule ip kube-proxy endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 meta l4proto tcp dnat to 10.180.0.3:80
+	stats, err = fake.SetStats(context.Background(), "unbounded")
+	if err != nil {
+		t.Fatalf("unexpected error from SetStats: %v", err)
+	}
+	if diff := cmp.Diff(&SetStats{}, stats); diff != "" {
+		t.Errorf("unexpected stats:\n%s", diff)
+	}
 
-			add rule ip kube-proxy firewall-HVFWP5L3-ns5/svc5/tcp/p80 ip saddr != { 203.0.113.0/25 } drop
+	if _, err := fake.SetStats(context.Background(), "nosuchset"); !IsNotFound(err) {
+		t.Errorf("expected NotFound error for nonexistent set, got %v", err)
+	}
+}
 
-			add element ip kube-proxy service-ips { 172.30.0.45 . tcp . 80 : goto service-HVFWP5L3-ns5/svc5/tcp/p80 }
-			add element ip kube-proxy service-ips { 5.6.7.8 . tcp . 80 : goto external-HVFWP5L3-ns5/svc5/tcp/p80 }
-			add element ip kube-proxy service-nodeports { tcp . 3002 : goto external-HVFWP5L3-ns5/svc5/tcp/p80 }
-			add element ip kube-proxy firewall-ips { 5.6.7.8 . tcp . 80 comment "ns5/svc5:p80" : goto firewall-HVFWP5L3-ns5/svc5/tcp/p80 }
+func TestFakeElementUpsert(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Chain{Name: "chain2"})
+	tx.Add(&Set{Name: "myset", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "mymap", Type: "ipv4_addr : verdict"})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.1"}, Comment: PtrTo("old")})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Map: "mymap", Key: []string{"10.0.0.1"}, Value: []string{"goto chain1"}, Comment: PtrTo("old")})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// Re-adding the elements with changed comments/values updates them in place
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.1"}, Comment: PtrTo("new")})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.2"}, Comment: PtrTo("added")})
+	tx.Add(&Element{Map: "mymap", Key: []string{"10.0.0.1"}, Value: []string{"goto chain2"}, Comment: PtrTo("new")})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain1
+		add chain ip kube-proxy chain2
+		add set ip kube-proxy myset { type ipv4_addr ; }
+		add map ip kube-proxy mymap { type ipv4_addr : verdict ; }
+		add element ip kube-proxy myset { 10.0.0.1 comment "new" }
+		add element ip kube-proxy myset { 10.0.0.2 comment "added" }
+		add element ip kube-proxy mymap { 10.0.0.1 comment "new" : goto chain2 }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump after re-adding elements:\n%s", diff)
+	}
+
+	// "create" of an existing element still fails, and doesn't modify it
+	tx = fake.NewTransaction()
+	tx.Create(&Element{Set: "myset", Key: []string{"10.0.0.1"}, Comment: PtrTo("newer")})
+	if err := fake.Run(context.Background(), tx); !IsAlreadyExists(err) {
+		t.Errorf("expected AlreadyExists error from create, got %v", err)
+	}
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump after failed create:\n%s", diff)
+	}
+}
+
+func TestFakeIntervalElements(t *testing.T) {
+	fake := NewFake(InetFamily, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Set{Name: "ranges4", Type: "ipv4_addr", Flags: []SetFlag{IntervalFlag}})
+	tx.Add(&Set{Name: "ranges6", Type: "ipv6_addr", Flags: []SetFlag{IntervalFlag}})
+	tx.Add(&Set{Name: "plain", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "portmap", Type: "ipv4_addr . inet_service : verdict", Flags: []SetFlag{IntervalFlag}})
+	tx.Add(&Element{Set: "ranges4", Key: []string{"10.0.0.0-10.0.0.255"}})
+	tx.Add(&Element{Set: "ranges4", Key: []string{"192.168.0.0/16"}})
+	tx.Add(&Element{Set: "ranges6", Key: []string{"fd00::1-fd00::ff"}})
+	tx.Add(&Element{Set: "ranges6", Key: []string{"2001:db8::/32"}})
+	tx.Add(&Element{Set: "plain", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Map: "portmap", Key: []string{"10.0.0.0/24", "1000-2000"}, Value: []string{"goto chain1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, tc := range []struct {
+		set      string
+		key      []string
+		expected []string
+	}{
+		{set: "ranges4", key: []string{"10.0.0.0-10.0.0.255"}, expected: []string{"10.0.0.0-10.0.0.255"}},
+		{set: "ranges4", key: []string{"10.0.0.0"}, expected: []string{"10.0.0.0-10.0.0.255"}},
+		{set: "ranges4", key: []string{"10.0.0.37"}, expected: []string{"10.0.0.0-10.0.0.255"}},
+		{set: "ranges4", key: []string{"10.0.0.255"}, expected: []string{"10.0.0.0-10.0.0.255"}},
+		{set: "ranges4", key: []string{"10.0.1.0"}, expected: nil},
+		{set: "ranges4", key: []string{"192.168.3.4"}, expected: []string{"192.168.0.0/16"}},
+		{set: "ranges4", key: []string{"::ffff:10.0.0.1"}, expected: []string{"10.0.0.0-10.0.0.255"}},
+		{set: "ranges6", key: []string{"fd00::80"}, expected: []string{"fd00::1-fd00::ff"}},
+		{set: "ranges6", key: []string{"fd00::100"}, expected: nil},
+		{set: "ranges6", key: []string{"2001:db8:1::1"}, expected: []string{"2001:db8::/32"}},
+		{set: "ranges6", key: []string{"10.0.0.1"}, expected: nil},
+		{set: "plain", key: []string{"10.0.0.1"}, expected: []string{"10.0.0.1"}},
+	} {
+		var elem *Element
+		if set := fake.Table.Sets[tc.set]; set != nil {
+			elem = set.FindElement(tc.key...)
+		}
+		if elem == nil && tc.expected != nil {
+			t.Errorf("expected to find %v in %s, got nil", tc.key, tc.set)
+		} else if elem != nil && !reflect.DeepEqual(elem.Key, tc.expected) {
+			t.Errorf("expected to find %v for %v in %s, got %v", tc.expected, tc.key, tc.set, elem.Key)
+		}
+	}
+
+	// A non-interval set only does exact matching
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "plain", Key: []string{"10.0.0.0-10.0.0.255"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if elem := fake.Table.Sets["plain"].FindElement("10.0.0.2"); elem != nil {
+		t.Errorf("expected no interval matching in non-interval set, got %v", elem.Key)
+	}
+
+	elem := fake.Table.Maps["portmap"].FindElement("10.0.0.5", "1500")
+	if elem == nil || !reflect.DeepEqual(elem.Value, []string{"goto chain1"}) {
+		t.Errorf("expected to find concatenated range element, got %+v", elem)
+	}
+	if elem := fake.Table.Maps["portmap"].FindElement("10.0.0.5", "2001"); elem != nil {
+		t.Errorf("expected no match for out-of-range port, got %v", elem.Key)
+	}
+}
+
+func TestFakeCTExpectations(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "prerouting"})
+	tx.Add(&CTExpectation{Name: "exp", Protocol: "tcp", DPort: 8888, Timeout: time.Hour, Size: 12, L3Proto: PtrTo(IPv4Family)})
+	tx.Add(&Rule{Chain: "prerouting", Rule: "tcp dport 8888 ct expectation set @exp"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expectations, err := fake.ListCTExpectations(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListCTExpectations: %v", err)
+	}
+	handle := *fake.Table.CTExpectations["exp"].Handle
+	expected := []*CTExpectation{
+		{
+			Name:     "exp",
+			Protocol: "tcp",
+			DPort:    8888,
+			Timeout:  time.Hour,
+			Size:     12,
+			L3Proto:  PtrTo(IPv4Family),
+			Handle:   PtrTo(handle),
+		},
+	}
+	if diff := cmp.Diff(expected, expectations); diff != "" {
+		t.Errorf("unexpected result from ListCTExpectations:\n%s", diff)
+	}
+
+	// Modifying the results of ListCTExpectations should not modify the fake
+	*expectations[0].L3Proto = IPv6Family
+	*expectations[0].Handle = handle + 100
+	if diff := cmp.Diff(expected[0], &fake.Table.CTExpectations["exp"].CTExpectation); diff != "" {
+		t.Errorf("modifying ListCTExpectations result modified the fake:\n%s", diff)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "prerouting", Rule: "tcp dport 8888 ct expectation set @other"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error for missing ct expectation, got %v", err)
+	}
+}
+
+func TestFakeSynproxies(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "prerouting"})
+	tx.Add(&Synproxy{Name: "syn", MSS: 1460, WScale: 7, Timestamp: PtrTo(true), SACKPerm: PtrTo(true)})
+	tx.Add(&Rule{Chain: "prerouting", Rule: "tcp dport 443 synproxy name @syn"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	synproxies, err := fake.ListSynproxies(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListSynproxies: %v", err)
+	}
+	handle := *fake.Table.Synproxies["syn"].Handle
+	expected := []*Synproxy{
+		{Name: "syn", MSS: 1460, WScale: 7, Timestamp: PtrTo(true), SACKPerm: PtrTo(true), Handle: PtrTo(handle)},
+	}
+	if diff := cmp.Diff(expected, synproxies); diff != "" {
+		t.Errorf("unexpected result from ListSynproxies:\n%s", diff)
+	}
+
+	// Modifying the results of ListSynproxies should not modify the fake
+	*synproxies[0].Timestamp = false
+	*synproxies[0].SACKPerm = false
+	*synproxies[0].Handle = handle + 100
+	if diff := cmp.Diff(expected[0], &fake.Table.Synproxies["syn"].Synproxy); diff != "" {
+		t.Errorf("modifying ListSynproxies result modified the fake:\n%s", diff)
+	}
+
+	for _, rule := range []string{
+		"tcp dport 443 synproxy name @other",
+		`tcp dport 443 synproxy name "other"`,
+	} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "prerouting", Rule: rule})
+		err = fake.Run(context.Background(), tx)
+		if err == nil || !IsNotFound(err) {
+			t.Errorf("expected not-found error for %q, got %v", rule, err)
+		}
+	}
+}
+
+func TestFakeFlowtableRefs(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "forward"})
+	tx.Add(&Flowtable{Name: "ft", Priority: PtrTo(FilterIngressPriority), Devices: []string{"eth0"}})
+	tx.Add(&Set{Name: "seen", Type: "ipv4_addr", Flags: []SetFlag{DynamicFlag}})
+	tx.Add(&Rule{Chain: "forward", Rule: "ip protocol tcp flow add @ft"})
+	tx.Add(&Rule{Chain: "forward", Rule: "ip protocol udp flow offload @ft"})
+	tx.Add(&Rule{Chain: "forward", Rule: "add @seen { ip saddr }"})
+	tx.Add(&Rule{Chain: "forward", Rule: "tcp flags syn synproxy name @sp"})
+	err := fake.Run(context.Background(), tx)
+	if err == nil || !strings.Contains(err.Error(), `no such synproxy "sp"`) {
+		t.Fatalf("expected error about missing synproxy, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "forward"})
+	tx.Add(&Flowtable{Name: "ft", Priority: PtrTo(FilterIngressPriority), Devices: []string{"eth0"}})
+	tx.Add(&Set{Name: "seen", Type: "ipv4_addr", Flags: []SetFlag{DynamicFlag}})
+	tx.Add(&Synproxy{Name: "sp", MSS: 1460, WScale: 7})
+	tx.Add(&Rule{Chain: "forward", Rule: "ip protocol tcp flow add @ft"})
+	tx.Add(&Rule{Chain: "forward", Rule: "ip protocol udp flow offload @ft"})
+	tx.Add(&Rule{Chain: "forward", Rule: "add @seen { ip saddr }"})
+	tx.Add(&Rule{Chain: "forward", Rule: "tcp flags syn synproxy name @sp"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, tc := range []struct {
+		rule string
+		err  string
+	}{
+		{"flow add @other", `no such flowtable "other"`},
+		{"flow offload @other", `no such flowtable "other"`},
+		{"add @ft { ip saddr }", `no such set "ft"`},
+	} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "forward", Rule: tc.rule})
+		err = fake.Run(context.Background(), tx)
+		if err == nil || !IsNotFound(err) || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected not-found error %q for %q, got %v", tc.err, tc.rule, err)
+		}
+	}
+}
+
+func TestFakeInterfaceSets(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "forward"})
+	tx.Add(&Set{Name: "egress-ifaces", Type: "ifname"})
+	tx.Add(&Set{Name: "ingress-ifaces", Type: "ifname"})
+	tx.Add(&Rule{Chain: "forward", Rule: "oifname @egress-ifaces accept"})
+	tx.Add(&Rule{Chain: "forward", Rule: "meta oifname != @egress-ifaces drop"})
+	tx.Add(&Rule{Chain: "forward", Rule: "iifname @ingress-ifaces oifname @egress-ifaces accept"})
+	tx.Add(&Element{Set: "egress-ifaces", Key: []string{`"eth0"`}})
+	tx.Add(&Element{Set: "egress-ifaces", Key: []string{`"veth*"`}, Comment: PtrTo("pod interfaces")})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, tc := range []struct {
+		rule string
+		err  string
+	}{
+		{"oifname @nosuchset accept", `no such set "nosuchset"`},
+		{"meta iifname @nosuchset accept", `no such set "nosuchset"`},
+		{"iifname @ingress-ifaces oifname @nosuchset accept", `no such set "nosuchset"`},
+	} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "forward", Rule: tc.rule})
+		err := fake.Run(context.Background(), tx)
+		if err == nil || !IsNotFound(err) || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected not-found error %q for %q, got %v", tc.err, tc.rule, err)
+		}
+	}
+
+	// Make sure the quoted elements survive a round trip through Dump and ParseDump
+	dump := fake.Dump()
+	fake2 := NewFake(IPv4Family, "kube-proxy")
+	if err := fake2.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	elements, err := fake2.ListElements(context.Background(), "set", "egress-ifaces")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	expected := []*Element{
+		{Set: "egress-ifaces", Key: []string{`"eth0"`}},
+		{Set: "egress-ifaces", Key: []string{`"veth*"`}, Comment: PtrTo("pod interfaces")},
+	}
+	if diff := cmp.Diff(expected, elements); diff != "" {
+		t.Errorf("unexpected elements after round trip:\n%s", diff)
+	}
+}
+
+func TestFakeMeterRules(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "input"})
+	tx.Add(&Chain{Name: "flood"})
+	tx.Add(&Set{Name: "allowed", Type: "ipv4_addr"})
+	tx.Add(&Rule{Chain: "input", Rule: "tcp flags syn meter flood size 65535 { ip saddr limit rate 10/second } accept"})
+	tx.Add(&Rule{Chain: "input", Rule: "meter flood { ip saddr . @th,16,16 limit rate over 10/second } jump flood"})
+	tx.Add(&Rule{Chain: "input", Rule: "ip saddr != @allowed meter flood size 1024 { ip saddr timeout 10s limit rate 5/second } drop"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, tc := range []struct {
+		rule string
+		err  string
+	}{
+		{"meter flood { ip saddr limit rate 10/second } jump nosuchchain", `no such chain "nosuchchain"`},
+		{"ip saddr @nosuchset meter flood { ip saddr limit rate 10/second } drop", `no such set "nosuchset"`},
+	} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "input", Rule: tc.rule})
+		err := fake.Run(context.Background(), tx)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error %q for %q, got %v", tc.err, tc.rule, err)
+		}
+	}
+}
+
+func TestFakeVmapRules(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	fake.StrictRuleValidation = true
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "services"})
+	tx.Add(&Chain{Name: "service-a"})
+	tx.Add(&Chain{Name: "service-b"})
+	tx.Add(&Set{Name: "service-set", Type: "ipv4_addr . inet_proto . inet_service"})
+	tx.Add(&Map{Name: "service-ips", Type: "ipv4_addr . inet_proto . inet_service : verdict"})
+	tx.Add(&Rule{Chain: "services", Rule: "ip daddr . meta l4proto . th dport vmap @service-ips"})
+	tx.Add(&Rule{Chain: "services", Rule: "tcp dport vmap { 80 : goto service-a, 443 : jump service-b }"})
+	tx.Add(&Rule{Chain: "services", Rule: "udp dport vmap {53: jump service-a, 5353: drop}"})
+	tx.Add(&Rule{Chain: "services", Rule: "meta l4proto vmap { tcp : jump service-a, udp : accept } comment \"goto nowhere\""})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, tc := range []struct {
+		rule string
+		err  string
+	}{
+		{"ip daddr . meta l4proto . th dport vmap @nosuchmap", `no such map "nosuchmap"`},
+		{"ip daddr . meta l4proto . th dport vmap @service-set", `no such map "service-set"`},
+		{"tcp dport vmap { 80 : goto service-a, 443 : jump nosuchchain }", `no such chain "nosuchchain"`},
+		{"tcp dport vmap { 80 : goto nosuchchain, 443 : jump service-b }", `no such chain "nosuchchain"`},
+		{"tcp dport vmap", "vmap must be followed by @name or an anonymous map"},
+	} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "services", Rule: tc.rule})
+		err := fake.Run(context.Background(), tx)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error %q for %q, got %v", tc.err, tc.rule, err)
+		}
+	}
+}
+
+func TestFakeLimitRules(t *testing.T) {
+	dump := dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy input
+		add set ip kube-proxy allowed { type ipv4_addr ; }
+		add rule ip kube-proxy input ip saddr @allowed limit rate 400/hour accept
+		add rule ip kube-proxy input tcp dport 22 limit rate over 10/second burst 5 packets drop
+		add rule ip kube-proxy input limit rate over 1 mbytes/second burst 512 kbytes counter drop
+		add rule ip kube-proxy input ip saddr 10.0.0.0/8 limit rate 1/minute log prefix "throttled: " comment "log throttling"
+		add rule ip kube-proxy input limit rate over 5/day burst 2 packets log prefix "@allowed jump input " drop
+		`)
+
+	fake := NewFake(IPv4Family, "kube-proxy")
+	fake.StrictRuleValidation = true
+	if err := fake.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+
+	rules, err := fake.ListRules(context.Background(), "input")
+	if err != nil {
+		t.Fatalf("unexpected error from ListRules: %v", err)
+	}
+	if len(rules) != 5 {
+		t.Fatalf("expected 5 rules, got %d", len(rules))
+	}
+	if rules[3].Rule != `ip saddr 10.0.0.0/8 limit rate 1/minute log prefix "throttled: "` {
+		t.Errorf("unexpected rule text %q", rules[3].Rule)
+	}
+	if rules[3].Comment == nil || *rules[3].Comment != "log throttling" {
+		t.Errorf("unexpected rule comment %v", rules[3].Comment)
+	}
+
+	if diff := cmp.Diff(strings.TrimPrefix(dump, "\n"), fake.Dump()); diff != "" {
+		t.Errorf("limit rules did not round-trip:\n%s", diff)
+	}
+}
+
+func TestFakeMonitor(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := fake.Monitor(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error from Monitor: %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// Failed transactions and Check() should not generate events
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{Name: "chain2"})
+	tx.Delete(&Set{Name: "nosuchset"})
+	if err := fake.Run(context.Background(), tx); err == nil {
+		t.Fatalf("unexpected lack of error from Run")
+	}
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{Name: "chain2"})
+	if err := fake.Check(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Check: %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Flush(&Chain{Name: "chain"})
+	tx.Delete(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expected := []*Event{
+		{Type: AddEvent, Object: &Table{Handle: PtrTo(1)}},
+		{Type: AddEvent, Object: &Chain{Name: "chain", Handle: PtrTo(2)}},
+		{Type: AddEvent, Object: &Rule{Chain: "chain", Handle: PtrTo(3)}},
+		{Type: AddEvent, Object: &Set{Name: "set", Type: "ipv4_addr", Handle: PtrTo(4)}},
+		{Type: AddEvent, Object: &Element{Set: "set", Key: []string{"10.0.0.1"}}},
+		{Type: DeleteEvent, Object: &Rule{Chain: "chain", Handle: PtrTo(3)}},
+		{Type: DeleteEvent, Object: &Element{Set: "set", Key: []string{"10.0.0.1"}}},
+	}
+	var got []*Event
+	for range expected {
+		got = append(got, <-events)
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected events:\n%s", diff)
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("expected channel to be closed after cancel")
+	}
+}
+
+func TestFakeElementTimeouts(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{
+		Name:  "affinity",
+		Type:  "ipv4_addr",
+		Flags: []SetFlag{DynamicFlag, TimeoutFlag},
+	})
+	tx.Add(&Element{
+		Set:     "affinity",
+		Key:     []string{"10.0.0.1"},
+		Timeout: PtrTo(3 * time.Hour),
+	})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	set := fake.Table.Sets["affinity"]
+	elem := set.FindElement("10.0.0.1")
+	if elem == nil {
+		t.Fatalf("could not find element with timeout")
+	}
+	if elem.Timeout == nil || *elem.Timeout != 3*time.Hour {
+		t.Errorf("expected element timeout to be preserved, got %v", elem.Timeout)
+	}
+
+	// Re-adding with a different timeout should update the existing element, and
+	// deleting should not require the timeout to match.
+	tx = fake.NewTransaction()
+	tx.Add(&Element{
+		Set:     "affinity",
+		Key:     []string{"10.0.0.1"},
+		Timeout: PtrTo(time.Minute),
+	})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	set = fake.Table.Sets["affinity"]
+	if len(set.Elements) != 1 || *set.Elements[0].Timeout != time.Minute {
+		t.Errorf("expected element to be updated, got %+v", set.Elements)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&Element{
+		Set: "affinity",
+		Key: []string{"10.0.0.1"},
+	})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	set = fake.Table.Sets["affinity"]
+	if len(set.Elements) != 0 {
+		t.Errorf("expected element to be deleted, got %+v", set.Elements)
+	}
+}
+
+func TestFakeListSetsAndMaps(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	// A missing table is not an error
+	sets, err := fake.ListSets(context.Background())
+	if err != nil || len(sets) != 0 {
+		t.Errorf("expected no sets and no error but got %v, %v", sets, err)
+	}
+	maps, err := fake.ListMaps(context.Background())
+	if err != nil || len(maps) != 0 {
+		t.Errorf("expected no maps and no error but got %v, %v", maps, err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{
+		Name:    "set2",
+		Type:    "ipv4_addr",
+		Flags:   []SetFlag{DynamicFlag, TimeoutFlag},
+		Timeout: PtrTo(3 * time.Hour),
+	})
+	tx.Add(&Set{
+		Name:    "set1",
+		Type:    "ipv4_addr . inet_proto . inet_service",
+		Comment: PtrTo("a set"),
+	})
+	tx.Add(&Element{
+		Set: "set1",
+		Key: []string{"10.0.0.1", "tcp", "80"},
+	})
+	tx.Add(&Map{
+		Name:   "map1",
+		Type:   "ipv4_addr : verdict",
+		Size:   PtrTo[uint64](100),
+		Policy: PtrTo(MemoryPolicy),
+	})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	sets, err = fake.ListSets(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListSets: %v", err)
+	}
+	expectedSets := []*Set{
+		{
+			Name:    "set1",
+			Type:    "ipv4_addr . inet_proto . inet_service",
+			Comment: PtrTo("a set"),
+			Handle:  fake.Table.Sets["set1"].Handle,
+		},
+		{
+			Name:    "set2",
+			Type:    "ipv4_addr",
+			Flags:   []SetFlag{DynamicFlag, TimeoutFlag},
+			Timeout: PtrTo(3 * time.Hour),
+			Handle:  fake.Table.Sets["set2"].Handle,
+		},
+	}
+	if diff := cmp.Diff(expectedSets, sets); diff != "" {
+		t.Errorf("unexpected result from ListSets:\n%s", diff)
+	}
+
+	maps, err = fake.ListMaps(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListMaps: %v", err)
+	}
+	expectedMaps := []*Map{
+		{
+			Name:   "map1",
+			Type:   "ipv4_addr : verdict",
+			Size:   PtrTo[uint64](100),
+			Policy: PtrTo(MemoryPolicy),
+			Handle: fake.Table.Maps["map1"].Handle,
+		},
+	}
+	if diff := cmp.Diff(expectedMaps, maps); diff != "" {
+		t.Errorf("unexpected result from ListMaps:\n%s", diff)
+	}
+
+	// The returned objects should be (deep) copies
+	*sets[0].Comment = "modified"
+	if *fake.Table.Sets["set1"].Comment != "a set" {
+		t.Errorf("modifying ListSets result modified the fake")
+	}
+	sets[1].Flags[0] = IntervalFlag
+	if fake.Table.Sets["set2"].Flags[0] != DynamicFlag {
+		t.Errorf("modifying ListSets result modified the fake")
+	}
+	*maps[0].Size = 1
+	if *fake.Table.Maps["map1"].Size != 100 {
+		t.Errorf("modifying ListMaps result modified the fake")
+	}
+}
+
+func TestFakeListChains(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	// A missing table is not an error
+	chains, err := fake.ListChains(context.Background())
+	if err != nil || len(chains) != 0 {
+		t.Errorf("expected no chains and no error but got %v, %v", chains, err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{
+		Name:     "prerouting",
+		Type:     PtrTo(NATType),
+		Hook:     PtrTo(PreroutingHook),
+		Priority: PtrTo(DNATPriority),
+	})
+	tx.Add(&Chain{
+		Name:    "chain",
+		Comment: PtrTo("a chain"),
+	})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	chains, err = fake.ListChains(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListChains: %v", err)
+	}
+	expected := []*Chain{
+		{
+			Name:    "chain",
+			Comment: PtrTo("a chain"),
+			Handle:  fake.Table.Chains["chain"].Handle,
+		},
+		{
+			Name:     "prerouting",
+			Type:     PtrTo(NATType),
+			Hook:     PtrTo(PreroutingHook),
+			Priority: PtrTo(DNATPriority),
+			Handle:   fake.Table.Chains["prerouting"].Handle,
+		},
+	}
+	if diff := cmp.Diff(expected, chains); diff != "" {
+		t.Errorf("unexpected result from ListChains:\n%s", diff)
+	}
+
+	// The returned objects should be (deep) copies
+	*chains[0].Comment = "modified"
+	if *fake.Table.Chains["chain"].Comment != "a chain" {
+		t.Errorf("modifying ListChains result modified the fake")
+	}
+	*chains[1].Priority = SNATPriority
+	if *fake.Table.Chains["prerouting"].Priority != DNATPriority {
+		t.Errorf("modifying ListChains result modified the fake")
+	}
+}
+
+func TestFakeGetObjects(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	_, err := fake.GetTable(context.Background())
+	if !IsNotFound(err) {
+		t.Errorf("expected table not found error but got: %v", err)
+	}
+	_, err = fake.GetChain(context.Background(), "chain")
+	if !IsNotFound(err) {
+		t.Errorf("expected chain not found error but got: %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{Comment: PtrTo("a table")})
+	tx.Add(&Chain{
+		Name:     "filter-input",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority),
+	})
+	tx.Add(&Set{
+		Name:  "set1",
+		Type:  "ipv4_addr",
+		Flags: []SetFlag{IntervalFlag},
+	})
+	tx.Add(&Map{
+		Name: "map1",
+		Type: "ipv4_addr : verdict",
+	})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	table, err := fake.GetTable(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from GetTable: %v", err)
+	}
+	if diff := cmp.Diff(&fake.Table.Table, table); diff != "" {
+		t.Errorf("unexpected result from GetTable:\n%s", diff)
+	}
+
+	chain, err := fake.GetChain(context.Background(), "filter-input")
+	if err != nil {
+		t.Fatalf("unexpected error from GetChain: %v", err)
+	}
+	expectedChain := &Chain{
+		Name:     "filter-input",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority),
+		Handle:   fake.Table.Chains["filter-input"].Handle,
+	}
+	if diff := cmp.Diff(expectedChain, chain); diff != "" {
+		t.Errorf("unexpected result from GetChain:\n%s", diff)
+	}
+
+	set, err := fake.GetSet(context.Background(), "set1")
+	if err != nil {
+		t.Fatalf("unexpected error from GetSet: %v", err)
+	}
+	expectedSet := &Set{
+		Name:   "set1",
+		Type:   "ipv4_addr",
+		Flags:  []SetFlag{IntervalFlag},
+		Handle: fake.Table.Sets["set1"].Handle,
+	}
+	if diff := cmp.Diff(expectedSet, set); diff != "" {
+		t.Errorf("unexpected result from GetSet:\n%s", diff)
+	}
+
+	mapObj, err := fake.GetMap(context.Background(), "map1")
+	if err != nil {
+		t.Fatalf("unexpected error from GetMap: %v", err)
+	}
+	expectedMap := &Map{
+		Name:   "map1",
+		Type:   "ipv4_addr : verdict",
+		Handle: fake.Table.Maps["map1"].Handle,
+	}
+	if diff := cmp.Diff(expectedMap, mapObj); diff != "" {
+		t.Errorf("unexpected result from GetMap:\n%s", diff)
+	}
+
+	for name, get := range map[string]func() error{
+		"chain": func() error { _, err := fake.GetChain(context.Background(), "nosuch"); return err },
+		"set":   func() error { _, err := fake.GetSet(context.Background(), "nosuch"); return err },
+		"map":   func() error { _, err := fake.GetMap(context.Background(), "nosuch"); return err },
+	} {
+		if err := get(); !IsNotFound(err) {
+			t.Errorf("expected %s not found error but got: %v", name, err)
+		}
+	}
+
+	// The returned objects should be (deep) copies
+	*table.Comment = "modified"
+	if *fake.Table.Comment != "a table" {
+		t.Errorf("modifying GetTable result modified the fake")
+	}
+	chain.Name = "modified"
+	*chain.Hook = OutputHook
+	if fake.Table.Chains["filter-input"].Name != "filter-input" || *fake.Table.Chains["filter-input"].Hook != InputHook {
+		t.Errorf("modifying GetChain result modified the fake")
+	}
+	set.Flags[0] = TimeoutFlag
+	if fake.Table.Sets["set1"].Flags[0] != IntervalFlag {
+		t.Errorf("modifying GetSet result modified the fake")
+	}
+	*mapObj.Handle = -1
+	if *fake.Table.Maps["map1"].Handle == -1 {
+		t.Errorf("modifying GetMap result modified the fake")
+	}
+}
+
+func assertRules(t *testing.T, fake *Fake, expected ...string) {
+	t.Helper()
+
+	actual, err := fake.ListRules(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("could not ListRules: %v", err)
+	}
+
+	if len(actual) != len(expected) {
+		t.Errorf("expected %d rules, got %d", len(expected), len(actual))
+	}
+
+	for i := range expected {
+		if i == len(actual) {
+			break
+		}
+		if actual[i].Rule != expected[i] {
+			t.Errorf("expected rule %d to be %q but got %q", i+1, expected[i], actual[i].Rule)
+		}
+		if actual[i].Index == nil || *actual[i].Index != i {
+			t.Errorf("expected rule %d to have index %d but got %v", i+1, i, actual[i].Index)
+		}
+	}
+
+	rulesByHandle := make(map[int][]string)
+	for _, r := range actual {
+		rulesByHandle[*r.Handle] = append(rulesByHandle[*r.Handle], r.Rule)
+	}
+	for handle, rules := range rulesByHandle {
+		if len(rules) > 1 {
+			t.Errorf("multiple rules for handle %d: %v", handle, rules)
+		}
+	}
+}
+
+func TestFakeHasRule(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if _, err := fake.HasRule(ctx, "chain", "drop"); !IsNotFound(err) {
+		t.Errorf("expected not-found error with no table, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.1  drop", Comment: PtrTo("comment")})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop "})
+	tx.Add(&Rule{Chain: "chain", Rule: "tcp dport 80 counter packets 3 bytes 180 accept"})
+	if err := fake.Run(ctx, tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, tc := range []struct {
+		rule     string
+		expected bool
+	}{
+		{"ip daddr 10.0.0.1 drop", true},
+		{"drop", true},
+		{" drop", true},
+		{"ip daddr 10.0.0.2 drop", false},
+		{"accept", false},
+		{"tcp dport 80 counter accept", true},
+		{"tcp dport 80 counter packets 0 bytes 0 accept", true},
+		{"tcp dport 80 accept", false},
+	} {
+		found, err := fake.HasRule(ctx, "chain", tc.rule)
+		if err != nil {
+			t.Errorf("unexpected error from HasRule(%q): %v", tc.rule, err)
+		} else if found != tc.expected {
+			t.Errorf("expected HasRule(%q) to return %v, got %v", tc.rule, tc.expected, found)
+		}
+	}
+
+	if _, err := fake.HasRule(ctx, "nosuchchain", "drop"); !IsNotFound(err) {
+		t.Errorf("expected not-found error for nonexistent chain, got %v", err)
+	}
+}
+
+func TestFakeAddInsertReplace(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	_, err = fake.ListRules(context.Background(), "test")
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected chain not found but got: %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{
+		Name: "test",
+	})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertRules(t, fake /* no rules */)
+
+	// Test basic Add
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{
+		Chain: "test",
+		Rule:  "first",
+	})
+	tx.Add(&Rule{
+		Chain: "test",
+		Rule:  "second",
+	})
+	tx.Add(&Rule{
+		Chain: "test",
+		Rule:  "third",
+	})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertRules(t, fake, "first", "second", "third")
+
+	// (can't fail: we just did this in assertRules)
+	rules, _ := fake.ListRules(context.Background(), "test")
+	firstHandle := *rules[0].Handle
+	secondHandle := *rules[1].Handle
+	thirdHandle := *rules[2].Handle
+
+	// Test Add with Handle or Index
+	tx = fake.NewTransaction()
+	// Should go after "second"
+	tx.Add(&Rule{
+		Chain: "test",
+		Rule:  "fourth",
+		Index: PtrTo(1),
+	})
+	// Should go after "first"
+	tx.Add(&Rule{
+		Chain:  "test",
+		Rule:   "fifth",
+		Handle: PtrTo(firstHandle),
+	})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertRules(t, fake, "first", "fifth", "second", "fourth", "third")
+
+	// Test Insert
+	tx = fake.NewTransaction()
+	// Should go first
+	tx.Insert(&Rule{
+		Chain: "test",
+		Rule:  "sixth",
+	})
+	// Should go before "second"
+	tx.Insert(&Rule{
+		Chain:  "test",
+		Rule:   "seventh",
+		Handle: PtrTo(secondHandle),
+	})
+	// Should go before "fourth". ("fourth" was rule[3] before this
+	// transaction and the previous two operations added two more rules
+	// before it, so it should now have index 5.)
+	tx.Insert(&Rule{
+		Chain: "test",
+		Rule:  "eighth",
+		Index: PtrTo(5),
+	})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertRules(t, fake, "sixth", "first", "fifth", "seventh", "second", "eighth", "fourth", "third")
+
+	// Test Replace. And Delete while we're here... the chain is getting kind of long
+	tx = fake.NewTransaction()
+
+	tx.Replace(&Rule{
+		Chain:  "test",
+		Rule:   "ninth",
+		Handle: PtrTo(secondHandle),
+	})
+	tx.Delete(&Rule{
+		Chain:  "test",
+		Handle: PtrTo(firstHandle),
+	})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertRules(t, fake, "sixth", "fifth", "seventh", "ninth", "eighth", "fourth", "third")
+
+	// Re-fetch handles; Replace should not have changed the handle for its rule.
+	// (can't fail: we just did this in assertRules)
+	rules, _ = fake.ListRules(context.Background(), "test")
+	if *rules[3].Handle != secondHandle {
+		t.Errorf("Replace changed the rule handle: expected %d got %d", secondHandle, *rules[3].Handle)
+	}
+	if *rules[6].Handle != thirdHandle {
+		t.Errorf("Handle for original third rule changed? expected %d got %d", thirdHandle, *rules[6].Handle)
+	}
+
+	// Test edge cases
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{
+		Chain: "test",
+		Rule:  "tenth",
+		Index: PtrTo(len(rules) - 1),
+	})
+	tx.Insert(&Rule{
+		Chain: "test",
+		Rule:  "eleventh",
+		Index: PtrTo(len(rules)),
+	})
+	tx.Add(&Rule{
+		Chain: "test",
+		Rule:  "twelfth",
+		Index: PtrTo(0),
+	})
+	tx.Insert(&Rule{
+		Chain: "test",
+		Rule:  "thirteenth",
+		Index: PtrTo(0),
+	})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertRules(t, fake, "thirteenth", "sixth", "twelfth", "fifth", "seventh", "ninth", "eighth", "fourth", "third", "eleventh", "tenth")
+
+	// Rules returned from ListRules (which have both Index and Handle set) can be
+	// passed back to Replace and Delete.
+	rules, _ = fake.ListRules(context.Background(), "test")
+	tx = fake.NewTransaction()
+	replaced := *rules[2]
+	replaced.Rule = "fourteenth"
+	tx.Replace(&replaced)
+	tx.Delete(rules[0])
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertRules(t, fake, "sixth", "fourteenth", "fifth", "seventh", "ninth", "eighth", "fourth", "third", "eleventh", "tenth")
+}
+
+func TestFakeParseDump(t *testing.T) {
+	for _, tc := range []struct {
+		ipFamily Family
+		dump     string
+		// expected is the expected output of Dump(), if it differs from dump
+		expected string
+	}{
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add flowtable ip kube-proxy myflowtable { hook ingress priority filter ; devices = { eth0, eth1 } ; }
+			add chain ip kube-proxy anotherchain
+			add chain ip kube-proxy chain { comment "foo" ; }
+			add map ip kube-proxy map1 { type ipv4_addr . inet_proto . inet_service ; }
+			add set ip kube-proxy set1 { type ipv4_addr . inet_proto . inet_service ; flags dynamic ; gc-interval 15s ; policy memory ; auto-merge ; }
+			add rule ip kube-proxy anotherchain ip saddr 1.2.3.4 drop comment "drop rule"
+			add rule ip kube-proxy anotherchain ip daddr 5.6.7.8 reject comment "reject rule"
+			add rule ip kube-proxy chain ip daddr 10.0.0.0/8 drop
+			add rule ip kube-proxy chain masquerade comment "comment"
+			add element ip kube-proxy map1 { 192.168.0.1 . tcp . 80 : drop }
+			add element ip kube-proxy map1 { 192.168.0.2 . tcp . 443 comment "with a comment" : goto anotherchain }
+			add set ip kube-proxy set2 { type ipv4_addr ; flags dynamic,timeout ; timeout 3600s ; }
+			add element ip kube-proxy set2 { 10.0.0.1 timeout 30s }
+			add element ip kube-proxy set2 { 10.0.0.2 timeout 1800s expires 29s comment "with a comment" }
+			add ct helper ip kube-proxy ftp-helper { type "ftp" protocol tcp ; }
+			add ct helper ip kube-proxy sip-helper { type "sip" protocol udp ; l3proto ip ; }
+			add map ip kube-proxy map2 { type ipv4_addr : ipv4_addr ; flags dynamic,timeout ; timeout 60s ; size 128 ; }
+			add map ip kube-proxy map3 { type ipv4_addr : verdict ; flags interval ; gc-interval 30s ; policy memory ; comment "map with policy" ; }
+			add element ip kube-proxy map2 { 10.0.0.1 timeout 30s : 192.168.0.1 }
+			add ct timeout ip kube-proxy ct-time { protocol tcp ; policy = { close : 10, established : 120 } ; }
+			add rule ip kube-proxy chain tcp dport 8080 ct timeout set @ct-time
+			add ct expectation ip kube-proxy exp { protocol tcp ; dport 8888 ; timeout 3600s ; size 12 ; }
+			add ct expectation ip kube-proxy exp6 { protocol udp ; dport 5060 ; timeout 60s ; size 1 ; l3proto ip ; }
+			add rule ip kube-proxy chain tcp dport 8888 ct expectation set @exp
+			add synproxy ip kube-proxy syn { mss 1460 wscale 7 timestamp sack-perm ; }
+			add synproxy ip kube-proxy syn2 { mss 1400 wscale 5 ; }
+			add rule ip kube-proxy chain tcp dport 443 synproxy name @syn
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy { flags dormant ; }
+			add chain ip kube-proxy filter-prerouting { type filter hook prerouting priority -100 ; policy drop ; }
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add chain ip kube-proxy chain
+			add set ip kube-proxy s { typeof ip saddr ; }
+			add set ip kube-proxy s2 { typeof ip daddr . tcp dport ; flags interval ; }
+			add map ip kube-proxy m { typeof ip saddr : meta mark ; }
+			add map ip kube-proxy m2 { typeof ip daddr . tcp dport : verdict ; }
+			add element ip kube-proxy s { 10.0.0.1 }
+			add element ip kube-proxy s2 { 10.0.0.0/8 . 80 }
+			add element ip kube-proxy m { 10.0.0.1 : 0x4000 }
+			add element ip kube-proxy m2 { 10.0.0.1 . 443 : goto chain }
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy { comment "rules for kube-proxy" ; }
+			add chain ip kube-proxy mark-for-masquerade
+			add chain ip kube-proxy masquerading
+			add chain ip kube-proxy services
+			add chain ip kube-proxy firewall-check
+			add chain ip kube-proxy endpoints-check
+			add chain ip kube-proxy filter-prerouting { type filter hook prerouting priority -110 ; }
+			add chain ip kube-proxy filter-forward { type filter hook forward priority -110 ; }
+			add chain ip kube-proxy filter-input { type filter hook input priority -110 ; }
+			add chain ip kube-proxy filter-output { type filter hook output priority -110 ; }
+			add chain ip kube-proxy nat-output { type nat hook output priority -100 ; }
+			add chain ip kube-proxy nat-postrouting { type nat hook postrouting priority 100 ; }
+			add chain ip kube-proxy nat-prerouting { type nat hook prerouting priority -100 ; }
+			add chain ip kube-proxy reject-chain { comment "helper for @no-endpoint-services / @no-endpoint-nodeports" ; }
+			add chain ip kube-proxy service-ULMVA6XW-ns1/svc1/tcp/p80
+			add chain ip kube-proxy endpoint-5OJB2KTY-ns1/svc1/tcp/p80__10.180.0.1/80
+			add chain ip kube-proxy service-42NFTM6N-ns2/svc2/tcp/p80
+			add chain ip kube-proxy endpoint-SGOXE6O3-ns2/svc2/tcp/p80__10.180.0.2/80
+			add chain ip kube-proxy external-42NFTM6N-ns2/svc2/tcp/p80
+			add chain ip kube-proxy service-4AT6LBPK-ns3/svc3/tcp/p80
+			add chain ip kube-proxy endpoint-UEIP74TE-ns3/svc3/tcp/p80__10.180.0.3/80
+			add chain ip kube-proxy external-4AT6LBPK-ns3/svc3/tcp/p80
+			add chain ip kube-proxy service-LAUZTJTB-ns4/svc4/tcp/p80
+			add chain ip kube-proxy endpoint-UNZV3OEC-ns4/svc4/tcp/p80__10.180.0.4/80
+			add chain ip kube-proxy endpoint-5RFCDDV7-ns4/svc4/tcp/p80__10.180.0.5/80
+			add chain ip kube-proxy external-LAUZTJTB-ns4/svc4/tcp/p80
+			add chain ip kube-proxy service-HVFWP5L3-ns5/svc5/tcp/p80
+			add chain ip kube-proxy external-HVFWP5L3-ns5/svc5/tcp/p80
+			add chain ip kube-proxy endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80
+			add chain ip kube-proxy firewall-HVFWP5L3-ns5/svc5/tcp/p80
+
+			add rule ip kube-proxy mark-for-masquerade mark set mark or 0x4000
+			add rule ip kube-proxy masquerading mark and 0x4000 == 0 return
+			add rule ip kube-proxy masquerading mark set mark xor 0x4000
+			add rule ip kube-proxy masquerading masquerade fully-random
+			add rule ip kube-proxy filter-prerouting ct state new jump firewall-check
+			add rule ip kube-proxy filter-forward ct state new jump endpoints-check
+			add rule ip kube-proxy filter-input ct state new jump endpoints-check
+			add rule ip kube-proxy filter-output ct state new jump endpoints-check
+			add rule ip kube-proxy filter-output ct state new jump firewall-check
+			add rule ip kube-proxy nat-output jump services
+			add rule ip kube-proxy nat-postrouting jump masquerading
+			add rule ip kube-proxy nat-prerouting jump services
+
+			add map ip kube-proxy firewall-ips { type ipv4_addr . inet_proto . inet_service : verdict ; comment "destinations that are subject to LoadBalancerSourceRanges" ; }
+			add rule ip kube-proxy firewall-check ip daddr . meta l4proto . th dport vmap @firewall-ips
+
+			add rule ip kube-proxy reject-chain reject
+
+			add map ip kube-proxy no-endpoint-services { type ipv4_addr . inet_proto . inet_service : verdict ; comment "vmap to drop or reject packets to services with no endpoints" ; }
+			add map ip kube-proxy no-endpoint-nodeports { type inet_proto . inet_service : verdict ; comment "vmap to drop or reject packets to service nodeports with no endpoints" ; }
+
+			add rule ip kube-proxy endpoints-check ip daddr . meta l4proto . th dport vmap @no-endpoint-services
+			add rule ip kube-proxy endpoints-check fib daddr type local ip daddr != 127.0.0.0/8 meta l4proto . th dport vmap @no-endpoint-nodeports
+
+			add map ip kube-proxy service-ips { type ipv4_addr . inet_proto . inet_service : verdict ; comment "ClusterIP, ExternalIP and LoadBalancer IP traffic" ; }
+			add map ip kube-proxy service-nodeports { type inet_proto . inet_service : verdict ; comment "NodePort traffic" ; }
+			add rule ip kube-proxy services ip daddr . meta l4proto . th dport vmap @service-ips
+			add rule ip kube-proxy services fib daddr type local ip daddr != 127.0.0.0/8 meta l4proto . th dport vmap @service-nodeports
+
+			# svc1
+			add rule ip kube-proxy service-ULMVA6XW-ns1/svc1/tcp/p80 ip daddr 172.30.0.41 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
+			add rule ip kube-proxy service-ULMVA6XW-ns1/svc1/tcp/p80 numgen random mod 1 vmap { 0 : goto endpoint-5OJB2KTY-ns1/svc1/tcp/p80__10.180.0.1/80 }
+
+			add rule ip kube-proxy endpoint-5OJB2KTY-ns1/svc1/tcp/p80__10.180.0.1/80 ip saddr 10.180.0.1 jump mark-for-masquerade
+			add rule ip kube-proxy endpoint-5OJB2KTY-ns1/svc1/tcp/p80__10.180.0.1/80 meta l4proto tcp dnat to 10.180.0.1:80
+
+			add element ip kube-proxy service-ips { 172.30.0.41 . tcp . 80 : goto service-ULMVA6XW-ns1/svc1/tcp/p80 }
+
+			# svc2
+			add rule ip kube-proxy service-42NFTM6N-ns2/svc2/tcp/p80 ip daddr 172.30.0.42 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
+			add rule ip kube-proxy service-42NFTM6N-ns2/svc2/tcp/p80 numgen random mod 1 vmap { 0 : goto endpoint-SGOXE6O3-ns2/svc2/tcp/p80__10.180.0.2/80 }
+			add rule ip kube-proxy external-42NFTM6N-ns2/svc2/tcp/p80 ip saddr 10.0.0.0/8 goto service-42NFTM6N-ns2/svc2/tcp/p80 comment "short-circuit pod traffic"
+			add rule ip kube-proxy external-42NFTM6N-ns2/svc2/tcp/p80 fib saddr type local jump mark-for-masquerade comment "masquerade local traffic"
+			add rule ip kube-proxy external-42NFTM6N-ns2/svc2/tcp/p80 fib saddr type local goto service-42NFTM6N-ns2/svc2/tcp/p80 comment "short-circuit local traffic"
+			add rule ip kube-proxy endpoint-SGOXE6O3-ns2/svc2/tcp/p80__10.180.0.2/80 ip saddr 10.180.0.2 jump mark-for-masquerade
+			add rule ip kube-proxy endpoint-SGOXE6O3-ns2/svc2/tcp/p80__10.180.0.2/80 meta l4proto tcp dnat to 10.180.0.2:80
+
+			add element ip kube-proxy service-ips { 172.30.0.42 . tcp . 80 : goto service-42NFTM6N-ns2/svc2/tcp/p80 }
+			add element ip kube-proxy service-ips { 192.168.99.22 . tcp . 80 : goto external-42NFTM6N-ns2/svc2/tcp/p80 }
+			add element ip kube-proxy service-ips { 1.2.3.4 . tcp . 80 : goto external-42NFTM6N-ns2/svc2/tcp/p80 }
+			add element ip kube-proxy service-nodeports { tcp . 3001 : goto external-42NFTM6N-ns2/svc2/tcp/p80 }
+
+			add element ip kube-proxy no-endpoint-nodeports { tcp . 3001 comment "ns2/svc2:p80" : drop }
+			add element ip kube-proxy no-endpoint-services { 1.2.3.4 . tcp . 80 comment "ns2/svc2:p80" : drop }
+			add element ip kube-proxy no-endpoint-services { 192.168.99.22 . tcp . 80 comment "ns2/svc2:p80" : drop }
+
+			# svc3
+			add rule ip kube-proxy service-4AT6LBPK-ns3/svc3/tcp/p80 ip daddr 172.30.0.43 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
+			add rule ip kube-proxy service-4AT6LBPK-ns3/svc3/tcp/p80 numgen random mod 1 vmap { 0 : goto endpoint-UEIP74TE-ns3/svc3/tcp/p80__10.180.0.3/80 }
+			add rule ip kube-proxy external-4AT6LBPK-ns3/svc3/tcp/p80 jump mark-for-masquerade
+			add rule ip kube-proxy external-4AT6LBPK-ns3/svc3/tcp/p80 goto service-4AT6LBPK-ns3/svc3/tcp/p80
+			add rule ip kube-proxy endpoint-UEIP74TE-ns3/svc3/tcp/p80__10.180.0.3/80 ip saddr 10.180.0.3 jump mark-for-masquerade
+			add rule ip kube-proxy endpoint-UEIP74TE-ns3/svc3/tcp/p80__10.180.0.3/80 meta l4proto tcp dnat to 10.180.0.3:80
+
+			add element ip kube-proxy service-ips { 172.30.0.43 . tcp . 80 : goto service-4AT6LBPK-ns3/svc3/tcp/p80 }
+			add element ip kube-proxy service-nodeports { tcp . 3003 : goto external-4AT6LBPK-ns3/svc3/tcp/p80 }
+
+			# svc4
+			add rule ip kube-proxy service-LAUZTJTB-ns4/svc4/tcp/p80 ip daddr 172.30.0.44 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
+			add rule ip kube-proxy service-LAUZTJTB-ns4/svc4/tcp/p80 numgen random mod 2 vmap { 0 : goto endpoint-UNZV3OEC-ns4/svc4/tcp/p80__10.180.0.4/80 , 1 : goto endpoint-5RFCDDV7-ns4/svc4/tcp/p80__10.180.0.5/80 }
+			add rule ip kube-proxy external-LAUZTJTB-ns4/svc4/tcp/p80 jump mark-for-masquerade
+			add rule ip kube-proxy external-LAUZTJTB-ns4/svc4/tcp/p80 goto service-LAUZTJTB-ns4/svc4/tcp/p80
+			add rule ip kube-proxy endpoint-5RFCDDV7-ns4/svc4/tcp/p80__10.180.0.5/80 ip saddr 10.180.0.5 jump mark-for-masquerade
+			add rule ip kube-proxy endpoint-5RFCDDV7-ns4/svc4/tcp/p80__10.180.0.5/80 meta l4proto tcp dnat to 10.180.0.5:80
+			add rule ip kube-proxy endpoint-UNZV3OEC-ns4/svc4/tcp/p80__10.180.0.4/80 ip saddr 10.180.0.4 jump mark-for-masquerade
+			add rule ip kube-proxy endpoint-UNZV3OEC-ns4/svc4/tcp/p80__10.180.0.4/80 meta l4proto tcp dnat to 10.180.0.4:80
+
+			add element ip kube-proxy service-ips { 172.30.0.44 . tcp . 80 : goto service-LAUZTJTB-ns4/svc4/tcp/p80 }
+			add element ip kube-proxy service-ips { 192.168.99.33 . tcp . 80 : goto external-LAUZTJTB-ns4/svc4/tcp/p80 }
+
+			# svc5
+			add set ip kube-proxy affinity-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 { type ipv4_addr ; flags dynamic,timeout ; timeout 10800s ; }
+			add rule ip kube-proxy service-HVFWP5L3-ns5/svc5/tcp/p80 ip daddr 172.30.0.45 tcp dport 80 ip saddr != 10.0.0.0/8 jump mark-for-masquerade
+			add rule ip kube-proxy service-HVFWP5L3-ns5/svc5/tcp/p80 ip saddr @affinity-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 goto endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80
+			add rule ip kube-proxy service-HVFWP5L3-ns5/svc5/tcp/p80 numgen random mod 1 vmap { 0 : goto endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 }
+			add rule ip kube-proxy external-HVFWP5L3-ns5/svc5/tcp/p80 jump mark-for-masquerade
+			add rule ip kube-proxy external-HVFWP5L3-ns5/svc5/tcp/p80 goto service-HVFWP5L3-ns5/svc5/tcp/p80
+
+			add rule ip kube-proxy endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 ip saddr 10.180.0.3 jump mark-for-masquerade
+			add rule ip kube-proxy endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 update @affinity-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 { ip saddr }
+			add rule ip kube-proxy endpoint-GTK6MW7G-ns5/svc5/tcp/p80__10.180.0.3/80 meta l4proto tcp dnat to 10.180.0.3:80
+
+			add rule ip kube-proxy firewall-HVFWP5L3-ns5/svc5/tcp/p80 ip saddr != { 203.0.113.0/25 } drop
+
+			add element ip kube-proxy service-ips { 172.30.0.45 . tcp . 80 : goto service-HVFWP5L3-ns5/svc5/tcp/p80 }
+			add element ip kube-proxy service-ips { 5.6.7.8 . tcp . 80 : goto external-HVFWP5L3-ns5/svc5/tcp/p80 }
+			add element ip kube-proxy service-nodeports { tcp . 3002 : goto external-HVFWP5L3-ns5/svc5/tcp/p80 }
+			add element ip kube-proxy firewall-ips { 5.6.7.8 . tcp . 80 comment "ns5/svc5:p80" : goto firewall-HVFWP5L3-ns5/svc5/tcp/p80 }
 
 			# svc6
 			add element ip kube-proxy no-endpoint-services { 172.30.0.46 . tcp . 80 comment "ns6/svc6:p80" : goto reject-chain }
@@ -827,6 +2465,193 @@ func TestFakeParseDump(t *testing.T) {
 			add element ip6 kube-proxy service-nodeports { tcp . 3001 comment "test comment" : goto external-ULMVA6XW-ns1/svc1/tcp/p80 }
 			`,
 		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add chain ip kube-proxy chain
+			add set ip kube-proxy set1 { type ipv4_addr ; elements = { 1.1.1.1, 2.2.2.2 comment "with, a comment" } ; }
+			add set ip kube-proxy set2 { type ipv4_addr ; elements = { 3.3.3.3 } ; comment "set comment" ; }
+			add map ip kube-proxy map1 { type ipv4_addr . inet_service : verdict ; elements = { 10.0.0.1 . 80 : goto chain, 10.0.0.2 . 443 : drop } ; }
+			`,
+			expected: `
+			add table ip kube-proxy
+			add chain ip kube-proxy chain
+			add set ip kube-proxy set1 { type ipv4_addr ; }
+			add set ip kube-proxy set2 { type ipv4_addr ; comment "set comment" ; }
+			add map ip kube-proxy map1 { type ipv4_addr . inet_service : verdict ; }
+			add element ip kube-proxy set1 { 1.1.1.1 }
+			add element ip kube-proxy set1 { 2.2.2.2 comment "with, a comment" }
+			add element ip kube-proxy set2 { 3.3.3.3 }
+			add element ip kube-proxy map1 { 10.0.0.1 . 80 : goto chain }
+			add element ip kube-proxy map1 { 10.0.0.2 . 443 : drop }
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add chain ip kube-proxy chain
+			add set ip kube-proxy set1 { type ipv4_addr ; elements = {
+					1.1.1.1,
+					2.2.2.2, 3.3.3.3,
+					4.4.4.4 comment "with, a { comment" } ; }
+			add map ip kube-proxy map1 { type ipv4_addr . inet_service : verdict ; }
+			add element ip kube-proxy map1 { 10.0.0.1 . 80 : goto chain, 10.0.0.2 . 443 : drop }
+			add element ip kube-proxy map1 {
+					10.0.0.3 . 80 : goto chain,
+					10.0.0.4 . 443 comment "wrapped" : drop, 10.0.0.5 . 443 : accept
+				}
+			add element ip kube-proxy set1 { 5.5.5.5,
+				6.6.6.6 }
+			`,
+			expected: `
+			add table ip kube-proxy
+			add chain ip kube-proxy chain
+			add set ip kube-proxy set1 { type ipv4_addr ; }
+			add map ip kube-proxy map1 { type ipv4_addr . inet_service : verdict ; }
+			add element ip kube-proxy set1 { 1.1.1.1 }
+			add element ip kube-proxy set1 { 2.2.2.2 }
+			add element ip kube-proxy set1 { 3.3.3.3 }
+			add element ip kube-proxy set1 { 4.4.4.4 comment "with, a { comment" }
+			add element ip kube-proxy set1 { 5.5.5.5 }
+			add element ip kube-proxy set1 { 6.6.6.6 }
+			add element ip kube-proxy map1 { 10.0.0.1 . 80 : goto chain }
+			add element ip kube-proxy map1 { 10.0.0.2 . 443 : drop }
+			add element ip kube-proxy map1 { 10.0.0.3 . 80 : goto chain }
+			add element ip kube-proxy map1 { 10.0.0.4 . 443 comment "wrapped" : drop }
+			add element ip kube-proxy map1 { 10.0.0.5 . 443 : accept }
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add chain ip kube-proxy chain
+			add rule ip kube-proxy chain ip daddr 10.0.0.0/8 drop # handle 4
+			add rule ip kube-proxy chain masquerade comment "comment" # handle 7
+			add rule ip kube-proxy chain index 0 ip saddr 1.2.3.4 accept # handle 9
+			`,
+			expected: `
+			add table ip kube-proxy
+			add chain ip kube-proxy chain
+			add rule ip kube-proxy chain ip daddr 10.0.0.0/8 drop
+			add rule ip kube-proxy chain ip saddr 1.2.3.4 accept
+			add rule ip kube-proxy chain masquerade comment "comment"
+			`,
+		},
+		{
+			ipFamily: IPv6Family,
+			dump: `
+			add table ip6 kube-proxy
+			add chain ip6 kube-proxy filter-input { type filter hook input priority 0 ; }
+			add rule ip6 kube-proxy filter-input ip6 flowlabel 0 accept
+			add rule ip6 kube-proxy filter-input ip6 flowlabel != 12345 counter
+			add rule ip6 kube-proxy filter-input ip6 hoplimit 1 drop
+			add rule ip6 kube-proxy filter-input ip6 hoplimit set 64
+			add rule ip6 kube-proxy filter-input ip6 nexthdr icmpv6 icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert } accept
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add chain ip kube-proxy filter-input { type filter hook input priority 0 ; }
+			add rule ip kube-proxy filter-input tcp flags syn / syn,ack osf name "Linux" accept
+			add rule ip kube-proxy filter-input osf ttl skip name "Windows" drop comment "no windows"
+			add rule ip kube-proxy filter-input osf version "Linux:4.20" counter comment "kernel 4.20"
+			add rule ip kube-proxy filter-input osf name "comment" drop
+			add rule ip kube-proxy filter-input osf name { "Linux", "MacOs" } accept comment "comment"
+			`,
+		},
+		{
+			ipFamily: InetFamily,
+			dump: `
+			add table inet kube-proxy
+			add chain inet kube-proxy ips { type filter hook forward priority 0 ; }
+			add rule inet kube-proxy ips tcp dport 80 queue num 0-3 fanout
+			add rule inet kube-proxy ips udp dport 53 queue flags bypass,fanout to 4-7
+			add rule inet kube-proxy ips meta l4proto icmp queue num 2 bypass comment "to IDS"
+			add rule inet kube-proxy ips queue to symhash mod 4 offset 0
+			`,
+		},
+		{
+			ipFamily: InetFamily,
+			dump: `
+			add table inet kube-proxy
+			add chain inet kube-proxy filter-input { type filter hook input priority 0 ; }
+			add rule inet kube-proxy filter-input meta nfproto ipv6 ip6 flowlabel 0 accept
+			add rule inet kube-proxy filter-input ip6 hoplimit 1 drop
+			add rule inet kube-proxy filter-input ip ttl 1 drop
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add chain ip kube-proxy forward
+			add map ip kube-proxy iface-chains { type ifname : verdict ; }
+			add set ip kube-proxy egress-ifaces { type ifname ; }
+			add rule ip kube-proxy forward oifname @egress-ifaces accept
+			add rule ip kube-proxy forward iifname vmap @iface-chains
+			add element ip kube-proxy egress-ifaces { "eth0" }
+			add element ip kube-proxy egress-ifaces { "veth*" comment "pod interfaces" }
+			add element ip kube-proxy iface-chains { "eth1" comment "uplink" : goto forward }
+			`,
+		},
+		{
+			ipFamily: NetDevFamily,
+			dump: `
+			add table netdev kube-proxy
+			add chain netdev kube-proxy ingress-one { type filter hook ingress device "eth0" priority -500 ; }
+			add chain netdev kube-proxy ingress-many { type filter hook ingress devices = { eth1, eth2 } priority 0 ; policy accept ; }
+			add rule netdev kube-proxy ingress-many ip saddr 10.0.0.1 drop
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add chain ip kube-proxy mirror { type filter hook prerouting priority 0 ; }
+			add rule ip kube-proxy mirror tcp dport 80 dup to 10.0.0.1 device "eth0"
+			add rule ip kube-proxy mirror udp dport 53 dup to 10.0.0.2 comment "mirror dns"
+			`,
+		},
+		{
+			ipFamily: NetDevFamily,
+			dump: `
+			add table netdev kube-proxy
+			add chain netdev kube-proxy ingress { type filter hook ingress device "eth0" priority 0 ; }
+			add rule netdev kube-proxy ingress ip saddr 10.0.0.0/8 dup to "eth1"
+			add rule netdev kube-proxy ingress ip daddr 192.168.0.1 fwd to "eth2" comment "redirect"
+			add rule netdev kube-proxy ingress ip daddr 192.168.0.2 fwd ip to 10.0.0.1 device "eth3"
+			`,
+		},
+		{
+			ipFamily: IPv4Family,
+			dump: `
+			add table ip kube-proxy
+			add set ip kube-proxy accounting { type ipv4_addr ; counter ; }
+			add map ip kube-proxy marks { type ipv4_addr : mark ; counter ; comment "counted" ; }
+			add set ip kube-proxy other { type ipv4_addr ; }
+			add element ip kube-proxy accounting { 10.0.0.1 }
+			add element ip kube-proxy accounting { 10.0.0.2 counter packets 12 bytes 1008 }
+			add element ip kube-proxy marks { 10.0.0.1 comment "foo" : 0x1 }
+			add element ip kube-proxy other { 10.0.0.1 }
+			add element ip kube-proxy other { 10.0.0.2 counter packets 3 bytes 180 }
+			`,
+			expected: `
+			add table ip kube-proxy
+			add set ip kube-proxy accounting { type ipv4_addr ; counter ; }
+			add map ip kube-proxy marks { type ipv4_addr : mark ; counter ; comment "counted" ; }
+			add set ip kube-proxy other { type ipv4_addr ; }
+			add element ip kube-proxy accounting { 10.0.0.1 counter packets 0 bytes 0 }
+			add element ip kube-proxy accounting { 10.0.0.2 counter packets 12 bytes 1008 }
+			add element ip kube-proxy marks { 10.0.0.1 comment "foo" counter packets 0 bytes 0 : 0x1 }
+			add element ip kube-proxy other { 10.0.0.1 }
+			add element ip kube-proxy other { 10.0.0.2 counter packets 3 bytes 180 }
+			`,
+		},
 	} {
 		rules := dedent.Dedent(tc.dump)
 		fake := NewFake(tc.ipFamily, "kube-proxy")
@@ -834,6 +2659,9 @@ func TestFakeParseDump(t *testing.T) {
 		if err != nil {
 			t.Fatalf("unexpected error from ParseDump: %v", err)
 		}
+		if tc.expected != "" {
+			rules = dedent.Dedent(tc.expected)
+		}
 
 		// Dump() will add 1 empty line, so add to rulesSlice to match
 		rulesSlice := []string{""}
@@ -853,3 +2681,687 @@ func TestFakeParseDump(t *testing.T) {
 		}
 	}
 }
+
+func TestFakeStrictParsing(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if err := fake.ParseDump("add table ip kube-proxy\nadd chain ip kube-proxy existing\n"); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+
+	// By default, a rule can be added to a chain that already exists
+	dump := "add rule ip kube-proxy existing drop\n"
+	if err := fake.ParseDump(dump); err != nil {
+		t.Errorf("unexpected error from non-strict ParseDump: %v", err)
+	}
+
+	fake.SetStrictParsing(true)
+	if err := fake.ParseDump(dump); err == nil {
+		t.Errorf("expected error from strict ParseDump of rule in undeclared chain")
+	}
+
+	err := fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add rule ip kube-proxy chain accept
+		add rule ip kube-proxy other drop
+		add chain ip kube-proxy other
+		`))
+	if err == nil || !strings.Contains(err.Error(), `chain "other", which was not declared`) || !strings.Contains(err.Error(), "at line 5:") {
+		t.Errorf("expected error for rule at line 5, got %v", err)
+	}
+	if rules := fake.Table.Chains["chain"]; rules != nil {
+		t.Errorf("expected failed ParseDump not to modify the Fake")
+	}
+
+	err = fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add rule ip kube-proxy chain accept
+		add chain ip kube-proxy other
+		add rule ip kube-proxy other drop
+		`))
+	if err != nil {
+		t.Errorf("unexpected error from strict ParseDump: %v", err)
+	}
+}
+
+func TestFakeSeed(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if err := fake.SeedSet("myset", []string{"10.0.0.1"}); err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error seeding set with no table, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "myset", Type: "ipv4_addr . inet_proto . inet_service"})
+	tx.Add(&Map{Name: "mymap", Type: "ipv4_addr . inet_service : verdict"})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Element{Set: "myset", Key: []string{"10.0.0.1", "tcp", "80"}, Comment: PtrTo("old")})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	err := fake.SeedSet("myset",
+		[]string{"10.0.0.1", "tcp", "80"},
+		[]string{"10.0.0.2", "udp", "53"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error from SeedSet: %v", err)
+	}
+	err = fake.SeedMap("mymap", map[string][]string{
+		"10.0.0.2 . 80": {"drop"},
+		"10.0.0.1 . 80": {"goto chain"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from SeedMap: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add set ip kube-proxy myset { type ipv4_addr . inet_proto . inet_service ; }
+		add map ip kube-proxy mymap { type ipv4_addr . inet_service : verdict ; }
+		add element ip kube-proxy myset { 10.0.0.1 . tcp . 80 }
+		add element ip kube-proxy myset { 10.0.0.2 . udp . 53 }
+		add element ip kube-proxy mymap { 10.0.0.1 . 80 : goto chain }
+		add element ip kube-proxy mymap { 10.0.0.2 . 80 : drop }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump after seeding:\n%s", diff)
+	}
+
+	if err := fake.SeedSet("nosuchset", []string{"10.0.0.1"}); err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error seeding nonexistent set, got %v", err)
+	}
+	if err := fake.SeedMap("myset", map[string][]string{"10.0.0.1": {"drop"}}); err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error seeding set as map, got %v", err)
+	}
+	if err := fake.SeedMap("mymap", map[string][]string{"10.0.0.3 . 80": nil}); err == nil {
+		t.Errorf("expected error seeding map element with no value")
+	}
+}
+
+func TestFakeValidateElement(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if err := fake.ValidateElement(&Element{Map: "vmap", Key: []string{"80"}, Value: []string{Drop()}}); !IsNotFound(err) {
+		t.Errorf("expected not-found error with no table, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Set{Name: "set", Type: "inet_service"})
+	tx.Add(&Map{Name: "vmap", Type: "inet_service : verdict"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		element *Element
+		err     string
+	}{
+		{
+			name:    "set element",
+			element: &Element{Set: "set", Key: []string{"80"}},
+		},
+		{
+			name:    "goto existing chain",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{Goto("chain")}},
+		},
+		{
+			name:    "jump existing chain",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{Jump("chain")}},
+		},
+		{
+			name:    "accept",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{Accept()}},
+		},
+		{
+			name:    "goto missing chain",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{Goto("nosuchchain")}},
+			err:     `no such chain "nosuchchain"`,
+		},
+		{
+			name:    "extra whitespace",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{"goto  chain "}},
+		},
+		{
+			name:    "verdict with quoted text",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{`jump chain comment "goto nowhere"`}},
+		},
+		{
+			name:    "one-word verdicts",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{"reject"}},
+		},
+		{
+			name:    "continue",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{"continue"}},
+		},
+		{
+			name:    "missing chain with trailing text",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{`goto nosuchchain comment "x"`}},
+			err:     `no such chain "nosuchchain"`,
+		},
+		{
+			name:    "goto without chain",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{"goto"}},
+			err:     "no chain name",
+		},
+		{
+			name:    "unterminated string",
+			element: &Element{Map: "vmap", Key: []string{"80"}, Value: []string{`goto chain comment "x`}},
+			err:     "unterminated string",
+		},
+		{
+			name:    "missing map",
+			element: &Element{Map: "nosuchmap", Key: []string{"80"}, Value: []string{Drop()}},
+			err:     `no such map "nosuchmap"`,
+		},
+		{
+			name:    "missing set",
+			element: &Element{Set: "nosuchset", Key: []string{"80"}},
+			err:     `no such set "nosuchset"`,
+		},
+		{
+			name:    "invalid element",
+			element: &Element{Map: "vmap", Key: []string{"80"}},
+			err:     "no map value",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := fake.ValidateElement(tc.element)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestFakeVersion(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if major, minor, patch := fake.Version(); major != 1 || minor != 0 || patch != 9 {
+		t.Errorf("unexpected default version %d.%d.%d", major, minor, patch)
+	}
+	if !fake.HasFeature(ObjectCommentsFeature) {
+		t.Errorf("expected all features to be supported by default")
+	}
+
+	fake.SetVersion(1, 0, 2)
+	fake.SetFeature(ObjectCommentsFeature, false)
+	if major, minor, patch := fake.Version(); major != 1 || minor != 0 || patch != 2 {
+		t.Errorf("unexpected version %d.%d.%d after SetVersion", major, minor, patch)
+	}
+	if fake.HasFeature(ObjectCommentsFeature) {
+		t.Errorf("expected ObjectCommentsFeature to be unsupported after SetFeature")
+	}
+
+	fake.SetFeature(ObjectCommentsFeature, true)
+	if !fake.HasFeature(ObjectCommentsFeature) {
+		t.Errorf("expected ObjectCommentsFeature to be supported again after SetFeature")
+	}
+}
+
+func TestFakeParseDumpDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		current  string
+		desired  string
+		expected string
+	}{
+		{
+			name: "no change",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				`,
+			expected: ``,
+		},
+		{
+			name:    "from empty",
+			current: ``,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add set ip kube-proxy set { type ipv4_addr ; }
+				add rule ip kube-proxy chain ip daddr @set drop
+				add element ip kube-proxy set { 10.0.0.1 }
+				`,
+			expected: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add set ip kube-proxy set { type ipv4_addr ; }
+				add rule ip kube-proxy chain ip daddr @set drop
+				add element ip kube-proxy set { 10.0.0.1 }
+				`,
+		},
+		{
+			name: "to empty",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				`,
+			desired: ``,
+			expected: `
+				delete table ip kube-proxy
+				`,
+		},
+		{
+			name: "rules",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add chain ip kube-proxy other
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.2 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.3 drop
+				add rule ip kube-proxy other ip daddr 10.0.0.4 drop
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add chain ip kube-proxy new
+				add rule ip kube-proxy chain ip daddr 10.0.0.0 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.3 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.5 jump new
+				`,
+			expected: `
+				delete rule ip kube-proxy chain handle 5
+				flush chain ip kube-proxy other
+				delete chain ip kube-proxy other
+				add chain ip kube-proxy new
+				insert rule ip kube-proxy chain handle 4 ip daddr 10.0.0.0 drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.5 jump new
+				`,
+		},
+		{
+			name: "elements",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add set ip kube-proxy set { type ipv4_addr ; }
+				add map ip kube-proxy map { type ipv4_addr : verdict ; }
+				add element ip kube-proxy set { 10.0.0.1 }
+				add element ip kube-proxy set { 10.0.0.2 }
+				add element ip kube-proxy map { 10.0.0.1 : drop }
+				add element ip kube-proxy map { 10.0.0.2 : drop }
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add set ip kube-proxy set { type ipv4_addr ; }
+				add map ip kube-proxy map { type ipv4_addr : verdict ; }
+				add element ip kube-proxy set { 10.0.0.2 }
+				add element ip kube-proxy set { 10.0.0.3 }
+				add element ip kube-proxy map { 10.0.0.1 : drop }
+				add element ip kube-proxy map { 10.0.0.2 : goto chain }
+				`,
+			expected: `
+				delete element ip kube-proxy set { 10.0.0.1 }
+				delete element ip kube-proxy map { 10.0.0.2 }
+				add element ip kube-proxy set { 10.0.0.3 }
+				add element ip kube-proxy map { 10.0.0.2 : goto chain }
+				`,
+		},
+		{
+			name: "changed set",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add set ip kube-proxy set { type ipv4_addr ; }
+				add rule ip kube-proxy chain ip daddr @set drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				add element ip kube-proxy set { 10.0.0.1 }
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				add set ip kube-proxy set { type ipv4_addr ; comment "new comment" ; }
+				add rule ip kube-proxy chain ip daddr @set drop
+				add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+				add element ip kube-proxy set { 10.0.0.1 }
+				`,
+			expected: `
+				delete rule ip kube-proxy chain handle 4
+				delete set ip kube-proxy set
+				add set ip kube-proxy set { type ipv4_addr ; comment "new comment" ; }
+				insert rule ip kube-proxy chain handle 5 ip daddr @set drop
+				add element ip kube-proxy set { 10.0.0.1 }
+				`,
+		},
+		{
+			name: "changed table",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain
+				`,
+			desired: `
+				add table ip kube-proxy { comment "new comment" ; }
+				add chain ip kube-proxy chain
+				`,
+			expected: `
+				delete table ip kube-proxy
+				add table ip kube-proxy { comment "new comment" ; }
+				add chain ip kube-proxy chain
+				`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake(IPv4Family, "kube-proxy")
+			if err := fake.ParseDump(dedent.Dedent(tc.current)); err != nil {
+				t.Fatalf("unexpected error parsing current state: %v", err)
+			}
+			before := fake.Dump()
+
+			tx, err := fake.ParseDumpDiff(dedent.Dedent(tc.desired))
+			if err != nil {
+				t.Fatalf("unexpected error from ParseDumpDiff: %v", err)
+			}
+			expected := strings.TrimPrefix(dedent.Dedent(tc.expected), "\n")
+			if diff := cmp.Diff(expected, tx.String()); diff != "" {
+				t.Errorf("unexpected transaction:\n%s", diff)
+			}
+			if dump := fake.Dump(); dump != before {
+				t.Errorf("ParseDumpDiff modified the Fake:\n%s", cmp.Diff(before, dump))
+			}
+
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Fatalf("unexpected error running transaction: %v", err)
+			}
+			desired := NewFake(IPv4Family, "kube-proxy")
+			if err := desired.ParseDump(dedent.Dedent(tc.desired)); err != nil {
+				t.Fatalf("unexpected error parsing desired state: %v", err)
+			}
+			if diff := cmp.Diff(normalizeDump(desired.Dump()), normalizeDump(fake.Dump())); diff != "" {
+				t.Errorf("unexpected result after running transaction:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFakeSetChainPolicy(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{
+		Name:     "input",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority),
+	})
+	tx.Add(&Chain{Name: "regular"})
+	tx.Add(&Rule{Chain: "input", Rule: "ct state established accept"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, policy := range []BaseChainPolicy{DropPolicy, AcceptPolicy} {
+		tx = fake.NewTransaction()
+		tx.SetChainPolicy("input", policy)
+		expected := fmt.Sprintf("add chain ip kube-proxy input { policy %s ; }\n", policy)
+		if tx.String() != expected {
+			t.Errorf("expected %q, got %q", expected, tx.String())
+		}
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+
+		chain := fake.Table.Chains["input"]
+		if chain.Policy == nil || *chain.Policy != policy {
+			t.Errorf("expected policy %q, got %v", policy, chain.Policy)
+		}
+		if len(chain.Rules) != 1 {
+			t.Errorf("expected rules to be unchanged, got %d rules", len(chain.Rules))
+		}
+	}
+
+	tx = fake.NewTransaction()
+	tx.SetChainPolicy("regular", DropPolicy)
+	if err := fake.Run(context.Background(), tx); err == nil || !strings.Contains(err.Error(), "not a base chain") {
+		t.Errorf("expected error setting policy on regular chain, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.SetChainPolicy("nosuchchain", DropPolicy)
+	if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+		t.Errorf("expected not-found error setting policy on nonexistent chain, got %v", err)
+	}
+}
+
+func TestFakeSnapshot(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if snapshot := fake.Snapshot(); snapshot != nil {
+		t.Errorf("expected nil snapshot with no table, got %+v", snapshot)
+	}
+
+	err := fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy { comment "rules for kube-proxy" ; }
+		add chain ip kube-proxy chain
+		add chain ip kube-proxy anotherchain
+		add set ip kube-proxy set { type ipv4_addr ; }
+		add map ip kube-proxy map { type ipv4_addr : verdict ; }
+		add rule ip kube-proxy chain ip daddr @set drop
+		add rule ip kube-proxy chain ip daddr vmap @map comment "vmap"
+		add element ip kube-proxy set { 10.0.0.2 }
+		add element ip kube-proxy set { 10.0.0.1 }
+		add element ip kube-proxy map { 10.0.0.1 : goto anotherchain }
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+
+	expected := &Snapshot{
+		Table: Table{Comment: PtrTo("rules for kube-proxy")},
+		Chains: []SnapshotChain{
+			{Chain: Chain{Name: "anotherchain"}},
+			{
+				Chain: Chain{Name: "chain"},
+				Rules: []Rule{
+					{Chain: "chain", Rule: "ip daddr @set drop"},
+					{Chain: "chain", Rule: "ip daddr vmap @map", Comment: PtrTo("vmap")},
+				},
+			},
+		},
+		Sets: []SnapshotSet{
+			{
+				Set: Set{Name: "set", Type: "ipv4_addr"},
+				Elements: []Element{
+					{Set: "set", Key: []string{"10.0.0.1"}},
+					{Set: "set", Key: []string{"10.0.0.2"}},
+				},
+			},
+		},
+		Maps: []SnapshotMap{
+			{
+				Map: Map{Name: "map", Type: "ipv4_addr : verdict"},
+				Elements: []Element{
+					{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"goto anotherchain"}},
+				},
+			},
+		},
+	}
+	snapshot := fake.Snapshot()
+	if diff := cmp.Diff(expected, snapshot); diff != "" {
+		t.Errorf("unexpected snapshot:\n%s", diff)
+	}
+
+	// Modifying the snapshot should not affect the Fake
+	snapshot.Sets[0].Elements[0].Key[0] = "1.2.3.4"
+	*snapshot.Chains[1].Rules[1].Comment = "modified"
+	if diff := cmp.Diff(expected, fake.Snapshot()); diff != "" {
+		t.Errorf("modifying snapshot modified Fake:\n%s", diff)
+	}
+
+	// A Fake with the same contents, created in a different order, should have an
+	// identical Snapshot.
+	other := NewFake(IPv4Family, "kube-proxy")
+	tx := other.NewTransaction()
+	tx.Add(&Table{Comment: PtrTo("rules for kube-proxy")})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.2"}})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	tx.Add(&Chain{Name: "anotherchain"})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"goto anotherchain"}})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr vmap @map", Comment: PtrTo("vmap")})
+	tx.Insert(&Rule{Chain: "chain", Rule: "ip daddr @set drop"})
+	if err := other.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if diff := cmp.Diff(fake.Snapshot(), other.Snapshot()); diff != "" {
+		t.Errorf("expected identical snapshots:\n%s", diff)
+	}
+}
+
+func TestFakeDumpJSON(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	err := fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy { comment "rules for kube-proxy" ; }
+		add ct helper ip kube-proxy ftp-helper { type "ftp" protocol tcp ; }
+		add chain ip kube-proxy chain
+		add chain ip kube-proxy anotherchain
+		add chain ip kube-proxy filter { type filter hook input priority 0 ; }
+		add set ip kube-proxy set { type ipv4_addr ; flags timeout ; timeout 3600s ; }
+		add map ip kube-proxy map { type ipv4_addr : verdict ; }
+		add rule ip kube-proxy chain ip daddr @set drop
+		add rule ip kube-proxy chain ip daddr vmap @map comment "vmap"
+		add rule ip kube-proxy filter jump chain
+		add element ip kube-proxy set { 10.0.0.2 timeout 60s }
+		add element ip kube-proxy set { 10.0.0.1 comment "first" }
+		add element ip kube-proxy map { 10.0.0.1 : goto anotherchain }
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+
+	data, err := fake.DumpJSON()
+	if err != nil {
+		t.Fatalf("unexpected error from DumpJSON: %v", err)
+	}
+	if !strings.Contains(string(data), `"Rule": "ip daddr vmap @map"`) {
+		t.Errorf("expected rule in JSON output, got:\n%s", data)
+	}
+
+	loaded := NewFake(IPv4Family, "kube-proxy")
+	if err := loaded.LoadJSON(data); err != nil {
+		t.Fatalf("unexpected error from LoadJSON: %v", err)
+	}
+	if diff := cmp.Diff(fake.Snapshot(), loaded.Snapshot()); diff != "" {
+		t.Errorf("unexpected snapshot after LoadJSON:\n%s", diff)
+	}
+	// (Element order is not preserved, since Snapshot sorts elements.)
+	if diff := cmp.Diff(normalizeDump(fake.Dump()), normalizeDump(loaded.Dump())); diff != "" {
+		t.Errorf("unexpected dump after LoadJSON:\n%s", diff)
+	}
+
+	// The output is stable
+	loadedData, err := loaded.DumpJSON()
+	if err != nil {
+		t.Fatalf("unexpected error from DumpJSON: %v", err)
+	}
+	if diff := cmp.Diff(string(data), string(loadedData)); diff != "" {
+		t.Errorf("unexpected JSON after LoadJSON:\n%s", diff)
+	}
+
+	// A Fake with no table dumps as "null", and loading that is a no-op
+	empty := NewFake(IPv4Family, "kube-proxy")
+	data, err = empty.DumpJSON()
+	if err != nil || string(data) != "null" {
+		t.Errorf("expected null JSON for empty Fake, got %q, %v", data, err)
+	}
+	if err := empty.LoadJSON(data); err != nil || empty.Table != nil {
+		t.Errorf("expected no-op LoadJSON of null, got %v", err)
+	}
+
+	if err := empty.LoadJSON([]byte("{")); err == nil {
+		t.Errorf("expected error from LoadJSON of invalid JSON")
+	}
+}
+
+func TestFakeRulesetGeneration(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	ctx := context.Background()
+	expectGeneration := func(expected uint32) {
+		t.Helper()
+		gen, err := fake.RulesetGeneration(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error from RulesetGeneration: %v", err)
+		}
+		if gen != expected {
+			t.Errorf("expected generation %d, got %d", expected, gen)
+		}
+	}
+	expectGeneration(0)
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	if err := fake.Run(ctx, tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	expectGeneration(1)
+
+	// Check does not change the generation
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	if err := fake.Check(ctx, tx); err != nil {
+		t.Fatalf("unexpected error from Check: %v", err)
+	}
+	expectGeneration(1)
+
+	// Nor does a failed Run
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "nosuchchain", Rule: "drop"})
+	if err := fake.Run(ctx, tx); err == nil {
+		t.Fatalf("expected error from Run")
+	}
+	expectGeneration(1)
+
+	// Nor does an empty transaction
+	if err := fake.Run(ctx, fake.NewTransaction()); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	expectGeneration(1)
+
+	if err := fake.ParseDump("add chain ip kube-proxy other\n"); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	expectGeneration(2)
+
+	// RunAtGeneration with the current generation succeeds
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	if err := fake.RunAtGeneration(ctx, tx, 2); err != nil {
+		t.Fatalf("unexpected error from RunAtGeneration: %v", err)
+	}
+	expectGeneration(3)
+
+	// But re-running it now fails, without changing anything
+	dump := fake.Dump()
+	if err := fake.RunAtGeneration(ctx, tx, 2); !IsGenerationMismatch(err) {
+		t.Errorf("expected generation mismatch error from RunAtGeneration, got %v", err)
+	}
+	expectGeneration(3)
+	if newDump := fake.Dump(); newDump != dump {
+		t.Errorf("transaction with wrong generation modified the Fake:\n%s", newDump)
+	}
+
+	// Other errors are not generation mismatches
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "nosuchchain", Rule: "drop"})
+	if err := fake.RunAtGeneration(ctx, tx, 3); err == nil || IsGenerationMismatch(err) {
+		t.Errorf("expected non-generation-mismatch error from RunAtGeneration, got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Monitor is part of Interface
+func (nft *realNFTables) Monitor(ctx context.Context) (<-chan *Event, error) {
+	cmd := nft.command(ctx, "--json", "monitor")
+	out, err := nft.exec.Start(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+
+		err := nft.readEvents(ctx, out, events)
+		closeErr := out.Close()
+		if ctx.Err() != nil {
+			// Cancelled by the caller, so any error is expected
+			return
+		}
+		if err == nil {
+			if closeErr != nil {
+				err = fmt.Errorf("nft monitor failed: %w", closeErr)
+			} else {
+				err = fmt.Errorf("nft monitor exited unexpectedly")
+			}
+		}
+		select {
+		case events <- &Event{Type: ErrorEvent, Err: err}:
+		case <-ctx.Done():
+		}
+	}()
+
+	return events, nil
+}
+
+// readEvents reads events from out (the output of `nft --json monitor`) and sends them
+// to events, until it reaches the end of out or ctx is cancelled. Lines that can't be
+// parsed are reported as ErrorEvents. It returns nil at the end of out, or an error if
+// out could not be read.
+func (nft *realNFTables) readEvents(ctx context.Context, out io.Reader, events chan<- *Event) error {
+	// Rules and element lists can get long, so we use a bufio.Reader rather than a
+	// bufio.Scanner, which has a maximum line length.
+	reader := bufio.NewReader(out)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read nft output: %w", err)
+		}
+
+		// Ignore anything that isn't JSON (eg, "# new generation" lines)
+		line = bytes.TrimSpace(line)
+		if len(line) != 0 && line[0] == '{' {
+			lineEvents, parseErr := nft.parseJSONEvent(line)
+			if parseErr != nil {
+				lineEvents = []*Event{{Type: ErrorEvent, Err: fmt.Errorf("could not parse nft output %q: %w", line, parseErr)}}
+			}
+			for _, event := range lineEvents {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// parseJSONEvent parses a single line of `nft --json monitor` output, which will look
+// something like:
+//
+//	{"add": {"chain": {"family": "ip", "table": "kube-proxy", "name": "services", "handle": 3}}}
+//
+// It returns the corresponding events, or nil if the line refers to a different table
+// or to an object type we don't handle. (A single line may produce multiple events in
+// the case of set/map elements.)
+func (nft *realNFTables) parseJSONEvent(line []byte) ([]*Event, error) {
+	var jsonEvent map[string]map[string]map[string]interface{}
+	if err := json.Unmarshal(line, &jsonEvent); err != nil {
+		return nil, err
+	}
+	if len(jsonEvent) != 1 {
+		return nil, fmt.Errorf("unexpected JSON output from nft (multiple event types)")
+	}
+
+	var eventType EventType
+	var jsonObjs map[string]map[string]interface{}
+	for key, val := range jsonEvent {
+		eventType = EventType(key)
+		jsonObjs = val
+	}
+	if eventType != AddEvent && eventType != DeleteEvent {
+		return nil, nil
+	}
+	if len(jsonObjs) != 1 {
+		return nil, fmt.Errorf("unexpected JSON output from nft (multiple objects)")
+	}
+
+	var objectType string
+	var jsonObj map[string]interface{}
+	for key, val := range jsonObjs {
+		objectType = key
+		jsonObj = val
+	}
+
+	family, _ := jsonVal[string](jsonObj, "family")
+	if family != string(nft.family) {
+		return nil, nil
+	}
+	tableKey := "table"
+	if objectType == "table" {
+		tableKey = "name"
+	}
+	if table, _ := jsonVal[string](jsonObj, tableKey); table != nft.table {
+		return nil, nil
+	}
+
+	var handle *int
+	if jsonHandle, ok := jsonVal[float64](jsonObj, "handle"); ok {
+		handle = PtrTo(int(jsonHandle))
+	}
+	var comment *string
+	if jsonComment, ok := jsonVal[string](jsonObj, "comment"); ok {
+		comment = &jsonComment
+	}
+
+	var objs []Object
+	switch objectType {
+	case "table":
+		objs = append(objs, parseJSONTable(jsonObj))
+
+	case "chain":
+		objs = append(objs, parseJSONChain(jsonObj))
+
+	case "rule":
+		rule := &Rule{Comment: comment, Handle: handle}
+		rule.Chain, _ = jsonVal[string](jsonObj, "chain")
+		objs = append(objs, rule)
+
+	case "set":
+		set, err := parseJSONSet(jsonObj)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, set)
+
+	case "map":
+		mapObj, err := parseJSONMap(jsonObj)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, mapObj)
+
+	case "element":
+		// The elements are wrapped in a "set" expression, even for maps:
+		//
+		//   "elem": {"set": ["10.0.0.1", "10.0.0.2"]}
+		//   "elem": {"set": [["10.0.0.1", 80], ["10.0.0.2", 443]]}
+		//
+		// (Older versions of nft may omit the wrapper.)
+		name, _ := jsonVal[string](jsonObj, "name")
+		jsonElements, ok := jsonVal[[]interface{}](jsonObj, "elem")
+		if !ok {
+			wrapper, _ := jsonVal[map[string]interface{}](jsonObj, "elem")
+			jsonElements, _ = jsonVal[[]interface{}](wrapper, "set")
+		}
+		for _, jsonElement := range jsonElements {
+			// Map elements are [key, value] tuples; set elements never are.
+			_, isMap := jsonElement.([]interface{})
+			elem, err := parseJSONElement(jsonElement, isMap)
+			if err != nil {
+				return nil, err
+			}
+			if isMap {
+				elem.Map = name
+			} else {
+				elem.Set = name
+			}
+			objs = append(objs, elem)
+		}
+
+	default:
+		return nil, nil
+	}
+
+	events := make([]*Event, 0, len(objs))
+	for _, obj := range objs {
+		events = append(events, &Event{Type: eventType, Object: obj})
+	}
+	return events, nil
+}
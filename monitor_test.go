@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestMonitor(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args: []string{"/nft", "--json", "monitor"},
+			stdout: dedent.Dedent(`
+				{"add": {"table": {"family": "ip", "name": "testing", "handle": 1}}}
+				{"add": {"table": {"family": "ip", "name": "other", "handle": 2}}}
+				{"add": {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}}
+				{"add": {"chain": {"family": "ip6", "table": "testing", "name": "prerouting", "handle": 1}}}
+				{"add": {"set": {"family": "ip", "name": "ips", "table": "testing", "type": "ipv4_addr", "handle": 3, "comment": "some IPs"}}}
+				{"add": {"map": {"family": "ip", "name": "ports", "table": "testing", "type": "inet_service", "handle": 4, "map": "verdict"}}}
+				{"add": {"element": {"family": "ip", "table": "testing", "name": "ips", "elem": {"set": ["10.0.0.1", {"elem": {"val": "10.0.0.2", "comment": "two"}}]}}}}
+				{"add": {"element": {"family": "ip", "table": "testing", "name": "ports", "elem": {"set": [[80, {"drop": null}]]}}}}
+				{"add": {"rule": {"family": "ip", "table": "testing", "chain": "prerouting", "handle": 5, "comment": "a rule", "expr": [{"accept": null}]}}}
+				# new generation 7 by process 1234 (nft)
+				{"delete": {"rule": {"family": "ip", "table": "testing", "chain": "prerouting", "handle": 5}}}
+				{"delete": {"flowtable": {"family": "ip", "table": "testing", "name": "ft", "handle": 6}}}
+				{"add": {"chain":
+				{"delete": {"table": {"family": "ip", "name": "testing", "handle": 1}}}
+				`),
+		},
+	)
+
+	events, err := nft.Monitor(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []*Event
+	for event := range events {
+		got = append(got, event)
+	}
+
+	expected := []*Event{
+		{Type: AddEvent, Object: &Table{Handle: PtrTo(1)}},
+		{Type: AddEvent, Object: &Chain{
+			Name:     "prerouting",
+			Type:     PtrTo(NATType),
+			Hook:     PtrTo(PreroutingHook),
+			Priority: PtrTo(BaseChainPriority("-100")),
+			Policy:   PtrTo(AcceptPolicy),
+			Handle:   PtrTo(1),
+		}},
+		{Type: AddEvent, Object: &Set{Name: "ips", Type: "ipv4_addr", Comment: PtrTo("some IPs"), Handle: PtrTo(3)}},
+		{Type: AddEvent, Object: &Map{Name: "ports", Type: "inet_service : verdict", Handle: PtrTo(4)}},
+		{Type: AddEvent, Object: &Element{Set: "ips", Key: []string{"10.0.0.1"}}},
+		{Type: AddEvent, Object: &Element{Set: "ips", Key: []string{"10.0.0.2"}, Comment: PtrTo("two")}},
+		{Type: AddEvent, Object: &Element{Map: "ports", Key: []string{"80"}, Value: []string{"drop"}}},
+		{Type: AddEvent, Object: &Rule{Chain: "prerouting", Comment: PtrTo("a rule"), Handle: PtrTo(5)}},
+		{Type: DeleteEvent, Object: &Rule{Chain: "prerouting", Handle: PtrTo(5)}},
+		{Type: ErrorEvent, Err: fmt.Errorf(`could not parse nft output "{\"add\": {\"chain\":": unexpected end of JSON input`)},
+		{Type: DeleteEvent, Object: &Table{Handle: PtrTo(1)}},
+		{Type: ErrorEvent, Err: fmt.Errorf("nft monitor exited unexpectedly")},
+	}
+	if diff := cmp.Diff(expected, got, compareErrors); diff != "" {
+		t.Errorf("unexpected events:\n%s", diff)
+	}
+}
+
+// compareErrors compares errors by their text
+var compareErrors = cmp.Comparer(func(a, b error) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+})
+
+func TestMonitorLongLine(t *testing.T) {
+	// Element events for large sets can be much longer than a bufio.Scanner's
+	// default maximum line length.
+	var ips []string
+	for i := 0; i < 100000; i++ {
+		ips = append(ips, fmt.Sprintf(`"10.%d.%d.%d"`, i>>16, (i>>8)&0xff, i&0xff))
+	}
+	line := `{"add": {"element": {"family": "ip", "table": "testing", "name": "ips", "elem": {"set": [` + strings.Join(ips, ", ") + `]}}}}`
+
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "monitor"},
+			stdout: line + "\n",
+		},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := nft.Monitor(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var elements int
+	for event := range events {
+		if event.Type == ErrorEvent {
+			if elements != len(ips) {
+				t.Fatalf("unexpected error after %d elements: %v", elements, event.Err)
+			}
+			cancel()
+			continue
+		}
+		elements++
+	}
+	if elements != len(ips) {
+		t.Errorf("expected %d elements, got %d", len(ips), elements)
+	}
+}
@@ -20,10 +20,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Interface is an interface for running nftables commands against a given family and table.
@@ -40,24 +45,136 @@ type Interface interface {
 	// result.
 	Check(ctx context.Context, tx *Transaction) error
 
+	// FlushTable runs a transaction that flushes the table (as with `nft flush
+	// table`). This is equivalent to running a transaction containing just
+	// `tx.Flush(&Table{})`, and returns an error if the table does not exist.
+	FlushTable(ctx context.Context) error
+
+	// SwapTable atomically replaces the entire contents of the table. It creates a
+	// transaction that deletes the table (if it exists) and recreates it, calls build
+	// to add the new contents of the table to the transaction, and then runs the
+	// transaction. Since the transaction is applied atomically, there is never any
+	// point at which the table is missing or only partially populated. (build does not
+	// need to add the Table itself, unless it needs to set the table's Comment or
+	// Flags, in which case that should be the first thing it adds.)
+	SwapTable(ctx context.Context, build func(tx *Transaction)) error
+
+	// ReplaceTable atomically replaces the entire contents of the table with the
+	// contents of desired (which must have the same family and table), as with
+	// SwapTable. If desired's table does not exist, then the table will be deleted (if
+	// it exists).
+	ReplaceTable(ctx context.Context, desired *Fake) error
+
 	// List returns a list of the names of the objects of objectType ("chain", "set",
 	// or "map") in the table. If there are no such objects, this will return an empty
 	// list and no error.
 	List(ctx context.Context, objectType string) ([]string, error)
 
+	// ListChains returns a list of the chains in the table, with all of their
+	// properties (but not their rules) filled in. (This can be used, eg, to find the
+	// base chains attached to a particular hook.) If there are no chains, this will
+	// return an empty list and no error.
+	ListChains(ctx context.Context) ([]*Chain, error)
+
+	// ListSets returns a list of the sets in the table, with all of their
+	// properties (but not their elements) filled in. If there are no sets, this will
+	// return an empty list and no error.
+	ListSets(ctx context.Context) ([]*Set, error)
+
+	// ListMaps returns a list of the maps in the table, with all of their
+	// properties (but not their elements) filled in. If there are no maps, this will
+	// return an empty list and no error.
+	ListMaps(ctx context.Context) ([]*Map, error)
+
+	// GetTable returns the table, with all of its properties filled in. If the table
+	// does not exist, it returns an error for which IsNotFound will return true.
+	GetTable(ctx context.Context) (*Table, error)
+
+	// GetChain returns the chain named name, with all of its properties (including
+	// Handle and, for a base chain, Type, Hook, and Priority) filled in. If the
+	// chain does not exist, it returns an error for which IsNotFound will return
+	// true. (A Priority returned by GetChain will always be numeric.)
+	GetChain(ctx context.Context, name string) (*Chain, error)
+
+	// GetSet returns the set named name, with all of its properties (but not its
+	// elements) filled in. If the set does not exist, it returns an error for which
+	// IsNotFound will return true.
+	GetSet(ctx context.Context, name string) (*Set, error)
+
+	// GetMap returns the map named name, with all of its properties (but not its
+	// elements) filled in. If the map does not exist, it returns an error for which
+	// IsNotFound will return true.
+	GetMap(ctx context.Context, name string) (*Map, error)
+
+	// ListCTHelpers returns a list of the ct helpers in the table. If there are no ct
+	// helpers, this will return an empty list and no error.
+	ListCTHelpers(ctx context.Context) ([]*CTHelper, error)
+
+	// ListCTTimeouts returns a list of the ct timeouts in the table. If there are no
+	// ct timeouts, this will return an empty list and no error.
+	ListCTTimeouts(ctx context.Context) ([]*CTTimeout, error)
+
+	// ListCTExpectations returns a list of the ct expectations in the table. If there
+	// are no ct expectations, this will return an empty list and no error.
+	ListCTExpectations(ctx context.Context) ([]*CTExpectation, error)
+
+	// ListSynproxies returns a list of the synproxies in the table. If there are no
+	// synproxies, this will return an empty list and no error.
+	ListSynproxies(ctx context.Context) ([]*Synproxy, error)
+
 	// ListRules returns a list of the rules in a chain, in order. If no chain name is
 	// specified, then all rules within the table will be returned. Note that at the
-	// present time, the Rule objects will have their `Comment` and `Handle` fields
-	// filled in, but *not* the actual `Rule` field. So this can only be used to find
+	// present time, the Rule objects will have their `Comment`, `Index`, and `Handle`
+	// fields filled in, but *not* the actual `Rule` field. So this can only be used to find
 	// the handles of rules if they have unique comments to recognize them by, or if
 	// you know the order of the rules within the chain. If the chain exists but
 	// contains no rules, this will return an empty list and no error.
 	ListRules(ctx context.Context, chain string) ([]*Rule, error)
 
+	// HasRule returns whether chain contains a rule whose text is ruleText (ignoring
+	// differences in whitespace and counter values, and ignoring the rules' handles
+	// and comments; so "counter drop" matches "counter packets 5 bytes 300 drop"). Note
+	// that nft normalizes rules when they are added (eg, "ip protocol tcp tcp dport
+	// 80" becomes "tcp dport 80"), so ruleText must be written in the same form that
+	// "nft list chain" would output it in order to match.
+	HasRule(ctx context.Context, chain, ruleText string) (bool, error)
+
 	// ListElements returns a list of the elements in a set or map. (objectType should
 	// be "set" or "map".) If the set/map exists but contains no elements, this will
 	// return an empty list and no error.
 	ListElements(ctx context.Context, objectType, name string) ([]*Element, error)
+
+	// SetStats returns statistics about the set named name (its current number of
+	// elements, and its maximum size, if any). (nft does not report the kernel memory
+	// usage of sets, so that is not included.)
+	SetStats(ctx context.Context, name string) (*SetStats, error)
+
+	// Monitor returns a channel of Events describing changes to the table, as they
+	// happen (as with `nft monitor`). The channel will be closed when ctx is
+	// cancelled. If a line of nft's output can't be parsed, an ErrorEvent is sent and
+	// monitoring continues; if nft exits or its output can't be read, an ErrorEvent is
+	// sent and then the channel is closed.
+	Monitor(ctx context.Context) (<-chan *Event, error)
+
+	// Verify reads back the current state of the table and compares it against
+	// expected (which must have the same family and table), returning a Difference
+	// for each object that is missing, unexpected, or different from what was
+	// expected. This can be used after Run to confirm that nft did not normalize
+	// anything differently than expected. The rules in each chain are matched up in
+	// the same way as with Diff, and the counter values of rules and elements, and
+	// the expiration times of elements, are ignored. The table is read with a single
+	// "nft --json list table" plus a "nft --handle list table" to get the rule texts
+	// (which the JSON output does not include); if rules are added or deleted in
+	// between, the table is read again.
+	Verify(ctx context.Context, expected *Fake) ([]Difference, error)
+
+	// Version returns the version of the nft binary (as detected when the Interface
+	// was created). If the version could not be determined, it returns 0, 0, 0.
+	Version() (major, minor, patch int)
+
+	// HasFeature returns whether the given feature is supported by the nft binary
+	// and kernel (as detected when the Interface was created).
+	HasFeature(feature Feature) bool
 }
 
 type nftContext struct {
@@ -78,13 +195,101 @@ type realNFTables struct {
 
 	exec execer
 	path string
+
+	// binary, commandPrefix, globalArgs, and netns are set by WithBinary,
+	// WithCommandPrefix, WithGlobalArgs, and WithNetworkNamespace
+	binary        string
+	commandPrefix []string
+	globalArgs    []string
+	netns         string
+
+	// argv is the start of the command line for each nft invocation (including
+	// commandPrefix, path, and globalArgs), as computed by newInternal
+	argv []string
+
+	// version is the version of nft, as detected by newInternal
+	version [3]int
+
+	// listTimeout and runTimeout are set by WithListTimeout and WithRunTimeout
+	listTimeout time.Duration
+	runTimeout  time.Duration
+
+	// killDelay is set by WithKillDelay
+	killDelay time.Duration
+}
+
+// Option is an option that can be passed to New
+type Option func(*realNFTables)
+
+// WithListTimeout sets a default timeout for the "list" operations (List, ListRules,
+// ListElements, etc). If the context passed to the operation already has a deadline,
+// then that deadline is used instead.
+func WithListTimeout(timeout time.Duration) Option {
+	return func(nft *realNFTables) {
+		nft.listTimeout = timeout
+	}
+}
+
+// WithRunTimeout sets a default timeout for Run and Check. If the context passed to Run
+// or Check already has a deadline, then that deadline is used instead.
+func WithRunTimeout(timeout time.Duration) Option {
+	return func(nft *realNFTables) {
+		nft.runTimeout = timeout
+	}
+}
+
+// WithKillDelay makes commands more robust against hanging after they time out (or
+// their context is cancelled). Normally, the nft process is killed when its context is
+// done, but the operation still waits for its output to be closed, which may not happen
+// if it was run via a command prefix that started other processes. With this option, nft
+// is run in its own process group (on platforms that support it), the entire process
+// group is killed when the context is done, and if the output has still not been closed
+// after delay, the operation stops waiting and returns. (Either way, IsTimeout can be
+// used to check whether an error was due to the operation's deadline passing.)
+func WithKillDelay(delay time.Duration) Option {
+	return func(nft *realNFTables) {
+		nft.killDelay = delay
+	}
+}
+
+// WithBinary sets the nft binary to use (either an absolute path, or a name to look up
+// in $PATH), instead of the default "nft".
+func WithBinary(binary string) Option {
+	return func(nft *realNFTables) {
+		nft.binary = binary
+	}
+}
+
+// WithCommandPrefix causes every nft invocation to be run via the given command, eg
+// `WithCommandPrefix("ip", "netns", "exec", "myns")`. The nft command line will be
+// appended to prefix.
+func WithCommandPrefix(prefix ...string) Option {
+	return func(nft *realNFTables) {
+		nft.commandPrefix = prefix
+	}
+}
+
+// WithGlobalArgs adds extra arguments (eg, "--numeric") to every nft invocation, before
+// the arguments for the specific command being run.
+func WithGlobalArgs(args ...string) Option {
+	return func(nft *realNFTables) {
+		nft.globalArgs = args
+	}
+}
+
+// WithNetworkNamespace causes every nft invocation to be run in the network namespace
+// at nsPath (eg, "/run/netns/myns" or "/proc/1234/ns/net"), by running it via
+// `nsenter --net=nsPath`. (This requires the nsenter binary to be available.) If
+// WithCommandPrefix is also used, the command prefix will be run inside the namespace.
+func WithNetworkNamespace(nsPath string) Option {
+	return func(nft *realNFTables) {
+		nft.netns = nsPath
+	}
 }
 
 // newInternal creates a new nftables.Interface for interacting with the given table; this
 // is split out from New() so it can be used from unit tests with a fakeExec.
-func newInternal(family Family, table string, execer execer) (Interface, error) {
-	var err error
-
+func newInternal(family Family, table string, execer execer, opts ...Option) (Interface, error) {
 	nft := &realNFTables{
 		nftContext: nftContext{
 			family: family,
@@ -93,19 +298,11 @@ func newInternal(family Family, table string, execer execer) (Interface, error)
 		buffer: &bytes.Buffer{},
 		exec:   execer,
 	}
-
-	nft.path, err = nft.exec.LookPath("nft")
-	if err != nil {
-		return nil, fmt.Errorf("could not find nftables binary: %w", err)
-	}
-
-	cmd := exec.Command(nft.path, "--version")
-	out, err := nft.exec.Run(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("could not run nftables command: %w", err)
+	for _, opt := range opts {
+		opt(nft)
 	}
-	if strings.HasPrefix(out, "nftables v0.") || strings.HasPrefix(out, "nftables v1.0.0 ") {
-		return nil, fmt.Errorf("nft version must be v1.0.1 or later (got %s)", strings.TrimSpace(out))
+	if err := nft.setupCommand(); err != nil {
+		return nil, err
 	}
 
 	// Check that (a) nft works, (b) we have permission, (c) the kernel is new enough
@@ -128,10 +325,186 @@ func newInternal(family Family, table string, execer execer) (Interface, error)
 	return nft, nil
 }
 
-// New creates a new nftables.Interface for interacting with the given table. If nftables
-// is not available/usable on the current host, it will return an error.
-func New(family Family, table string) (Interface, error) {
-	return newInternal(family, table, realExec{})
+// setupCommand finds the nft binary (and command prefix binary, if any), fills in
+// nft.argv, and checks that the nft version is new enough.
+func (nft *realNFTables) setupCommand() error {
+	var err error
+
+	if nft.binary == "" {
+		nft.binary = "nft"
+	}
+	nft.path, err = nft.exec.LookPath(nft.binary)
+	if err != nil {
+		return fmt.Errorf("could not find nftables binary: %w", err)
+	}
+	prefix := nft.commandPrefix
+	if nft.netns != "" {
+		prefix = append([]string{"nsenter", "--net=" + nft.netns, "--"}, prefix...)
+	}
+	if len(prefix) > 0 {
+		prefixPath, err := nft.exec.LookPath(prefix[0])
+		if err != nil {
+			return fmt.Errorf("could not find command prefix binary: %w", err)
+		}
+		nft.argv = append(nft.argv, prefixPath)
+		nft.argv = append(nft.argv, prefix[1:]...)
+	}
+	nft.argv = append(nft.argv, nft.path)
+	nft.argv = append(nft.argv, nft.globalArgs...)
+
+	ctx := context.Background()
+	cmd := nft.command(ctx, "--version")
+	out, err := nft.exec.Run(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("could not run nftables command: %w", err)
+	}
+	if strings.HasPrefix(out, "nftables v0.") || strings.HasPrefix(out, "nftables v1.0.0 ") {
+		return fmt.Errorf("nft version must be v1.0.1 or later (got %s)", strings.TrimSpace(out))
+	}
+	if match := versionRegexp.FindStringSubmatch(out); match != nil {
+		for i := range nft.version {
+			nft.version[i], _ = strconv.Atoi(match[i+1])
+		}
+	}
+	return nil
+}
+
+// command returns an exec.Cmd to run nft with the given arguments (along with any
+// command prefix and global arguments).
+func (nft *realNFTables) command(ctx context.Context, args ...string) *exec.Cmd {
+	fullArgs := make([]string, 0, len(nft.argv)-1+len(args))
+	fullArgs = append(fullArgs, nft.argv[1:]...)
+	fullArgs = append(fullArgs, args...)
+	cmd := exec.CommandContext(ctx, nft.argv[0], fullArgs...)
+	if nft.killDelay != 0 {
+		killProcessGroupOnCancel(cmd)
+		cmd.WaitDelay = nft.killDelay
+	}
+	return cmd
+}
+
+// run runs cmd (which must have been created with ctx), returning its output. If it
+// fails because ctx's deadline passed, the returned error will be one for which
+// IsTimeout returns true.
+func (nft *realNFTables) run(ctx context.Context, cmd *exec.Cmd) (string, error) {
+	out, err := nft.exec.Run(ctx, cmd)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = timeoutError(err)
+	}
+	return out, err
+}
+
+// runJSON runs cmd (which must have been created with ctx) and returns the objects of
+// objectType from its "nft --json list" output, which is decoded as it is read rather
+// than being collected in memory first. As with run, if it fails because ctx's deadline
+// passed, the returned error will be one for which IsTimeout returns true.
+func (nft *realNFTables) runJSON(ctx context.Context, cmd *exec.Cmd, objectType string) ([]map[string]interface{}, error) {
+	var objects []map[string]interface{}
+	err := nft.runDecode(ctx, cmd, func(r io.Reader) (err error) {
+		objects, err = decodeJSONObjects(r, objectType)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// runDecode runs cmd (which must have been created with ctx), passing its "nft --json
+// list" output to decode as it is read. Errors are handled as with runJSON.
+func (nft *realNFTables) runDecode(ctx context.Context, cmd *exec.Cmd, decode func(r io.Reader) error) error {
+	var parseErr error
+	err := nft.exec.RunReader(ctx, cmd, func(r io.Reader) {
+		parseErr = decode(r)
+	})
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = timeoutError(err)
+		}
+		return fmt.Errorf("failed to run nft: %w", err)
+	}
+	if parseErr != nil {
+		return fmt.Errorf("unable to parse JSON output: %w", parseErr)
+	}
+	return nil
+}
+
+// New creates a new nftables.Interface for interacting with the given table, with the
+// given options (if any). If nftables is not available/usable on the current host, it
+// will return an error.
+func New(family Family, table string, opts ...Option) (Interface, error) {
+	return newInternal(family, table, realExec{}, opts...)
+}
+
+// Available checks whether nftables is usable on the current host (with the given
+// options, if any), without reference to any particular table: it checks that the nft
+// binary exists and is new enough, and that the kernel allows us to list the ruleset.
+// This can be used to decide whether to fall back to some other firewall mechanism
+// before calling New.
+func Available(opts ...Option) error {
+	return availableInternal(realExec{}, opts...)
+}
+
+// availableInternal implements Available; this is split out so it can be used from unit
+// tests with a fakeExec.
+func availableInternal(execer execer, opts ...Option) error {
+	nft := &realNFTables{
+		buffer: &bytes.Buffer{},
+		exec:   execer,
+	}
+	for _, opt := range opts {
+		opt(nft)
+	}
+	if err := nft.setupCommand(); err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(context.Background(), nft.listTimeout)
+	defer cancel()
+	cmd := nft.command(ctx, "list", "tables")
+	if _, err := nft.run(ctx, cmd); err != nil {
+		return fmt.Errorf("could not run nftables command: %w", err)
+	}
+	return nil
+}
+
+// withTimeout returns ctx with the given timeout applied, unless timeout is 0 or ctx
+// already has a deadline.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// runContext returns the context to use for a Run or Check operation
+func (nft *realNFTables) runContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, nft.runTimeout)
+}
+
+// listContext returns the context to use for a List operation
+func (nft *realNFTables) listContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, nft.listTimeout)
+}
+
+var versionRegexp = regexp.MustCompile(`^nftables v([0-9]+)\.([0-9]+)\.([0-9]+)`)
+
+// Version is part of Interface
+func (nft *realNFTables) Version() (major, minor, patch int) {
+	return nft.version[0], nft.version[1], nft.version[2]
+}
+
+// HasFeature is part of Interface
+func (nft *realNFTables) HasFeature(feature Feature) bool {
+	switch feature {
+	case ObjectCommentsFeature:
+		return !nft.noObjectComments
+	default:
+		return false
+	}
 }
 
 // NewTransaction is part of Interface
@@ -154,10 +527,15 @@ func (nft *realNFTables) Run(ctx context.Context, tx *Transaction) error {
 		return err
 	}
 
-	cmd := exec.CommandContext(ctx, nft.path, "-f", "-")
+	ctx, cancel := nft.runContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "-f", "-")
 	cmd.Stdin = nft.buffer
-	_, err = nft.exec.Run(cmd)
-	return err
+	_, err = nft.run(ctx, cmd)
+	if err != nil {
+		return tx.annotateError(err)
+	}
+	return nil
 }
 
 // Check is part of Interface
@@ -175,10 +553,70 @@ func (nft *realNFTables) Check(ctx context.Context, tx *Transaction) error {
 		return err
 	}
 
-	cmd := exec.CommandContext(ctx, nft.path, "--check", "-f", "-")
+	ctx, cancel := nft.runContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "--check", "-f", "-")
 	cmd.Stdin = nft.buffer
-	_, err = nft.exec.Run(cmd)
-	return err
+	_, err = nft.run(ctx, cmd)
+	if err != nil {
+		return tx.annotateError(err)
+	}
+	return nil
+}
+
+// FlushTable is part of Interface
+func (nft *realNFTables) FlushTable(ctx context.Context) error {
+	tx := nft.NewTransaction()
+	tx.Flush(&Table{})
+	return nft.Run(ctx, tx)
+}
+
+// SwapTable is part of Interface
+func (nft *realNFTables) SwapTable(ctx context.Context, build func(tx *Transaction)) error {
+	return swapTable(ctx, nft, build)
+}
+
+// swapTable implements SwapTable for both realNFTables and Fake
+func swapTable(ctx context.Context, nft Interface, build func(tx *Transaction)) error {
+	newTx := nft.NewTransaction()
+	build(newTx)
+
+	tx := nft.NewTransaction()
+	// "add" first, so that the "delete" won't fail if the table doesn't exist yet.
+	tx.Add(&Table{})
+	tx.Delete(&Table{})
+	if len(newTx.operations) == 0 || !isTableAdd(newTx.operations[0]) {
+		tx.Add(&Table{})
+	}
+	tx.Append(newTx)
+	return nft.Run(ctx, tx)
+}
+
+// ReplaceTable is part of Interface
+func (nft *realNFTables) ReplaceTable(ctx context.Context, desired *Fake) error {
+	return replaceTable(ctx, nft, &nft.nftContext, desired)
+}
+
+// replaceTable implements ReplaceTable for both realNFTables and Fake
+func replaceTable(ctx context.Context, nft Interface, nftCtx *nftContext, desired *Fake) error {
+	if desired.family != nftCtx.family || desired.table != nftCtx.table {
+		return fmt.Errorf("cannot replace %s %s with %s %s", nftCtx.family, nftCtx.table, desired.family, desired.table)
+	}
+
+	snapshot := desired.Snapshot()
+	if snapshot == nil {
+		tx := nft.NewTransaction()
+		// "add" first, so that the "delete" won't fail if the table doesn't exist.
+		tx.Add(&Table{})
+		tx.Delete(&Table{})
+		return nft.Run(ctx, tx)
+	}
+	return swapTable(ctx, nft, snapshot.addToTransaction)
+}
+
+func isTableAdd(op operation) bool {
+	_, isTable := op.obj.(*Table)
+	return isTable && (op.verb == addVerb || op.verb == createVerb)
 }
 
 // jsonVal looks up key in json; if it exists and is of type T, it returns (json[key], true).
@@ -192,10 +630,13 @@ func jsonVal[T any](json map[string]interface{}, key string) (T, bool) {
 	return zero, false
 }
 
-// getJSONObjects takes the output of "nft -j list", validates it, and returns an array
-// of just the objects of objectType.
-func getJSONObjects(listOutput, objectType string) ([]map[string]interface{}, error) {
-	// listOutput should contain JSON looking like:
+// decodeJSONObjects reads the output of "nft -j list" from r, validates it, and returns
+// an array of just the objects of objectType. The output is decoded one object at a
+// time, and only the objects of objectType are fully unmarshalled, so (when r is a pipe
+// from nft) the memory used is proportional to the size of the result rather than the
+// size of the entire output.
+func decodeJSONObjects(r io.Reader, objectType string) ([]map[string]interface{}, error) {
+	// The output should contain JSON looking like:
 	//
 	// {
 	//   "nftables": [
@@ -243,33 +684,113 @@ func getJSONObjects(listOutput, objectType string) ([]map[string]interface{}, er
 	//   ...
 	// ]
 
-	jsonResult := map[string][]map[string]map[string]interface{}{}
-	if err := json.Unmarshal([]byte(listOutput), &jsonResult); err != nil {
-		return nil, fmt.Errorf("could not parse nft output: %w", err)
+	var objects []map[string]interface{}
+	err := decodeJSONOutput(r, func(rawType string, raw json.RawMessage) error {
+		if rawType != objectType {
+			return nil
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return fmt.Errorf("could not parse nft output: %w", err)
+		}
+		if obj != nil {
+			objects = append(objects, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// decodeJSONOutput reads the output of "nft -j list" from r, validates it, and calls
+// visit with the type and raw JSON value of each object in it, in order.
+func decodeJSONOutput(r io.Reader, visit func(objectType string, raw json.RawMessage) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	foundResult := false
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("could not parse nft output: %w", err)
+		}
+		if key != "nftables" || foundResult {
+			var ignored []interface{}
+			if err := dec.Decode(&ignored); err != nil {
+				return fmt.Errorf("could not parse nft output: %w", err)
+			}
+			continue
+		}
+
+		if err := expectJSONDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var objContainer map[string]json.RawMessage
+			if err := dec.Decode(&objContainer); err != nil {
+				return fmt.Errorf("could not parse nft output: %w", err)
+			}
+			if !foundResult {
+				foundResult = true
+				if err := checkJSONMetainfo(objContainer["metainfo"]); err != nil {
+					return err
+				}
+				continue
+			}
+
+			for objectType, raw := range objContainer {
+				if err := visit(objectType, raw); err != nil {
+					return err
+				}
+			}
+		}
+		if err := expectJSONDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	if err := expectJSONDelim(dec, '}'); err != nil {
+		return err
+	}
+
+	if !foundResult {
+		return fmt.Errorf("could not find result in nft output")
+	}
+	return nil
+}
+
+// expectJSONDelim reads the next token from dec and returns an error if it is not delim.
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("could not parse nft output: %w", err)
+	}
+	if token != delim {
+		return fmt.Errorf("could not parse nft output: expected %q, got %v", delim, token)
 	}
+	return nil
+}
 
-	nftablesResult := jsonResult["nftables"]
-	if len(nftablesResult) == 0 {
-		return nil, fmt.Errorf("could not find result in nft output %q", listOutput)
+// checkJSONMetainfo validates the "metainfo" object from "nft -j list" output.
+func checkJSONMetainfo(raw json.RawMessage) error {
+	var metainfo map[string]interface{}
+	if raw != nil {
+		if err := json.Unmarshal(raw, &metainfo); err != nil {
+			return fmt.Errorf("could not parse nft output: %w", err)
+		}
 	}
-	metainfo := nftablesResult[0]["metainfo"]
 	if metainfo == nil {
-		return nil, fmt.Errorf("could not find metadata in nft output %q", listOutput)
+		return fmt.Errorf("could not find metadata in nft output")
 	}
 	// json_schema_version is an integer but `json.Unmarshal()` will have parsed it as
 	// a float64 since we didn't tell it otherwise.
 	if version, ok := jsonVal[float64](metainfo, "json_schema_version"); !ok || version != 1.0 {
-		return nil, fmt.Errorf("could not find supported json_schema_version in nft output %q", listOutput)
-	}
-
-	var objects []map[string]interface{}
-	for _, objContainer := range nftablesResult {
-		obj := objContainer[objectType]
-		if obj != nil {
-			objects = append(objects, obj)
-		}
+		return fmt.Errorf("could not find supported json_schema_version in nft output metainfo %s", string(raw))
 	}
-	return objects, nil
+	return nil
 }
 
 // List is part of Interface.
@@ -285,13 +806,10 @@ func (nft *realNFTables) List(ctx context.Context, objectType string) ([]string,
 		typePlural = objectType + "s"
 	}
 
-	cmd := exec.CommandContext(ctx, nft.path, "--json", "list", typePlural, string(nft.family))
-	out, err := nft.exec.Run(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("failed to run nft: %w", err)
-	}
-
-	objects, err := getJSONObjects(out, typeSingular)
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "--json", "list", typePlural, string(nft.family))
+	objects, err := nft.runJSON(ctx, cmd, typeSingular)
 	if err != nil {
 		return nil, err
 	}
@@ -310,126 +828,880 @@ func (nft *realNFTables) List(ctx context.Context, objectType string) ([]string,
 	return result, nil
 }
 
-// ListRules is part of Interface
-func (nft *realNFTables) ListRules(ctx context.Context, chain string) ([]*Rule, error) {
-	// If no chain is given, return all rules from within the table.
-	var cmd *exec.Cmd
-	if chain == "" {
-		cmd = exec.CommandContext(ctx, nft.path, "--json", "list", "table", string(nft.family), nft.table)
-	} else {
-		cmd = exec.CommandContext(ctx, nft.path, "--json", "list", "chain", string(nft.family), nft.table, chain)
-	}
-	out, err := nft.exec.Run(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("failed to run nft: %w", err)
-	}
-
-	jsonRules, err := getJSONObjects(out, "rule")
+// listTableObjects runs "nft --json list <objectType>s" and returns the JSON objects
+// of objectType belonging to nft's table.
+func (nft *realNFTables) listTableObjects(ctx context.Context, objectType string) ([]map[string]interface{}, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "--json", "list", objectType+"s", string(nft.family))
+	objects, err := nft.runJSON(ctx, cmd, objectType)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse JSON output: %w", err)
+		return nil, err
 	}
 
-	rules := make([]*Rule, 0, len(jsonRules))
-	for _, jsonRule := range jsonRules {
-		parentChain, ok := jsonVal[string](jsonRule, "chain")
-		if !ok {
-			return nil, fmt.Errorf("unexpected JSON output from nft (rule with no chain)")
-		}
-		rule := &Rule{
-			Chain: parentChain,
+	result := make([]map[string]interface{}, 0, len(objects))
+	for _, obj := range objects {
+		if objTable, _ := jsonVal[string](obj, "table"); objTable == nft.table {
+			result = append(result, obj)
 		}
+	}
+	return result, nil
+}
 
-		// handle is written as an integer in nft's output, but json.Unmarshal
-		// will have parsed it as a float64. (Handles are uint64s, but they are
-		// assigned consecutively starting from 1, so as long as fewer than 2**53
-		// nftables objects have been created since boot time, we won't run into
-		// float64-vs-uint64 precision issues.)
-		if handle, ok := jsonVal[float64](jsonRule, "handle"); ok {
-			rule.Handle = PtrTo(int(handle))
-		}
-		if comment, ok := jsonVal[string](jsonRule, "comment"); ok {
-			rule.Comment = &comment
-		}
+// ListChains is part of Interface
+func (nft *realNFTables) ListChains(ctx context.Context) ([]*Chain, error) {
+	jsonChains, err := nft.listTableObjects(ctx, "chain")
+	if err != nil {
+		return nil, err
+	}
 
-		rules = append(rules, rule)
+	chains := make([]*Chain, 0, len(jsonChains))
+	for _, jsonChain := range jsonChains {
+		chains = append(chains, parseJSONChain(jsonChain))
 	}
-	return rules, nil
+	return chains, nil
 }
 
-// ListElements is part of Interface
-func (nft *realNFTables) ListElements(ctx context.Context, objectType, name string) ([]*Element, error) {
-	cmd := exec.CommandContext(ctx, nft.path, "--json", "list", objectType, string(nft.family), nft.table, name)
-	out, err := nft.exec.Run(cmd)
+// ListSets is part of Interface
+func (nft *realNFTables) ListSets(ctx context.Context) ([]*Set, error) {
+	jsonSets, err := nft.listTableObjects(ctx, "set")
 	if err != nil {
-		return nil, fmt.Errorf("failed to run nft: %w", err)
+		return nil, err
+	}
+
+	sets := make([]*Set, 0, len(jsonSets))
+	for _, jsonSet := range jsonSets {
+		set, err := parseJSONSet(jsonSet)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
 	}
+	return sets, nil
+}
 
-	jsonSetsOrMaps, err := getJSONObjects(out, objectType)
+// ListMaps is part of Interface
+func (nft *realNFTables) ListMaps(ctx context.Context) ([]*Map, error) {
+	jsonMaps, err := nft.listTableObjects(ctx, "map")
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse JSON output: %w", err)
+		return nil, err
+	}
+
+	maps := make([]*Map, 0, len(jsonMaps))
+	for _, jsonMap := range jsonMaps {
+		mapObj, err := parseJSONMap(jsonMap)
+		if err != nil {
+			return nil, err
+		}
+		maps = append(maps, mapObj)
+	}
+	return maps, nil
+}
+
+// getObject runs "nft --json list <objectType> <family> <table> [name]" and returns the
+// single JSON object of objectType in the result.
+func (nft *realNFTables) getObject(ctx context.Context, objectType string, name string) (map[string]interface{}, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	args := []string{"--json", "list", objectType, string(nft.family), nft.table}
+	if name != "" {
+		args = append(args, name)
+	}
+	cmd := nft.command(ctx, args...)
+	objects, err := nft.runJSON(ctx, cmd, objectType)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) != 1 {
+		return nil, fmt.Errorf("unexpected JSON output from nft (%d results)", len(objects))
+	}
+	return objects[0], nil
+}
+
+// GetTable is part of Interface
+func (nft *realNFTables) GetTable(ctx context.Context) (*Table, error) {
+	jsonTable, err := nft.getObject(ctx, "table", "")
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONTable(jsonTable), nil
+}
+
+// GetChain is part of Interface
+func (nft *realNFTables) GetChain(ctx context.Context, name string) (*Chain, error) {
+	jsonChain, err := nft.getObject(ctx, "chain", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONChain(jsonChain), nil
+}
+
+// GetSet is part of Interface
+func (nft *realNFTables) GetSet(ctx context.Context, name string) (*Set, error) {
+	jsonSet, err := nft.getObject(ctx, "set", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONSet(jsonSet)
+}
+
+// GetMap is part of Interface
+func (nft *realNFTables) GetMap(ctx context.Context, name string) (*Map, error) {
+	jsonMap, err := nft.getObject(ctx, "map", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONMap(jsonMap)
+}
+
+// listTableContents runs "nft list table" and returns the JSON objects of objectType.
+// (This is used for object types that can't be listed individually.)
+func (nft *realNFTables) listTableContents(ctx context.Context, objectType string) ([]map[string]interface{}, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "--json", "list", "table", string(nft.family), nft.table)
+	objects, err := nft.runJSON(ctx, cmd, objectType)
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// ListCTHelpers is part of Interface
+func (nft *realNFTables) ListCTHelpers(ctx context.Context) ([]*CTHelper, error) {
+	jsonHelpers, err := nft.listTableContents(ctx, "ct helper")
+	if err != nil {
+		return nil, err
+	}
+
+	helpers := make([]*CTHelper, 0, len(jsonHelpers))
+	for _, jsonHelper := range jsonHelpers {
+		helpers = append(helpers, parseJSONCTHelper(jsonHelper))
+	}
+	return helpers, nil
+}
+
+// ListCTTimeouts is part of Interface
+func (nft *realNFTables) ListCTTimeouts(ctx context.Context) ([]*CTTimeout, error) {
+	jsonTimeouts, err := nft.listTableContents(ctx, "ct timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := make([]*CTTimeout, 0, len(jsonTimeouts))
+	for _, jsonTimeout := range jsonTimeouts {
+		timeout, err := parseJSONCTTimeout(jsonTimeout)
+		if err != nil {
+			return nil, err
+		}
+		timeouts = append(timeouts, timeout)
+	}
+	return timeouts, nil
+}
+
+// ListCTExpectations is part of Interface
+func (nft *realNFTables) ListCTExpectations(ctx context.Context) ([]*CTExpectation, error) {
+	jsonExpectations, err := nft.listTableContents(ctx, "ct expectation")
+	if err != nil {
+		return nil, err
+	}
+
+	expectations := make([]*CTExpectation, 0, len(jsonExpectations))
+	for _, jsonExpectation := range jsonExpectations {
+		expectations = append(expectations, parseJSONCTExpectation(jsonExpectation))
+	}
+	return expectations, nil
+}
+
+// ListSynproxies is part of Interface
+func (nft *realNFTables) ListSynproxies(ctx context.Context) ([]*Synproxy, error) {
+	jsonSynproxies, err := nft.listTableContents(ctx, "synproxy")
+	if err != nil {
+		return nil, err
+	}
+
+	synproxies := make([]*Synproxy, 0, len(jsonSynproxies))
+	for _, jsonSynproxy := range jsonSynproxies {
+		synproxies = append(synproxies, parseJSONSynproxy(jsonSynproxy))
+	}
+	return synproxies, nil
+}
+
+// Verify is part of Interface
+func (nft *realNFTables) Verify(ctx context.Context, expected *Fake) ([]Difference, error) {
+	return verify(&nft.nftContext, expected, func() (*FakeTable, error) {
+		return nft.readTable(ctx)
+	})
+}
+
+// maxReadTableAttempts is the number of times readTable will try to read the table
+// before giving up, if it keeps changing while being read.
+const maxReadTableAttempts = 3
+
+// readTable reads the entire contents of the table, or returns nil if it does not
+// exist. Everything but the rule texts comes from a single "nft --json list table";
+// since the JSON output does not include rules in nft syntax, the rule texts then come
+// from "nft --handle list table", and are matched up with the JSON rules by handle. If
+// the rules were added or deleted in between, the table is read again. (A rule that was
+// replaced in between keeps its handle, so that can't be detected.)
+func (nft *realNFTables) readTable(ctx context.Context) (*FakeTable, error) {
+	for attempt := 1; ; attempt++ {
+		table, err := nft.readTableJSON(ctx)
+		if err != nil {
+			if IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		ruleTexts, err := nft.readRuleTexts(ctx)
+		if err != nil && !IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil && fillRuleTexts(table, ruleTexts) {
+			return table, nil
+		}
+		if attempt == maxReadTableAttempts {
+			return nil, fmt.Errorf("table %s %s changed while it was being read", nft.family, nft.table)
+		}
+	}
+}
+
+// readTableJSON runs "nft --json list table" and parses all of its output (other than
+// the rule texts) into a FakeTable.
+func (nft *realNFTables) readTableJSON(ctx context.Context) (*FakeTable, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "--json", "list", "table", string(nft.family), nft.table)
+
+	table := &FakeTable{
+		Flowtables:     make(map[string]*FakeFlowtable),
+		CTHelpers:      make(map[string]*FakeCTHelper),
+		CTTimeouts:     make(map[string]*FakeCTTimeout),
+		CTExpectations: make(map[string]*FakeCTExpectation),
+		Synproxies:     make(map[string]*FakeSynproxy),
+		Chains:         make(map[string]*FakeChain),
+		Sets:           make(map[string]*FakeSet),
+		Maps:           make(map[string]*FakeMap),
+	}
+	err := nft.runDecode(ctx, cmd, func(r io.Reader) error {
+		return decodeJSONOutput(r, func(objectType string, raw json.RawMessage) error {
+			var obj map[string]interface{}
+			if err := json.Unmarshal(raw, &obj); err != nil {
+				return fmt.Errorf("could not parse nft output: %w", err)
+			}
+			return addJSONObject(table, objectType, obj)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// addJSONObject parses a JSON object of objectType from "nft --json list table" output
+// and adds it to table. Object types that knftables does not support are ignored.
+func addJSONObject(table *FakeTable, objectType string, obj map[string]interface{}) error {
+	switch objectType {
+	case "table":
+		table.Table = *parseJSONTable(obj)
+	case "flowtable":
+		flowtable := parseJSONFlowtable(obj)
+		table.Flowtables[flowtable.Name] = &FakeFlowtable{Flowtable: *flowtable}
+	case "ct helper":
+		helper := parseJSONCTHelper(obj)
+		table.CTHelpers[helper.Name] = &FakeCTHelper{CTHelper: *helper}
+	case "ct timeout":
+		timeout, err := parseJSONCTTimeout(obj)
+		if err != nil {
+			return err
+		}
+		table.CTTimeouts[timeout.Name] = &FakeCTTimeout{CTTimeout: *timeout}
+	case "ct expectation":
+		expectation := parseJSONCTExpectation(obj)
+		table.CTExpectations[expectation.Name] = &FakeCTExpectation{CTExpectation: *expectation}
+	case "synproxy":
+		synproxy := parseJSONSynproxy(obj)
+		table.Synproxies[synproxy.Name] = &FakeSynproxy{Synproxy: *synproxy}
+	case "chain":
+		chain := parseJSONChain(obj)
+		table.Chains[chain.Name] = &FakeChain{Chain: *chain}
+	case "rule":
+		// nft outputs each chain before its rules, and each chain's rules in order.
+		chainName, _ := jsonVal[string](obj, "chain")
+		chain := table.Chains[chainName]
+		if chain == nil {
+			return fmt.Errorf("unexpected JSON output from nft (rule in unknown chain %q)", chainName)
+		}
+		rule := &Rule{Chain: chainName}
+		if handle, ok := jsonVal[float64](obj, "handle"); ok {
+			rule.Handle = PtrTo(int(handle))
+		}
+		if comment, ok := jsonVal[string](obj, "comment"); ok {
+			rule.Comment = &comment
+		}
+		chain.Rules = append(chain.Rules, rule)
+	case "set":
+		set, err := parseJSONSet(obj)
+		if err != nil {
+			return err
+		}
+		elements, err := parseJSONElements(obj, "set", set.Name)
+		if err != nil {
+			return err
+		}
+		table.Sets[set.Name] = &FakeSet{Set: *set, Elements: elements}
+	case "map":
+		mapObj, err := parseJSONMap(obj)
+		if err != nil {
+			return err
+		}
+		elements, err := parseJSONElements(obj, "map", mapObj.Name)
+		if err != nil {
+			return err
+		}
+		table.Maps[mapObj.Name] = &FakeMap{Map: *mapObj, Elements: elements}
+	}
+	return nil
+}
+
+// readRuleTexts runs "nft --handle list table" and returns the text of each rule
+// (without its comment), keyed by handle.
+func (nft *realNFTables) readRuleTexts(ctx context.Context) (map[int]string, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "--handle", "list", "table", string(nft.family), nft.table)
+	out, err := nft.run(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	ruleTexts := make(map[int]string)
+	depth := 0
+	inChain := false
+	for _, line := range strings.Split(out, "\n") {
+		line, handle := stripHandleComment(strings.TrimSpace(line))
+		switch {
+		case strings.HasSuffix(line, "{"):
+			depth++
+			if depth == 2 {
+				inChain = strings.HasPrefix(line, "chain ")
+			}
+		case line == "}":
+			depth--
+		case depth == 2 && inChain && handle != nil:
+			ruleTexts[*handle] = chainRuleCommentRegexp.ReplaceAllString(line, "")
+		}
+	}
+	return ruleTexts, nil
+}
+
+// fillRuleTexts fills in the text of each of table's rules from ruleTexts. It returns
+// false if the rules in ruleTexts do not exactly match the rules in table.
+func fillRuleTexts(table *FakeTable, ruleTexts map[int]string) bool {
+	numRules := 0
+	for _, chain := range table.Chains {
+		for _, rule := range chain.Rules {
+			if rule.Handle == nil {
+				return false
+			}
+			text, ok := ruleTexts[*rule.Handle]
+			if !ok {
+				return false
+			}
+			rule.Rule = text
+			numRules++
+		}
+	}
+	return numRules == len(ruleTexts)
+}
+
+// parseJSONStrings parses a JSON value that is either a single string or an array of
+// strings (as with "flags" and "dev").
+func parseJSONStrings(json interface{}) []string {
+	switch val := json.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		var strs []string
+		for i := range val {
+			if str, ok := val[i].(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// parseJSONTable parses a JSON "table" object.
+func parseJSONTable(jsonTable map[string]interface{}) *Table {
+	table := &Table{}
+	for _, flag := range parseJSONStrings(jsonTable["flags"]) {
+		table.Flags = append(table.Flags, TableFlag(flag))
+	}
+	if comment, ok := jsonVal[string](jsonTable, "comment"); ok {
+		table.Comment = &comment
+	}
+	if handle, ok := jsonVal[float64](jsonTable, "handle"); ok {
+		table.Handle = PtrTo(int(handle))
+	}
+	return table
+}
+
+// parseJSONChain parses a JSON "chain" object.
+func parseJSONChain(jsonChain map[string]interface{}) *Chain {
+	chain := &Chain{}
+	chain.Name, _ = jsonVal[string](jsonChain, "name")
+	if chainType, ok := jsonVal[string](jsonChain, "type"); ok {
+		chain.Type = PtrTo(BaseChainType(chainType))
+	}
+	if hook, ok := jsonVal[string](jsonChain, "hook"); ok {
+		chain.Hook = PtrTo(BaseChainHook(hook))
+	}
+	if prio, ok := jsonVal[float64](jsonChain, "prio"); ok {
+		chain.Priority = PtrTo(BaseChainPriority(fmt.Sprintf("%d", int(prio))))
+	}
+	if policy, ok := jsonVal[string](jsonChain, "policy"); ok {
+		chain.Policy = PtrTo(BaseChainPolicy(policy))
+	}
+	if devices := parseJSONStrings(jsonChain["dev"]); len(devices) == 1 {
+		chain.Device = &devices[0]
+	} else if len(devices) > 1 {
+		chain.Devices = devices
+	}
+	if comment, ok := jsonVal[string](jsonChain, "comment"); ok {
+		chain.Comment = &comment
+	}
+	if handle, ok := jsonVal[float64](jsonChain, "handle"); ok {
+		chain.Handle = PtrTo(int(handle))
+	}
+	return chain
+}
+
+// parseJSONType parses a JSON set/map "type" or "map" value, which is either a string
+// (for a simple type) or an array of strings (for a concatenation), into nft syntax.
+func parseJSONType(json interface{}) (string, error) {
+	switch val := json.(type) {
+	case string:
+		return val, nil
+	case []interface{}:
+		types := make([]string, len(val))
+		for i := range val {
+			str, ok := val[i].(string)
+			if !ok {
+				return "", fmt.Errorf("could not parse type %q", json)
+			}
+			types[i] = str
+		}
+		return strings.Join(types, " . "), nil
+	}
+	return "", fmt.Errorf("could not parse type %q", json)
+}
+
+// parseJSONSet parses a JSON "set" object. (It is also used to parse the common
+// properties of "map" objects.)
+func parseJSONSet(jsonSet map[string]interface{}) (*Set, error) {
+	name, ok := jsonVal[string](jsonSet, "name")
+	if !ok {
+		return nil, fmt.Errorf("unexpected JSON output from nft (set with no name)")
+	}
+	set := &Set{Name: name}
+
+	setType, err := parseJSONType(jsonSet["type"])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected JSON output from nft (set %q): %w", name, err)
+	}
+	set.Type = setType
+
+	// flags is normally an array, but may be a single string if there is only one
+	// flag.
+	if flags, ok := jsonVal[[]interface{}](jsonSet, "flags"); ok {
+		for _, flag := range flags {
+			if str, ok := flag.(string); ok {
+				set.Flags = append(set.Flags, SetFlag(str))
+			}
+		}
+	} else if flag, ok := jsonVal[string](jsonSet, "flags"); ok {
+		set.Flags = []SetFlag{SetFlag(flag)}
+	}
+
+	// As with handles (see ListRules), numbers will have been parsed as float64s.
+	if timeout, ok := jsonVal[float64](jsonSet, "timeout"); ok {
+		set.Timeout = PtrTo(time.Duration(timeout) * time.Second)
+	}
+	if gcInterval, ok := jsonVal[float64](jsonSet, "gc-interval"); ok {
+		set.GCInterval = PtrTo(time.Duration(gcInterval) * time.Second)
+	}
+	if size, ok := jsonVal[float64](jsonSet, "size"); ok {
+		set.Size = PtrTo(uint64(size))
+	}
+	if policy, ok := jsonVal[string](jsonSet, "policy"); ok {
+		set.Policy = (*SetPolicy)(&policy)
+	}
+	if autoMerge, ok := jsonVal[bool](jsonSet, "auto-merge"); ok {
+		set.AutoMerge = &autoMerge
+	}
+	// Per-element statements show up as e.g. `"stmt": [{"counter": null}]`.
+	if stmts, ok := jsonVal[[]interface{}](jsonSet, "stmt"); ok {
+		for _, stmt := range stmts {
+			if obj, ok := stmt.(map[string]interface{}); ok {
+				if _, ok := obj["counter"]; ok {
+					set.Counters = PtrTo(true)
+				}
+			}
+		}
+	}
+	if comment, ok := jsonVal[string](jsonSet, "comment"); ok {
+		set.Comment = &comment
+	}
+	if handle, ok := jsonVal[float64](jsonSet, "handle"); ok {
+		set.Handle = PtrTo(int(handle))
+	}
+
+	return set, nil
+}
+
+// parseJSONMap parses a JSON "map" object.
+func parseJSONMap(jsonMap map[string]interface{}) (*Map, error) {
+	// Other than the value type (and auto-merge, which is not supported for maps),
+	// the JSON representation of a map is identical to that of a set.
+	set, err := parseJSONSet(jsonMap)
+	if err != nil {
+		return nil, err
+	}
+	valueType, err := parseJSONType(jsonMap["map"])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected JSON output from nft (map %q): %w", set.Name, err)
+	}
+
+	return &Map{
+		Name:       set.Name,
+		Type:       set.Type + " : " + valueType,
+		Flags:      set.Flags,
+		Timeout:    set.Timeout,
+		GCInterval: set.GCInterval,
+		Size:       set.Size,
+		Policy:     set.Policy,
+		Counters:   set.Counters,
+		Comment:    set.Comment,
+		Handle:     set.Handle,
+	}, nil
+}
+
+// parseJSONFlowtable parses a JSON "flowtable" object.
+func parseJSONFlowtable(jsonFlowtable map[string]interface{}) *Flowtable {
+	flowtable := &Flowtable{}
+	flowtable.Name, _ = jsonVal[string](jsonFlowtable, "name")
+	if prio, ok := jsonVal[float64](jsonFlowtable, "prio"); ok {
+		flowtable.Priority = PtrTo(FlowtableIngressPriority(fmt.Sprintf("%d", int(prio))))
+	}
+	flowtable.Devices = parseJSONStrings(jsonFlowtable["dev"])
+	if handle, ok := jsonVal[float64](jsonFlowtable, "handle"); ok {
+		flowtable.Handle = PtrTo(int(handle))
+	}
+	return flowtable
+}
+
+// parseJSONCTHelper parses a JSON "ct helper" object.
+func parseJSONCTHelper(jsonHelper map[string]interface{}) *CTHelper {
+	helper := &CTHelper{}
+	helper.Name, _ = jsonVal[string](jsonHelper, "name")
+	helper.Type, _ = jsonVal[string](jsonHelper, "type")
+	helper.Protocol, _ = jsonVal[string](jsonHelper, "protocol")
+	if l3proto, ok := jsonVal[string](jsonHelper, "l3proto"); ok {
+		helper.L3Proto = PtrTo(Family(l3proto))
+	}
+	if handle, ok := jsonVal[float64](jsonHelper, "handle"); ok {
+		helper.Handle = PtrTo(int(handle))
+	}
+	return helper
+}
+
+// parseJSONCTTimeout parses a JSON "ct timeout" object.
+func parseJSONCTTimeout(jsonTimeout map[string]interface{}) (*CTTimeout, error) {
+	timeout := &CTTimeout{}
+	timeout.Name, _ = jsonVal[string](jsonTimeout, "name")
+	timeout.Protocol, _ = jsonVal[string](jsonTimeout, "protocol")
+	if l3proto, ok := jsonVal[string](jsonTimeout, "l3proto"); ok {
+		timeout.L3Proto = PtrTo(Family(l3proto))
+	}
+	if policy, ok := jsonVal[map[string]interface{}](jsonTimeout, "policy"); ok {
+		timeout.Policy = make(map[string]time.Duration, len(policy))
+		for state, value := range policy {
+			seconds, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("unexpected JSON output from nft (bad ct timeout policy %q)", policy)
+			}
+			timeout.Policy[state] = time.Duration(seconds) * time.Second
+		}
+	}
+	if handle, ok := jsonVal[float64](jsonTimeout, "handle"); ok {
+		timeout.Handle = PtrTo(int(handle))
+	}
+	return timeout, nil
+}
+
+// parseJSONCTExpectation parses a JSON "ct expectation" object.
+func parseJSONCTExpectation(jsonExpectation map[string]interface{}) *CTExpectation {
+	expectation := &CTExpectation{}
+	expectation.Name, _ = jsonVal[string](jsonExpectation, "name")
+	expectation.Protocol, _ = jsonVal[string](jsonExpectation, "protocol")
+	if dport, ok := jsonVal[float64](jsonExpectation, "dport"); ok {
+		expectation.DPort = int(dport)
+	}
+	// The JSON timeout is in milliseconds
+	if timeout, ok := jsonVal[float64](jsonExpectation, "timeout"); ok {
+		expectation.Timeout = time.Duration(timeout) * time.Millisecond
+	}
+	if size, ok := jsonVal[float64](jsonExpectation, "size"); ok {
+		expectation.Size = int(size)
+	}
+	if l3proto, ok := jsonVal[string](jsonExpectation, "l3proto"); ok {
+		expectation.L3Proto = PtrTo(Family(l3proto))
+	}
+	if handle, ok := jsonVal[float64](jsonExpectation, "handle"); ok {
+		expectation.Handle = PtrTo(int(handle))
+	}
+	return expectation
+}
+
+// parseJSONSynproxy parses a JSON "synproxy" object.
+func parseJSONSynproxy(jsonSynproxy map[string]interface{}) *Synproxy {
+	synproxy := &Synproxy{}
+	synproxy.Name, _ = jsonVal[string](jsonSynproxy, "name")
+	if mss, ok := jsonVal[float64](jsonSynproxy, "mss"); ok {
+		synproxy.MSS = uint32(mss)
+	}
+	if wscale, ok := jsonVal[float64](jsonSynproxy, "wscale"); ok {
+		synproxy.WScale = uint8(wscale)
+	}
+	for _, flag := range parseJSONStrings(jsonSynproxy["flags"]) {
+		switch flag {
+		case "timestamp":
+			synproxy.Timestamp = PtrTo(true)
+		case "sack-perm":
+			synproxy.SACKPerm = PtrTo(true)
+		}
+	}
+	if handle, ok := jsonVal[float64](jsonSynproxy, "handle"); ok {
+		synproxy.Handle = PtrTo(int(handle))
+	}
+	return synproxy
+}
+
+// ListRules is part of Interface
+func (nft *realNFTables) ListRules(ctx context.Context, chain string) ([]*Rule, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	// If no chain is given, return all rules from within the table.
+	var cmd *exec.Cmd
+	if chain == "" {
+		cmd = nft.command(ctx, "--json", "list", "table", string(nft.family), nft.table)
+	} else {
+		cmd = nft.command(ctx, "--json", "list", "chain", string(nft.family), nft.table, chain)
+	}
+	jsonRules, err := nft.runJSON(ctx, cmd, "rule")
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*Rule, 0, len(jsonRules))
+	// nft outputs each chain's rules in order, so we can compute their indexes
+	// by counting.
+	indexes := make(map[string]int)
+	for _, jsonRule := range jsonRules {
+		parentChain, ok := jsonVal[string](jsonRule, "chain")
+		if !ok {
+			return nil, fmt.Errorf("unexpected JSON output from nft (rule with no chain)")
+		}
+		rule := &Rule{
+			Chain: parentChain,
+			Index: PtrTo(indexes[parentChain]),
+		}
+		indexes[parentChain]++
+
+		// handle is written as an integer in nft's output, but json.Unmarshal
+		// will have parsed it as a float64. (Handles are uint64s, but they are
+		// assigned consecutively starting from 1, so as long as fewer than 2**53
+		// nftables objects have been created since boot time, we won't run into
+		// float64-vs-uint64 precision issues.)
+		if handle, ok := jsonVal[float64](jsonRule, "handle"); ok {
+			rule.Handle = PtrTo(int(handle))
+		}
+		if comment, ok := jsonVal[string](jsonRule, "comment"); ok {
+			rule.Comment = &comment
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// chainRuleCommentRegexp matches the comment at the end of a rule in the output of "nft
+// list chain"
+var chainRuleCommentRegexp = regexp.MustCompile(` ?comment ".*"$`)
+
+// HasRule is part of Interface
+func (nft *realNFTables) HasRule(ctx context.Context, chain, ruleText string) (bool, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	// The JSON output doesn't include the rule text in nft syntax, so we have to
+	// parse the non-JSON output instead.
+	cmd := nft.command(ctx, "list", "chain", string(nft.family), nft.table, chain)
+	out, err := nft.run(ctx, cmd)
+	if err != nil {
+		return false, fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	ruleText = normalizeRuleText(StripCounters(ruleText))
+	depth := 0
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasSuffix(line, "{"):
+			depth++
+		case line == "}":
+			depth--
+		case depth == 2 && !strings.HasSuffix(line, ";"):
+			// A rule (or a chain comment, which will be stripped to "").
+			line = chainRuleCommentRegexp.ReplaceAllString(line, "")
+			if line != "" && normalizeRuleText(StripCounters(line)) == ruleText {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// ListElements is part of Interface
+func (nft *realNFTables) ListElements(ctx context.Context, objectType, name string) ([]*Element, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "--json", "list", objectType, string(nft.family), nft.table, name)
+	jsonSetsOrMaps, err := nft.runJSON(ctx, cmd, objectType)
+	if err != nil {
+		return nil, err
 	}
 	if len(jsonSetsOrMaps) != 1 {
 		return nil, fmt.Errorf("unexpected JSON output from nft (multiple results)")
 	}
 
-	jsonElements, _ := jsonVal[[]interface{}](jsonSetsOrMaps[0], "elem")
+	return parseJSONElements(jsonSetsOrMaps[0], objectType, name)
+}
+
+// parseJSONElements parses the elements of the JSON "set" or "map" (according to
+// objectType) object named name.
+func parseJSONElements(jsonSetOrMap map[string]interface{}, objectType, name string) ([]*Element, error) {
+	jsonElements, _ := jsonVal[[]interface{}](jsonSetOrMap, "elem")
 	elements := make([]*Element, 0, len(jsonElements))
 	for _, jsonElement := range jsonElements {
-		var key, value interface{}
-
-		elem := &Element{}
+		elem, err := parseJSONElement(jsonElement, objectType == "map")
+		if err != nil {
+			return nil, err
+		}
 		if objectType == "set" {
 			elem.Set = name
-			key = jsonElement
 		} else {
 			elem.Map = name
-			tuple, ok := jsonElement.([]interface{})
-			if !ok || len(tuple) != 2 {
-				return nil, fmt.Errorf("unexpected JSON output from nft (elem is not [key,val]: %q)", jsonElement)
+		}
+		elements = append(elements, elem)
+	}
+	return elements, nil
+}
+
+// SetStats is part of Interface
+func (nft *realNFTables) SetStats(ctx context.Context, name string) (*SetStats, error) {
+	ctx, cancel := nft.listContext(ctx)
+	defer cancel()
+	cmd := nft.command(ctx, "--json", "list", "set", string(nft.family), nft.table, name)
+	jsonSets, err := nft.runJSON(ctx, cmd, "set")
+	if err != nil {
+		return nil, err
+	}
+	if len(jsonSets) != 1 {
+		return nil, fmt.Errorf("unexpected JSON output from nft (multiple results)")
+	}
+
+	stats := &SetStats{}
+	jsonElements, _ := jsonVal[[]interface{}](jsonSets[0], "elem")
+	stats.Elements = len(jsonElements)
+	if size, ok := jsonVal[float64](jsonSets[0], "size"); ok {
+		stats.Size = PtrTo(uint64(size))
+	}
+	return stats, nil
+}
+
+// parseJSONElement parses a single JSON set or map element (without filling in the Set
+// or Map field).
+func parseJSONElement(jsonElement interface{}, isMap bool) (*Element, error) {
+	var key, value interface{}
+
+	elem := &Element{}
+	if !isMap {
+		key = jsonElement
+	} else {
+		tuple, ok := jsonElement.([]interface{})
+		if !ok || len(tuple) != 2 {
+			return nil, fmt.Errorf("unexpected JSON output from nft (elem is not [key,val]: %q)", jsonElement)
+		}
+		key, value = tuple[0], tuple[1]
+	}
+
+	// If the element has a comment, timeout, or counter, then key will be a compound
+	// object like:
+	//
+	//   {
+	//     "elem": {
+	//       "val": "192.168.0.1",
+	//       "timeout": 30,
+	//       "expires": 27,
+	//       "comment": "this is a comment",
+	//       "counter": { "packets": 12, "bytes": 1008 }
+	//     }
+	//   }
+	//
+	// (Where "val" contains the value that key would have held if there was no
+	// comment, timeout, or counter.)
+	if obj, ok := key.(map[string]interface{}); ok {
+		if compoundElem, ok := jsonVal[map[string]interface{}](obj, "elem"); ok {
+			if key, ok = jsonVal[interface{}](compoundElem, "val"); !ok {
+				return nil, fmt.Errorf("unexpected JSON output from nft (elem with no val: %q)", jsonElement)
 			}
-			key, value = tuple[0], tuple[1]
-		}
-
-		// If the element has a comment, then key will be a compound object like:
-		//
-		//   {
-		//     "elem": {
-		//       "val": "192.168.0.1",
-		//       "comment": "this is a comment"
-		//     }
-		//   }
-		//
-		// (Where "val" contains the value that key would have held if there was no
-		// comment.)
-		if obj, ok := key.(map[string]interface{}); ok {
-			if compoundElem, ok := jsonVal[map[string]interface{}](obj, "elem"); ok {
-				if key, ok = jsonVal[interface{}](compoundElem, "val"); !ok {
-					return nil, fmt.Errorf("unexpected JSON output from nft (elem with no val: %q)", jsonElement)
-				}
-				if comment, ok := jsonVal[string](compoundElem, "comment"); ok {
-					elem.Comment = &comment
-				}
+			if comment, ok := jsonVal[string](compoundElem, "comment"); ok {
+				elem.Comment = &comment
+			}
+			if timeout, ok := jsonVal[float64](compoundElem, "timeout"); ok {
+				elem.Timeout = PtrTo(time.Duration(timeout) * time.Second)
+			}
+			if expires, ok := jsonVal[float64](compoundElem, "expires"); ok {
+				elem.Expires = PtrTo(time.Duration(expires) * time.Second)
+			}
+			if counter, ok := jsonVal[map[string]interface{}](compoundElem, "counter"); ok {
+				packets, _ := jsonVal[float64](counter, "packets")
+				bytes, _ := jsonVal[float64](counter, "bytes")
+				elem.Packets = PtrTo(uint64(packets))
+				elem.Bytes = PtrTo(uint64(bytes))
 			}
 		}
+	}
 
-		elem.Key, err = parseElementValue(key)
+	var err error
+	elem.Key, err = parseElementValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if value != nil {
+		elem.Value, err = parseElementValue(value)
 		if err != nil {
 			return nil, err
 		}
-		if value != nil {
-			elem.Value, err = parseElementValue(value)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		elements = append(elements, elem)
 	}
-	return elements, nil
+	return elem, nil
 }
 
-// parseElementValue parses a JSON element key/value, handling concatenations, prefixes, and
-// converting numeric or "verdict" values to strings.
+// parseElementValue parses a JSON element key/value, handling concatenations, prefixes,
+// ranges, and converting numeric or "verdict" values to strings.
 func parseElementValue(json interface{}) ([]string, error) {
 	// json can be:
 	//
@@ -445,6 +1717,14 @@ func parseElementValue(json interface{}) ([]string, error) {
 	//       }
 	//     }
 	//
+	//   - a range, expressed as an object containing the start and end values:
+	//     {
+	//       "range": [
+	//         "10.0.0.0",
+	//         "10.0.0.255"
+	//       ]
+	//     }
+	//
 	//   - a concatenation, expressed as an object containing an array of simple
 	//     values:
 	//        {
@@ -479,6 +1759,13 @@ func parseElementValue(json interface{}) ([]string, error) {
 					vals[i] = str
 				} else if num, ok := concat[i].(float64); ok {
 					vals[i] = fmt.Sprintf("%d", int(num))
+				} else if nested, ok := concat[i].(map[string]interface{}); ok && (nested["prefix"] != nil || nested["range"] != nil) {
+					// A prefix or range within an interval concatenation
+					nestedVals, err := parseElementValue(nested)
+					if err != nil {
+						return nil, err
+					}
+					vals[i] = nestedVals[0]
 				} else {
 					return nil, fmt.Errorf("could not parse element value %q", concat[i])
 				}
@@ -495,6 +1782,19 @@ func parseElementValue(json interface{}) ([]string, error) {
 				return nil, fmt.Errorf("could not parse 'len' value as number: %q", prefix)
 			}
 			return []string{fmt.Sprintf("%s/%d", addr, int(length))}, nil
+		} else if rangeVal, _ := jsonVal[[]interface{}](val, "range"); len(rangeVal) == 2 {
+			// For range-type elements, return the element as "start-end".
+			var ends [2]string
+			for i := range rangeVal {
+				if str, ok := rangeVal[i].(string); ok {
+					ends[i] = str
+				} else if num, ok := rangeVal[i].(float64); ok {
+					ends[i] = fmt.Sprintf("%d", int(num))
+				} else {
+					return nil, fmt.Errorf("could not parse range value %q", rangeVal[i])
+				}
+			}
+			return []string{ends[0] + "-" + ends[1]}, nil
 		} else if len(val) == 1 {
 			var verdict string
 			// We just checked that len(val) == 1, so this loop body will only
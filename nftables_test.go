@@ -19,9 +19,11 @@ package knftables
 import (
 	"context"
 	"fmt"
+	"net"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/lithammer/dedent"
@@ -123,76 +125,1276 @@ func TestListBad(t *testing.T) {
 	}
 }
 
+func TestListLargeOutput(t *testing.T) {
+	const numRules = 20000
+
+	// Build a large "nft --json list ruleset"-style output, with many objects that
+	// are not of the requested type interleaved with the ones that are.
+	var out strings.Builder
+	out.WriteString(`{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}`)
+	for i := 0; i < numRules; i++ {
+		fmt.Fprintf(&out, `, {"rule": {"family": "ip", "table": "testing", "chain": "chain", "handle": %d, "expr": [{"counter": {"packets": 0, "bytes": 0}}, {"accept": null}]}}`, i+10)
+		if i%10 == 0 {
+			fmt.Fprintf(&out, `, {"chain": {"family": "ip", "table": "testing", "name": "chain%d", "handle": %d}}`, i, i+1)
+		}
+	}
+	out.WriteString(`]}`)
+
+	objects, err := decodeJSONObjects(strings.NewReader(out.String()), "chain")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(objects) != numRules/10 {
+		t.Fatalf("expected %d chains, got %d", numRules/10, len(objects))
+	}
+	for i, obj := range objects {
+		expected := fmt.Sprintf("chain%d", i*10)
+		if name, _ := jsonVal[string](obj, "name"); name != expected {
+			t.Fatalf("expected chain %d to be %q, got %q", i, expected, name)
+		}
+	}
+
+	objects, err = decodeJSONObjects(strings.NewReader(out.String()), "rule")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(objects) != numRules {
+		t.Fatalf("expected %d rules, got %d", numRules, len(objects))
+	}
+	if handle, _ := jsonVal[float64](objects[numRules-1], "handle"); handle != numRules+9 {
+		t.Errorf("unexpected handle on last rule: %v", handle)
+	}
+}
+
 func TestList(t *testing.T) {
 	for _, tc := range []struct {
-		name       string
-		objType    string
-		nftOutput  string
-		listOutput []string
+		name       string
+		objType    string
+		nftOutput  string
+		listOutput []string
+	}{
+		{
+			name:       "empty list",
+			objType:    "chains",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}]}`,
+			listOutput: nil,
+		},
+		{
+			name:       "singular objType",
+			objType:    "chain",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "output", "handle": 3, "type": "nat", "hook": "output", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "postrouting", "handle": 7, "type": "nat", "hook": "postrouting", "prio": 100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11}}, {"chain": {"family": "ip", "table": "filter", "name": "INPUT", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "filter", "name": "FOO", "handle": 3}}]}`,
+			listOutput: []string{"prerouting", "output", "postrouting", "KUBE-SERVICES"},
+		},
+		{
+			name:       "plural objType",
+			objType:    "chains",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "output", "handle": 3, "type": "nat", "hook": "output", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "postrouting", "handle": 7, "type": "nat", "hook": "postrouting", "prio": 100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11}}, {"chain": {"family": "ip", "table": "filter", "name": "INPUT", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "filter", "name": "FOO", "handle": 3}}]}`,
+			listOutput: []string{"prerouting", "output", "postrouting", "KUBE-SERVICES"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "--json", "list", "chains", "ip"},
+					stdout: tc.nftOutput,
+				},
+			)
+			result, err := nft.List(context.Background(), tc.objType)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tc.listOutput) {
+				t.Errorf("unexpected result: wanted %v got %v", tc.listOutput, result)
+			}
+		})
+	}
+}
+
+func TestListChains(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		nftOutput  string
+		listOutput []*Chain
+	}{
+		{
+			name:       "no chains",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}]}`,
+			listOutput: []*Chain{},
+		},
+		{
+			name:      "various chains",
+			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "filter-input", "handle": 3, "type": "filter", "hook": "input", "prio": 0, "policy": "drop", "comment": "input filter"}}, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11}}, {"chain": {"family": "ip", "table": "filter", "name": "INPUT", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "accept"}}]}`,
+			listOutput: []*Chain{
+				{
+					Name:     "prerouting",
+					Type:     PtrTo(NATType),
+					Hook:     PtrTo(PreroutingHook),
+					Priority: PtrTo(BaseChainPriority("-100")),
+					Policy:   PtrTo(AcceptPolicy),
+					Handle:   PtrTo(1),
+				},
+				{
+					Name:     "filter-input",
+					Type:     PtrTo(FilterType),
+					Hook:     PtrTo(InputHook),
+					Priority: PtrTo(BaseChainPriority("0")),
+					Policy:   PtrTo(DropPolicy),
+					Comment:  PtrTo("input filter"),
+					Handle:   PtrTo(3),
+				},
+				{
+					Name:   "KUBE-SERVICES",
+					Handle: PtrTo(11),
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "--json", "list", "chains", "ip"},
+					stdout: tc.nftOutput,
+				},
+			)
+			result, err := nft.ListChains(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			diff := cmp.Diff(tc.listOutput, result)
+			if diff != "" {
+				t.Errorf("unexpected result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListSets(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		nftOutput  string
+		listOutput []*Set
+	}{
+		{
+			name:       "no sets",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}]}`,
+			listOutput: []*Set{},
+		},
+		{
+			name:      "various sets",
+			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "simple", "table": "testing", "type": "ipv4_addr", "handle": 12}}, {"set": {"family": "ip", "name": "concat", "table": "testing", "type": ["ipv4_addr", "inet_proto", "inet_service"], "handle": 13, "flags": ["interval"], "auto-merge": true, "comment": "concatenated"}}, {"set": {"family": "ip", "name": "affinity", "table": "testing", "type": "ipv4_addr", "handle": 14, "flags": ["dynamic", "timeout"], "timeout": 10800, "gc-interval": 15, "size": 65535, "policy": "memory"}}, {"set": {"family": "ip", "name": "other", "table": "filter", "type": "ipv4_addr", "handle": 3}}]}`,
+			listOutput: []*Set{
+				{
+					Name:   "simple",
+					Type:   "ipv4_addr",
+					Handle: PtrTo(12),
+				},
+				{
+					Name:      "concat",
+					Type:      "ipv4_addr . inet_proto . inet_service",
+					Flags:     []SetFlag{IntervalFlag},
+					AutoMerge: PtrTo(true),
+					Comment:   PtrTo("concatenated"),
+					Handle:    PtrTo(13),
+				},
+				{
+					Name:       "affinity",
+					Type:       "ipv4_addr",
+					Flags:      []SetFlag{DynamicFlag, TimeoutFlag},
+					Timeout:    PtrTo(10800 * time.Second),
+					GCInterval: PtrTo(15 * time.Second),
+					Size:       PtrTo[uint64](65535),
+					Policy:     PtrTo(MemoryPolicy),
+					Handle:     PtrTo(14),
+				},
+			},
+		},
+		{
+			name:      "sets with counters",
+			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "counted", "table": "testing", "type": "ipv4_addr", "handle": 12, "stmt": [{"counter": null}]}}, {"set": {"family": "ip", "name": "uncounted", "table": "testing", "type": "ipv4_addr", "handle": 13}}]}`,
+			listOutput: []*Set{
+				{
+					Name:     "counted",
+					Type:     "ipv4_addr",
+					Counters: PtrTo(true),
+					Handle:   PtrTo(12),
+				},
+				{
+					Name:   "uncounted",
+					Type:   "ipv4_addr",
+					Handle: PtrTo(13),
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "--json", "list", "sets", "ip"},
+					stdout: tc.nftOutput,
+				},
+			)
+			result, err := nft.ListSets(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			diff := cmp.Diff(tc.listOutput, result)
+			if diff != "" {
+				t.Errorf("unexpected result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListMaps(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		nftOutput  string
+		listOutput []*Map
+	}{
+		{
+			name:       "no maps",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}]}`,
+			listOutput: []*Map{},
+		},
+		{
+			name:      "various maps",
+			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"map": {"family": "ip", "name": "simple", "table": "testing", "type": "ipv4_addr", "handle": 14, "map": "inet_service"}}, {"map": {"family": "ip", "name": "service-ips", "table": "testing", "type": ["ipv4_addr", "inet_proto", "inet_service"], "handle": 15, "map": "verdict", "comment": "ClusterIP traffic"}}, {"map": {"family": "ip", "name": "dynamic", "table": "testing", "type": "ipv4_addr", "handle": 16, "map": ["ipv4_addr", "inet_service"], "flags": ["dynamic", "timeout"], "timeout": 60, "size": 128}}]}`,
+			listOutput: []*Map{
+				{
+					Name:   "simple",
+					Type:   "ipv4_addr : inet_service",
+					Handle: PtrTo(14),
+				},
+				{
+					Name:    "service-ips",
+					Type:    "ipv4_addr . inet_proto . inet_service : verdict",
+					Comment: PtrTo("ClusterIP traffic"),
+					Handle:  PtrTo(15),
+				},
+				{
+					Name:    "dynamic",
+					Type:    "ipv4_addr : ipv4_addr . inet_service",
+					Flags:   []SetFlag{DynamicFlag, TimeoutFlag},
+					Timeout: PtrTo(time.Minute),
+					Size:    PtrTo[uint64](128),
+					Handle:  PtrTo(16),
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "--json", "list", "maps", "ip"},
+					stdout: tc.nftOutput,
+				},
+			)
+			result, err := nft.ListMaps(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			diff := cmp.Diff(tc.listOutput, result)
+			if diff != "" {
+				t.Errorf("unexpected result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListCTHelpers(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		nftOutput  string
+		listOutput []*CTHelper
+	}{
+		{
+			name:       "no helpers",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 1}}]}`,
+			listOutput: []*CTHelper{},
+		},
+		{
+			name:      "helpers",
+			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 1}}, {"ct helper": {"family": "ip", "name": "ftp-helper", "table": "testing", "handle": 2, "type": "ftp", "protocol": "tcp", "l3proto": "ip"}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 3}}, {"ct helper": {"family": "ip", "name": "sip-helper", "table": "testing", "handle": 4, "type": "sip", "protocol": "udp"}}]}`,
+			listOutput: []*CTHelper{
+				{
+					Name:     "ftp-helper",
+					Type:     "ftp",
+					Protocol: "tcp",
+					L3Proto:  PtrTo(IPv4Family),
+					Handle:   PtrTo(2),
+				},
+				{
+					Name:     "sip-helper",
+					Type:     "sip",
+					Protocol: "udp",
+					Handle:   PtrTo(4),
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "--json", "list", "table", "ip", "testing"},
+					stdout: tc.nftOutput,
+				},
+			)
+			result, err := nft.ListCTHelpers(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.listOutput, result); diff != "" {
+				t.Errorf("unexpected result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListCTTimeouts(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "table", "ip", "testing"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 1}}, {"ct timeout": {"family": "ip", "name": "ct-time", "table": "testing", "handle": 2, "protocol": "tcp", "l3proto": "ip", "policy": {"established": 120, "close": 10}}}]}`,
+		},
+	)
+	result, err := nft.ListCTTimeouts(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*CTTimeout{
+		{
+			Name:     "ct-time",
+			Protocol: "tcp",
+			L3Proto:  PtrTo(IPv4Family),
+			Policy: map[string]time.Duration{
+				"established": 120 * time.Second,
+				"close":       10 * time.Second,
+			},
+			Handle: PtrTo(2),
+		},
+	}
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("unexpected result:\n%s", diff)
+	}
+}
+
+func TestListCTExpectations(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "table", "ip", "testing"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 1}}, {"ct expectation": {"family": "ip", "name": "exp", "table": "testing", "handle": 2, "l3proto": "ip", "protocol": "tcp", "dport": 8888, "timeout": 3600000, "size": 12}}]}`,
+		},
+	)
+	result, err := nft.ListCTExpectations(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*CTExpectation{
+		{
+			Name:     "exp",
+			Protocol: "tcp",
+			DPort:    8888,
+			Timeout:  time.Hour,
+			Size:     12,
+			L3Proto:  PtrTo(IPv4Family),
+			Handle:   PtrTo(2),
+		},
+	}
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("unexpected result:\n%s", diff)
+	}
+}
+
+func TestListSynproxies(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "table", "ip", "testing"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 1}}, {"synproxy": {"family": "ip", "name": "syn", "table": "testing", "handle": 2, "mss": 1460, "wscale": 7, "flags": ["timestamp", "sack-perm"]}}, {"synproxy": {"family": "ip", "name": "syn2", "table": "testing", "handle": 3, "mss": 1400, "wscale": 5, "flags": "timestamp"}}, {"synproxy": {"family": "ip", "name": "syn3", "table": "testing", "handle": 4, "mss": 1300, "wscale": 0}}]}`,
+		},
+	)
+	result, err := nft.ListSynproxies(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*Synproxy{
+		{Name: "syn", MSS: 1460, WScale: 7, Timestamp: PtrTo(true), SACKPerm: PtrTo(true), Handle: PtrTo(2)},
+		{Name: "syn2", MSS: 1400, WScale: 5, Timestamp: PtrTo(true), Handle: PtrTo(3)},
+		{Name: "syn3", MSS: 1300, Handle: PtrTo(4)},
+	}
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("unexpected result:\n%s", diff)
+	}
+}
+
+func TestRun(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	tx := nft.NewTransaction()
+
+	tx.Add(&Table{})
+	tx.Add(&Chain{
+		Name:    "chain",
+		Comment: PtrTo("foo"),
+	})
+	tx.Add(&Rule{
+		Chain: "chain",
+		Rule:  "ip daddr 10.0.0.0/8 drop",
+	})
+	tx.Add(&Flowtable{
+		Name:     "flowtable",
+		Priority: PtrTo(FilterIngressPriority),
+		Devices:  []string{"eth0", "eth1"},
+	})
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain { comment "foo" ; }
+		add rule ip kube-proxy chain ip daddr 10.0.0.0/8 drop
+		add flowtable ip kube-proxy flowtable { hook ingress priority filter ; devices = { eth0, eth1 } ; }
+		`), "\n")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:  []string{"/nft", "-f", "-"},
+			stdin: expected,
+		},
+	)
+
+	err := nft.Run(context.Background(), tx)
+	if err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+}
+
+func TestRunError(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		nftError  string
+		expectErr string
+	}{
+		{
+			name:      "error in an annotated rule",
+			nftError:  "/dev/stdin:8:1-52: Error: No such file or directory; did you mean chain 'chain' in table ip 'kube-proxy'?\nadd rule ip kube-proxy nosuchchain ip daddr 10.0.0.2 drop\n^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^\n",
+			expectErr: `operation 5 "add rule ip kube-proxy nosuchchain ip daddr 10.0.0.2 drop" failed: /dev/stdin:8:`,
+		},
+		{
+			name:      "error in first operation",
+			nftError:  "/dev/stdin:1:1-23: Error: No such file or directory\nadd table ip kube-proxy\n^^^^^^^^^^^^^^^^^^^^^^^\n",
+			expectErr: `operation 1 "add table ip kube-proxy" failed: /dev/stdin:1:`,
+		},
+		{
+			name:      "error with no line number",
+			nftError:  "Error: No such file or directory\n",
+			expectErr: "Error: No such file or directory",
+		},
+		{
+			name:      "error with out-of-range line number",
+			nftError:  "/dev/stdin:20:1-5: Error: No such file or directory\n",
+			expectErr: "/dev/stdin:20:",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+			tx := nft.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(&Chain{Name: "chain"})
+			tx.AddWithAnnotation(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.1 drop"}, "first rule\n(two lines)")
+			tx.Delete(&Chain{Name: "old", Handle: PtrTo(5)})
+			tx.AddWithAnnotation(&Rule{Chain: "nosuchchain", Rule: "ip daddr 10.0.0.2 drop"}, "second rule")
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:  []string{"/nft", "-f", "-"},
+					stdin: tx.String(),
+					err:   mkExecError(tc.nftError),
+				},
+			)
+
+			err := nft.Run(context.Background(), tx)
+			if err == nil {
+				t.Fatalf("expected error from Run")
+			}
+			if !strings.HasPrefix(err.Error(), tc.expectErr) {
+				t.Errorf("expected error starting with %q, got %q", tc.expectErr, err.Error())
+			}
+			if !IsNotFound(err) {
+				t.Errorf("expected IsNotFound to still be true for %v", err)
+			}
+		})
+	}
+}
+
+func TestFlushTable(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:  []string{"/nft", "-f", "-"},
+			stdin: "flush table ip kube-proxy\n",
+		},
+	)
+
+	err := nft.FlushTable(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error from FlushTable: %v", err)
+	}
+}
+
+func TestSwapTable(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		delete table ip kube-proxy
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add rule ip kube-proxy chain ip daddr 10.0.0.0/8 drop
+		`), "\n")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:  []string{"/nft", "-f", "-"},
+			stdin: expected,
+		},
+	)
+
+	err := nft.SwapTable(context.Background(), func(tx *Transaction) {
+		tx.Add(&Chain{Name: "chain"})
+		tx.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.0/8 drop"})
+	})
+	if err != nil {
+		t.Errorf("unexpected error from SwapTable: %v", err)
+	}
+}
+
+func TestReplaceTable(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	desired := NewFake(IPv4Family, "kube-proxy")
+	err := desired.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy { comment "rules" ; }
+		add chain ip kube-proxy chain
+		add set ip kube-proxy set { type ipv4_addr ; }
+		add rule ip kube-proxy chain ip daddr @set drop
+		add element ip kube-proxy set { 10.0.0.1 }
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args: []string{"/nft", "-f", "-"},
+			stdin: strings.TrimPrefix(dedent.Dedent(`
+				add table ip kube-proxy
+				delete table ip kube-proxy
+				add table ip kube-proxy { comment "rules" ; }
+				add chain ip kube-proxy chain
+				add set ip kube-proxy set { type ipv4_addr ; }
+				add rule ip kube-proxy chain ip daddr @set drop
+				add element ip kube-proxy set { 10.0.0.1 }
+				`), "\n"),
+		},
+		expectedCmd{
+			args: []string{"/nft", "-f", "-"},
+			stdin: strings.TrimPrefix(dedent.Dedent(`
+				add table ip kube-proxy
+				delete table ip kube-proxy
+				`), "\n"),
+		},
+	)
+
+	if err := nft.ReplaceTable(context.Background(), desired); err != nil {
+		t.Errorf("unexpected error from ReplaceTable: %v", err)
+	}
+	// If the desired table doesn't exist, the table is deleted
+	if err := nft.ReplaceTable(context.Background(), NewFake(IPv4Family, "kube-proxy")); err != nil {
+		t.Errorf("unexpected error from ReplaceTable: %v", err)
+	}
+	// desired must be for the same table
+	if err := nft.ReplaceTable(context.Background(), NewFake(IPv6Family, "kube-proxy")); err == nil {
+		t.Errorf("expected error from ReplaceTable with wrong family")
+	}
+}
+
+func TestRunWithAnnotations(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	tx := nft.NewTransaction()
+
+	tx.AddWithAnnotation(&Table{}, "kube-proxy table")
+	tx.Add(&Chain{
+		Name: "chain",
+	})
+	tx.AddWithAnnotation(&Rule{
+		Chain: "chain",
+		Rule:  "ip daddr 10.0.0.0/8 drop",
+	}, "drop private traffic\n(for testing)")
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		# kube-proxy table
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		# drop private traffic
+		# (for testing)
+		add rule ip kube-proxy chain ip daddr 10.0.0.0/8 drop
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected transaction String(): %s", diff)
+	}
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:  []string{"/nft", "-f", "-"},
+			stdin: expected,
+		},
+	)
+	err := nft.Run(context.Background(), tx)
+	if err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+
+	fake := NewFake(IPv4Family, "kube-proxy")
+	err = fake.ParseDump(expected)
+	if err != nil {
+		t.Fatalf("unexpected error parsing annotated transaction: %v", err)
+	}
+	if fake.Table == nil || fake.Table.Chains["chain"] == nil || len(fake.Table.Chains["chain"].Rules) != 1 {
+		t.Errorf("annotated transaction was not parsed correctly:\n%s", fake.Dump())
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	fexec := newFakeExec(t)
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--version"},
+			stdout: "nftables v1.0.7 (Old Doc Yak)\n",
+		},
+		expectedCmd{
+			args:     []string{"/nft", "--check", "-f", "-"},
+			stdin:    "add table ip kube-proxy { comment \"test\" ; }\n",
+			deadline: 10 * time.Minute,
+		},
+	)
+	nft, err := newInternal(IPv4Family, "kube-proxy", fexec, WithListTimeout(time.Hour), WithRunTimeout(10*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error from newInternal: %v", err)
+	}
+
+	tx := nft.NewTransaction()
+	tx.Add(&Table{})
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:     []string{"/nft", "-f", "-"},
+			stdin:    "add table ip kube-proxy\n",
+			deadline: 10 * time.Minute,
+		},
+		expectedCmd{
+			args:     []string{"/nft", "--json", "list", "chains", "ip"},
+			stdout:   `{"nftables": [{"metainfo": {"json_schema_version": 1}}]}`,
+			deadline: time.Hour,
+		},
+		expectedCmd{
+			args:     []string{"/nft", "--json", "list", "chains", "ip"},
+			stdout:   `{"nftables": [{"metainfo": {"json_schema_version": 1}}]}`,
+			deadline: 5 * time.Minute,
+		},
+	)
+
+	if err := nft.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	if _, err := nft.List(context.Background(), "chains"); err != nil {
+		t.Errorf("unexpected error from List: %v", err)
+	}
+
+	// An explicit deadline on the context overrides the default timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if _, err := nft.List(ctx, "chains"); err != nil {
+		t.Errorf("unexpected error from List: %v", err)
+	}
+}
+
+func TestTimeoutErrors(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+	killed := fmt.Errorf("signal: killed")
+
+	// A command that fails after its context's deadline has passed returns a
+	// timeout error.
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:     []string{"/nft", "--json", "list", "chains", "ip"},
+			err:      killed,
+			deadline: time.Nanosecond,
+		},
+		expectedCmd{
+			args:     []string{"/nft", "-f", "-"},
+			stdin:    "add table ip kube-proxy\n",
+			err:      killed,
+			deadline: time.Nanosecond,
+		},
+	)
+	_, err := nft.List(expired, "chains")
+	if !IsTimeout(err) {
+		t.Errorf("expected timeout error from List, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+	tx := nft.NewTransaction()
+	tx.Add(&Table{})
+	if err := nft.Run(expired, tx); !IsTimeout(err) {
+		t.Errorf("expected timeout error from Run, got %v", err)
+	}
+
+	// A command that fails because its context was cancelled, or while its context
+	// is still live, does not.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args: []string{"/nft", "--json", "list", "chains", "ip"},
+			err:  killed,
+		},
+		expectedCmd{
+			args: []string{"/nft", "--json", "list", "chains", "ip"},
+			err:  mkExecError("Error: No such file or directory\n"),
+		},
+	)
+	if _, err := nft.List(cancelled, "chains"); err == nil || IsTimeout(err) {
+		t.Errorf("expected non-timeout error from List with cancelled context, got %v", err)
+	}
+	if _, err := nft.List(context.Background(), "chains"); !IsNotFound(err) || IsTimeout(err) {
+		t.Errorf("expected not-found error from List, got %v", err)
+	}
+}
+
+func TestKillDelay(t *testing.T) {
+	fexec := newFakeExec(t)
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--version"},
+			stdout: "nftables v1.0.7 (Old Doc Yak)\n",
+		},
+		expectedCmd{
+			args:  []string{"/nft", "--check", "-f", "-"},
+			stdin: "add table ip kube-proxy { comment \"test\" ; }\n",
+		},
+	)
+	nft, err := newInternal(IPv4Family, "kube-proxy", fexec, WithKillDelay(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error from newInternal: %v", err)
+	}
+
+	cmd := nft.(*realNFTables).command(context.Background(), "list", "tables")
+	if cmd.WaitDelay != 5*time.Second {
+		t.Errorf("expected WaitDelay to be set, got %v", cmd.WaitDelay)
+	}
+}
+
+func TestCommandOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		argv   []string
+		errStr string
 	}{
 		{
-			name:       "empty list",
-			objType:    "chains",
-			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}]}`,
-			listOutput: nil,
+			name: "default",
+			argv: []string{"/nft"},
 		},
 		{
-			name:       "singular objType",
-			objType:    "chain",
-			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "output", "handle": 3, "type": "nat", "hook": "output", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "postrouting", "handle": 7, "type": "nat", "hook": "postrouting", "prio": 100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11}}, {"chain": {"family": "ip", "table": "filter", "name": "INPUT", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "filter", "name": "FOO", "handle": 3}}]}`,
-			listOutput: []string{"prerouting", "output", "postrouting", "KUBE-SERVICES"},
+			name: "absolute binary path",
+			opts: []Option{WithBinary("/usr/sbin/nft")},
+			argv: []string{"/usr/sbin/nft"},
 		},
 		{
-			name:       "plural objType",
-			objType:    "chains",
-			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "output", "handle": 3, "type": "nat", "hook": "output", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "postrouting", "handle": 7, "type": "nat", "hook": "postrouting", "prio": 100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11}}, {"chain": {"family": "ip", "table": "filter", "name": "INPUT", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "filter", "name": "FOO", "handle": 3}}]}`,
-			listOutput: []string{"prerouting", "output", "postrouting", "KUBE-SERVICES"},
+			name: "binary name",
+			opts: []Option{WithBinary("nft-custom")},
+			argv: []string{"/nft-custom"},
+		},
+		{
+			name: "global args",
+			opts: []Option{WithGlobalArgs("--numeric", "--stateless")},
+			argv: []string{"/nft", "--numeric", "--stateless"},
+		},
+		{
+			name: "all options",
+			opts: []Option{WithBinary("/usr/sbin/nft"), WithCommandPrefix("ip", "netns", "exec", "myns"), WithGlobalArgs("--numeric")},
+			argv: []string{"/ip", "netns", "exec", "myns", "/usr/sbin/nft", "--numeric"},
+		},
+		{
+			name: "network namespace",
+			opts: []Option{WithNetworkNamespace("/run/netns/myns")},
+			argv: []string{"/nsenter", "--net=/run/netns/myns", "--", "/nft"},
+		},
+		{
+			name: "network namespace with prefix and global args",
+			opts: []Option{WithNetworkNamespace("/proc/1234/ns/net"), WithCommandPrefix("unshare", "--mount"), WithGlobalArgs("--numeric")},
+			argv: []string{"/nsenter", "--net=/proc/1234/ns/net", "--", "unshare", "--mount", "/nft", "--numeric"},
+		},
+		{
+			name:   "missing binary",
+			opts:   []Option{WithBinary("/does/not/exist/nft")},
+			errStr: "could not find nftables binary",
+		},
+		{
+			name:   "missing prefix binary",
+			opts:   []Option{WithCommandPrefix("/does/not/exist/nsenter")},
+			errStr: "could not find command prefix binary",
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+			fexec := newFakeExec(t)
+			fexec.missingBinaries["/does/not/exist/nft"] = true
+			fexec.missingBinaries["/does/not/exist/nsenter"] = true
+			args := func(args ...string) []string {
+				return append(append([]string{}, tc.argv...), args...)
+			}
+			if tc.errStr == "" {
+				fexec.expected = append(fexec.expected,
+					expectedCmd{
+						args:   args("--version"),
+						stdout: "nftables v1.0.7 (Old Doc Yak)\n",
+					},
+					expectedCmd{
+						args:  args("--check", "-f", "-"),
+						stdin: "add table ip kube-proxy { comment \"test\" ; }\n",
+					},
+				)
+			}
+
+			nft, err := newInternal(IPv4Family, "kube-proxy", fexec, tc.opts...)
+			if tc.errStr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errStr) {
+					t.Fatalf("expected error containing %q, got %v", tc.errStr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error from newInternal: %v", err)
+			}
 
+			tx := nft.NewTransaction()
+			tx.Add(&Table{})
 			fexec.expected = append(fexec.expected,
 				expectedCmd{
-					args:   []string{"/nft", "--json", "list", "chains", "ip"},
-					stdout: tc.nftOutput,
+					args:  args("-f", "-"),
+					stdin: "add table ip kube-proxy\n",
+				},
+				expectedCmd{
+					args:   args("--json", "list", "chains", "ip"),
+					stdout: `{"nftables": [{"metainfo": {"json_schema_version": 1}}]}`,
 				},
 			)
-			result, err := nft.List(context.Background(), tc.objType)
-			if err != nil {
-				t.Errorf("unexpected error: %v", err)
+			if err := nft.Run(context.Background(), tx); err != nil {
+				t.Errorf("unexpected error from Run: %v", err)
 			}
-			if !reflect.DeepEqual(result, tc.listOutput) {
-				t.Errorf("unexpected result: wanted %v got %v", tc.listOutput, result)
+			if _, err := nft.List(context.Background(), "chains"); err != nil {
+				t.Errorf("unexpected error from List: %v", err)
 			}
 		})
 	}
 }
 
-func TestRun(t *testing.T) {
-	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+func TestAvailable(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected []expectedCmd
+		errStr   string
+	}{
+		{
+			name: "available",
+			expected: []expectedCmd{
+				{
+					args:   []string{"/nft", "--version"},
+					stdout: "nftables v1.0.7 (Old Doc Yak)\n",
+				},
+				{
+					args: []string{"/nft", "list", "tables"},
+				},
+			},
+		},
+		{
+			name: "with options",
+			opts: []Option{WithNetworkNamespace("/run/netns/myns"), WithGlobalArgs("--numeric")},
+			expected: []expectedCmd{
+				{
+					args:   []string{"/nsenter", "--net=/run/netns/myns", "--", "/nft", "--numeric", "--version"},
+					stdout: "nftables v1.0.7 (Old Doc Yak)\n",
+				},
+				{
+					args: []string{"/nsenter", "--net=/run/netns/myns", "--", "/nft", "--numeric", "list", "tables"},
+				},
+			},
+		},
+		{
+			name:   "missing binary",
+			opts:   []Option{WithBinary("/does/not/exist/nft")},
+			errStr: "could not find nftables binary",
+		},
+		{
+			name: "old version",
+			expected: []expectedCmd{
+				{
+					args:   []string{"/nft", "--version"},
+					stdout: "nftables v0.9.8 (E.D.S.)\n",
+				},
+			},
+			errStr: "nft version must be v1.0.1 or later",
+		},
+		{
+			name: "no permission",
+			expected: []expectedCmd{
+				{
+					args:   []string{"/nft", "--version"},
+					stdout: "nftables v1.0.7 (Old Doc Yak)\n",
+				},
+				{
+					args: []string{"/nft", "list", "tables"},
+					err:  mkExecError("Error: Operation not permitted"),
+				},
+			},
+			errStr: "could not run nftables command",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fexec := newFakeExec(t)
+			fexec.missingBinaries["/does/not/exist/nft"] = true
+			fexec.expected = tc.expected
+
+			err := availableInternal(fexec, tc.opts...)
+			if tc.errStr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errStr) {
+					t.Errorf("expected error containing %q, got %v", tc.errStr, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error from Available: %v", err)
+			}
+			if fexec.matched != len(fexec.expected) {
+				t.Errorf("expected %d commands to be run, got %d", len(fexec.expected), fexec.matched)
+			}
+		})
+	}
+}
+
+func TestTransactionCompact(t *testing.T) {
+	nft, _, _ := newTestInterface(t, IPv4Family, "kube-proxy")
 
 	tx := nft.NewTransaction()
+	if compact := tx.Compact(); compact != "" {
+		t.Errorf("expected empty string for empty transaction, got %q", compact)
+	}
 
 	tx.Add(&Table{})
-	tx.Add(&Chain{
-		Name:    "chain",
-		Comment: PtrTo("foo"),
-	})
-	tx.Add(&Rule{
-		Chain: "chain",
-		Rule:  "ip daddr 10.0.0.0/8 drop",
+	tx.AddWithAnnotation(&Chain{Name: "chain", Comment: PtrTo("a chain")}, "an annotation")
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.1 drop"})
+	tx.Delete(&Chain{Name: "other", Handle: PtrTo(5)})
+	expected := `add table ip kube-proxy ; add chain ip kube-proxy chain { comment "a chain" ; } ; add rule ip kube-proxy chain ip daddr 10.0.0.1 drop ; delete chain ip kube-proxy handle 5`
+	if diff := cmp.Diff(expected, tx.Compact()); diff != "" {
+		t.Errorf("unexpected compact transaction: %s", diff)
+	}
+
+	tx.Add(&Rule{Chain: "chain"})
+	expected += " # ERROR: " + tx.err.Error()
+	if diff := cmp.Diff(expected, tx.Compact()); diff != "" {
+		t.Errorf("unexpected compact transaction with error: %s", diff)
+	}
+}
+
+func TestTransactionStringGrouped(t *testing.T) {
+	nft, _, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	tx := nft.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Rule{Chain: "chain1", Rule: "ip daddr @set1 drop"})
+	tx.Add(&Set{Name: "set1", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "set1", Key: []string{"10.0.0.1"}})
+	tx.AddWithAnnotation(&Chain{Name: "chain2"}, "the second chain")
+	tx.Add(&Rule{Chain: "chain2", Rule: "jump chain1"})
+	tx.Add(&Rule{Chain: "chain1", Rule: "accept"})
+	tx.Add(&Element{Set: "set1", Key: []string{"10.0.0.2"}})
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain1
+		# the second chain
+		add chain ip kube-proxy chain2
+		add set ip kube-proxy set1 { type ipv4_addr ; }
+		add rule ip kube-proxy chain1 ip daddr @set1 drop
+		add rule ip kube-proxy chain2 jump chain1
+		add rule ip kube-proxy chain1 accept
+		add element ip kube-proxy set1 { 10.0.0.1 }
+		add element ip kube-proxy set1 { 10.0.0.2 }
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.StringGrouped()); diff != "" {
+		t.Errorf("unexpected grouped transaction: %s", diff)
+	}
+
+	// The transaction itself is not modified
+	if _, ok := tx.Operations()[3].Object.(*Set); !ok {
+		t.Errorf("StringGrouped modified the transaction")
+	}
+	if strings.HasPrefix(tx.String(), expected) {
+		t.Errorf("expected String output to be ungrouped")
+	}
+}
+
+func TestTransactionOperations(t *testing.T) {
+	nft, _, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	tx := nft.NewTransaction()
+	if ops := tx.Operations(); len(ops) != 0 {
+		t.Errorf("expected no operations, got %v", ops)
+	}
+
+	table := &Table{}
+	chain := &Chain{Name: "chain"}
+	rule := &Rule{Chain: "chain", Rule: "drop"}
+	oldChain := &Chain{Name: "old"}
+	tx.Add(table)
+	tx.Flush(chain)
+	tx.AddWithAnnotation(rule, "an annotation")
+	tx.Delete(oldChain)
+
+	expected := []Operation{
+		{Verb: "add", Object: table},
+		{Verb: "flush", Object: chain},
+		{Verb: "add", Object: rule},
+		{Verb: "delete", Object: oldChain},
+	}
+	if diff := cmp.Diff(expected, tx.Operations()); diff != "" {
+		t.Errorf("unexpected operations: %s", diff)
+	}
+	if len(tx.Operations()) != tx.NumOperations() {
+		t.Errorf("Operations() and NumOperations() disagree")
+	}
+}
+
+func TestTransactionRuleHelpers(t *testing.T) {
+	nft, _, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	tx := nft.NewTransaction()
+	tx.AddRule("chain", "ip daddr", net.ParseIP("10.0.0.1"), "tcp dport", 80, Drop())
+	tx.InsertRule("chain", "ip saddr", "@", "allowed", Accept())
+	tx.ReplaceRule("chain", 5, "ip daddr 10.0.0.2", Jump("other"))
+	tx.DeleteRule("chain", 7)
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add rule ip kube-proxy chain ip daddr 10.0.0.1 tcp dport 80 drop
+		insert rule ip kube-proxy chain ip saddr @allowed accept
+		replace rule ip kube-proxy chain handle 5 ip daddr 10.0.0.2 jump other
+		delete rule ip kube-proxy chain handle 7
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected transaction: %s", diff)
+	}
+
+	tx = nft.NewTransaction()
+	tx.AddRule("chain")
+	if tx.err == nil {
+		t.Errorf("expected error from AddRule with empty rule")
+	}
+}
+
+func TestTransactionAppend(t *testing.T) {
+	nft, _, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	tx := nft.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+
+	sub := nft.NewTransaction()
+	sub.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.1 drop"})
+	sub.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.2 drop"})
+	tx.Append(sub)
+	tx.Append(nft.NewTransaction())
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add rule ip kube-proxy chain ip daddr 10.0.0.1 drop
+		add rule ip kube-proxy chain ip daddr 10.0.0.2 drop
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected transaction after Append: %s", diff)
+	}
+	if tx.NumOperations() != 4 {
+		t.Errorf("expected 4 operations, got %d", tx.NumOperations())
+	}
+
+	// An error in other is propagated
+	bad := nft.NewTransaction()
+	bad.Add(&Rule{Chain: "chain"})
+	tx.Append(bad)
+	if tx.err == nil || tx.err != bad.err {
+		t.Errorf("expected error to be propagated, got %v", tx.err)
+	}
+
+	// Once tx has an error, Append is a no-op that preserves the first error
+	firstErr := tx.err
+	another := nft.NewTransaction()
+	another.Add(&Chain{Name: "another"})
+	tx.Append(another)
+	if tx.err != firstErr || tx.NumOperations() != 4 {
+		t.Errorf("expected Append to be a no-op after error, got %v, %d operations", tx.err, tx.NumOperations())
+	}
+
+	// Appending a transaction from a different table is an error
+	other, _, _ := newTestInterface(t, IPv6Family, "kube-proxy")
+	tx = nft.NewTransaction()
+	tx.Append(other.NewTransaction())
+	if tx.err == nil {
+		t.Errorf("expected error appending transaction for a different family")
+	}
+}
+
+func TestTransactionReorder(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Chain{Name: "old"})
+	tx.Add(&Rule{Chain: "old", Rule: "ip daddr 10.0.0.1 drop"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	ruleHandle := fake.Table.Chains["old"].Rules[0].Handle
+
+	// Deleting the chain before its rule fails, as does adding the rule before the
+	// set it refers to.
+	tx = fake.NewTransaction()
+	tx.Delete(&Chain{Name: "old"})
+	tx.Delete(&Rule{Chain: "old", Handle: ruleHandle})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr @ips drop"})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.2"}})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.3 drop"})
+	tx.Add(&Set{Name: "ips", Type: "ipv4_addr"})
+	if err := fake.Check(context.Background(), tx); err == nil {
+		t.Fatalf("expected error from un-reordered transaction")
+	}
+
+	tx.Reorder()
+	expected := strings.TrimPrefix(dedent.Dedent(fmt.Sprintf(`
+		delete rule ip kube-proxy old handle %d
+		delete chain ip kube-proxy old
+		add set ip kube-proxy ips { type ipv4_addr ; }
+		add rule ip kube-proxy chain ip daddr @ips drop
+		add element ip kube-proxy ips { 10.0.0.2 }
+		add rule ip kube-proxy chain ip daddr 10.0.0.3 drop
+		`, *ruleHandle)), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected reordered transaction:\n%s", diff)
+	}
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error from reordered transaction: %v", err)
+	}
+
+	// Operations are not moved past operations of the other kind, and flushes stay
+	// ahead of deletes.
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	tx.Add(&Chain{Name: "old"})
+	tx.Delete(&Chain{Name: "old"})
+	tx.Delete(&Table{})
+	tx.Flush(&Chain{Name: "chain"})
+	tx.Add(&Chain{Name: "new"})
+	tx.Add(&Table{})
+	tx.Reorder()
+	expected = strings.TrimPrefix(dedent.Dedent(`
+		add chain ip kube-proxy old
+		add rule ip kube-proxy chain drop
+		flush chain ip kube-proxy chain
+		delete chain ip kube-proxy old
+		delete table ip kube-proxy
+		add table ip kube-proxy
+		add chain ip kube-proxy new
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected reordered transaction:\n%s", diff)
+	}
+
+	// Deletions of named objects are sorted according to the references made by the
+	// rules and elements in the transaction: here, "target" can't be deleted until
+	// both "jumper" and "vmap" (which jump to it) have been.
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{Name: "jumper"})
+	tx.Add(&Chain{Name: "target"})
+	tx.Add(&Rule{Chain: "jumper", Rule: "jump target"})
+	tx.Add(&Map{Name: "vmap", Type: "ipv4_addr : verdict"})
+	tx.Add(&Element{Map: "vmap", Key: []string{"10.0.0.1"}, Value: []string{"goto target"}})
+	tx.Delete(&Chain{Name: "target"})
+	tx.Delete(&Map{Name: "vmap"})
+	tx.Delete(&Chain{Name: "jumper"})
+	if err := fake.Check(context.Background(), tx); !IsBusy(err) {
+		t.Fatalf("expected busy error from un-reordered transaction, got %v", err)
+	}
+
+	tx.Reorder()
+	expected = strings.TrimPrefix(dedent.Dedent(`
+		add chain ip kube-proxy jumper
+		add chain ip kube-proxy target
+		add map ip kube-proxy vmap { type ipv4_addr : verdict ; }
+		add rule ip kube-proxy jumper jump target
+		add element ip kube-proxy vmap { 10.0.0.1 : goto target }
+		delete map ip kube-proxy vmap
+		delete chain ip kube-proxy jumper
+		delete chain ip kube-proxy target
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected reordered transaction:\n%s", diff)
+	}
+	if err := fake.Check(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error from reordered transaction: %v", err)
+	}
+
+	// A reference loop is left in its original order.
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "a", Rule: "jump b"})
+	tx.Add(&Rule{Chain: "b", Rule: "jump a"})
+	tx.Delete(&Chain{Name: "c"})
+	tx.Delete(&Chain{Name: "a"})
+	tx.Delete(&Chain{Name: "b"})
+	tx.Reorder()
+	expected = strings.TrimPrefix(dedent.Dedent(`
+		add rule ip kube-proxy a jump b
+		add rule ip kube-proxy b jump a
+		delete chain ip kube-proxy c
+		delete chain ip kube-proxy a
+		delete chain ip kube-proxy b
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected reordered transaction:\n%s", diff)
+	}
+}
+
+func TestRunFlushSet(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	tx := nft.NewTransaction()
+	tx.Flush(&Set{
+		Name: "myset",
 	})
-	tx.Add(&Flowtable{
-		Name:     "flowtable",
-		Priority: PtrTo(FilterIngressPriority),
-		Devices:  []string{"eth0", "eth1"},
+	tx.Add(&Element{
+		Set: "myset",
+		Key: []string{"10.0.0.3"},
 	})
 	expected := strings.TrimPrefix(dedent.Dedent(`
-		add table ip kube-proxy
-		add chain ip kube-proxy chain { comment "foo" ; }
-		add rule ip kube-proxy chain ip daddr 10.0.0.0/8 drop
-		add flowtable ip kube-proxy flowtable { hook ingress priority filter ; devices = { eth0, eth1 } ; }
+		flush set ip kube-proxy myset
+		add element ip kube-proxy myset { 10.0.0.3 }
 		`), "\n")
 	fexec.expected = append(fexec.expected,
 		expectedCmd{
@@ -233,15 +1435,18 @@ func TestListRules(t *testing.T) {
 			listOutput: []*Rule{
 				{
 					Chain:  "testchain",
+					Index:  PtrTo(0),
 					Handle: PtrTo(169),
 				},
 				{
 					Chain:   "testchain",
 					Comment: PtrTo("This rule does something"),
+					Index:   PtrTo(1),
 					Handle:  PtrTo(170),
 				},
 				{
 					Chain:  "testchain",
+					Index:  PtrTo(2),
 					Handle: PtrTo(171),
 				},
 			},
@@ -252,10 +1457,12 @@ func TestListRules(t *testing.T) {
 			listOutput: []*Rule{
 				{
 					Chain:  "chain1",
+					Index:  PtrTo(0),
 					Handle: PtrTo(3),
 				},
 				{
 					Chain:  "chain2",
+					Index:  PtrTo(0),
 					Handle: PtrTo(4),
 				},
 			},
@@ -375,8 +1582,63 @@ func TestListElements(t *testing.T) {
 			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": ["ipv4_addr"], "handle": 13, "flags": ["interval"], "elem": [{"prefix": {"addr": "192.168.0.0", "len": 16}}]}}]}`,
 			listOutput: []*Element{
 				{
-					Set: "test",
-					Key: []string{"192.168.0.0/16"},
+					Set: "test",
+					Key: []string{"192.168.0.0/16"},
+				},
+			},
+		},
+		{
+			name:       "range type",
+			objectType: "set",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": ["ipv4_addr", "inet_service"], "handle": 13, "flags": ["interval"], "elem": [{"concat": [{"range": ["10.0.0.0", "10.0.0.255"]}, {"range": [1000, 2000]}]}, {"range": ["10.1.0.0", "10.1.0.255"]}]}}]}`,
+			listOutput: []*Element{
+				{
+					Set: "test",
+					Key: []string{"10.0.0.0-10.0.0.255", "1000-2000"},
+				},
+				{
+					Set: "test",
+					Key: []string{"10.1.0.0-10.1.0.255"},
+				},
+			},
+		},
+		{
+			name:       "elements with timeouts",
+			objectType: "set",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "flags": ["dynamic", "timeout"], "timeout": 10800, "elem": [{"elem": {"val": "192.168.1.1", "timeout": 10800, "expires": 10755}}, {"elem": {"val": "192.168.1.2", "timeout": 30, "expires": 12, "comment": "with a comment"}}]}}]}`,
+			listOutput: []*Element{
+				{
+					Set:     "test",
+					Key:     []string{"192.168.1.1"},
+					Timeout: PtrTo(3 * time.Hour),
+					Expires: PtrTo(10755 * time.Second),
+				},
+				{
+					Set:     "test",
+					Key:     []string{"192.168.1.2"},
+					Timeout: PtrTo(30 * time.Second),
+					Expires: PtrTo(12 * time.Second),
+					Comment: PtrTo("with a comment"),
+				},
+			},
+		},
+		{
+			name:       "elements with counters",
+			objectType: "set",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "stmt": [{"counter": null}], "elem": [{"elem": {"val": "192.168.1.1", "counter": {"packets": 0, "bytes": 0}}}, {"elem": {"val": "192.168.1.2", "comment": "with a comment", "counter": {"packets": 12, "bytes": 1008}}}]}}]}`,
+			listOutput: []*Element{
+				{
+					Set:     "test",
+					Key:     []string{"192.168.1.1"},
+					Packets: PtrTo[uint64](0),
+					Bytes:   PtrTo[uint64](0),
+				},
+				{
+					Set:     "test",
+					Key:     []string{"192.168.1.2"},
+					Comment: PtrTo("with a comment"),
+					Packets: PtrTo[uint64](12),
+					Bytes:   PtrTo[uint64](1008),
 				},
 			},
 		},
@@ -468,6 +1730,448 @@ func TestListElements(t *testing.T) {
 	}
 }
 
+func TestSetStats(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		nftOutput string
+		nftError  string
+		stats     *SetStats
+	}{
+		{
+			name:     "no such set",
+			nftError: "Error: No such file or directory\nlist set ip testing test\n                    ^^^^\n",
+		},
+		{
+			name:      "empty set",
+			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12}}]}`,
+			stats:     &SetStats{},
+		},
+		{
+			name:      "set with elements and size",
+			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "size": 1000, "elem": ["192.168.1.1", "192.168.1.2", {"elem": {"val": "192.168.1.3", "comment": "with a comment"}}]}}]}`,
+			stats: &SetStats{
+				Elements: 3,
+				Size:     PtrTo[uint64](1000),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+			var err error
+			if tc.nftError != "" {
+				err = fmt.Errorf(tc.nftError)
+			}
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "--json", "list", "set", "ip", "testing", "test"},
+					stdout: tc.nftOutput,
+					err:    err,
+				},
+			)
+
+			stats, err := nft.SetStats(context.Background(), "test")
+			if err != nil {
+				if tc.nftError == "" {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			} else if tc.nftError != "" {
+				t.Errorf("unexpected non-error")
+				return
+			}
+
+			if diff := cmp.Diff(tc.stats, stats); diff != "" {
+				t.Errorf("unexpected result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetObjects(t *testing.T) {
+	const metainfo = `{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}`
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		nftOutput string
+		nftError  string
+		get       func(nft Interface) (interface{}, error)
+		expected  interface{}
+	}{
+		{
+			name:      "table",
+			args:      []string{"table", "ip", "testing"},
+			nftOutput: `{"nftables": [` + metainfo + `, {"table": {"family": "ip", "name": "testing", "handle": 3, "flags": "dormant", "comment": "foo"}}, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11}}]}`,
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetTable(context.Background())
+			},
+			expected: &Table{
+				Flags:   []TableFlag{DormantFlag},
+				Comment: PtrTo("foo"),
+				Handle:  PtrTo(3),
+			},
+		},
+		{
+			name:     "no such table",
+			args:     []string{"table", "ip", "testing"},
+			nftError: "Error: No such file or directory\nlist table ip testing\n",
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetTable(context.Background())
+			},
+		},
+		{
+			name:      "base chain",
+			args:      []string{"chain", "ip", "testing", "prerouting"},
+			nftOutput: `{"nftables": [` + metainfo + `, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept", "comment": "bar"}}]}`,
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetChain(context.Background(), "prerouting")
+			},
+			expected: &Chain{
+				Name:     "prerouting",
+				Type:     PtrTo(NATType),
+				Hook:     PtrTo(PreroutingHook),
+				Priority: PtrTo(BaseChainPriority("-100")),
+				Policy:   PtrTo(AcceptPolicy),
+				Comment:  PtrTo("bar"),
+				Handle:   PtrTo(1),
+			},
+		},
+		{
+			name:      "ingress chain",
+			args:      []string{"chain", "ip", "testing", "ingress"},
+			nftOutput: `{"nftables": [` + metainfo + `, {"chain": {"family": "ip", "table": "testing", "name": "ingress", "handle": 2, "type": "filter", "hook": "ingress", "prio": 0, "policy": "accept", "dev": ["eth0", "eth1"]}}, {"rule": {"family": "ip", "table": "testing", "chain": "ingress", "handle": 3, "expr": []}}]}`,
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetChain(context.Background(), "ingress")
+			},
+			expected: &Chain{
+				Name:     "ingress",
+				Type:     PtrTo(FilterType),
+				Hook:     PtrTo(IngressHook),
+				Priority: PtrTo(BaseChainPriority("0")),
+				Policy:   PtrTo(AcceptPolicy),
+				Devices:  []string{"eth0", "eth1"},
+				Handle:   PtrTo(2),
+			},
+		},
+		{
+			name:      "regular chain",
+			args:      []string{"chain", "ip", "testing", "KUBE-SERVICES"},
+			nftOutput: `{"nftables": [` + metainfo + `, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11}}]}`,
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetChain(context.Background(), "KUBE-SERVICES")
+			},
+			expected: &Chain{
+				Name:   "KUBE-SERVICES",
+				Handle: PtrTo(11),
+			},
+		},
+		{
+			name:     "no such chain",
+			args:     []string{"chain", "ip", "testing", "nosuchchain"},
+			nftError: "Error: No such file or directory\nlist chain ip testing nosuchchain\n",
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetChain(context.Background(), "nosuchchain")
+			},
+		},
+		{
+			name:      "set",
+			args:      []string{"set", "ip", "testing", "test"},
+			nftOutput: `{"nftables": [` + metainfo + `, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "flags": ["interval"], "size": 1000, "elem": ["192.168.1.1"]}}]}`,
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetSet(context.Background(), "test")
+			},
+			expected: &Set{
+				Name:   "test",
+				Type:   "ipv4_addr",
+				Flags:  []SetFlag{IntervalFlag},
+				Size:   PtrTo[uint64](1000),
+				Handle: PtrTo(12),
+			},
+		},
+		{
+			name:      "map",
+			args:      []string{"map", "ip", "testing", "test"},
+			nftOutput: `{"nftables": [` + metainfo + `, {"map": {"family": "ip", "name": "test", "table": "testing", "type": ["ipv4_addr", "inet_service"], "handle": 13, "map": "verdict", "comment": "baz"}}]}`,
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetMap(context.Background(), "test")
+			},
+			expected: &Map{
+				Name:    "test",
+				Type:    "ipv4_addr . inet_service : verdict",
+				Comment: PtrTo("baz"),
+				Handle:  PtrTo(13),
+			},
+		},
+		{
+			name:     "no such map",
+			args:     []string{"map", "ip", "testing", "test"},
+			nftError: "Error: No such file or directory\nlist map ip testing test\n",
+			get: func(nft Interface) (interface{}, error) {
+				return nft.GetMap(context.Background(), "test")
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+			var err error
+			if tc.nftError != "" {
+				err = mkExecError(tc.nftError)
+			}
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   append([]string{"/nft", "--json", "list"}, tc.args...),
+					stdout: tc.nftOutput,
+					err:    err,
+				},
+			)
+
+			result, err := tc.get(nft)
+			if err != nil {
+				if tc.nftError == "" {
+					t.Errorf("unexpected error: %v", err)
+				} else if !IsNotFound(err) {
+					t.Errorf("expected IsNotFound error, got %v", err)
+				}
+				return
+			} else if tc.nftError != "" {
+				t.Errorf("unexpected non-error")
+				return
+			}
+
+			if diff := cmp.Diff(tc.expected, result); diff != "" {
+				t.Errorf("unexpected result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHasRule(t *testing.T) {
+	const chainOutput = `table ip testing {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		comment "chain comment"
+		ip daddr 10.0.0.1 tcp dport 80 dnat to 192.168.0.1
+		ip saddr { 10.0.0.2, 10.0.0.3 } drop comment "drop rule"
+		counter packets 17 bytes 1432 log prefix "foo: "
+	}
+}
+`
+	for _, tc := range []struct {
+		name     string
+		rule     string
+		nftError string
+		expected bool
+	}{
+		{
+			name:     "simple match",
+			rule:     "ip daddr 10.0.0.1 tcp dport 80 dnat to 192.168.0.1",
+			expected: true,
+		},
+		{
+			name:     "match ignoring whitespace",
+			rule:     " ip daddr 10.0.0.1  tcp dport 80 dnat to 192.168.0.1 ",
+			expected: true,
+		},
+		{
+			name:     "match ignoring comment",
+			rule:     "ip saddr { 10.0.0.2, 10.0.0.3 } drop",
+			expected: true,
+		},
+		{
+			name:     "match with quoted string",
+			rule:     `counter packets 17 bytes 1432 log prefix "foo: "`,
+			expected: true,
+		},
+		{
+			name:     "match ignoring counter values",
+			rule:     `counter log prefix "foo: "`,
+			expected: true,
+		},
+		{
+			name:     "match with different counter values",
+			rule:     `counter packets 0 bytes 0 log prefix "foo: "`,
+			expected: true,
+		},
+		{
+			name:     "no match with different quoted string",
+			rule:     `counter log prefix "bar: "`,
+			expected: false,
+		},
+		{
+			name:     "no match",
+			rule:     "ip daddr 10.0.0.1 drop",
+			expected: false,
+		},
+		{
+			name:     "chain comment is not a rule",
+			rule:     "",
+			expected: false,
+		},
+		{
+			name:     "no such chain",
+			rule:     "drop",
+			nftError: "Error: No such file or directory\nlist chain ip testing prerouting\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+			var err error
+			if tc.nftError != "" {
+				err = mkExecError(tc.nftError)
+			}
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "list", "chain", "ip", "testing", "prerouting"},
+					stdout: chainOutput,
+					err:    err,
+				},
+			)
+
+			found, err := nft.HasRule(context.Background(), "prerouting", tc.rule)
+			if tc.nftError != "" {
+				if !IsNotFound(err) {
+					t.Errorf("expected IsNotFound error, got %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if found != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, found)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	expected := NewFake(IPv6Family, "testing")
+	tx := expected.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Flowtable{Name: "ft", Priority: PtrTo(FilterIngressPriority), Devices: []string{"eth0"}})
+	tx.Add(&Chain{Name: "input", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(FilterPriority)})
+	tx.Add(&Set{Name: "myset", Type: "ipv6_addr"})
+	tx.Add(&Rule{Chain: "input", Rule: "ip6 saddr @myset drop", Comment: PtrTo("block")})
+	tx.Add(&Element{Set: "myset", Key: []string{"2001:db8::2"}})
+	tx.Add(&Element{Set: "myset", Key: []string{"2001:db8:0::1"}})
+	if err := expected.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	const metainfo = `{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}`
+	jsonCmd := expectedCmd{
+		args:   []string{"/nft", "--json", "list", "table", "ip6", "testing"},
+		stdout: `{"nftables": [` + metainfo + `, {"table": {"family": "ip6", "name": "testing", "handle": 1}}, {"flowtable": {"family": "ip6", "name": "ft", "table": "testing", "handle": 5, "hook": "ingress", "prio": 0, "dev": "eth0"}}, {"set": {"family": "ip6", "name": "myset", "table": "testing", "type": "ipv6_addr", "handle": 3, "elem": ["2001:db8::1", "2001:db8::2"]}}, {"chain": {"family": "ip6", "table": "testing", "name": "input", "handle": 2, "type": "filter", "hook": "input", "prio": 0, "policy": "accept"}}, {"rule": {"family": "ip6", "table": "testing", "chain": "input", "handle": 4, "comment": "block", "expr": []}}]}`,
+	}
+	textArgs := []string{"/nft", "--handle", "list", "table", "ip6", "testing"}
+	textCmd := func(rules ...string) expectedCmd {
+		return expectedCmd{
+			args: textArgs,
+			stdout: dedent.Dedent(`
+				table ip6 testing { # handle 1
+					flowtable ft { # handle 5
+						hook ingress priority filter
+						devices = { eth0 }
+					}
+
+					set myset { # handle 3
+						type ipv6_addr
+						elements = { 2001:db8::1, 2001:db8::2 }
+					}
+
+					chain input { # handle 2
+						type filter hook input priority filter; policy accept;
+				`) + strings.Join(rules, "\n") + "\n\t}\n}\n",
+		}
+	}
+	blockRule := "\t\tip6 saddr @myset drop comment \"block\" # handle 4"
+	extraRule := "\t\tip6 saddr ::1 accept # handle 6"
+
+	// nft has canonicalized one element's key.
+	elementDiffs := []Difference{
+		{Expected: &Element{Set: "myset", Key: []string{"2001:db8:0::1"}}},
+		{Actual: &Element{Set: "myset", Key: []string{"2001:db8::1"}}},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		commands  []expectedCmd
+		diffs     []Difference
+		expectErr string
+	}{
+		{
+			name:     "everything but the element matches",
+			commands: []expectedCmd{jsonCmd, textCmd(blockRule)},
+			diffs:    elementDiffs,
+		},
+		{
+			name:     "rule differs",
+			commands: []expectedCmd{jsonCmd, textCmd("\t\tip6 saddr @myset reject comment \"block\" # handle 4")},
+			diffs: append([]Difference{
+				{
+					Expected: expected.Table.Chains["input"].Rules[0],
+					Actual: &Rule{
+						Chain:   "input",
+						Rule:    "ip6 saddr @myset reject",
+						Comment: PtrTo("block"),
+						Index:   PtrTo(0),
+						Handle:  PtrTo(4),
+					},
+				},
+			}, elementDiffs...),
+		},
+		{
+			name:     "rules change while reading",
+			commands: []expectedCmd{jsonCmd, textCmd(blockRule, extraRule), jsonCmd, textCmd(blockRule)},
+			diffs:    elementDiffs,
+		},
+		{
+			name: "rules keep changing while reading",
+			commands: []expectedCmd{
+				jsonCmd, textCmd(blockRule, extraRule),
+				jsonCmd, textCmd(blockRule, extraRule),
+				jsonCmd, textCmd(blockRule, extraRule),
+			},
+			expectErr: "table ip6 testing changed while it was being read",
+		},
+		{
+			name: "no table",
+			commands: []expectedCmd{
+				{
+					args: jsonCmd.args,
+					err:  mkExecError("Error: No such file or directory\nlist table ip6 testing\n"),
+				},
+			},
+			diffs: []Difference{
+				{Expected: &expected.Table.Table},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv6Family, "testing")
+			fexec.expected = append(fexec.expected, tc.commands...)
+
+			diffs, err := nft.Verify(context.Background(), expected)
+			if fexec.matched != len(fexec.expected) {
+				t.Errorf("expected %d commands to be run, got %d", len(fexec.expected), fexec.matched)
+			}
+			if tc.expectErr != "" {
+				if err == nil || err.Error() != tc.expectErr {
+					t.Fatalf("expected error %q from Verify, got %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error from Verify: %v", err)
+			}
+			if diff := cmp.Diff(tc.diffs, diffs); diff != "" {
+				t.Errorf("unexpected result from Verify:\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestFeatures(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
@@ -553,3 +2257,79 @@ func TestFeatures(t *testing.T) {
 		})
 	}
 }
+
+func TestVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		versionOutput  string
+		version        [3]int
+		objectComments bool
+	}{
+		{
+			name:           "1.0.7",
+			versionOutput:  "nftables v1.0.7 (Old Doc Yak)\n",
+			version:        [3]int{1, 0, 7},
+			objectComments: true,
+		},
+		{
+			name:           "1.0.8",
+			versionOutput:  "nftables v1.0.8 (Old Doc Yak #2)\n",
+			version:        [3]int{1, 0, 8},
+			objectComments: true,
+		},
+		{
+			name:           "1.1.0",
+			versionOutput:  "nftables v1.1.0 (Commodore Bullmoose)\n",
+			version:        [3]int{1, 1, 0},
+			objectComments: false,
+		},
+		{
+			name:           "unparseable",
+			versionOutput:  "nftables (unknown)\n",
+			version:        [3]int{0, 0, 0},
+			objectComments: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fexec := newFakeExec(t)
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "--version"},
+					stdout: tc.versionOutput,
+				},
+			)
+			if tc.objectComments {
+				fexec.expected = append(fexec.expected,
+					expectedCmd{
+						args:  []string{"/nft", "--check", "-f", "-"},
+						stdin: "add table ip testing { comment \"test\" ; }\n",
+					},
+				)
+			} else {
+				fexec.expected = append(fexec.expected,
+					expectedCmd{
+						args:  []string{"/nft", "--check", "-f", "-"},
+						stdin: "add table ip testing { comment \"test\" ; }\n",
+						err:   fmt.Errorf("Error: syntax error, unexpected comment"),
+					},
+					expectedCmd{
+						args:  []string{"/nft", "--check", "-f", "-"},
+						stdin: "add table ip testing\n",
+					},
+				)
+			}
+
+			nft, err := newInternal(IPv4Family, "testing", fexec)
+			if err != nil {
+				t.Fatalf("Unexpected error creating Interface: %v", err)
+			}
+			major, minor, patch := nft.Version()
+			if version := [3]int{major, minor, patch}; version != tc.version {
+				t.Errorf("expected version %v, got %v", tc.version, version)
+			}
+			if nft.HasFeature(ObjectCommentsFeature) != tc.objectComments {
+				t.Errorf("expected ObjectCommentsFeature %v, got %v", tc.objectComments, !tc.objectComments)
+			}
+		})
+	}
+}
@@ -69,7 +69,7 @@ func (table *Table) validate(verb verb) error {
 func (table *Table) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 	// Special case for delete-by-handle
 	if verb == deleteVerb && table.Handle != nil {
-		fmt.Fprintf(writer, "delete table %s handle %d", ctx.family, *table.Handle)
+		fmt.Fprintf(writer, "delete table %s handle %d\n", ctx.family, *table.Handle)
 		return
 	}
 
@@ -130,13 +130,16 @@ func (chain *Chain) validate(verb verb) error {
 		if chain.Policy != nil {
 			return fmt.Errorf("regular chain %q must not specify Policy", chain.Name)
 		}
-		if chain.Device != nil {
+		if chain.Device != nil || len(chain.Devices) != 0 {
 			return fmt.Errorf("regular chain %q must not specify Device", chain.Name)
 		}
 	} else {
 		if chain.Type == nil || chain.Priority == nil {
 			return fmt.Errorf("base chain %q must specify Type and Priority", chain.Name)
 		}
+		if chain.Device != nil && len(chain.Devices) != 0 {
+			return fmt.Errorf("base chain %q must not specify both Device and Devices", chain.Name)
+		}
 	}
 
 	switch verb {
@@ -161,7 +164,7 @@ func (chain *Chain) validate(verb verb) error {
 func (chain *Chain) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 	// Special case for delete-by-handle
 	if verb == deleteVerb && chain.Handle != nil {
-		fmt.Fprintf(writer, "delete chain %s %s handle %d", ctx.family, ctx.table, *chain.Handle)
+		fmt.Fprintf(writer, "delete chain %s %s handle %d\n", ctx.family, ctx.table, *chain.Handle)
 		return
 	}
 
@@ -174,6 +177,10 @@ func (chain *Chain) writeOperation(verb verb, ctx *nftContext, writer io.Writer)
 				fmt.Fprintf(writer, " type %s hook %s", *chain.Type, *chain.Hook)
 				if chain.Device != nil {
 					fmt.Fprintf(writer, " device %q", *chain.Device)
+				} else if len(chain.Devices) == 1 {
+					fmt.Fprintf(writer, " device %q", chain.Devices[0])
+				} else if len(chain.Devices) > 1 {
+					fmt.Fprintf(writer, " devices = { %s }", strings.Join(chain.Devices, ", "))
 				}
 
 				// Parse the priority to a number if we can, because older
@@ -200,9 +207,9 @@ func (chain *Chain) writeOperation(verb verb, ctx *nftContext, writer io.Writer)
 	fmt.Fprintf(writer, "\n")
 }
 
-// groups in []: [1]%s(?: {(?: type [2]%s hook [3]%s(?: device "[4]%s")(?: priority [5]%s ;)(?: policy [6]%s ;)?)(?: comment [7]%s ;) })
+// groups in []: [1]%s(?: {(?: type [2]%s hook [3]%s(?: device "[4]%s")(?: devices = { [5]([^}]*) })(?: priority [6]%s ;)(?: policy [7]%s ;)?)(?: comment [8]%s ;) })
 var chainRegexp = regexp.MustCompile(fmt.Sprintf(
-	`%s(?: {(?: type %s hook %s(?: device "%s")?(?: priority %s ;)(?: policy %s ;)?)?(?: comment %s ;)? })?`,
+	`%s(?: {(?: type %s hook %s(?: device "%s")?(?: devices = { ([^}]*) })?(?: priority %s ;)(?: policy %s ;)?)?(?: comment %s ;)? })?`,
 	noSpaceGroup, noSpaceGroup, noSpaceGroup, noSpaceGroup, noSpaceGroup, noSpaceGroup, commentGroup))
 
 func (chain *Chain) parse(line string) error {
@@ -211,7 +218,7 @@ func (chain *Chain) parse(line string) error {
 		return fmt.Errorf("failed parsing chain add command")
 	}
 	chain.Name = match[1]
-	chain.Comment = getComment(match[7])
+	chain.Comment = getComment(match[8])
 	if match[2] != "" {
 		chain.Type = (*BaseChainType)(&match[2])
 	}
@@ -222,26 +229,57 @@ func (chain *Chain) parse(line string) error {
 		chain.Device = &match[4]
 	}
 	if match[5] != "" {
-		chain.Priority = (*BaseChainPriority)(&match[5])
+		chain.Devices = strings.Split(match[5], ", ")
 	}
 	if match[6] != "" {
-		chain.Policy = (*BaseChainPolicy)(&match[6])
+		chain.Priority = (*BaseChainPriority)(&match[6])
+	}
+	if match[7] != "" {
+		chain.Policy = (*BaseChainPolicy)(&match[7])
 	}
 	return nil
 }
 
+// chainPolicy is used by Transaction.SetChainPolicy to update the policy of an existing
+// base chain.
+type chainPolicy struct {
+	chain  string
+	policy BaseChainPolicy
+}
+
+// Object implementation for chainPolicy
+func (cp *chainPolicy) validate(verb verb) error {
+	if cp.chain == "" {
+		return fmt.Errorf("no chain name specified")
+	}
+	if cp.policy == "" {
+		return fmt.Errorf("no policy specified for chain %q", cp.chain)
+	}
+	if verb != addVerb {
+		return fmt.Errorf("%s is not implemented for chain policies", verb)
+	}
+	return nil
+}
+
+func (cp *chainPolicy) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	fmt.Fprintf(writer, "%s chain %s %s %s { policy %s ; }\n", verb, ctx.family, ctx.table, cp.chain, cp.policy)
+}
+
+func (cp *chainPolicy) parse(line string) error {
+	return fmt.Errorf("parsing chain policies is not supported")
+}
+
 // Object implementation for Rule
 func (rule *Rule) validate(verb verb) error {
 	if rule.Chain == "" {
 		return fmt.Errorf("no chain name specified for rule")
 	}
 
-	if rule.Index != nil && rule.Handle != nil {
-		return fmt.Errorf("cannot specify both Index and Handle")
-	}
-
 	switch verb {
 	case addVerb, insertVerb:
+		if rule.Index != nil && rule.Handle != nil {
+			return fmt.Errorf("cannot specify both Index and Handle")
+		}
 		if rule.Rule == "" {
 			return fmt.Errorf("no rule specified")
 		}
@@ -265,7 +303,9 @@ func (rule *Rule) validate(verb verb) error {
 
 func (rule *Rule) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 	fmt.Fprintf(writer, "%s rule %s %s %s", verb, ctx.family, ctx.table, rule.Chain)
-	if rule.Index != nil {
+	// (Index is ignored by Replace and Delete, so that a Rule returned from
+	// ListRules, which has both Index and Handle set, can be passed to them.)
+	if rule.Index != nil && (verb == addVerb || verb == insertVerb) {
 		fmt.Fprintf(writer, " index %d", *rule.Index)
 	} else if rule.Handle != nil {
 		fmt.Fprintf(writer, " handle %d", *rule.Handle)
@@ -283,12 +323,27 @@ func (rule *Rule) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 	fmt.Fprintf(writer, "\n")
 }
 
-// groups in []: [1]%s(?: index [2]%s)?(?: handle [3]%s)? [4]([^"]*)(?: comment [5]%s)?$
+// groups in []: [1]%s(?: index [2]%s)?(?: handle [3]%s)? [4]((?:[^"]|"[^"]*")*?)(?: comment [5]%s)?$
 var ruleRegexp = regexp.MustCompile(fmt.Sprintf(
-	`%s(?: index %s)?(?: handle %s)? ([^"]*)(?: comment %s)?$`,
+	`%s(?: index %s)?(?: handle %s)? ((?:[^"]|"[^"]*")*?)(?: comment %s)?$`,
 	noSpaceGroup, numberGroup, numberGroup, commentGroup))
 
+// handleCommentRegexp matches the "# handle N" comment that "nft --handle list" appends
+// to each rule.
+var handleCommentRegexp = regexp.MustCompile(` +# handle ([0-9]+)$`)
+
+// stripHandleComment removes a trailing "# handle N" comment from line, returning the
+// stripped line and the handle (or nil if there was no such comment).
+func stripHandleComment(line string) (string, *int) {
+	match := handleCommentRegexp.FindStringSubmatchIndex(line)
+	if match == nil {
+		return line, nil
+	}
+	return line[:match[0]], parseInt(line[match[2]:match[3]])
+}
+
 func (rule *Rule) parse(line string) error {
+	line, handle := stripHandleComment(line)
 	match := ruleRegexp.FindStringSubmatch(line)
 	if match == nil {
 		return fmt.Errorf("failed parsing rule add command")
@@ -301,10 +356,58 @@ func (rule *Rule) parse(line string) error {
 	}
 	if match[3] != "" {
 		rule.Handle = parseInt(match[3])
+	} else if handle != nil && rule.Index == nil {
+		rule.Handle = handle
 	}
 	return nil
 }
 
+// ReferencedMarks does a best-effort parse of the rule and returns the hex mark values
+// (eg, "0x4000") that it reads or writes via "mark", "meta mark", or "ct mark"
+// expressions, in the order they appear, without duplicates. (It does not attempt to
+// find marks that are stored in sets or maps, or written in decimal.)
+func (rule *Rule) ReferencedMarks() []string {
+	words, err := tokenizeRule(rule.Rule)
+	if err != nil {
+		return nil
+	}
+
+	var marks []string
+	seen := make(map[string]bool)
+	inMarkExpr := false
+	for _, word := range words {
+		if word == "mark" {
+			inMarkExpr = true
+			continue
+		}
+		if !inMarkExpr {
+			continue
+		}
+
+		value := strings.TrimSuffix(word, ",")
+		switch {
+		case markHexRegexp.MatchString(value):
+			if !seen[value] {
+				seen[value] = true
+				marks = append(marks, value)
+			}
+		case markOperators[value]:
+			// still part of the mark expression
+		default:
+			inMarkExpr = false
+		}
+	}
+	return marks
+}
+
+var markHexRegexp = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+
+// markOperators are the words that can appear between "mark" and a mark value
+var markOperators = map[string]bool{
+	"set": true, "and": true, "or": true, "xor": true, "&": true, "|": true, "^": true,
+	"==": true, "!=": true, "eq": true, "ne": true, "{": true, "}": true, "meta": true, "ct": true,
+}
+
 // Object implementation for Set
 func (set *Set) validate(verb verb) error {
 	switch verb {
@@ -334,7 +437,7 @@ func (set *Set) validate(verb verb) error {
 func (set *Set) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 	// Special case for delete-by-handle
 	if verb == deleteVerb && set.Handle != nil {
-		fmt.Fprintf(writer, "delete set %s %s handle %d", ctx.family, ctx.table, *set.Handle)
+		fmt.Fprintf(writer, "delete set %s %s handle %d\n", ctx.family, ctx.table, *set.Handle)
 		return
 	}
 
@@ -374,6 +477,9 @@ func (set *Set) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 		if set.AutoMerge != nil && *set.AutoMerge {
 			fmt.Fprintf(writer, " auto-merge ;")
 		}
+		if set.Counters != nil && *set.Counters {
+			fmt.Fprintf(writer, " counter ;")
+		}
 
 		if set.Comment != nil && !ctx.noObjectComments {
 			fmt.Fprintf(writer, " comment %q ;", *set.Comment)
@@ -391,7 +497,7 @@ func (set *Set) parse(line string) error {
 		return fmt.Errorf("failed parsing set add command")
 	}
 	set.Name, set.Type, set.TypeOf, set.Flags, set.Timeout, set.GCInterval,
-		set.Size, set.Policy, set.Comment, set.AutoMerge = parseMapAndSetProps(match)
+		set.Size, set.Policy, set.Comment, set.AutoMerge, set.Counters = parseMapAndSetProps(match)
 	return nil
 }
 
@@ -424,7 +530,7 @@ func (mapObj *Map) validate(verb verb) error {
 func (mapObj *Map) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 	// Special case for delete-by-handle
 	if verb == deleteVerb && mapObj.Handle != nil {
-		fmt.Fprintf(writer, "delete map %s %s handle %d", ctx.family, ctx.table, *mapObj.Handle)
+		fmt.Fprintf(writer, "delete map %s %s handle %d\n", ctx.family, ctx.table, *mapObj.Handle)
 		return
 	}
 
@@ -461,6 +567,9 @@ func (mapObj *Map) writeOperation(verb verb, ctx *nftContext, writer io.Writer)
 		if mapObj.Policy != nil {
 			fmt.Fprintf(writer, " policy %s ;", *mapObj.Policy)
 		}
+		if mapObj.Counters != nil && *mapObj.Counters {
+			fmt.Fprintf(writer, " counter ;")
+		}
 
 		if mapObj.Comment != nil && !ctx.noObjectComments {
 			fmt.Fprintf(writer, " comment %q ;", *mapObj.Comment)
@@ -478,22 +587,27 @@ func (mapObj *Map) parse(line string) error {
 		return fmt.Errorf("failed parsing map add command")
 	}
 	mapObj.Name, mapObj.Type, mapObj.TypeOf, mapObj.Flags, mapObj.Timeout, mapObj.GCInterval,
-		mapObj.Size, mapObj.Policy, mapObj.Comment, _ = parseMapAndSetProps(match)
+		mapObj.Size, mapObj.Policy, mapObj.Comment, _, mapObj.Counters = parseMapAndSetProps(match)
 	return nil
 }
 
 var autoMergeProp = `( auto-merge ;)?`
 
-// groups in []:  [1]%s {(?: [2](type|typeof) [3]([^;]*)) ;(?: flags [4]([^;]*) ;)?(?: timeout [5]%ss ;)?(?: gc-interval [6]%ss ;)?(?: size [7]%s ;)?(?: policy [8]%s ;)?[9]%s(?: comment [10]%s ;)? }
-var mapOrSet = `%s {(?: (type|typeof) ([^;]*)) ;(?: flags ([^;]*) ;)?(?: timeout %ss ;)?(?: gc-interval %ss ;)?(?: size %s ;)?(?: policy %s ;)?%s(?: comment %s ;)? }`
+// groups in []:  [1]%s {(?: [2](type|typeof) [3]([^;]*)) ;(?: flags [4]([^;]*) ;)?(?: timeout [5]%ss ;)?(?: gc-interval [6]%ss ;)?(?: size [7]%s ;)?(?: policy [8]%s ;)?[9]%s[10]( counter ;)?(?: comment [11]%s ;)? }
+var mapOrSet = `%s {(?: (type|typeof) ([^;]*)) ;(?: flags ([^;]*) ;)?(?: timeout %ss ;)?(?: gc-interval %ss ;)?(?: size %s ;)?(?: policy %s ;)?%s( counter ;)?(?: comment %s ;)? }`
 var mapRegexp = regexp.MustCompile(fmt.Sprintf(mapOrSet, noSpaceGroup, numberGroup, numberGroup, noSpaceGroup, noSpaceGroup, "", commentGroup))
 var setRegexp = regexp.MustCompile(fmt.Sprintf(mapOrSet, noSpaceGroup, numberGroup, numberGroup, noSpaceGroup, noSpaceGroup, autoMergeProp, commentGroup))
 
 func parseMapAndSetProps(match []string) (name string, typeProp string, typeOf string, flags []SetFlag,
-	timeout *time.Duration, gcInterval *time.Duration, size *uint64, policy *SetPolicy, comment *string, autoMerge *bool) {
+	timeout *time.Duration, gcInterval *time.Duration, size *uint64, policy *SetPolicy, comment *string, autoMerge *bool, counters *bool) {
 	name = match[1]
-	// set and map have different number of match groups, but comment is always the last
+	// set and map have different number of match groups, but comment is always the
+	// last, and counter is always just before it.
 	comment = getComment(match[len(match)-1])
+	if match[len(match)-2] != "" {
+		countersObj := true
+		counters = &countersObj
+	}
 	if match[2] == "type" {
 		typeProp = match[3]
 	} else {
@@ -516,7 +630,7 @@ func parseMapAndSetProps(match []string) (name string, typeProp string, typeOf s
 	if match[8] != "" {
 		policy = (*SetPolicy)(&match[8])
 	}
-	if len(match) > 10 {
+	if len(match) > 11 {
 		// set
 		if match[9] != "" {
 			autoMergeObj := true
@@ -572,9 +686,25 @@ func (element *Element) writeOperation(verb verb, ctx *nftContext, writer io.Wri
 		strings.Join(element.Key, " . "))
 
 	if verb == addVerb || verb == createVerb {
+		if element.Timeout != nil {
+			fmt.Fprintf(writer, " timeout %ds", int64(element.Timeout.Seconds()))
+		}
+		if element.Expires != nil {
+			fmt.Fprintf(writer, " expires %ds", int64(element.Expires.Seconds()))
+		}
 		if element.Comment != nil {
 			fmt.Fprintf(writer, " comment %q", *element.Comment)
 		}
+		if element.Packets != nil || element.Bytes != nil {
+			var packets, bytes uint64
+			if element.Packets != nil {
+				packets = *element.Packets
+			}
+			if element.Bytes != nil {
+				bytes = *element.Bytes
+			}
+			fmt.Fprintf(writer, " counter packets %d bytes %d", packets, bytes)
+		}
 
 		if len(element.Value) != 0 {
 			fmt.Fprintf(writer, " : %s", strings.Join(element.Value, " . "))
@@ -584,13 +714,19 @@ func (element *Element) writeOperation(verb verb, ctx *nftContext, writer io.Wri
 	fmt.Fprintf(writer, " }\n")
 }
 
-// groups in []: [1]%s { [2]([^:"]*)(?: comment [3]%s)? : [4](.*) }
+// elementKeyGroup matches an element key, which may contain quoted strings (eg,
+// interface names).
+var elementKeyGroup = `((?:[^"]|"[^"]*")*?)`
+
+// groups in []: [1]%s { [2]%s(?: timeout [3]%ss)?(?: expires [4]%ss)?(?: comment [5]%s)?(?: counter packets [6]%s bytes [7]%s)? : [8](.*) }
 var mapElementRegexp = regexp.MustCompile(fmt.Sprintf(
-	`%s { ([^"]*)(?: comment %s)? : (.*) }`, noSpaceGroup, commentGroup))
+	`%s { %s(?: timeout %ss)?(?: expires %ss)?(?: comment %s)?(?: counter packets %s bytes %s)? : (.*) }`,
+	noSpaceGroup, elementKeyGroup, numberGroup, numberGroup, commentGroup, numberGroup, numberGroup))
 
-// groups in []: [1]%s { [2]([^:"]*)(?: comment [3]%s)? }
+// groups in []: [1]%s { [2]%s(?: timeout [3]%ss)?(?: expires [4]%ss)?(?: comment [5]%s)?(?: counter packets [6]%s bytes [7]%s)? }
 var setElementRegexp = regexp.MustCompile(fmt.Sprintf(
-	`%s { ([^"]*)(?: comment %s)? }`, noSpaceGroup, commentGroup))
+	`%s { %s(?: timeout %ss)?(?: expires %ss)?(?: comment %s)?(?: counter packets %s bytes %s)? }`,
+	noSpaceGroup, elementKeyGroup, numberGroup, numberGroup, commentGroup, numberGroup, numberGroup))
 
 func (element *Element) parse(line string) error {
 	// try to match map element first, since it has more groups, and if it matches, then we can be sure
@@ -602,13 +738,25 @@ func (element *Element) parse(line string) error {
 			return fmt.Errorf("failed parsing element add command")
 		}
 	}
-	element.Comment = getComment(match[3])
+	if match[3] != "" {
+		timeout, _ := time.ParseDuration(match[3] + "s")
+		element.Timeout = &timeout
+	}
+	if match[4] != "" {
+		expires, _ := time.ParseDuration(match[4] + "s")
+		element.Expires = &expires
+	}
+	element.Comment = getComment(match[5])
+	if match[6] != "" {
+		element.Packets = parseUint(match[6])
+		element.Bytes = parseUint(match[7])
+	}
 	mapOrSetName := match[1]
 	element.Key = append(element.Key, strings.Split(match[2], " . ")...)
-	if len(match) == 5 {
+	if len(match) == 9 {
 		// map regex matched
 		element.Map = mapOrSetName
-		element.Value = append(element.Value, strings.Split(match[4], " . ")...)
+		element.Value = append(element.Value, strings.Split(match[8], " . ")...)
 	} else {
 		element.Set = mapOrSetName
 	}
@@ -639,7 +787,7 @@ func (flowtable *Flowtable) validate(verb verb) error {
 func (flowtable *Flowtable) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 	// Special case for delete-by-handle
 	if verb == deleteVerb && flowtable.Handle != nil {
-		fmt.Fprintf(writer, "delete flowtable %s %s handle %d", ctx.family, ctx.table, *flowtable.Handle)
+		fmt.Fprintf(writer, "delete flowtable %s %s handle %d\n", ctx.family, ctx.table, *flowtable.Handle)
 		return
 	}
 
@@ -691,3 +839,293 @@ func (flowtable *Flowtable) parse(line string) error {
 	}
 	return nil
 }
+
+// Object implementation for CTHelper
+func (helper *CTHelper) validate(verb verb) error {
+	switch verb {
+	case addVerb, createVerb:
+		if helper.Name == "" {
+			return fmt.Errorf("no name specified for ct helper")
+		}
+		if helper.Type == "" {
+			return fmt.Errorf("no type specified for ct helper")
+		}
+		if helper.Protocol == "" {
+			return fmt.Errorf("no protocol specified for ct helper")
+		}
+		if helper.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+	case deleteVerb:
+		if helper.Name == "" && helper.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for ct helpers", verb)
+	}
+
+	return nil
+}
+
+func (helper *CTHelper) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete-by-handle
+	if verb == deleteVerb && helper.Handle != nil {
+		fmt.Fprintf(writer, "delete ct helper %s %s handle %d\n", ctx.family, ctx.table, *helper.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s ct helper %s %s %s", verb, ctx.family, ctx.table, helper.Name)
+	if verb == addVerb || verb == createVerb {
+		fmt.Fprintf(writer, " { type %q protocol %s ;", helper.Type, helper.Protocol)
+		if helper.L3Proto != nil {
+			fmt.Fprintf(writer, " l3proto %s ;", *helper.L3Proto)
+		}
+		fmt.Fprintf(writer, " }")
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s { type "[2]([^"]*)" protocol [3]%s ;(?: l3proto [4]%s ;)? }
+var ctHelperRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s { type "([^"]*)" protocol %s ;(?: l3proto %s ;)? }`,
+	noSpaceGroup, noSpaceGroup, noSpaceGroup))
+
+func (helper *CTHelper) parse(line string) error {
+	match := ctHelperRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing ct helper add command")
+	}
+	helper.Name = match[1]
+	helper.Type = match[2]
+	helper.Protocol = match[3]
+	if match[4] != "" {
+		helper.L3Proto = (*Family)(&match[4])
+	}
+	return nil
+}
+
+// Object implementation for CTTimeout
+func (timeout *CTTimeout) validate(verb verb) error {
+	switch verb {
+	case addVerb, createVerb:
+		if timeout.Name == "" {
+			return fmt.Errorf("no name specified for ct timeout")
+		}
+		if timeout.Protocol == "" {
+			return fmt.Errorf("no protocol specified for ct timeout")
+		}
+		if len(timeout.Policy) == 0 {
+			return fmt.Errorf("no policy specified for ct timeout")
+		}
+		if timeout.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+	case deleteVerb:
+		if timeout.Name == "" && timeout.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for ct timeouts", verb)
+	}
+
+	return nil
+}
+
+func (timeout *CTTimeout) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete-by-handle
+	if verb == deleteVerb && timeout.Handle != nil {
+		fmt.Fprintf(writer, "delete ct timeout %s %s handle %d\n", ctx.family, ctx.table, *timeout.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s ct timeout %s %s %s", verb, ctx.family, ctx.table, timeout.Name)
+	if verb == addVerb || verb == createVerb {
+		fmt.Fprintf(writer, " { protocol %s ;", timeout.Protocol)
+		if timeout.L3Proto != nil {
+			fmt.Fprintf(writer, " l3proto %s ;", *timeout.L3Proto)
+		}
+		fmt.Fprintf(writer, " policy = {")
+		for i, state := range sortKeys(timeout.Policy) {
+			if i > 0 {
+				fmt.Fprintf(writer, ",")
+			}
+			fmt.Fprintf(writer, " %s : %d", state, int64(timeout.Policy[state].Seconds()))
+		}
+		fmt.Fprintf(writer, " } ; }")
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s { protocol [2]%s ;(?: l3proto [3]%s ;)? policy = { [4]([^}]*) } ; }
+var ctTimeoutRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s { protocol %s ;(?: l3proto %s ;)? policy = { ([^}]*) } ; }`,
+	noSpaceGroup, noSpaceGroup, noSpaceGroup))
+
+func (timeout *CTTimeout) parse(line string) error {
+	match := ctTimeoutRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing ct timeout add command")
+	}
+	timeout.Name = match[1]
+	timeout.Protocol = match[2]
+	if match[3] != "" {
+		timeout.L3Proto = (*Family)(&match[3])
+	}
+	timeout.Policy = make(map[string]time.Duration)
+	for _, entry := range strings.Split(match[4], ",") {
+		state, value, found := strings.Cut(entry, ":")
+		if !found {
+			return fmt.Errorf("failed parsing ct timeout policy %q", entry)
+		}
+		seconds, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), "s"))
+		if err != nil {
+			return fmt.Errorf("failed parsing ct timeout policy %q: %w", entry, err)
+		}
+		timeout.Policy[strings.TrimSpace(state)] = time.Duration(seconds) * time.Second
+	}
+	return nil
+}
+
+// Object implementation for CTExpectation
+func (expectation *CTExpectation) validate(verb verb) error {
+	switch verb {
+	case addVerb, createVerb:
+		if expectation.Name == "" {
+			return fmt.Errorf("no name specified for ct expectation")
+		}
+		if expectation.Protocol == "" {
+			return fmt.Errorf("no protocol specified for ct expectation")
+		}
+		if expectation.DPort == 0 {
+			return fmt.Errorf("no dport specified for ct expectation")
+		}
+		if expectation.Timeout < time.Second {
+			return fmt.Errorf("no timeout specified for ct expectation")
+		}
+		if expectation.Size == 0 {
+			return fmt.Errorf("no size specified for ct expectation")
+		}
+		if expectation.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+	case deleteVerb:
+		if expectation.Name == "" && expectation.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for ct expectations", verb)
+	}
+
+	return nil
+}
+
+func (expectation *CTExpectation) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete-by-handle
+	if verb == deleteVerb && expectation.Handle != nil {
+		fmt.Fprintf(writer, "delete ct expectation %s %s handle %d\n", ctx.family, ctx.table, *expectation.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s ct expectation %s %s %s", verb, ctx.family, ctx.table, expectation.Name)
+	if verb == addVerb || verb == createVerb {
+		fmt.Fprintf(writer, " { protocol %s ; dport %d ; timeout %ds ; size %d ;",
+			expectation.Protocol, expectation.DPort, int64(expectation.Timeout.Seconds()), expectation.Size)
+		if expectation.L3Proto != nil {
+			fmt.Fprintf(writer, " l3proto %s ;", *expectation.L3Proto)
+		}
+		fmt.Fprintf(writer, " }")
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s { protocol [2]%s ; dport [3]%s ; timeout [4]%ss ; size [5]%s ;(?: l3proto [6]%s ;)? }
+var ctExpectationRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s { protocol %s ; dport %s ; timeout %ss ; size %s ;(?: l3proto %s ;)? }`,
+	noSpaceGroup, noSpaceGroup, numberGroup, numberGroup, numberGroup, noSpaceGroup))
+
+func (expectation *CTExpectation) parse(line string) error {
+	match := ctExpectationRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing ct expectation add command")
+	}
+	expectation.Name = match[1]
+	expectation.Protocol = match[2]
+	expectation.DPort = *parseInt(match[3])
+	expectation.Timeout = time.Duration(*parseInt(match[4])) * time.Second
+	expectation.Size = *parseInt(match[5])
+	if match[6] != "" {
+		expectation.L3Proto = (*Family)(&match[6])
+	}
+	return nil
+}
+
+// Object implementation for Synproxy
+func (synproxy *Synproxy) validate(verb verb) error {
+	switch verb {
+	case addVerb, createVerb:
+		if synproxy.Name == "" {
+			return fmt.Errorf("no name specified for synproxy")
+		}
+		if synproxy.MSS == 0 {
+			return fmt.Errorf("no mss specified for synproxy")
+		}
+		if synproxy.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+	case deleteVerb:
+		if synproxy.Name == "" && synproxy.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for synproxies", verb)
+	}
+
+	return nil
+}
+
+func (synproxy *Synproxy) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete-by-handle
+	if verb == deleteVerb && synproxy.Handle != nil {
+		fmt.Fprintf(writer, "delete synproxy %s %s handle %d\n", ctx.family, ctx.table, *synproxy.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s synproxy %s %s %s", verb, ctx.family, ctx.table, synproxy.Name)
+	if verb == addVerb || verb == createVerb {
+		fmt.Fprintf(writer, " { mss %d wscale %d", synproxy.MSS, synproxy.WScale)
+		if synproxy.Timestamp != nil && *synproxy.Timestamp {
+			fmt.Fprintf(writer, " timestamp")
+		}
+		if synproxy.SACKPerm != nil && *synproxy.SACKPerm {
+			fmt.Fprintf(writer, " sack-perm")
+		}
+		fmt.Fprintf(writer, " ; }")
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s { mss [2]%s wscale [3]%s[4]( timestamp)?[5]( sack-perm)? ; }
+var synproxyRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s { mss %s wscale %s( timestamp)?( sack-perm)? ; }`,
+	noSpaceGroup, numberGroup, numberGroup))
+
+func (synproxy *Synproxy) parse(line string) error {
+	match := synproxyRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing synproxy add command")
+	}
+	synproxy.Name = match[1]
+	synproxy.MSS = uint32(*parseUint(match[2]))
+	synproxy.WScale = uint8(*parseUint(match[3]))
+	if match[4] != "" {
+		synproxy.Timestamp = PtrTo(true)
+	}
+	if match[5] != "" {
+		synproxy.SACKPerm = PtrTo(true)
+	}
+	return nil
+}
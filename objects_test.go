@@ -18,9 +18,13 @@ package knftables
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
 )
 
 func getObjType(object Object) string {
@@ -205,6 +209,230 @@ func TestObjects(t *testing.T) {
 			err: "cannot specify Handle",
 		},
 
+		// CT helpers
+		{
+			name:   "add ct helper",
+			verb:   addVerb,
+			object: &CTHelper{Name: "ftp-helper", Type: "ftp", Protocol: "tcp"},
+			out:    `add ct helper ip mytable ftp-helper { type "ftp" protocol tcp ; }`,
+		},
+		{
+			name:   "create ct helper with l3proto",
+			verb:   createVerb,
+			object: &CTHelper{Name: "sip-helper", Type: "sip", Protocol: "udp", L3Proto: PtrTo(IPv4Family)},
+			out:    `create ct helper ip mytable sip-helper { type "sip" protocol udp ; l3proto ip ; }`,
+		},
+		{
+			name:   "delete ct helper",
+			verb:   deleteVerb,
+			object: &CTHelper{Name: "ftp-helper"},
+			out:    `delete ct helper ip mytable ftp-helper`,
+		},
+		{
+			name:   "delete ct helper by handle",
+			verb:   deleteVerb,
+			object: &CTHelper{Name: "ftp-helper", Handle: PtrTo(5)},
+			out:    `delete ct helper ip mytable handle 5`,
+		},
+		{
+			name:   "invalid add ct helper with no type",
+			verb:   addVerb,
+			object: &CTHelper{Name: "ftp-helper", Protocol: "tcp"},
+			err:    "no type",
+		},
+		{
+			name:   "invalid add ct helper with no protocol",
+			verb:   addVerb,
+			object: &CTHelper{Name: "ftp-helper", Type: "ftp"},
+			err:    "no protocol",
+		},
+		{
+			name:   "invalid add ct helper with Handle",
+			verb:   addVerb,
+			object: &CTHelper{Name: "ftp-helper", Type: "ftp", Protocol: "tcp", Handle: PtrTo(5)},
+			err:    "cannot specify Handle",
+		},
+		{
+			name:   "invalid flush ct helper",
+			verb:   flushVerb,
+			object: &CTHelper{Name: "ftp-helper"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert ct helper",
+			verb:   insertVerb,
+			object: &CTHelper{Name: "ftp-helper"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace ct helper",
+			verb:   replaceVerb,
+			object: &CTHelper{Name: "ftp-helper"},
+			err:    "not implemented",
+		},
+
+		// CT timeouts
+		{
+			name:   "add ct timeout",
+			verb:   addVerb,
+			object: &CTTimeout{Name: "ct-time", Protocol: "tcp", Policy: map[string]time.Duration{"established": 120 * time.Second, "close": 10 * time.Second}},
+			out:    `add ct timeout ip mytable ct-time { protocol tcp ; policy = { close : 10, established : 120 } ; }`,
+		},
+		{
+			name:   "create ct timeout with l3proto",
+			verb:   createVerb,
+			object: &CTTimeout{Name: "ct-time", Protocol: "udp", L3Proto: PtrTo(IPv4Family), Policy: map[string]time.Duration{"unreplied": time.Minute}},
+			out:    `create ct timeout ip mytable ct-time { protocol udp ; l3proto ip ; policy = { unreplied : 60 } ; }`,
+		},
+		{
+			name:   "delete ct timeout",
+			verb:   deleteVerb,
+			object: &CTTimeout{Name: "ct-time"},
+			out:    `delete ct timeout ip mytable ct-time`,
+		},
+		{
+			name:   "delete ct timeout by handle",
+			verb:   deleteVerb,
+			object: &CTTimeout{Name: "ct-time", Handle: PtrTo(5)},
+			out:    `delete ct timeout ip mytable handle 5`,
+		},
+		{
+			name:   "invalid add ct timeout with no protocol",
+			verb:   addVerb,
+			object: &CTTimeout{Name: "ct-time", Policy: map[string]time.Duration{"established": time.Minute}},
+			err:    "no protocol",
+		},
+		{
+			name:   "invalid add ct timeout with no policy",
+			verb:   addVerb,
+			object: &CTTimeout{Name: "ct-time", Protocol: "tcp"},
+			err:    "no policy",
+		},
+		{
+			name:   "invalid flush ct timeout",
+			verb:   flushVerb,
+			object: &CTTimeout{Name: "ct-time"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert ct timeout",
+			verb:   insertVerb,
+			object: &CTTimeout{Name: "ct-time"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace ct timeout",
+			verb:   replaceVerb,
+			object: &CTTimeout{Name: "ct-time"},
+			err:    "not implemented",
+		},
+
+		// CT expectations
+		{
+			name:   "add ct expectation",
+			verb:   addVerb,
+			object: &CTExpectation{Name: "exp", Protocol: "tcp", DPort: 8888, Timeout: time.Hour, Size: 12},
+			out:    `add ct expectation ip mytable exp { protocol tcp ; dport 8888 ; timeout 3600s ; size 12 ; }`,
+		},
+		{
+			name:   "create ct expectation with l3proto",
+			verb:   createVerb,
+			object: &CTExpectation{Name: "exp", Protocol: "udp", DPort: 5060, Timeout: time.Minute, Size: 1, L3Proto: PtrTo(IPv6Family)},
+			out:    `create ct expectation ip mytable exp { protocol udp ; dport 5060 ; timeout 60s ; size 1 ; l3proto ip6 ; }`,
+		},
+		{
+			name:   "delete ct expectation",
+			verb:   deleteVerb,
+			object: &CTExpectation{Name: "exp"},
+			out:    `delete ct expectation ip mytable exp`,
+		},
+		{
+			name:   "delete ct expectation by handle",
+			verb:   deleteVerb,
+			object: &CTExpectation{Handle: PtrTo(5)},
+			out:    `delete ct expectation ip mytable handle 5`,
+		},
+		{
+			name:   "invalid add ct expectation with no dport",
+			verb:   addVerb,
+			object: &CTExpectation{Name: "exp", Protocol: "tcp", Timeout: time.Hour, Size: 12},
+			err:    "no dport",
+		},
+		{
+			name:   "invalid add ct expectation with no timeout",
+			verb:   addVerb,
+			object: &CTExpectation{Name: "exp", Protocol: "tcp", DPort: 8888, Size: 12},
+			err:    "no timeout",
+		},
+		{
+			name:   "invalid flush ct expectation",
+			verb:   flushVerb,
+			object: &CTExpectation{Name: "exp"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert ct expectation",
+			verb:   insertVerb,
+			object: &CTExpectation{Name: "exp"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace ct expectation",
+			verb:   replaceVerb,
+			object: &CTExpectation{Name: "exp"},
+			err:    "not implemented",
+		},
+
+		// Synproxies
+		{
+			name:   "add synproxy",
+			verb:   addVerb,
+			object: &Synproxy{Name: "syn", MSS: 1460, WScale: 7, Timestamp: PtrTo(true), SACKPerm: PtrTo(true)},
+			out:    `add synproxy ip mytable syn { mss 1460 wscale 7 timestamp sack-perm ; }`,
+		},
+		{
+			name:   "create synproxy without flags",
+			verb:   createVerb,
+			object: &Synproxy{Name: "syn", MSS: 1460, WScale: 7, Timestamp: PtrTo(false)},
+			out:    `create synproxy ip mytable syn { mss 1460 wscale 7 ; }`,
+		},
+		{
+			name:   "delete synproxy",
+			verb:   deleteVerb,
+			object: &Synproxy{Name: "syn"},
+			out:    `delete synproxy ip mytable syn`,
+		},
+		{
+			name:   "delete synproxy by handle",
+			verb:   deleteVerb,
+			object: &Synproxy{Handle: PtrTo(5)},
+			out:    `delete synproxy ip mytable handle 5`,
+		},
+		{
+			name:   "invalid add synproxy with no mss",
+			verb:   addVerb,
+			object: &Synproxy{Name: "syn", WScale: 7},
+			err:    "no mss",
+		},
+		{
+			name:   "invalid flush synproxy",
+			verb:   flushVerb,
+			object: &Synproxy{Name: "syn"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert synproxy",
+			verb:   insertVerb,
+			object: &Synproxy{Name: "syn"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace synproxy",
+			verb:   replaceVerb,
+			object: &Synproxy{Name: "syn"},
+			err:    "not implemented",
+		},
+
 		// Chains
 		{
 			name:   "add chain",
@@ -254,6 +482,18 @@ func TestObjects(t *testing.T) {
 			object: &Chain{Name: "mychain", Type: PtrTo(NATType), Hook: PtrTo(IngressHook), Device: PtrTo("eth0"), Priority: PtrTo(SNATPriority)},
 			out:    `add chain ip mytable mychain { type nat hook ingress device "eth0" priority 100 ; }`,
 		},
+		{
+			name:   "add base chain with single-element Devices",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Devices: []string{"eth0"}, Priority: PtrTo(FilterPriority)},
+			out:    `add chain ip mytable mychain { type filter hook ingress device "eth0" priority 0 ; }`,
+		},
+		{
+			name:   "add base chain with multiple Devices",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Devices: []string{"eth0", "eth1"}, Priority: PtrTo(FilterPriority)},
+			out:    `add chain ip mytable mychain { type filter hook ingress devices = { eth0, eth1 } priority 0 ; }`,
+		},
 		{
 			name:   "create chain",
 			verb:   createVerb,
@@ -356,6 +596,18 @@ func TestObjects(t *testing.T) {
 			object: &Chain{Name: "mychain", Device: PtrTo("eth0")},
 			err:    "must not specify Device",
 		},
+		{
+			name:   "invalid add non-base chain with Devices",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Devices: []string{"eth0", "eth1"}},
+			err:    "must not specify Device",
+		},
+		{
+			name:   "invalid add base chain with Device and Devices",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Device: PtrTo("eth0"), Devices: []string{"eth1", "eth2"}, Priority: PtrTo(FilterPriority)},
+			err:    "must not specify both Device and Devices",
+		},
 
 		// Rules
 		{
@@ -400,6 +652,30 @@ func TestObjects(t *testing.T) {
 			object: &Rule{Chain: "mychain", Rule: "drop", Handle: PtrTo(2)},
 			out:    `replace rule ip mytable mychain handle 2 drop`,
 		},
+		{
+			name:   "add rule relative to handle uses Handle, not Index",
+			verb:   addVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Handle: PtrTo(17)},
+			out:    `add rule ip mytable mychain handle 17 drop`,
+		},
+		{
+			name:   "insert rule relative to handle uses Handle, not Index",
+			verb:   insertVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Handle: PtrTo(17)},
+			out:    `insert rule ip mytable mychain handle 17 drop`,
+		},
+		{
+			name:   "insert rule relative to index",
+			verb:   insertVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Index: PtrTo(3)},
+			out:    `insert rule ip mytable mychain index 3 drop`,
+		},
+		{
+			name:   "replace rule uses Handle, not Index",
+			verb:   replaceVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Handle: PtrTo(17)},
+			out:    `replace rule ip mytable mychain handle 17 drop`,
+		},
 		{
 			name:   "delete rule",
 			verb:   deleteVerb,
@@ -412,6 +688,18 @@ func TestObjects(t *testing.T) {
 			object: &Rule{Chain: "mychain", Handle: PtrTo(2)},
 			out:    `delete rule ip mytable mychain handle 2`,
 		},
+		{
+			name:   "replace rule from ListRules ignores Index",
+			verb:   replaceVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Index: PtrTo(0), Handle: PtrTo(2)},
+			out:    `replace rule ip mytable mychain handle 2 drop`,
+		},
+		{
+			name:   "delete rule from ListRules ignores Index",
+			verb:   deleteVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Index: PtrTo(0), Handle: PtrTo(2)},
+			out:    `delete rule ip mytable mychain handle 2`,
+		},
 		{
 			name:   "invalid create rule",
 			verb:   createVerb,
@@ -484,6 +772,17 @@ func TestObjects(t *testing.T) {
 			},
 			out: `add set ip mytable myset { type ipv4_addr ; flags dynamic,interval ; timeout 180s ; gc-interval 3600s ; size 1000 ; policy performance ; auto-merge ; comment "that's a lot of options" ; }`,
 		},
+		{
+			name: "add set with counters",
+			verb: addVerb,
+			object: &Set{
+				Name:     "myset",
+				Type:     "ipv4_addr",
+				Counters: PtrTo(true),
+				Comment:  PtrTo("counted"),
+			},
+			out: `add set ip mytable myset { type ipv4_addr ; counter ; comment "counted" ; }`,
+		},
 		{
 			name:   "create set",
 			verb:   createVerb,
@@ -585,6 +884,17 @@ func TestObjects(t *testing.T) {
 			},
 			out: `add map ip mytable mymap { type ipv4_addr : ipv4_addr ; flags dynamic,interval ; timeout 180s ; gc-interval 3600s ; size 1000 ; policy performance ; comment "that's a lot of options" ; }`,
 		},
+		{
+			name: "add map with counters",
+			verb: addVerb,
+			object: &Map{
+				Name:     "mymap",
+				Type:     "ipv4_addr : verdict",
+				Flags:    []SetFlag{IntervalFlag},
+				Counters: PtrTo(true),
+			},
+			out: `add map ip mytable mymap { type ipv4_addr : verdict ; flags interval ; counter ; }`,
+		},
 		{
 			name:   "create map",
 			verb:   createVerb,
@@ -683,6 +993,42 @@ func TestObjects(t *testing.T) {
 			object: &Element{Map: "mymap", Key: []string{"10.0.0.1"}, Value: []string{"192.168.1.1"}, Comment: PtrTo("comment")},
 			out:    `add element ip mytable mymap { 10.0.0.1 comment "comment" : 192.168.1.1 }`,
 		},
+		{
+			name:   "add (set) element with timeout",
+			verb:   addVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}, Timeout: PtrTo(30 * time.Second)},
+			out:    `add element ip mytable myset { 10.0.0.1 timeout 30s }`,
+		},
+		{
+			name:   "add (map) element with timeout, expires, and comment",
+			verb:   addVerb,
+			object: &Element{Map: "mymap", Key: []string{"10.0.0.1"}, Value: []string{"192.168.1.1"}, Timeout: PtrTo(time.Hour), Expires: PtrTo(10 * time.Minute), Comment: PtrTo("comment")},
+			out:    `add element ip mytable mymap { 10.0.0.1 timeout 3600s expires 600s comment "comment" : 192.168.1.1 }`,
+		},
+		{
+			name:   "add (set) element with counter",
+			verb:   addVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}, Packets: PtrTo[uint64](0)},
+			out:    `add element ip mytable myset { 10.0.0.1 counter packets 0 bytes 0 }`,
+		},
+		{
+			name:   "add (map) element with comment and counter",
+			verb:   addVerb,
+			object: &Element{Map: "mymap", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Comment: PtrTo("comment"), Packets: PtrTo[uint64](5), Bytes: PtrTo[uint64](420)},
+			out:    `add element ip mytable mymap { 10.0.0.1 comment "comment" counter packets 5 bytes 420 : drop }`,
+		},
+		{
+			name:   "delete (set) element with counter",
+			verb:   deleteVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}, Packets: PtrTo[uint64](5), Bytes: PtrTo[uint64](420)},
+			out:    `delete element ip mytable myset { 10.0.0.1 }`,
+		},
+		{
+			name:   "delete (set) element with timeout",
+			verb:   deleteVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}, Timeout: PtrTo(30 * time.Second)},
+			out:    `delete element ip mytable myset { 10.0.0.1 }`,
+		},
 		{
 			name:   "delete (set) element",
 			verb:   deleteVerb,
@@ -772,6 +1118,9 @@ func TestObjects(t *testing.T) {
 				b := &strings.Builder{}
 				ctx := &nftContext{family: IPv4Family, table: "mytable"}
 				tc.object.writeOperation(tc.verb, ctx, b)
+				if !strings.HasSuffix(b.String(), "\n") {
+					t.Errorf("expected output to end with a newline but got %q", b.String())
+				}
 				out := strings.TrimSuffix(b.String(), "\n")
 				if out != tc.out {
 					t.Errorf("expected %q but got %q", tc.out, out)
@@ -789,6 +1138,30 @@ func TestObjects(t *testing.T) {
 	}
 }
 
+func TestDeleteByHandle(t *testing.T) {
+	// Each delete-by-handle operation must be terminated, so that it doesn't run
+	// into the following operation.
+	tx := &Transaction{nftContext: &nftContext{family: IPv4Family, table: "mytable"}}
+	tx.Delete(&Chain{Handle: PtrTo(2)})
+	tx.Delete(&Set{Handle: PtrTo(3)})
+	tx.Delete(&Map{Handle: PtrTo(4)})
+	tx.Delete(&Flowtable{Handle: PtrTo(5)})
+	tx.Delete(&Table{Handle: PtrTo(1)})
+	tx.Add(&Table{})
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		delete chain ip mytable handle 2
+		delete set ip mytable handle 3
+		delete map ip mytable handle 4
+		delete flowtable ip mytable handle 5
+		delete table ip handle 1
+		add table ip mytable
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected transaction:\n%s", diff)
+	}
+}
+
 func TestNoObjectComments(t *testing.T) {
 	for _, tc := range []struct {
 		name   string
@@ -848,6 +1221,144 @@ func TestNoObjectComments(t *testing.T) {
 	}
 }
 
+func TestRuleReferencedMarks(t *testing.T) {
+	for _, tc := range []struct {
+		rule  string
+		marks []string
+	}{
+		{
+			rule:  "ip daddr 10.0.0.1 drop",
+			marks: nil,
+		},
+		{
+			rule:  "mark set mark or 0x4000",
+			marks: []string{"0x4000"},
+		},
+		{
+			rule:  "mark and 0x4000 == 0 return",
+			marks: []string{"0x4000"},
+		},
+		{
+			rule:  "meta mark set meta mark xor 0x4000",
+			marks: []string{"0x4000"},
+		},
+		{
+			rule:  "ct mark set meta mark and 0xff00",
+			marks: []string{"0xff00"},
+		},
+		{
+			rule:  "meta mark != 0x1 ct mark set 0x2 counter jump chain",
+			marks: []string{"0x1", "0x2"},
+		},
+		{
+			rule:  "meta mark { 0x10, 0x20 } accept",
+			marks: []string{"0x10", "0x20"},
+		},
+		{
+			rule:  "meta mark 0x10 meta mark set 0x10",
+			marks: []string{"0x10"},
+		},
+		{
+			rule:  "ip saddr 10.0.0.1 tcp dport 0x50 accept",
+			marks: nil,
+		},
+		{
+			rule:  `meta mark 0x1 log prefix "0x2"`,
+			marks: []string{"0x1"},
+		},
+	} {
+		t.Run(tc.rule, func(t *testing.T) {
+			rule := &Rule{Chain: "mychain", Rule: tc.rule}
+			marks := rule.ReferencedMarks()
+			if !reflect.DeepEqual(marks, tc.marks) {
+				t.Errorf("expected %v, got %v", tc.marks, marks)
+			}
+		})
+	}
+}
+
+func TestRuleParse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		line     string
+		expected *Rule
+	}{
+		{
+			name: "plain",
+			line: "chain ip daddr 10.0.0.0/8 drop",
+			expected: &Rule{
+				Chain: "chain",
+				Rule:  "ip daddr 10.0.0.0/8 drop",
+			},
+		},
+		{
+			name: "handle comment",
+			line: "chain ip daddr 10.0.0.0/8 drop # handle 4",
+			expected: &Rule{
+				Chain:  "chain",
+				Rule:   "ip daddr 10.0.0.0/8 drop",
+				Handle: PtrTo(4),
+			},
+		},
+		{
+			name: "comment and handle comment",
+			line: `chain masquerade comment "# handle 3" # handle 12`,
+			expected: &Rule{
+				Chain:   "chain",
+				Rule:    "masquerade",
+				Comment: PtrTo("# handle 3"),
+				Handle:  PtrTo(12),
+			},
+		},
+		{
+			name: "index",
+			line: "chain index 2 drop # handle 5",
+			expected: &Rule{
+				Chain: "chain",
+				Rule:  "drop",
+				Index: PtrTo(2),
+			},
+		},
+		{
+			name: "quoted string in rule",
+			line: `chain osf name "Linux" accept`,
+			expected: &Rule{
+				Chain: "chain",
+				Rule:  `osf name "Linux" accept`,
+			},
+		},
+		{
+			name: "quoted strings in rule and comment",
+			line: `chain osf ttl skip name "comment" drop comment "osf name Linux" # handle 7`,
+			expected: &Rule{
+				Chain:   "chain",
+				Rule:    `osf ttl skip name "comment" drop`,
+				Comment: PtrTo("osf name Linux"),
+				Handle:  PtrTo(7),
+			},
+		},
+		{
+			name: "explicit handle",
+			line: "chain handle 3 drop",
+			expected: &Rule{
+				Chain:  "chain",
+				Rule:   "drop",
+				Handle: PtrTo(3),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &Rule{}
+			if err := rule.parse(tc.line); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, rule); diff != "" {
+				t.Errorf("unexpected result: %s", diff)
+			}
+		})
+	}
+}
+
 func TestParsePriority(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
@@ -868,6 +1379,48 @@ func TestParsePriority(t *testing.T) {
 			priority: "dstnat",
 			out:      -300,
 		},
+		{
+			name:     "inet family",
+			family:   InetFamily,
+			priority: "mangle",
+			out:      -150,
+		},
+		{
+			name:     "netdev family",
+			family:   NetDevFamily,
+			priority: "filter",
+			out:      0,
+		},
+		{
+			name:     "netdev family with math",
+			family:   NetDevFamily,
+			priority: "filter-10",
+			out:      -10,
+		},
+		{
+			name:     "netdev family, unsupported name",
+			family:   NetDevFamily,
+			priority: "dstnat",
+			err:      true,
+		},
+		{
+			name:     "arp family",
+			family:   ARPFamily,
+			priority: "filter",
+			out:      0,
+		},
+		{
+			name:     "arp family, unsupported name",
+			family:   ARPFamily,
+			priority: "raw",
+			err:      true,
+		},
+		{
+			name:     "bridge family, unsupported name",
+			family:   BridgeFamily,
+			priority: "raw",
+			err:      true,
+		},
 		{
 			name:     "numeric",
 			family:   IPv4Family,
@@ -19,6 +19,10 @@ package knftables
 import (
 	"bytes"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // Transaction represents an nftables transaction
@@ -33,6 +37,20 @@ type Transaction struct {
 type operation struct {
 	verb verb
 	obj  Object
+
+	// annotation, if set, is output as a comment before the operation
+	annotation string
+}
+
+// Operation describes a single operation in a Transaction, as returned by
+// Transaction.Operations.
+type Operation struct {
+	// Verb is the nft verb for the operation ("add", "create", "insert", "replace",
+	// "delete", or "flush").
+	Verb string
+
+	// Object is the object that the operation applies to.
+	Object Object
 }
 
 // verb is used internally to represent the different "nft" verbs
@@ -47,6 +65,16 @@ const (
 	flushVerb   verb = "flush"
 )
 
+// writeOperation writes op (preceded by its annotation, if any) to buf.
+func (op *operation) writeOperation(ctx *nftContext, buf *bytes.Buffer) {
+	if op.annotation != "" {
+		for _, line := range strings.Split(op.annotation, "\n") {
+			fmt.Fprintf(buf, "# %s\n", line)
+		}
+	}
+	op.obj.writeOperation(op.verb, ctx, buf)
+}
+
 // populateCommandBuf populates the transaction as series of nft commands to the given bytes.Buffer.
 func (tx *Transaction) populateCommandBuf(buf *bytes.Buffer) error {
 	if tx.err != nil {
@@ -54,17 +82,65 @@ func (tx *Transaction) populateCommandBuf(buf *bytes.Buffer) error {
 	}
 
 	for _, op := range tx.operations {
-		op.obj.writeOperation(op.verb, tx.nftContext, buf)
+		op.writeOperation(tx.nftContext, buf)
 	}
 	return nil
 }
 
+// errorLineRegexp matches the location prefix of an nft error message for input read
+// from stdin (eg, "/dev/stdin:3:1-4: Error: ...").
+var errorLineRegexp = regexp.MustCompile(`(?m)^(?:/dev/stdin|-):([0-9]+):`)
+
+// annotateError takes an error returned from running tx with "nft -f -" and, if nft
+// indicated which line of the input caused the error, wraps it with an indication of the
+// corresponding operation.
+func (tx *Transaction) annotateError(err error) error {
+	match := errorLineRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+	errLine, _ := strconv.Atoi(match[1])
+
+	line := 0
+	for i, op := range tx.operations {
+		buf := &bytes.Buffer{}
+		op.writeOperation(tx.nftContext, buf)
+		line += strings.Count(buf.String(), "\n")
+		if errLine <= line {
+			cmdBuf := &bytes.Buffer{}
+			op.obj.writeOperation(op.verb, tx.nftContext, cmdBuf)
+			return fmt.Errorf("operation %d %q failed: %w", i+1, strings.TrimSuffix(cmdBuf.String(), "\n"), err)
+		}
+	}
+	return err
+}
+
 // String returns the transaction as a string containing the nft commands; if there is
 // a pending error, it will be output as a comment at the end of the transaction.
 func (tx *Transaction) String() string {
+	return tx.stringOperations(tx.operations)
+}
+
+// StringGrouped is like String, but outputs the operations grouped by object type, in
+// the same order as Fake.Dump (the table, then flowtables, ct objects, and synproxies,
+// then chains, sets, maps, rules, and elements), preserving the relative order of
+// operations on objects of the same type. This is purely cosmetic, for displaying a
+// transaction to humans; since the grouped operations may depend on being run in their
+// original order, the output is not necessarily a valid nft transaction.
+func (tx *Transaction) StringGrouped() string {
+	ops := make([]operation, len(tx.operations))
+	copy(ops, tx.operations)
+	sort.SliceStable(ops, func(a, b int) bool {
+		return objectTypeRank(ops[a].obj) < objectTypeRank(ops[b].obj)
+	})
+	return tx.stringOperations(ops)
+}
+
+// stringOperations implements String and StringGrouped
+func (tx *Transaction) stringOperations(ops []operation) string {
 	buf := &bytes.Buffer{}
-	for _, op := range tx.operations {
-		op.obj.writeOperation(op.verb, tx.nftContext, buf)
+	for _, op := range ops {
+		op.writeOperation(tx.nftContext, buf)
 	}
 
 	if tx.err != nil {
@@ -74,12 +150,79 @@ func (tx *Transaction) String() string {
 	return buf.String()
 }
 
+// objectTypeRank returns the rank of obj's type for StringGrouped; objects of
+// lower-ranked types are output first.
+func objectTypeRank(obj Object) int {
+	switch obj.(type) {
+	case *Table:
+		return 0
+	case *Flowtable:
+		return 1
+	case *CTHelper:
+		return 2
+	case *CTTimeout:
+		return 3
+	case *CTExpectation:
+		return 4
+	case *Synproxy:
+		return 5
+	case *Chain, *chainPolicy:
+		return 6
+	case *Set:
+		return 7
+	case *Map:
+		return 8
+	case *Rule:
+		return 9
+	case *Element:
+		return 10
+	default:
+		return 11
+	}
+}
+
+// Compact returns the transaction as a single line, with the nft commands separated by
+// " ; " (eg, for logging). Annotations are not included. If there is a pending error, it
+// will be output as a comment at the end of the line.
+func (tx *Transaction) Compact() string {
+	commands := make([]string, 0, len(tx.operations))
+	for _, op := range tx.operations {
+		buf := &bytes.Buffer{}
+		op.obj.writeOperation(op.verb, tx.nftContext, buf)
+		commands = append(commands, strings.TrimSuffix(buf.String(), "\n"))
+	}
+	compact := strings.Join(commands, " ; ")
+
+	if tx.err != nil {
+		if compact != "" {
+			compact += " "
+		}
+		compact += fmt.Sprintf("# ERROR: %v", tx.err)
+	}
+
+	return compact
+}
+
 // NumOperations returns the number of operations queued in the transaction.
 func (tx *Transaction) NumOperations() int {
 	return len(tx.operations)
 }
 
+// Operations returns the operations queued in the transaction, in order. (The Objects are
+// the same ones that were passed to Add, Delete, etc, and should not be modified.)
+func (tx *Transaction) Operations() []Operation {
+	ops := make([]Operation, 0, len(tx.operations))
+	for _, op := range tx.operations {
+		ops = append(ops, Operation{Verb: string(op.verb), Object: op.obj})
+	}
+	return ops
+}
+
 func (tx *Transaction) operation(verb verb, obj Object) {
+	tx.annotatedOperation(verb, obj, "")
+}
+
+func (tx *Transaction) annotatedOperation(verb verb, obj Object, annotation string) {
 	if tx.err != nil {
 		return
 	}
@@ -87,7 +230,7 @@ func (tx *Transaction) operation(verb verb, obj Object) {
 		return
 	}
 
-	tx.operations = append(tx.operations, operation{verb: verb, obj: obj})
+	tx.operations = append(tx.operations, operation{verb: verb, obj: obj, annotation: annotation})
 }
 
 // Add adds an "nft add" operation to tx, ensuring that obj exists by creating it if it
@@ -99,6 +242,14 @@ func (tx *Transaction) Add(obj Object) {
 	tx.operation(addVerb, obj)
 }
 
+// AddWithAnnotation is like Add, but also outputs annotation as a comment (a line
+// starting with "#") immediately before the operation, to make the generated nft input
+// easier for humans to read. (nft itself ignores the comment.) If annotation contains
+// newlines, each line will be output as a separate comment.
+func (tx *Transaction) AddWithAnnotation(obj Object, annotation string) {
+	tx.annotatedOperation(addVerb, obj, annotation)
+}
+
 // Create adds an "nft create" operation to tx, creating obj, which must not already
 // exist. (If obj is a Rule, it will be appended to the end of its chain, or else added
 // after the Rule indicated by this rule's Index or Handle.) The Create() call always
@@ -139,3 +290,217 @@ func (tx *Transaction) Flush(obj Object) {
 func (tx *Transaction) Delete(obj Object) {
 	tx.operation(deleteVerb, obj)
 }
+
+// AddRule is a shorthand for `tx.Add(&Rule{Chain: chain, Rule: Concat(args...)})`,
+// appending a rule to the end of chain.
+func (tx *Transaction) AddRule(chain string, args ...interface{}) {
+	tx.Add(&Rule{Chain: chain, Rule: Concat(args...)})
+}
+
+// InsertRule is a shorthand for `tx.Insert(&Rule{Chain: chain, Rule: Concat(args...)})`,
+// inserting a rule at the start of chain.
+func (tx *Transaction) InsertRule(chain string, args ...interface{}) {
+	tx.Insert(&Rule{Chain: chain, Rule: Concat(args...)})
+}
+
+// ReplaceRule is a shorthand for `tx.Replace(&Rule{Chain: chain, Handle: &handle, Rule:
+// Concat(args...)})`, replacing the rule in chain with the given handle.
+func (tx *Transaction) ReplaceRule(chain string, handle int, args ...interface{}) {
+	tx.Replace(&Rule{Chain: chain, Handle: &handle, Rule: Concat(args...)})
+}
+
+// DeleteRule is a shorthand for `tx.Delete(&Rule{Chain: chain, Handle: &handle})`,
+// deleting the rule in chain with the given handle.
+func (tx *Transaction) DeleteRule(chain string, handle int) {
+	tx.Delete(&Rule{Chain: chain, Handle: &handle})
+}
+
+// SetChainPolicy adds an operation to tx to change the policy of the existing base chain
+// named chain, without otherwise modifying it. The SetChainPolicy() call always
+// succeeds, but if the chain does not exist or is not a base chain then an error will be
+// returned when the transaction is Run.
+func (tx *Transaction) SetChainPolicy(chain string, policy BaseChainPolicy) {
+	tx.operation(addVerb, &chainPolicy{chain: chain, policy: policy})
+}
+
+// Append appends the operations of other to tx. If other has a pending error, that error
+// is copied to tx (and no operations are appended). If tx already has a pending error,
+// then Append does nothing. other must belong to the same Interface (or at least the
+// same family and table) as tx.
+func (tx *Transaction) Append(other *Transaction) {
+	if tx.err != nil {
+		return
+	}
+	if other.err != nil {
+		tx.err = other.err
+		return
+	}
+	if tx.family != other.family || tx.table != other.table {
+		tx.err = fmt.Errorf("cannot append transaction for %s %s to transaction for %s %s", other.family, other.table, tx.family, tx.table)
+		return
+	}
+
+	tx.operations = append(tx.operations, other.operations...)
+}
+
+// Reorder sorts the operations in tx so that, within each run of consecutive additions
+// (add, create, insert, replace) the table is added first, followed by chains, sets,
+// maps, and other named objects, followed by rules and elements (which may refer to
+// those objects). Within each run of consecutive removals (delete and flush), flushes and
+// deletions of rules and elements come first, followed by deletions of named objects,
+// followed by the deletion of the table. Deletions of named objects are further sorted
+// so that an object is deleted before any other deleted object that it refers to (eg, a
+// chain before the chains its rules jump to, or a map before the chains its elements
+// jump to). Operations are never moved past an operation of the other kind, and the
+// relative order of operations is otherwise preserved. Reorder only changes the existing
+// operations; it should be called after everything has been added to tx.
+//
+// Note that Reorder only knows about the references made by the rules and elements in tx
+// itself; it can't know what the rules and elements already in the kernel refer to. (If
+// tx deletes a chain whose existing rules jump to another chain that tx also deletes,
+// then either tx must contain those rules, or the chains must be deleted in the right
+// order to begin with.)
+func (tx *Transaction) Reorder() {
+	refs := tx.references()
+	start := 0
+	for i := 1; i <= len(tx.operations); i++ {
+		if i < len(tx.operations) && isRemoval(tx.operations[i].verb) == isRemoval(tx.operations[start].verb) {
+			continue
+		}
+		run := tx.operations[start:i]
+		sort.SliceStable(run, func(a, b int) bool {
+			return operationRank(&run[a]) < operationRank(&run[b])
+		})
+		if isRemoval(run[0].verb) {
+			// The deletions of named objects are now contiguous.
+			first := 0
+			for first < len(run) && (run[first].verb != deleteVerb || operationRank(&run[first]) != 1) {
+				first++
+			}
+			last := first
+			for last < len(run) && run[last].verb == deleteVerb && operationRank(&run[last]) == 1 {
+				last++
+			}
+			sortDeletions(run[first:last], refs)
+		}
+		start = i
+	}
+}
+
+// references returns the references made by the rules and map elements in tx, as a map
+// from the key (see referenceKey) of each chain or map to the keys of the objects that
+// its rules or elements refer to.
+func (tx *Transaction) references() map[string]map[string]bool {
+	refs := make(map[string]map[string]bool)
+	addRefs := func(from, text string) {
+		chains, objects := ruleReferences(text)
+		if len(chains) == 0 && len(objects) == 0 {
+			return
+		}
+		if refs[from] == nil {
+			refs[from] = make(map[string]bool)
+		}
+		for _, chain := range chains {
+			refs[from][referenceKey(&Chain{Name: chain})] = true
+		}
+		for _, name := range objects {
+			refs[from][name] = true
+		}
+	}
+
+	for _, op := range tx.operations {
+		switch obj := op.obj.(type) {
+		case *Rule:
+			addRefs(referenceKey(&Chain{Name: obj.Chain}), obj.Rule)
+		case *Element:
+			if obj.Map != "" {
+				addRefs(referenceKey(&Map{Name: obj.Map}), strings.Join(obj.Value, " "))
+			}
+		}
+	}
+	return refs
+}
+
+// referenceKey returns the key used to identify obj in the result of references. Chains
+// are distinguished from other named objects (since they are referred to differently
+// and have a separate namespace). It returns "" for objects that can't be referred to
+// by name.
+func referenceKey(obj Object) string {
+	switch o := obj.(type) {
+	case *Chain:
+		return "chain " + o.Name
+	case *Set:
+		return o.Name
+	case *Map:
+		return o.Name
+	case *Flowtable:
+		return o.Name
+	case *CTHelper:
+		return o.Name
+	case *CTTimeout:
+		return o.Name
+	case *CTExpectation:
+		return o.Name
+	case *Synproxy:
+		return o.Name
+	}
+	return ""
+}
+
+// sortDeletions sorts ops (which are all deletions of named objects) so that each object
+// is deleted before any of the other objects that it refers to, according to refs, while
+// otherwise preserving their order. (If there is a reference loop, the remaining
+// operations are left in their original order.)
+func sortDeletions(ops []operation, refs map[string]map[string]bool) {
+	remaining := append([]operation{}, ops...)
+	isReferenced := func(i int) bool {
+		key := referenceKey(remaining[i].obj)
+		if key == "" {
+			return false
+		}
+		for j := range remaining {
+			if j != i && refs[referenceKey(remaining[j].obj)][key] {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := range ops {
+		next := 0
+		for j := range remaining {
+			if !isReferenced(j) {
+				next = j
+				break
+			}
+		}
+		ops[i] = remaining[next]
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+}
+
+// isRemoval returns true if verb removes objects (or their contents) rather than adding
+// them.
+func isRemoval(verb verb) bool {
+	return verb == deleteVerb || verb == flushVerb
+}
+
+// operationRank returns the rank of op for Reorder; lower-ranked operations are sorted
+// first.
+func operationRank(op *operation) int {
+	if op.verb == flushVerb {
+		return 0
+	}
+
+	rank := 1
+	switch op.obj.(type) {
+	case *Table:
+		rank = 0
+	case *Rule, *Element:
+		rank = 2
+	}
+	if op.verb == deleteVerb {
+		return 2 - rank
+	}
+	return rank
+}
@@ -71,6 +71,16 @@ const (
 	NetDevFamily Family = "netdev"
 )
 
+// Feature represents an optional nftables feature, which may or may not be supported by
+// the nft binary and kernel in use.
+type Feature string
+
+const (
+	// ObjectCommentsFeature indicates support for comments on tables, chains, sets,
+	// and maps. (If it is not supported, such comments are silently dropped.)
+	ObjectCommentsFeature Feature = "object-comments"
+)
+
 // TableFlag represents a table flag
 type TableFlag string
 
@@ -232,9 +242,15 @@ type Chain struct {
 
 	// Device is the network interface that the chain is attached to; this must be set
 	// for a base chain connected to the "ingress" or "egress" hooks, and unset for
-	// all other chains.
+	// all other chains. (Alternatively, you can set Devices.)
 	Device *string
 
+	// Devices is a list of network interfaces that the chain is attached to, for an
+	// "ingress" or "egress" base chain that is attached to more than one device.
+	// (Requires nft >= 1.0.1 if more than one device is specified.) At most one of
+	// Device and Devices may be set.
+	Devices []string
+
 	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
 	// nft >= 0.9.7; otherwise this field will be silently ignored. Requires
 	// nft >= 1.0.8 to include comments in List() results.)
@@ -261,7 +277,9 @@ type Rule struct {
 	// Index is the number of a rule (counting from 0) to Add this Rule after or
 	// Insert it before. Cannot be specified along with Handle. If neither Index
 	// nor Handle is specified then Add appends the rule the end of the chain and
-	// Insert prepends it to the beginning.
+	// Insert prepends it to the beginning. In the result of ListRules, this will
+	// indicate the rule's current position in its chain. It is ignored by Replace
+	// and Delete, which always use Handle.
 	Index *int
 
 	// Handle is a rule handle. In Add or Insert, if set, this is the handle of
@@ -340,6 +358,11 @@ type Set struct {
 	// together (only for interval sets)
 	AutoMerge *bool
 
+	// Counters indicates that every element in the set should have a counter
+	// attached. (Requires nft >= 0.9.5.) The counts can be read back via the Packets
+	// and Bytes fields of the elements returned by ListElements.
+	Counters *bool
+
 	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
 	// nft >= 0.9.7; otherwise this field will be silently ignored.)
 	Comment *string
@@ -381,6 +404,10 @@ type Map struct {
 	// Policy is the FIXME
 	Policy *SetPolicy
 
+	// Counters indicates that every element in the map should have a counter
+	// attached. (Requires nft >= 0.9.5.)
+	Counters *bool
+
 	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
 	// nft >= 0.9.7; otherwise this field will be silently ignored.)
 	Comment *string
@@ -390,6 +417,16 @@ type Map struct {
 	Handle *int
 }
 
+// SetStats contains statistics about a set, as returned by Interface.SetStats.
+type SetStats struct {
+	// Elements is the number of elements currently in the set.
+	Elements int
+
+	// Size is the set's maximum size, if it has one. (If Elements reaches Size,
+	// further adds to the set will fail.)
+	Size *uint64
+}
+
 // Element represents a set or map element
 type Element struct {
 	// Set is the name of the set that contains this element (or the empty string if
@@ -410,6 +447,23 @@ type Element struct {
 
 	// Comment is an optional comment for the element
 	Comment *string
+
+	// Timeout is an optional per-element timeout. (The set or map must have the
+	// "timeout" flag.) This is rounded down to a whole number of seconds.
+	Timeout *time.Duration
+
+	// Expires is the time remaining before the element expires. This is filled in by
+	// ListElements for elements with a timeout; it can also be specified when adding
+	// an element to make it expire sooner than Timeout would imply.
+	Expires *time.Duration
+
+	// Packets and Bytes are the element's counter values. These are filled in by
+	// ListElements for elements that have a counter (either because the set or map
+	// has Counters set, or because the element was added with a counter). When adding
+	// an element, setting either of them causes the element to be created with a
+	// counter starting from the given values.
+	Packets *uint64
+	Bytes   *uint64
 }
 
 type FlowtableIngressPriority string
@@ -438,3 +492,138 @@ type Flowtable struct {
 	// deleting it. When adding a new object, this must be nil
 	Handle *int
 }
+
+// CTHelper represents an nftables conntrack helper ("ct helper") object, which can be
+// assigned to connections by a rule like `ct helper set "myhelper"`.
+type CTHelper struct {
+	// Name is the name of the ct helper object.
+	Name string
+
+	// Type is the name of the kernel conntrack helper, eg "ftp" or "sip".
+	Type string
+
+	// Protocol is the layer 4 protocol of the helper ("tcp" or "udp").
+	Protocol string
+
+	// L3Proto is the optional layer 3 protocol of the helper ("ip" or "ip6"). If
+	// unset, this defaults to the family of the table.
+	L3Proto *Family
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
+// CTTimeout represents an nftables conntrack timeout policy ("ct timeout") object, which
+// can be assigned to connections by a rule like `ct timeout set "mytimeout"`.
+type CTTimeout struct {
+	// Name is the name of the ct timeout object.
+	Name string
+
+	// Protocol is the layer 4 protocol that the policy applies to (eg "tcp").
+	Protocol string
+
+	// L3Proto is the optional layer 3 protocol of the policy ("ip" or "ip6"). If
+	// unset, this defaults to the family of the table.
+	L3Proto *Family
+
+	// Policy maps connection states (eg "established") to timeouts. Timeouts are
+	// rounded down to a whole number of seconds.
+	Policy map[string]time.Duration
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
+// CTExpectation represents an nftables conntrack expectation ("ct expectation") object,
+// which can be assigned to connections by a rule like `ct expectation set "myexpect"`.
+type CTExpectation struct {
+	// Name is the name of the ct expectation object.
+	Name string
+
+	// Protocol is the layer 4 protocol of the expected connection (eg "tcp").
+	Protocol string
+
+	// DPort is the destination port of the expected connection.
+	DPort int
+
+	// Timeout is how long the expectation lasts. This is rounded down to a whole
+	// number of seconds.
+	Timeout time.Duration
+
+	// Size is the maximum number of expectations per connection.
+	Size int
+
+	// L3Proto is the optional layer 3 protocol of the expectation ("ip" or "ip6").
+	// If unset, this defaults to the family of the table.
+	L3Proto *Family
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
+// Synproxy represents an nftables named synproxy object, which can be used by a rule
+// like `synproxy name "mysynproxy"`.
+type Synproxy struct {
+	// Name is the name of the synproxy object.
+	Name string
+
+	// MSS is the maximum segment size announced to clients.
+	MSS uint32
+
+	// WScale is the window scale announced to clients.
+	WScale uint8
+
+	// Timestamp indicates whether to pass through TCP timestamps.
+	Timestamp *bool
+
+	// SACKPerm indicates whether to pass through TCP selective acknowledgement.
+	SACKPerm *bool
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
+// Difference describes an object whose actual state does not match its expected state,
+// as reported by Interface.Verify.
+type Difference struct {
+	// Expected is the object as it was expected to be, or nil if the object exists
+	// but was not expected to.
+	Expected Object
+
+	// Actual is the object as it actually is, or nil if the object was expected to
+	// exist but does not.
+	Actual Object
+}
+
+// EventType is the type of an Event
+type EventType string
+
+const (
+	// AddEvent indicates that an object was added
+	AddEvent EventType = "add"
+
+	// DeleteEvent indicates that an object was deleted
+	DeleteEvent EventType = "delete"
+
+	// ErrorEvent indicates that Monitor was unable to read or parse nft's output
+	ErrorEvent EventType = "error"
+)
+
+// Event represents a change to the ruleset, as reported by Interface.Monitor.
+type Event struct {
+	// Type is the type of change
+	Type EventType
+
+	// Object is the object that was added or deleted: a *Table, *Chain, *Rule,
+	// *Set, *Map, or *Element. As with ListRules, a *Rule will have its Chain,
+	// Handle, and Comment fields filled in but not its Rule field. (Object is nil
+	// for an ErrorEvent.)
+	Object Object
+
+	// Err is the error, for an ErrorEvent
+	Err error
+}
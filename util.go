@@ -18,8 +18,11 @@ package knftables
 
 import (
 	"fmt"
+	"net"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // PtrTo can be used to fill in optional field values in objects
@@ -43,6 +46,11 @@ var bridgeNumericPriorities = map[string]int{
 	"srcnat": 300,
 }
 
+// The "arp" and "netdev" families only support the "filter" priority name.
+var filterOnlyNumericPriorities = map[string]int{
+	"filter": 0,
+}
+
 // ParsePriority tries to convert the string form of a chain priority into a number
 func ParsePriority(family Family, priority string) (int, error) {
 	val, err := strconv.Atoi(priority)
@@ -61,9 +69,12 @@ func ParsePriority(family Family, priority string) (int, error) {
 	}
 
 	var found bool
-	if family == BridgeFamily {
+	switch family {
+	case BridgeFamily:
 		val, found = bridgeNumericPriorities[priority]
-	} else {
+	case ARPFamily, NetDevFamily:
+		val, found = filterOnlyNumericPriorities[priority]
+	default:
 		val, found = numericPriorities[priority]
 	}
 	if !found {
@@ -76,7 +87,9 @@ func ParsePriority(family Family, priority string) (int, error) {
 // Concat is a helper (primarily) for constructing Rule objects. It takes a series of
 // arguments and concatenates them together into a single string with spaces between the
 // arguments. Strings are output as-is, string arrays are output element by element,
-// numbers are output as with `fmt.Sprintf("%d")`, and all other types are output as with
+// numbers are output as with `fmt.Sprintf("%d")`, IPs and CIDRs (`net.IP`, `net.IPNet`,
+// and `*net.IPNet`) are output in their standard string form, `time.Duration`s are output
+// as a whole number of seconds (eg, "90s"), and all other types are output as with
 // `fmt.Sprintf("%s")`. To help with set/map lookup syntax, an argument of "@" will not
 // be followed by a space, so you can do, eg, `Concat("ip saddr", "@", setName)`.
 func Concat(args ...interface{}) string {
@@ -99,11 +112,39 @@ func Concat(args ...interface{}) string {
 				wroteAt = (s == "@")
 				needSpace = b.Len() > 0 && !wroteAt
 			}
+		case RuleFragment:
+			if x.fragment == "" {
+				continue
+			}
+			if needSpace {
+				b.WriteByte(' ')
+			}
+			b.WriteString(x.fragment)
 		case int, uint, int16, uint16, int32, uint32, int64, uint64:
 			if needSpace {
 				b.WriteByte(' ')
 			}
 			fmt.Fprintf(b, "%d", x)
+		case net.IP:
+			if needSpace {
+				b.WriteByte(' ')
+			}
+			b.WriteString(x.String())
+		case net.IPNet:
+			if needSpace {
+				b.WriteByte(' ')
+			}
+			b.WriteString(x.String())
+		case *net.IPNet:
+			if needSpace {
+				b.WriteByte(' ')
+			}
+			b.WriteString(x.String())
+		case time.Duration:
+			if needSpace {
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(b, "%ds", int64(x.Seconds()))
 		default:
 			if needSpace {
 				b.WriteByte(' ')
@@ -115,3 +156,276 @@ func Concat(args ...interface{}) string {
 	}
 	return b.String()
 }
+
+// NeedsIntervalFlag returns true if any field of any of keys is a CIDR prefix (eg
+// "10.0.0.0/8") or a range (eg "10.0.0.1-10.0.0.10" or "1000-2000"), meaning that a set
+// or map containing those keys must have the "interval" flag.
+func NeedsIntervalFlag(keys [][]string) bool {
+	for _, key := range keys {
+		for _, field := range key {
+			if isIntervalField(field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isIntervalField(field string) bool {
+	if _, _, err := net.ParseCIDR(field); err == nil {
+		return true
+	}
+	start, end, found := strings.Cut(field, "-")
+	if !found {
+		return false
+	}
+	if net.ParseIP(start) != nil && net.ParseIP(end) != nil {
+		return true
+	}
+	_, startErr := strconv.ParseUint(start, 10, 64)
+	_, endErr := strconv.ParseUint(end, 10, 64)
+	return startErr == nil && endErr == nil
+}
+
+// Goto returns the verdict "goto chain", eg for use as the Value of a verdict map
+// Element.
+func Goto(chain string) string {
+	return "goto " + chain
+}
+
+// Jump returns the verdict "jump chain", eg for use as the Value of a verdict map
+// Element.
+func Jump(chain string) string {
+	return "jump " + chain
+}
+
+// Drop returns the verdict "drop", eg for use as the Value of a verdict map Element.
+func Drop() string {
+	return "drop"
+}
+
+// Accept returns the verdict "accept", eg for use as the Value of a verdict map Element.
+func Accept() string {
+	return "accept"
+}
+
+// Return returns the verdict "return", eg for use as the Value of a verdict map Element.
+func Return() string {
+	return "return"
+}
+
+// tcpFlags is the set of flag names accepted by TCPFlags
+var tcpFlags = map[string]bool{
+	"fin": true, "syn": true, "rst": true, "psh": true,
+	"ack": true, "urg": true, "ecn": true, "cwr": true,
+}
+
+// TCPFlags returns a "tcp flags" match, eg `TCPFlags([]string{"syn"}, []string{"syn",
+// "ack"})` returns "tcp flags syn / syn,ack", which matches packets that have the SYN
+// flag set and the ACK flag unset. If mask is empty, the match is just "tcp flags X",
+// which matches packets that have any of the flags in set set. It returns an error if set
+// is empty, if any flag name is not valid, or if set contains a flag that is not in mask
+// (which would result in a match that can never succeed).
+func TCPFlags(set, mask []string) (string, error) {
+	if len(set) == 0 {
+		return "", fmt.Errorf("no flags specified for tcp flags match")
+	}
+	inMask := make(map[string]bool, len(mask))
+	for _, flag := range mask {
+		if !tcpFlags[flag] {
+			return "", fmt.Errorf("invalid tcp flag %q", flag)
+		}
+		inMask[flag] = true
+	}
+	for _, flag := range set {
+		if !tcpFlags[flag] {
+			return "", fmt.Errorf("invalid tcp flag %q", flag)
+		}
+		if len(mask) > 0 && !inMask[flag] {
+			return "", fmt.Errorf("tcp flag %q is not in mask %q", flag, strings.Join(mask, ","))
+		}
+	}
+	if len(mask) == 0 {
+		return "tcp flags " + strings.Join(set, ","), nil
+	}
+	return "tcp flags " + strings.Join(set, ",") + " / " + strings.Join(mask, ","), nil
+}
+
+// NumgenVmap returns a "numgen random mod N vmap { ... }" clause that picks one of
+// endpoints (which are chain names) at random with equal probability, and does a
+// "goto" to it, eg `NumgenVmap([]string{"ep1", "ep2"})` returns
+// "numgen random mod 2 vmap { 0 : goto ep1, 1 : goto ep2 }". If endpoints is empty, it
+// returns "".
+func NumgenVmap(endpoints []string) string {
+	if len(endpoints) == 0 {
+		return ""
+	}
+	elements := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		elements[i] = fmt.Sprintf("%d : %s", i, Goto(endpoint))
+	}
+	return fmt.Sprintf("numgen random mod %d vmap { %s }", len(endpoints), strings.Join(elements, ", "))
+}
+
+// NumgenVmapWeighted is like NumgenVmap, but picks each endpoint with a probability
+// proportional to the corresponding entry in weights, eg `NumgenVmapWeighted([]string{"ep1",
+// "ep2"}, []int{1, 3})` returns "numgen random mod 4 vmap { 0 : goto ep1, 1-3 : goto ep2 }".
+// It returns an error if endpoints is empty, if endpoints and weights have different
+// lengths, or if any weight is not positive.
+func NumgenVmapWeighted(endpoints []string, weights []int) (string, error) {
+	if len(endpoints) == 0 {
+		return "", fmt.Errorf("no endpoints specified for numgen vmap")
+	}
+	if len(weights) != len(endpoints) {
+		return "", fmt.Errorf("got %d weights for %d endpoints", len(weights), len(endpoints))
+	}
+	elements := make([]string, len(endpoints))
+	start := 0
+	for i, endpoint := range endpoints {
+		if weights[i] <= 0 {
+			return "", fmt.Errorf("invalid weight %d for endpoint %q", weights[i], endpoint)
+		}
+		end := start + weights[i] - 1
+		if end == start {
+			elements[i] = fmt.Sprintf("%d : %s", start, Goto(endpoint))
+		} else {
+			elements[i] = fmt.Sprintf("%d-%d : %s", start, end, Goto(endpoint))
+		}
+		start = end + 1
+	}
+	return fmt.Sprintf("numgen random mod %d vmap { %s }", start, strings.Join(elements, ", ")), nil
+}
+
+// RuleFragment is a validated partial rule, such as a common match or a jump to a helper
+// chain, that can be shared between multiple rules. Pass it to Concat (or call its
+// String method) to include it in a rule.
+type RuleFragment struct {
+	fragment string
+}
+
+// NewRuleFragment concatenates args as with Concat, and returns the result as a
+// RuleFragment. It returns an error if the result is empty, or could not be safely
+// included in a larger rule (eg, because it contains a newline or semicolon, or has
+// unbalanced quotes or braces).
+func NewRuleFragment(args ...interface{}) (RuleFragment, error) {
+	fragment := strings.TrimSpace(Concat(args...))
+	if fragment == "" {
+		return RuleFragment{}, fmt.Errorf("empty rule fragment")
+	}
+
+	inQuotes := false
+	depth := 0
+	for _, c := range fragment {
+		switch c {
+		case '"':
+			inQuotes = !inQuotes
+		case '\n':
+			return RuleFragment{}, fmt.Errorf("rule fragment %q contains a newline", fragment)
+		case ';':
+			if !inQuotes {
+				return RuleFragment{}, fmt.Errorf("rule fragment %q contains a semicolon", fragment)
+			}
+		case '{':
+			if !inQuotes {
+				depth++
+			}
+		case '}':
+			if !inQuotes {
+				depth--
+				if depth < 0 {
+					return RuleFragment{}, fmt.Errorf("rule fragment %q has unbalanced braces", fragment)
+				}
+			}
+		}
+	}
+	if inQuotes {
+		return RuleFragment{}, fmt.Errorf("rule fragment %q has unbalanced quotes", fragment)
+	}
+	if depth != 0 {
+		return RuleFragment{}, fmt.Errorf("rule fragment %q has unbalanced braces", fragment)
+	}
+
+	return RuleFragment{fragment: fragment}, nil
+}
+
+// String returns the fragment as a string
+func (rf RuleFragment) String() string {
+	return rf.fragment
+}
+
+// tokenizeRule splits rule into whitespace-separated words, except that quoted strings
+// are returned as single words (including the quotes) and "{" and "}" are always
+// returned as separate words.
+func tokenizeRule(rule string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	endWord := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+
+	inQuotes := false
+	for _, c := range rule {
+		switch {
+		case inQuotes:
+			word.WriteRune(c)
+			if c == '"' {
+				inQuotes = false
+			}
+		case c == '"':
+			word.WriteRune(c)
+			inQuotes = true
+		case c == '{' || c == '}':
+			endWord()
+			words = append(words, string(c))
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == '\n':
+			return nil, fmt.Errorf("syntax error: newline in rule")
+		default:
+			word.WriteRune(c)
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("syntax error: unterminated string")
+	}
+	endWord()
+	return words, nil
+}
+
+// normalizeRuleText normalizes the whitespace in a rule, for comparison purposes
+func normalizeRuleText(rule string) string {
+	return strings.Join(strings.Fields(rule), " ")
+}
+
+// ruleReferences returns the names of the chains that text (a rule, or the value of a
+// verdict map element) jumps to or gotos, and of the other named objects (sets, maps,
+// ct helpers, etc) that it refers to.
+func ruleReferences(text string) (chains, objects []string) {
+	words := strings.Fields(text)
+	for i, word := range words {
+		if i > 0 && (words[i-1] == "goto" || words[i-1] == "jump") {
+			chains = append(chains, strings.TrimSuffix(word, ","))
+		} else if strings.HasPrefix(word, "@") || strings.HasPrefix(word, `"`) {
+			objects = append(objects, strings.Trim(strings.TrimPrefix(word, "@"), `"`))
+		}
+	}
+	return chains, objects
+}
+
+// counterValuesRegexp matches the values of a "counter" statement in a rule
+var counterValuesRegexp = regexp.MustCompile(`\bcounter packets [0-9]+ bytes [0-9]+\b`)
+
+// StripCounters returns rule with the values removed from any "counter" statements (eg,
+// "counter packets 10 bytes 800 accept" becomes "counter accept"), so that rules that
+// differ only in their counter values can be compared. Quoted strings in rule are left
+// unchanged.
+func StripCounters(rule string) string {
+	parts := strings.Split(rule, `"`)
+	for i := 0; i < len(parts); i += 2 {
+		parts[i] = counterValuesRegexp.ReplaceAllString(parts[i], "counter")
+	}
+	return strings.Join(parts, `"`)
+}
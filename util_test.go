@@ -18,7 +18,9 @@ package knftables
 
 import (
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConcat(t *testing.T) {
@@ -70,6 +72,32 @@ func TestConcat(t *testing.T) {
 			},
 			out: "1 65535 -123456789",
 		},
+		{
+			name: "IPs and CIDRs",
+			values: []interface{}{
+				"ip saddr", net.ParseIP("10.0.0.1"),
+				"ip daddr", *cidr,
+				"ip6 daddr", net.ParseIP("fd00::1"),
+				"ip daddr", cidr,
+			},
+			out: "ip saddr 10.0.0.1 ip daddr 10.2.0.0/24 ip6 daddr fd00::1 ip daddr 10.2.0.0/24",
+		},
+		{
+			name: "IPv4 in 16-byte form",
+			values: []interface{}{
+				"ip daddr", net.IPv4(192, 168, 0, 1).To16(),
+			},
+			out: "ip daddr 192.168.0.1",
+		},
+		{
+			name: "durations",
+			values: []interface{}{
+				"timeout", 30 * time.Second,
+				"timeout", 90 * time.Second,
+				"timeout", 3*time.Hour + 1500*time.Millisecond,
+			},
+			out: "timeout 30s timeout 90s timeout 10801s",
+		},
 		{
 			name: "everything",
 			values: []interface{}{
@@ -83,6 +111,15 @@ func TestConcat(t *testing.T) {
 			},
 			out: "ip saddr 10.2.0.0/24 th port 8080 @mySetName @myMapName ct state established drop",
 		},
+		{
+			name: "rule fragments",
+			values: []interface{}{
+				"ip daddr 10.0.0.1",
+				RuleFragment{},
+				RuleFragment{fragment: "jump mark-for-masquerade"},
+			},
+			out: "ip daddr 10.0.0.1 jump mark-for-masquerade",
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			out := Concat(tc.values...)
@@ -92,3 +129,345 @@ func TestConcat(t *testing.T) {
 		})
 	}
 }
+
+func TestNewRuleFragment(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []interface{}
+		out    string
+		err    string
+	}{
+		{
+			name:   "simple",
+			values: []interface{}{"ip saddr != 10.0.0.0/8", "jump", "mark-for-masquerade"},
+			out:    "ip saddr != 10.0.0.0/8 jump mark-for-masquerade",
+		},
+		{
+			name:   "nested fragment",
+			values: []interface{}{RuleFragment{fragment: "meta l4proto tcp"}, "th dport", 80},
+			out:    "meta l4proto tcp th dport 80",
+		},
+		{
+			name:   "braces and quoted semicolon",
+			values: []interface{}{`numgen random mod 2 vmap { 0 : goto a , 1 : goto b }`, `log prefix "a;b"`},
+			out:    `numgen random mod 2 vmap { 0 : goto a , 1 : goto b } log prefix "a;b"`,
+		},
+		{
+			name:   "empty",
+			values: []interface{}{" "},
+			err:    "empty",
+		},
+		{
+			name:   "newline",
+			values: []interface{}{"drop\nflush ruleset"},
+			err:    "newline",
+		},
+		{
+			name:   "semicolon",
+			values: []interface{}{"drop ; flush ruleset"},
+			err:    "semicolon",
+		},
+		{
+			name:   "unbalanced quotes",
+			values: []interface{}{`log prefix "foo`},
+			err:    "unbalanced quotes",
+		},
+		{
+			name:   "unbalanced braces",
+			values: []interface{}{"ip daddr { 10.0.0.1"},
+			err:    "unbalanced braces",
+		},
+		{
+			name:   "misordered braces",
+			values: []interface{}{"ip daddr } 10.0.0.1 {"},
+			err:    "unbalanced braces",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fragment, err := NewRuleFragment(tc.values...)
+			if tc.err != "" {
+				if err == nil {
+					t.Errorf("expected error containing %q, got %q", tc.err, fragment.String())
+				} else if !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fragment.String() != tc.out {
+				t.Errorf("expected %q got %q", tc.out, fragment.String())
+			}
+		})
+	}
+}
+
+func TestVerdicts(t *testing.T) {
+	for _, tc := range []struct {
+		verdict  string
+		expected string
+	}{
+		{Goto("mychain"), "goto mychain"},
+		{Jump("mychain"), "jump mychain"},
+		{Drop(), "drop"},
+		{Accept(), "accept"},
+		{Return(), "return"},
+	} {
+		if tc.verdict != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, tc.verdict)
+		}
+	}
+}
+
+func TestTCPFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  []string
+		mask []string
+		out  string
+		err  string
+	}{
+		{
+			name: "syn without ack",
+			set:  []string{"syn"},
+			mask: []string{"syn", "ack"},
+			out:  "tcp flags syn / syn,ack",
+		},
+		{
+			name: "no mask",
+			set:  []string{"fin", "rst"},
+			out:  "tcp flags fin,rst",
+		},
+		{
+			name: "all flags",
+			set:  []string{"fin", "syn", "rst", "psh", "ack", "urg", "ecn", "cwr"},
+			mask: []string{"fin", "syn", "rst", "psh", "ack", "urg", "ecn", "cwr"},
+			out:  "tcp flags fin,syn,rst,psh,ack,urg,ecn,cwr / fin,syn,rst,psh,ack,urg,ecn,cwr",
+		},
+		{
+			name: "empty set",
+			mask: []string{"syn"},
+			err:  "no flags specified",
+		},
+		{
+			name: "invalid flag in set",
+			set:  []string{"SYN"},
+			err:  `invalid tcp flag "SYN"`,
+		},
+		{
+			name: "invalid flag in mask",
+			set:  []string{"syn"},
+			mask: []string{"syn", "push"},
+			err:  `invalid tcp flag "push"`,
+		},
+		{
+			name: "flag not in mask",
+			set:  []string{"syn", "fin"},
+			mask: []string{"syn", "ack"},
+			err:  `tcp flag "fin" is not in mask "syn,ack"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := TCPFlags(tc.set, tc.mask)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tc.out {
+				t.Errorf("expected %q, got %q", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestNumgenVmap(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		endpoints []string
+		out       string
+	}{
+		{
+			name: "no endpoints",
+			out:  "",
+		},
+		{
+			name:      "one endpoint",
+			endpoints: []string{"ep1"},
+			out:       "numgen random mod 1 vmap { 0 : goto ep1 }",
+		},
+		{
+			name:      "two endpoints",
+			endpoints: []string{"ep1", "ep2"},
+			out:       "numgen random mod 2 vmap { 0 : goto ep1, 1 : goto ep2 }",
+		},
+		{
+			name:      "many endpoints",
+			endpoints: []string{"ep1", "ep2", "ep3", "ep4", "ep5"},
+			out:       "numgen random mod 5 vmap { 0 : goto ep1, 1 : goto ep2, 2 : goto ep3, 3 : goto ep4, 4 : goto ep5 }",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := NumgenVmap(tc.endpoints)
+			if out != tc.out {
+				t.Errorf("expected %q, got %q", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestNumgenVmapWeighted(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		endpoints []string
+		weights   []int
+		out       string
+		err       string
+	}{
+		{
+			name:      "one endpoint",
+			endpoints: []string{"ep1"},
+			weights:   []int{5},
+			out:       "numgen random mod 5 vmap { 0-4 : goto ep1 }",
+		},
+		{
+			name:      "two endpoints",
+			endpoints: []string{"ep1", "ep2"},
+			weights:   []int{1, 3},
+			out:       "numgen random mod 4 vmap { 0 : goto ep1, 1-3 : goto ep2 }",
+		},
+		{
+			name:      "many endpoints",
+			endpoints: []string{"ep1", "ep2", "ep3", "ep4"},
+			weights:   []int{2, 1, 1, 3},
+			out:       "numgen random mod 7 vmap { 0-1 : goto ep1, 2 : goto ep2, 3 : goto ep3, 4-6 : goto ep4 }",
+		},
+		{
+			name:      "equal weights",
+			endpoints: []string{"ep1", "ep2", "ep3"},
+			weights:   []int{1, 1, 1},
+			out:       NumgenVmap([]string{"ep1", "ep2", "ep3"}),
+		},
+		{
+			name: "no endpoints",
+			err:  "no endpoints specified",
+		},
+		{
+			name:      "mismatched lengths",
+			endpoints: []string{"ep1", "ep2"},
+			weights:   []int{1},
+			err:       "got 1 weights for 2 endpoints",
+		},
+		{
+			name:      "zero weight",
+			endpoints: []string{"ep1", "ep2"},
+			weights:   []int{1, 0},
+			err:       `invalid weight 0 for endpoint "ep2"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := NumgenVmapWeighted(tc.endpoints, tc.weights)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tc.out {
+				t.Errorf("expected %q, got %q", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestNeedsIntervalFlag(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		keys     [][]string
+		expected bool
+	}{
+		{
+			name:     "no keys",
+			expected: false,
+		},
+		{
+			name:     "plain addresses",
+			keys:     [][]string{{"10.0.0.1"}, {"fd00::1"}},
+			expected: false,
+		},
+		{
+			name:     "IPv4 CIDR",
+			keys:     [][]string{{"10.0.0.1"}, {"192.168.0.0/16"}},
+			expected: true,
+		},
+		{
+			name:     "IPv6 CIDR",
+			keys:     [][]string{{"fd00::/64"}},
+			expected: true,
+		},
+		{
+			name:     "address range",
+			keys:     [][]string{{"10.0.0.1-10.0.0.10"}},
+			expected: true,
+		},
+		{
+			name:     "port range in concatenation",
+			keys:     [][]string{{"10.0.0.1", "tcp", "80"}, {"10.0.0.1", "tcp", "8000-8080"}},
+			expected: true,
+		},
+		{
+			name:     "hyphenated non-range",
+			keys:     [][]string{{"veth-abc"}, {"10.0.0.1-foo"}},
+			expected: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if result := NeedsIntervalFlag(tc.keys); result != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestStripCounters(t *testing.T) {
+	for _, tc := range []struct {
+		rule string
+		out  string
+	}{
+		{
+			rule: "ip daddr 10.0.0.1 counter packets 10 bytes 800 accept",
+			out:  "ip daddr 10.0.0.1 counter accept",
+		},
+		{
+			rule: "ip daddr 10.0.0.1 counter accept",
+			out:  "ip daddr 10.0.0.1 counter accept",
+		},
+		{
+			rule: "counter packets 0 bytes 0 jump other counter packets 5 bytes 300",
+			out:  "counter jump other counter",
+		},
+		{
+			rule: `ip daddr 10.0.0.1 counter packets 1 bytes 60 log prefix "counter packets 1 bytes 60 " drop`,
+			out:  `ip daddr 10.0.0.1 counter log prefix "counter packets 1 bytes 60 " drop`,
+		},
+		{
+			rule: "ip daddr 10.0.0.1 drop",
+			out:  "ip daddr 10.0.0.1 drop",
+		},
+	} {
+		t.Run(tc.rule, func(t *testing.T) {
+			out := StripCounters(tc.rule)
+			if out != tc.out {
+				t.Errorf("expected %q, got %q", tc.out, out)
+			}
+		})
+	}
+}